@@ -1,15 +1,28 @@
 package headscale
 
 import (
+	"crypto/sha256"
+	"encoding"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"net"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
+	"github.com/rs/zerolog/log"
 	"github.com/tailscale/hujson"
+	"gopkg.in/yaml.v2"
 	"inet.af/netaddr"
 	"tailscale.com/tailcfg"
 )
@@ -18,56 +31,711 @@ const errorEmptyPolicy = Error("empty policy")
 const errorInvalidAction = Error("invalid action")
 const errorInvalidUserSection = Error("invalid user section")
 const errorInvalidGroup = Error("invalid group")
+const errorGroupCycle = Error("group contains itself")
 const errorInvalidTag = Error("invalid tag")
 const errorInvalidNamespace = Error("invalid namespace")
 const errorInvalidPortFormat = Error("invalid port format")
+const errorUnknownACLReferences = Error("the ACL policy references unknown namespaces or groups")
+const errorACLPolicyConflict = Error("defined in several ACL policy files")
+const errorInvalidSSHRule = Error("invalid SSH rule")
+const errorInvalidNodeAttr = Error("invalid node attribute")
+const errorUnknownACLFields = Error("unknown fields in the ACL policy, ignored with acl_policy_lenient")
 
-// LoadACLPolicy loads the ACL policy from the specify path, and generates the ACL rules
-func (h *Headscale) LoadACLPolicy(path string) error {
+// sshUserRegexp matches the local users of the SSH rules besides root and
+// autogroup:nonroot, like useradd accepts them
+var sshUserRegexp = regexp.MustCompile(`^[a-z_][a-z0-9_.-]{0,30}[$]?$`)
+
+// ParseACLPolicy reads and parses the ACL policy from the specified path,
+// without generating the ACL rules. The path can be a directory, whose
+// policy files are merged. Unless lenient, the fields unknown to ACLPolicy
+// are refused rather than ignored.
+func ParseACLPolicy(path string, lenient bool) (*ACLPolicy, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	var policy *ACLPolicy
+	if info.IsDir() {
+		policy, err = parseACLPolicyDir(path, lenient)
+	} else {
+		policy, err = parseACLPolicyFile(path, lenient)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if policy.IsZero() {
+		return nil, errorEmptyPolicy
+	}
+	for g := range policy.Groups {
+		if _, err := policy.groupNamespaces(g); err != nil {
+			if f, ok := policy.groupFiles[g]; ok {
+				return nil, fmt.Errorf("%s: %w", f, err)
+			}
+			return nil, err
+		}
+	}
+	for r := range policy.AutoApprovers.Routes {
+		if _, err := netaddr.ParseIPPrefix(r); err != nil {
+			return nil, fmt.Errorf("AutoApprovers: %w", err)
+		}
+	}
+	for i, r := range policy.SSH {
+		if err := validateSSHRule(r); err != nil {
+			return nil, fmt.Errorf("%s: %w", policy.sshName(i), err)
+		}
+	}
+	for i, a := range policy.NodeAttrs {
+		if err := policy.validateNodeAttr(a); err != nil {
+			return nil, fmt.Errorf("%s: %w", policy.nodeAttrName(i), err)
+		}
+	}
+	return policy, nil
+}
+
+// validateSSHRule checks the syntax of a rule of the SSH section. As in
+// Tailscale, the sources are namespaces, groups or tags, and the
+// destinations namespaces, tags or autogroup:self, the machines of the
+// namespace of the source.
+func validateSSHRule(r SSH) error {
+	switch r.Action {
+	case "accept":
+		if r.CheckPeriod != "" {
+			return fmt.Errorf("%w: CheckPeriod is only valid with the check action", errorInvalidSSHRule)
+		}
+	case "check":
+		if r.CheckPeriod != "" {
+			d, err := time.ParseDuration(r.CheckPeriod)
+			if err != nil || d <= 0 {
+				return fmt.Errorf("%w: invalid CheckPeriod %q", errorInvalidSSHRule, r.CheckPeriod)
+			}
+		}
+	default:
+		return fmt.Errorf("%w: action %q, valid: accept, check", errorInvalidSSHRule, r.Action)
+	}
+
+	if len(r.Src) == 0 || len(r.Dst) == 0 || len(r.Users) == 0 {
+		return fmt.Errorf("%w: Src, Dst and Users cannot be empty", errorInvalidSSHRule)
+	}
+	for _, src := range r.Src {
+		switch {
+		case src == "*", strings.HasPrefix(src, "group:"), strings.HasPrefix(src, "tag:"):
+		case namespaceNameRegexp.MatchString(src):
+		default:
+			return fmt.Errorf("%w: source %q is not a namespace, group or tag", errorInvalidSSHRule, src)
+		}
+	}
+	for _, dst := range r.Dst {
+		switch {
+		case dst == "autogroup:self", strings.HasPrefix(dst, "tag:"):
+		case namespaceNameRegexp.MatchString(dst):
+		default:
+			return fmt.Errorf("%w: destination %q is not a namespace, tag or autogroup:self", errorInvalidSSHRule, dst)
+		}
+	}
+	for _, u := range r.Users {
+		if u != "root" && u != "autogroup:nonroot" && !sshUserRegexp.MatchString(u) {
+			return fmt.Errorf("%w: invalid user %q", errorInvalidSSHRule, u)
+		}
+	}
+	return nil
+}
+
+// validateNodeAttr checks the targets and the capabilities of a node
+// attribute. The targets are namespaces, groups, tags with owners, hosts,
+// IPs or *, like the users of the ACLs.
+func (p *ACLPolicy) validateNodeAttr(a NodeAttr) error {
+	if len(a.Target) == 0 || len(a.Attr) == 0 {
+		return fmt.Errorf("%w: Target and Attr cannot be empty", errorInvalidNodeAttr)
+	}
+	for _, t := range a.Target {
+		switch {
+		case t == "*", strings.HasPrefix(t, "group:"):
+		case strings.HasPrefix(t, "tag:"):
+			if _, ok := p.TagOwners[t]; !ok {
+				return fmt.Errorf("%w: target %q has no tag owners", errorInvalidNodeAttr, t)
+			}
+		case namespaceNameRegexp.MatchString(t):
+		default:
+			if _, err := netaddr.ParseIP(t); err == nil {
+				continue
+			}
+			if _, err := netaddr.ParseIPPrefix(t); err == nil {
+				continue
+			}
+			return fmt.Errorf("%w: target %q is not a namespace, group, tag, host or IP", errorInvalidNodeAttr, t)
+		}
+	}
+	for _, attr := range a.Attr {
+		if attr == "" || strings.ContainsAny(attr, " \t\n") {
+			return fmt.Errorf("%w: invalid attribute %q", errorInvalidNodeAttr, attr)
+		}
+	}
+	return nil
+}
+
+// nodeAttrName tells which node attribute of the policy, and of which file
+// if it was merged from a directory, the i-th one is
+func (p *ACLPolicy) nodeAttrName(i int) string {
+	if i < len(p.nodeAttrOrigins) {
+		return p.nodeAttrOrigins[i]
+	}
+	return fmt.Sprintf("node attribute %d", i)
+}
+
+// sshName tells which SSH rule of the policy, and of which file if it was
+// merged from a directory, the i-th rule is
+func (p *ACLPolicy) sshName(i int) string {
+	if i < len(p.sshOrigins) {
+		return p.sshOrigins[i]
+	}
+	return fmt.Sprintf("SSH rule %d", i)
+}
+
+func parseACLPolicyFile(path string, lenient bool) (*ACLPolicy, error) {
 	policyFile, err := os.Open(path)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer policyFile.Close()
 
 	var policy ACLPolicy
 	b, err := io.ReadAll(policyFile)
+	if err != nil {
+		return nil, err
+	}
+	isYAML := false
+	switch filepath.Ext(path) {
+	case ".yaml", ".yml":
+		isYAML = true
+		err = yaml.Unmarshal(b, &policy)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		// HuJSON is a superset of JSON, so this handles plain JSON too
+		err = hujson.Unmarshal(b, &policy)
+		if err != nil {
+			return nil, withErrorPosition(b, err)
+		}
+	}
+	if !lenient {
+		unknown, err := unknownACLFields(b, isYAML)
+		if err != nil {
+			return nil, err
+		}
+		if len(unknown) > 0 {
+			return nil, fmt.Errorf("%w: %s", errorUnknownACLFields, strings.Join(unknown, "; "))
+		}
+	}
+	sum := sha256.Sum256(b)
+	policy.fingerprint = hex.EncodeToString(sum[:])
+	return &policy, nil
+}
+
+// parseACLPolicyDir merges the policy files of dir in lexical order: the
+// ACLs and the tests are concatenated, and the groups, hosts, tag owners and
+// auto approvers can only be defined in one of the files. The SSH rules and
+// the node attributes are concatenated like the ACLs.
+func parseACLPolicyDir(dir string, lenient bool) (*ACLPolicy, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	policy := ACLPolicy{
+		Groups:        Groups{},
+		Hosts:         Hosts{},
+		TagOwners:     TagOwners{},
+		AutoApprovers: AutoApprovers{Routes: map[string][]string{}},
+		groupFiles:    map[string]string{},
+	}
+	defined := map[string]string{}
+	define := func(kind, key, file string) error {
+		if f, ok := defined[kind+" "+key]; ok {
+			return fmt.Errorf("%w: %s %s in %s and %s", errorACLPolicyConflict, kind, key, f, file)
+		}
+		defined[kind+" "+key] = file
+		return nil
+	}
+
+	fingerprint := sha256.New()
+	for _, e := range entries {
+		switch filepath.Ext(e.Name()) {
+		case ".json", ".hujson", ".yaml", ".yml":
+		default:
+			continue
+		}
+		if e.IsDir() {
+			continue
+		}
+		name := e.Name()
+		p, err := parseACLPolicyFile(filepath.Join(dir, name), lenient)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		fmt.Fprintf(fingerprint, "%s %s\n", name, p.fingerprint)
+
+		for _, g := range sortedKeys(p.Groups) {
+			if err := define("group", g, name); err != nil {
+				return nil, err
+			}
+			policy.Groups[g] = p.Groups[g]
+			policy.groupFiles[g] = name
+		}
+		hosts := make([]string, 0, len(p.Hosts))
+		for h := range p.Hosts {
+			hosts = append(hosts, h)
+		}
+		sort.Strings(hosts)
+		for _, h := range hosts {
+			if err := define("host", h, name); err != nil {
+				return nil, err
+			}
+			policy.Hosts[h] = p.Hosts[h]
+		}
+		for _, t := range sortedKeys(p.TagOwners) {
+			if err := define("tag owners of", t, name); err != nil {
+				return nil, err
+			}
+			policy.TagOwners[t] = p.TagOwners[t]
+		}
+		for _, r := range sortedKeys(p.AutoApprovers.Routes) {
+			if err := define("auto approvers of", r, name); err != nil {
+				return nil, err
+			}
+			policy.AutoApprovers.Routes[r] = p.AutoApprovers.Routes[r]
+		}
+		for i, a := range p.ACLs {
+			policy.ACLs = append(policy.ACLs, a)
+			policy.aclOrigins = append(policy.aclOrigins, fmt.Sprintf("%s ACL %d", name, i))
+		}
+		for i, r := range p.SSH {
+			policy.SSH = append(policy.SSH, r)
+			policy.sshOrigins = append(policy.sshOrigins, fmt.Sprintf("%s SSH rule %d", name, i))
+		}
+		for i, a := range p.NodeAttrs {
+			policy.NodeAttrs = append(policy.NodeAttrs, a)
+			policy.nodeAttrOrigins = append(policy.nodeAttrOrigins, fmt.Sprintf("%s node attribute %d", name, i))
+		}
+		policy.Tests = append(policy.Tests, p.Tests...)
+	}
+	policy.fingerprint = hex.EncodeToString(fingerprint.Sum(nil))
+	return &policy, nil
+}
+
+// aclName tells which ACL of the policy, and of which file if it was merged
+// from a directory, the i-th ACL is
+func (p *ACLPolicy) aclName(i int) string {
+	if i < len(p.aclOrigins) {
+		return p.aclOrigins[i]
+	}
+	return fmt.Sprintf("ACL %d", i)
+}
+
+// groupNamespaces returns the namespaces of a group, including the members
+// of the groups it contains
+func (p *ACLPolicy) groupNamespaces(group string) ([]string, error) {
+	return p.expandGroup(group, map[string]bool{})
+}
+
+func (p *ACLPolicy) expandGroup(group string, visiting map[string]bool) ([]string, error) {
+	members, ok := p.Groups[group]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", errorInvalidGroup, group)
+	}
+	if visiting[group] {
+		return nil, fmt.Errorf("%w: %s", errorGroupCycle, group)
+	}
+	visiting[group] = true
+	defer delete(visiting, group)
+
+	namespaces := []string{}
+	for _, m := range members {
+		if !strings.HasPrefix(m, "group:") {
+			if !containsString(namespaces, m) {
+				namespaces = append(namespaces, m)
+			}
+			continue
+		}
+		nested, err := p.expandGroup(m, visiting)
+		if err != nil {
+			return nil, err
+		}
+		for _, n := range nested {
+			if !containsString(namespaces, n) {
+				namespaces = append(namespaces, n)
+			}
+		}
+	}
+	return namespaces, nil
+}
+
+// LoadACLPolicy loads the ACL policy from the specify path, and generates the ACL rules
+func (h *Headscale) LoadACLPolicy(path string) (err error) {
+	defer func() { h.audit("acl.load", "path:"+path, err) }()
+	policy, err := ParseACLPolicy(path, h.cfg.ACLPolicyLenient)
 	if err != nil {
 		return err
 	}
-	err = hujson.Unmarshal(b, &policy)
+
+	unknown, err := h.unknownACLReferences(policy)
 	if err != nil {
 		return err
 	}
-	if policy.IsZero() {
-		return errorEmptyPolicy
+	if len(unknown) > 0 && h.cfg.ACLPolicyStrict {
+		return fmt.Errorf("%w: %s", errorUnknownACLReferences, strings.Join(unknown, "; "))
+	}
+	for _, u := range unknown {
+		log.Warn().
+			Str("path", path).
+			Str("reference", u).
+			Msg("The ACL policy references an unknown namespace or group")
 	}
 
-	h.aclPolicy = &policy
-	rules, err := h.generateACLRules()
+	// Keep the current policy if the new one does not generate valid rules
+	h.aclMu.Lock()
+	defer h.aclMu.Unlock()
+	rules, err := h.generateACLRules(policy)
 	if err != nil {
 		return err
 	}
-	h.aclRules = rules
+	h.acl.Store(&aclState{policy: policy, rules: rules})
+	log.Info().
+		Str("path", path).
+		Str("fingerprint", policy.fingerprint).
+		Int("acls", len(policy.ACLs)).
+		Int("rules", len(*rules)).
+		Int("groups", len(policy.Groups)).
+		Int("hosts", len(policy.Hosts)).
+		Int("tag_owners", len(policy.TagOwners)).
+		Int("ssh_rules", len(policy.SSH)).
+		Int("node_attrs", len(policy.NodeAttrs)).
+		Msg("ACL policy loaded")
+	// tailcfg only has an SSH policy in the map responses from Tailscale 1.24
+	if len(policy.SSH) > 0 {
+		log.Warn().
+			Str("path", path).
+			Msg("The SSH rules of the ACL policy are checked but not sent to the machines, the Tailscale protocol of this version has no SSH policy")
+	}
 	return nil
 }
 
-func (h *Headscale) generateACLRules() (*[]tailcfg.FilterRule, error) {
+// ReloadACLPolicyOnSIGHUP reloads the ACL policy from path every time the process
+// receives a SIGHUP, and sends the updated rules to the connected clients
+func (h *Headscale) ReloadACLPolicyOnSIGHUP(path string) {
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGHUP)
+	for range sigc {
+		err := h.LoadACLPolicy(path)
+		if err != nil {
+			aclReloads.WithLabelValues("failure").Inc()
+			log.Error().
+				Err(err).
+				Msg("Could not reload the ACL policy, keeping the current one")
+			continue
+		}
+		aclReloads.WithLabelValues("success").Inc()
+		log.Info().
+			Str("path", path).
+			Msg("ACL policy reloaded")
+		h.notifyAllClients()
+	}
+}
+
+// withErrorPosition adds the line and column to the errors of the HuJSON parser,
+// which only report the offset in the file
+func withErrorPosition(b []byte, err error) error {
+	var offset int64
+	var syntaxErr *hujson.SyntaxError
+	var typeErr *hujson.UnmarshalTypeError
+	if errors.As(err, &syntaxErr) {
+		offset = syntaxErr.Offset
+	} else if errors.As(err, &typeErr) {
+		offset = typeErr.Offset
+	} else {
+		return err
+	}
+
+	line, column := 1, 1
+	for i := int64(0); i < offset && i < int64(len(b)); i++ {
+		if b[i] == '\n' {
+			line++
+			column = 1
+		} else {
+			column++
+		}
+	}
+	return fmt.Errorf("line %d, column %d: %w", line, column, err)
+}
+
+var (
+	jsonUnmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+)
+
+// unknownACLFields lists the fields of a policy file that ACLPolicy does not
+// have, with where they are, which the decoders skip without a word and can
+// leave a rule inert. Like the decoders, the JSON fields match regardless of
+// their case, the YAML ones do not.
+func unknownACLFields(b []byte, isYAML bool) ([]string, error) {
+	var generic interface{}
+	tag := "json"
+	if isYAML {
+		tag = "yaml"
+		if err := yaml.Unmarshal(b, &generic); err != nil {
+			return nil, err
+		}
+	} else if err := hujson.Unmarshal(b, &generic); err != nil {
+		return nil, withErrorPosition(b, err)
+	}
+	unknown := []string{}
+	checkACLFields(generic, reflect.TypeOf(ACLPolicy{}), "", tag, &unknown)
+	return unknown, nil
+}
+
+func checkACLFields(v interface{}, t reflect.Type, path string, tag string, unknown *[]string) {
+	// Hosts and the prefixes are decoded by their own methods
+	if p := reflect.PtrTo(t); p.Implements(jsonUnmarshalerType) || p.Implements(textUnmarshalerType) {
+		return
+	}
+	switch t.Kind() {
+	case reflect.Slice:
+		items, _ := v.([]interface{})
+		for i, item := range items {
+			checkACLFields(item, t.Elem(), fmt.Sprintf("%s[%d]", path, i), tag, unknown)
+		}
+	case reflect.Map:
+		m := genericMap(v)
+		for _, k := range genericMapKeys(m) {
+			checkACLFields(m[k], t.Elem(), aclFieldPath(path, k), tag, unknown)
+		}
+	case reflect.Struct:
+		fields := map[string]reflect.Type{}
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.PkgPath != "" {
+				continue // unexported
+			}
+			name := strings.Split(f.Tag.Get(tag), ",")[0]
+			if name == "" {
+				name = f.Name
+			}
+			fields[name] = f.Type
+		}
+		m := genericMap(v)
+		for _, k := range genericMapKeys(m) {
+			if ft, ok := fields[k]; ok {
+				checkACLFields(m[k], ft, aclFieldPath(path, k), tag, unknown)
+				continue
+			}
+			match := ""
+			for name := range fields {
+				if strings.EqualFold(name, k) {
+					match = name
+				}
+			}
+			switch {
+			case match != "" && tag == "json":
+				checkACLFields(m[k], fields[match], aclFieldPath(path, k), tag, unknown)
+			case match != "":
+				*unknown = append(*unknown, fmt.Sprintf("%s (did you mean %s?)", aclFieldPath(path, k), match))
+			default:
+				*unknown = append(*unknown, aclFieldPath(path, k))
+			}
+		}
+	}
+}
+
+// genericMap returns the object decoded from JSON, or from YAML whose keys
+// can be of any type, with string keys
+func genericMap(v interface{}) map[string]interface{} {
+	m := map[string]interface{}{}
+	switch v := v.(type) {
+	case map[string]interface{}:
+		return v
+	case map[interface{}]interface{}:
+		for k, item := range v {
+			m[fmt.Sprint(k)] = item
+		}
+	}
+	return m
+}
+
+func genericMapKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func aclFieldPath(path string, field string) string {
+	if path == "" {
+		return field
+	}
+	return path + "." + field
+}
+
+// unknownACLReferences lists the namespaces and groups used in the groups,
+// the tag owners and the rules of the policy that do not exist. The unknown
+// namespaces match no machine.
+func (h *Headscale) unknownACLReferences(policy *ACLPolicy) ([]string, error) {
+	namespaces, err := h.ListNamespaces()
+	if err != nil {
+		return nil, err
+	}
+	known := map[string]bool{}
+	for _, n := range *namespaces {
+		known[n.Name] = true
+	}
+
+	unknown := []string{}
+	checkNamespace := func(where string, name string) {
+		if !known[name] {
+			unknown = append(unknown, fmt.Sprintf("%s: unknown namespace %q", where, name))
+		}
+	}
+	checkGroup := func(where string, name string) {
+		if _, ok := policy.Groups[name]; !ok {
+			unknown = append(unknown, fmt.Sprintf("%s: unknown group %q", where, name))
+		}
+	}
+	checkAlias := func(where string, alias string) {
+		switch {
+		case alias == "*", strings.HasPrefix(alias, "tag:"):
+		case strings.HasPrefix(alias, "group:"):
+			checkGroup(where, alias)
+		default:
+			if _, ok := policy.Hosts[alias]; ok {
+				return
+			}
+			if _, err := netaddr.ParseIP(alias); err == nil {
+				return
+			}
+			if _, err := netaddr.ParseIPPrefix(alias); err == nil {
+				return
+			}
+			checkNamespace(where, alias)
+		}
+	}
+
+	// The nested groups are checked by ParseACLPolicy
+	for _, g := range sortedKeys(policy.Groups) {
+		for _, n := range policy.Groups[g] {
+			if !strings.HasPrefix(n, "group:") {
+				checkNamespace("group "+g, n)
+			}
+		}
+	}
+	for _, t := range sortedKeys(policy.TagOwners) {
+		for _, owner := range policy.TagOwners[t] {
+			if strings.HasPrefix(owner, "group:") {
+				checkGroup("tag owners of "+t, owner)
+			} else {
+				checkNamespace("tag owners of "+t, owner)
+			}
+		}
+	}
+	for _, r := range sortedKeys(policy.AutoApprovers.Routes) {
+		for _, approver := range policy.AutoApprovers.Routes[r] {
+			checkAlias("auto approvers of "+r, approver)
+		}
+	}
+	for i, a := range policy.ACLs {
+		for _, u := range a.Users {
+			checkAlias(policy.aclName(i)+" users", u)
+		}
+		for _, d := range a.Ports {
+			// The port format itself is checked when generating the rules
+			tokens := strings.Split(d, ":")
+			switch len(tokens) {
+			case 2:
+				checkAlias(policy.aclName(i)+" ports", tokens[0])
+			case 3:
+				checkAlias(policy.aclName(i)+" ports", tokens[0]+":"+tokens[1])
+			}
+		}
+	}
+	for i, r := range policy.SSH {
+		for _, src := range r.Src {
+			checkAlias(policy.sshName(i)+" src", src)
+		}
+		for _, dst := range r.Dst {
+			if dst != "autogroup:self" {
+				checkAlias(policy.sshName(i)+" dst", dst)
+			}
+		}
+	}
+	for i, a := range policy.NodeAttrs {
+		for _, t := range a.Target {
+			checkAlias(policy.nodeAttrName(i)+" target", t)
+		}
+	}
+	return unknown, nil
+}
+
+func sortedKeys(m map[string][]string) []string {
+	keys := []string{}
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// aclState is an ACL policy and the rules generated from it, nil and allow
+// all without a policy
+type aclState struct {
+	policy *ACLPolicy
+	rules  *[]tailcfg.FilterRule
+}
+
+// loadACL returns the ACL policy and rules in use, to read both from the
+// same policy
+func (h *Headscale) loadACL() *aclState {
+	if acl, ok := h.acl.Load().(*aclState); ok {
+		return acl
+	}
+	return &aclState{rules: &tailcfg.FilterAllowAll} // default allowall
+}
+
+// updateACLRules generates the rules of the ACL policy in use again, after
+// a change to the namespaces, tags or addresses they are expanded to
+func (h *Headscale) updateACLRules() error {
+	h.aclMu.Lock()
+	defer h.aclMu.Unlock()
+	acl := h.loadACL()
+	if acl.policy == nil {
+		return nil
+	}
+	rules, err := h.generateACLRules(acl.policy)
+	if err != nil {
+		return err
+	}
+	h.acl.Store(&aclState{policy: acl.policy, rules: rules})
+	return nil
+}
+
+func (h *Headscale) generateACLRules(policy *ACLPolicy) (*[]tailcfg.FilterRule, error) {
 	rules := []tailcfg.FilterRule{}
 
-	for i, a := range h.aclPolicy.ACLs {
+	for i, a := range policy.ACLs {
 		if a.Action != "accept" {
-			return nil, errorInvalidAction
+			return nil, policy.aclError(i, errorInvalidAction)
 		}
 
 		r := tailcfg.FilterRule{}
 
 		srcIPs := []string{}
 		for j, u := range a.Users {
-			srcs, err := h.generateACLPolicySrcIP(u)
+			srcs, err := h.generateACLPolicySrcIP(policy, u)
 			if err != nil {
-				log.Printf("Error parsing ACL %d, User %d", i, j)
-				return nil, err
+				log.Error().
+					Int("acl", i).
+					Int("user", j).
+					Err(err).
+					Msg("Error parsing ACL")
+				return nil, policy.aclError(i, err)
 			}
 			srcIPs = append(srcIPs, *srcs...)
 		}
@@ -75,10 +743,14 @@ func (h *Headscale) generateACLRules() (*[]tailcfg.FilterRule, error) {
 
 		destPorts := []tailcfg.NetPortRange{}
 		for j, d := range a.Ports {
-			dests, err := h.generateACLPolicyDestPorts(d)
+			dests, err := h.generateACLPolicyDestPorts(policy, d)
 			if err != nil {
-				log.Printf("Error parsing ACL %d, Port %d", i, j)
-				return nil, err
+				log.Error().
+					Int("acl", i).
+					Int("port", j).
+					Err(err).
+					Msg("Error parsing ACL")
+				return nil, policy.aclError(i, err)
 			}
 			destPorts = append(destPorts, *dests...)
 		}
@@ -92,11 +764,30 @@ func (h *Headscale) generateACLRules() (*[]tailcfg.FilterRule, error) {
 	return &rules, nil
 }
 
-func (h *Headscale) generateACLPolicySrcIP(u string) (*[]string, error) {
-	return h.expandAlias(u)
+// aclError adds the file and the index of the ACL to the errors of the
+// policies merged from a directory
+func (p *ACLPolicy) aclError(i int, err error) error {
+	if i < len(p.aclOrigins) {
+		return fmt.Errorf("%s: %w", p.aclOrigins[i], err)
+	}
+	return err
+}
+
+func (h *Headscale) generateACLPolicySrcIP(policy *ACLPolicy, u string) (*[]string, error) {
+	return h.expandRuleAlias(policy, u)
 }
 
-func (h *Headscale) generateACLPolicyDestPorts(d string) (*[]tailcfg.NetPortRange, error) {
+// expandRuleAlias is expandAlias for the rules, where a namespace that does
+// not exist (yet) has no machines. unknownACLReferences reports them.
+func (h *Headscale) expandRuleAlias(policy *ACLPolicy, s string) (*[]string, error) {
+	ips, err := h.expandAlias(policy, s)
+	if errors.Is(err, errorInvalidUserSection) && namespaceNameRegexp.MatchString(s) {
+		return &[]string{}, nil
+	}
+	return ips, err
+}
+
+func (h *Headscale) generateACLPolicyDestPorts(policy *ACLPolicy, d string) (*[]tailcfg.NetPortRange, error) {
 	tokens := strings.Split(d, ":")
 	if len(tokens) < 2 || len(tokens) > 3 {
 		return nil, errorInvalidPortFormat
@@ -115,7 +806,7 @@ func (h *Headscale) generateACLPolicyDestPorts(d string) (*[]tailcfg.NetPortRang
 		alias = fmt.Sprintf("%s:%s", tokens[0], tokens[1])
 	}
 
-	expanded, err := h.expandAlias(alias)
+	expanded, err := h.expandRuleAlias(policy, alias)
 	if err != nil {
 		return nil, err
 	}
@@ -137,59 +828,52 @@ func (h *Headscale) generateACLPolicyDestPorts(d string) (*[]tailcfg.NetPortRang
 	return &dests, nil
 }
 
-func (h *Headscale) expandAlias(s string) (*[]string, error) {
+func (h *Headscale) expandAlias(policy *ACLPolicy, s string) (*[]string, error) {
 	if s == "*" {
 		return &[]string{"*"}, nil
 	}
 
 	if strings.HasPrefix(s, "group:") {
-		if _, ok := h.aclPolicy.Groups[s]; !ok {
-			return nil, errorInvalidGroup
+		namespaces, err := policy.groupNamespaces(s)
+		if err != nil {
+			return nil, err
 		}
 		ips := []string{}
-		for _, n := range h.aclPolicy.Groups[s] {
+		for _, n := range namespaces {
+			// The unknown namespaces are reported by unknownACLReferences
+			if _, err := h.GetNamespace(n); err != nil {
+				continue
+			}
 			nodes, err := h.ListMachinesInNamespace(n)
 			if err != nil {
 				return nil, errorInvalidNamespace
 			}
 			for _, node := range *nodes {
-				ips = append(ips, node.IPAddress)
+				ips = append(ips, node.IPAddresses()...)
 			}
 		}
 		return &ips, nil
 	}
 
 	if strings.HasPrefix(s, "tag:") {
-		if _, ok := h.aclPolicy.TagOwners[s]; !ok {
+		if _, ok := policy.TagOwners[s]; !ok {
 			return nil, errorInvalidTag
 		}
 
 		// This will have HORRIBLE performance.
 		// We need to change the data model to better store tags
 		machines := []Machine{}
-		if err := h.db.Where("registered").Find(&machines).Error; err != nil {
+		if err := h.db.Preload("Namespace").Where("registered").Find(&machines).Error; err != nil {
 			return nil, err
 		}
 		ips := []string{}
 		for _, m := range machines {
-			hostinfo := tailcfg.Hostinfo{}
-			if len(m.HostInfo) != 0 {
-				hi, err := m.HostInfo.MarshalJSON()
-				if err != nil {
-					return nil, err
-				}
-				err = json.Unmarshal(hi, &hostinfo)
-				if err != nil {
-					return nil, err
-				}
-
-				// FIXME: Check TagOwners allows this
-				for _, t := range hostinfo.RequestTags {
-					if s[4:] == t {
-						ips = append(ips, m.IPAddress)
-						break
-					}
-				}
+			hasTag, err := h.machineHasTag(policy, m, s)
+			if err != nil {
+				return nil, err
+			}
+			if hasTag {
+				ips = append(ips, m.IPAddresses()...)
 			}
 		}
 		return &ips, nil
@@ -203,12 +887,12 @@ func (h *Headscale) expandAlias(s string) (*[]string, error) {
 		}
 		ips := []string{}
 		for _, n := range *nodes {
-			ips = append(ips, n.IPAddress)
+			ips = append(ips, n.IPAddresses()...)
 		}
 		return &ips, nil
 	}
 
-	if h, ok := h.aclPolicy.Hosts[s]; ok {
+	if h, ok := policy.Hosts[s]; ok {
 		return &[]string{h.String()}, nil
 	}
 
@@ -261,3 +945,321 @@ func (h *Headscale) expandPorts(s string) (*[]tailcfg.PortRange, error) {
 	}
 	return &ports, nil
 }
+
+// ACLCheckResult is the result of checking whether a source can reach a destination
+type ACLCheckResult struct {
+	Src     string
+	Dst     string
+	Port    uint16
+	Allowed bool
+
+	// RuleIndex is the index in the ACLs section of the rule that allows the
+	// connection, or -1 if it is not allowed by any rule
+	RuleIndex int
+	Rule      *ACL `json:",omitempty"`
+}
+
+// CheckACL checks whether the current ACL policy allows src to reach dst on the
+// given port. src and dst are resolved like in the ACL rules (namespaces, tags,
+// groups, hosts, IPs...), or can be the name of a machine.
+func (h *Headscale) CheckACL(src string, dst string, port uint16) (*ACLCheckResult, error) {
+	result := ACLCheckResult{
+		Src:       src,
+		Dst:       dst,
+		Port:      port,
+		RuleIndex: -1,
+	}
+	acl := h.loadACL()
+	if acl.policy == nil {
+		result.Allowed = true // allow all by default
+		return &result, nil
+	}
+
+	srcIPs, err := h.resolveACLCheckAlias(acl.policy, src)
+	if err != nil {
+		return nil, fmt.Errorf("cannot resolve %s: %w", src, err)
+	}
+	dstIPs, err := h.resolveACLCheckAlias(acl.policy, dst)
+	if err != nil {
+		return nil, fmt.Errorf("cannot resolve %s: %w", dst, err)
+	}
+
+	for i, r := range *acl.rules {
+		if !anyACLEntryMatches(r.SrcIPs, srcIPs) {
+			continue
+		}
+		for _, dp := range r.DstPorts {
+			if port < dp.Ports.First || port > dp.Ports.Last {
+				continue
+			}
+			if anyACLEntryMatches([]string{dp.IP}, dstIPs) {
+				result.Allowed = true
+				result.RuleIndex = i
+				result.Rule = &acl.policy.ACLs[i]
+				return &result, nil
+			}
+		}
+	}
+	return &result, nil
+}
+
+// ACLConnection is a machine allowed by the ACL rules to connect to one of
+// its peers, on at least one port
+type ACLConnection struct {
+	SrcID uint64
+	Src   string
+	DstID uint64
+	Dst   string
+}
+
+// ACLPolicyDiff lists the connections between peers allowed by a candidate
+// policy but not by the current one, and the other way around
+type ACLPolicyDiff struct {
+	Added   []ACLConnection
+	Removed []ACLConnection
+}
+
+// DiffACLPolicy compares the connections between peers allowed by the policy
+// in path with the ones allowed by the current policy, with the same rules
+// sent to the clients. The current policy stays loaded.
+func (h *Headscale) DiffACLPolicy(path string) (*ACLPolicyDiff, error) {
+	policy, err := ParseACLPolicy(path, h.cfg.ACLPolicyLenient)
+	if err != nil {
+		return nil, err
+	}
+	rules, err := h.generateACLRules(policy)
+	if err != nil {
+		return nil, err
+	}
+	current := *h.loadACL().rules
+
+	machines := []Machine{}
+	if err := h.db.Where("registered").Order("id").Find(&machines).Error; err != nil {
+		return nil, err
+	}
+	diff := ACLPolicyDiff{
+		Added:   []ACLConnection{},
+		Removed: []ACLConnection{},
+	}
+	for _, m := range machines {
+		if m.isExpired() || m.NodeKey == "" {
+			continue
+		}
+		peers, err := h.getPeerMachines(m)
+		if err != nil {
+			return nil, err
+		}
+		sort.Slice(peers, func(i, j int) bool { return peers[i].ID < peers[j].ID })
+		for _, p := range peers {
+			before := aclRulesAllow(current, m.IPAddresses(), p.IPAddresses())
+			after := aclRulesAllow(*rules, m.IPAddresses(), p.IPAddresses())
+			if before == after {
+				continue
+			}
+			conn := ACLConnection{
+				SrcID: m.ID,
+				Src:   m.DisplayName(),
+				DstID: p.ID,
+				Dst:   p.DisplayName(),
+			}
+			if after {
+				diff.Added = append(diff.Added, conn)
+			} else {
+				diff.Removed = append(diff.Removed, conn)
+			}
+		}
+	}
+	return &diff, nil
+}
+
+// aclRulesAllow tells whether the rules let the source addresses reach the
+// destination addresses on any port
+func aclRulesAllow(rules []tailcfg.FilterRule, src []string, dst []string) bool {
+	for _, r := range rules {
+		if !anyACLEntryOverlaps(r.SrcIPs, src) {
+			continue
+		}
+		for _, dp := range r.DstPorts {
+			if anyACLEntryOverlaps([]string{dp.IP}, dst) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// aclAllowsPeers tells whether the rules let either machine connect to the
+// other. The routes enabled for a machine count as its addresses, so the
+// subnet routers and exit nodes stay visible to the machines using them.
+func aclAllowsPeers(rules []tailcfg.FilterRule, a Machine, b Machine) bool {
+	aAddresses := a.aclAddresses()
+	bAddresses := b.aclAddresses()
+	return aclRulesAllow(rules, aAddresses, bAddresses) || aclRulesAllow(rules, bAddresses, aAddresses)
+}
+
+func (m Machine) aclAddresses() []string {
+	addresses := m.IPAddresses()
+	routes, _ := m.getEnabledRoutes()
+	for _, r := range routes {
+		addresses = append(addresses, r.String())
+	}
+	return addresses
+}
+
+// nodeCapabilities returns the capabilities the node attributes of the ACL
+// policy grant to the machine, in the order of the policy
+func (h *Headscale) nodeCapabilities(policy *ACLPolicy, m Machine) ([]string, error) {
+	if policy == nil {
+		return nil, nil
+	}
+	caps := []string{}
+	for _, a := range policy.NodeAttrs {
+		matches, err := h.machineMatchesNodeAttr(policy, m, a)
+		if err != nil {
+			return nil, err
+		}
+		if !matches {
+			continue
+		}
+		for _, attr := range a.Attr {
+			if !containsString(caps, attr) {
+				caps = append(caps, attr)
+			}
+		}
+	}
+	return caps, nil
+}
+
+// machineMatchesNodeAttr tells whether a target of the node attribute is the
+// machine: *, its namespace, a group of its namespace, one of its tags, or a
+// host or IP containing one of its addresses
+func (h *Headscale) machineMatchesNodeAttr(policy *ACLPolicy, m Machine, a NodeAttr) (bool, error) {
+	for _, t := range a.Target {
+		switch {
+		case t == "*":
+			return true, nil
+		case strings.HasPrefix(t, "tag:"):
+			hasTag, err := h.machineHasTag(policy, m, t)
+			if err != nil {
+				return false, err
+			}
+			if hasTag {
+				return true, nil
+			}
+		case strings.HasPrefix(t, "group:"):
+			namespaces, _ := policy.groupNamespaces(t)
+			if containsString(namespaces, m.Namespace.Name) {
+				return true, nil
+			}
+		default:
+			if t == m.Namespace.Name {
+				return true, nil
+			}
+			entry := t
+			if prefix, ok := policy.Hosts[t]; ok {
+				entry = prefix.String()
+			}
+			if anyACLEntryMatches([]string{entry}, m.IPAddresses()) {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+func (h *Headscale) resolveACLCheckAlias(policy *ACLPolicy, s string) ([]string, error) {
+	ips, err := h.expandAlias(policy, s)
+	if err == nil {
+		return *ips, nil
+	}
+	if !errors.Is(err, errorInvalidUserSection) {
+		return nil, err
+	}
+
+	machines := []Machine{}
+	if err := h.db.Where("registered AND name = ?", s).Find(&machines).Error; err != nil {
+		return nil, err
+	}
+	if len(machines) == 0 {
+		return nil, err
+	}
+	addresses := []string{}
+	for _, m := range machines {
+		addresses = append(addresses, m.IPAddresses()...)
+	}
+	return addresses, nil
+}
+
+// anyACLEntryMatches returns true if any of the addresses is matched by any of
+// the entries of a rule ("*", IP or CIDR)
+func anyACLEntryMatches(entries []string, addresses []string) bool {
+	for _, e := range entries {
+		for _, a := range addresses {
+			if aclEntryMatches(e, a) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// anyACLEntryOverlaps returns true if any of the entries of a rule has an
+// address in common with any of the addresses or ranges
+func anyACLEntryOverlaps(entries []string, addresses []string) bool {
+	for _, e := range entries {
+		for _, a := range addresses {
+			if e == "*" || e == a {
+				return true
+			}
+			_, entryNet, err := parseIPOrCIDR(e)
+			if err != nil {
+				continue
+			}
+			_, addrNet, err := parseIPOrCIDR(a)
+			if err != nil {
+				continue
+			}
+			if entryNet.Contains(addrNet.IP) || addrNet.Contains(entryNet.IP) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func aclEntryMatches(entry string, address string) bool {
+	if entry == "*" || entry == address {
+		return true
+	}
+	if address == "*" {
+		return false
+	}
+
+	_, entryNet, err := parseIPOrCIDR(entry)
+	if err != nil {
+		return false
+	}
+	ip, addrNet, err := parseIPOrCIDR(address)
+	if err != nil {
+		return false
+	}
+	entryBits, _ := entryNet.Mask.Size()
+	addrBits, _ := addrNet.Mask.Size()
+	return entryNet.Contains(ip) && entryBits <= addrBits
+}
+
+func parseIPOrCIDR(s string) (net.IP, *net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, nil, errorInvalidUserSection
+		}
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			ip = ip.To4()
+			bits = 8 * net.IPv4len
+		}
+		return ip, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	return net.ParseCIDR(s)
+}
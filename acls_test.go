@@ -1,7 +1,15 @@
 package headscale
 
 import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
 	"gopkg.in/check.v1"
+	"gorm.io/datatypes"
+	"inet.af/netaddr"
+	"tailscale.com/tailcfg"
 )
 
 func (s *Suite) TestWrongPath(c *check.C) {
@@ -15,12 +23,109 @@ func (s *Suite) TestBrokenHuJson(c *check.C) {
 
 }
 
+func (s *Suite) TestBrokenHuJsonPosition(c *check.C) {
+	err := h.LoadACLPolicy("./tests/acls/broken.hujson")
+	c.Assert(err, check.ErrorMatches, "line .*, column .*")
+}
+
+func (s *Suite) TestYAMLPolicy(c *check.C) {
+	err := h.LoadACLPolicy("./tests/acls/acl_policy_basic_1.yaml")
+	c.Assert(err, check.IsNil)
+
+	yamlRules := h.loadACL().rules
+
+	err = h.LoadACLPolicy("./tests/acls/acl_policy_basic_1.hujson")
+	c.Assert(err, check.IsNil)
+	c.Assert(*yamlRules, check.DeepEquals, *h.loadACL().rules)
+}
+
+func (s *Suite) TestACLPolicyFingerprint(c *check.C) {
+	p1, err := ParseACLPolicy("./tests/acls/acl_policy_basic_1.hujson", false)
+	c.Assert(err, check.IsNil)
+	c.Assert(p1.fingerprint, check.HasLen, 64)
+
+	p2, err := ParseACLPolicy("./tests/acls/acl_policy_basic_1.hujson", false)
+	c.Assert(err, check.IsNil)
+	c.Assert(p2.fingerprint, check.Equals, p1.fingerprint)
+
+	p3, err := ParseACLPolicy("./tests/acls/acl_policy_basic_1.yaml", false)
+	c.Assert(err, check.IsNil)
+	c.Assert(p3.fingerprint, check.Not(check.Equals), p1.fingerprint)
+}
+
+func (s *Suite) TestACLPolicyDir(c *check.C) {
+	dir := c.MkDir()
+	write := func(name, content string) {
+		c.Assert(os.WriteFile(filepath.Join(dir, name), []byte(content), 0o600), check.IsNil)
+	}
+	write("00-groups.hujson", `{
+		// Owned by the network team
+		"Groups": {"group:admins": ["admin"]},
+		"Hosts": {"db": "100.64.0.10"},
+	}`)
+	write("10-admins.json", `{"ACLs": [{"Action": "accept", "Users": ["group:admins"], "Ports": ["*:*"]}]}`)
+	write("20-db.json", `{"ACLs": [{"Action": "accept", "Users": ["*"], "Ports": ["db:5432"]}]}`)
+	write("README.md", "not a policy")
+
+	err := h.LoadACLPolicy(dir)
+	c.Assert(err, check.IsNil)
+	acl := h.loadACL()
+	c.Assert(acl.policy.ACLs, check.HasLen, 2)
+	c.Assert(*acl.rules, check.HasLen, 2)
+	c.Assert(acl.policy.fingerprint, check.HasLen, 64)
+
+	write("30-broken.json", `{"ACLs": [{"Action": "deny", "Users": ["*"], "Ports": ["*:*"]}]}`)
+	err = h.LoadACLPolicy(dir)
+	c.Assert(errors.Is(err, errorInvalidAction), check.Equals, true)
+	c.Assert(err, check.ErrorMatches, "30-broken.json ACL 0: invalid action")
+	c.Assert(os.Remove(filepath.Join(dir, "30-broken.json")), check.IsNil)
+
+	write("30-groups.json", `{"Groups": {"group:admins": ["other"]}}`)
+	_, err = ParseACLPolicy(dir, false)
+	c.Assert(errors.Is(err, errorACLPolicyConflict), check.Equals, true)
+	c.Assert(err, check.ErrorMatches, ".*group group:admins in 00-groups.hujson and 30-groups.json")
+
+	write("30-groups.json", `{"Groups": {"group:x": [}`)
+	_, err = ParseACLPolicy(dir, false)
+	c.Assert(err, check.ErrorMatches, "30-groups.json: line 1, column .*")
+}
+
 func (s *Suite) TestInvalidPolicyHuson(c *check.C) {
 	err := h.LoadACLPolicy("./tests/acls/invalid.hujson")
+	c.Assert(errors.Is(err, errorUnknownACLFields), check.Equals, true)
+	c.Assert(err, check.ErrorMatches, ".*: but_a_policy_though; valid_json")
+
+	h.cfg.ACLPolicyLenient = true
+	err = h.LoadACLPolicy("./tests/acls/invalid.hujson")
 	c.Assert(err, check.NotNil)
 	c.Assert(err, check.Equals, errorEmptyPolicy)
 }
 
+func (s *Suite) TestUnknownACLFields(c *check.C) {
+	_, err := ParseACLPolicy("./tests/acls/acl_policy_unknown_fields.hujson", false)
+	c.Assert(errors.Is(err, errorUnknownACLFields), check.Equals, true)
+	c.Assert(err, check.ErrorMatches, ".*: ACLs\\[0\\]\\.Dst; Groupz")
+
+	_, err = ParseACLPolicy("./tests/acls/acl_policy_unknown_fields.yaml", false)
+	c.Assert(errors.Is(err, errorUnknownACLFields), check.Equals, true)
+	c.Assert(err, check.ErrorMatches, ".*: ACLs\\[0\\]\\.action \\(did you mean Action\\?\\)")
+
+	policy, err := ParseACLPolicy("./tests/acls/acl_policy_unknown_fields.yaml", true)
+	c.Assert(err, check.IsNil)
+	c.Assert(policy.ACLs[0].Action, check.Equals, "")
+
+	h.cfg.ACLPolicyLenient = true
+	err = h.LoadACLPolicy("./tests/acls/acl_policy_unknown_fields.hujson")
+	c.Assert(err, check.IsNil)
+	c.Assert(h.loadACL().policy.Hosts, check.HasLen, 1)
+	c.Assert(h.loadACL().policy.Groups, check.HasLen, 0)
+
+	dir := c.MkDir()
+	c.Assert(os.WriteFile(filepath.Join(dir, "10-acls.json"), []byte(`{"ACLs": [{"Action": "accept", "Users": ["*"], "Port": ["*:*"]}]}`), 0o600), check.IsNil)
+	_, err = ParseACLPolicy(dir, false)
+	c.Assert(err, check.ErrorMatches, "10-acls.json: .*: ACLs\\[0\\]\\.Port")
+}
+
 func (s *Suite) TestParseHosts(c *check.C) {
 	var hs Hosts
 	err := hs.UnmarshalJSON([]byte(`{"example-host-1": "100.100.100.100","example-host-2": "100.100.101.100/24"}`))
@@ -35,6 +140,16 @@ func (s *Suite) TestParseInvalidCIDR(c *check.C) {
 	c.Assert(err, check.NotNil)
 }
 
+func (s *Suite) TestReloadKeepsPolicyOnError(c *check.C) {
+	err := h.LoadACLPolicy("./tests/acls/acl_policy_basic_1.hujson")
+	c.Assert(err, check.IsNil)
+	acl := h.loadACL()
+
+	err = h.LoadACLPolicy("./tests/acls/acl_policy_invalid.hujson")
+	c.Assert(err, check.NotNil)
+	c.Assert(h.loadACL(), check.Equals, acl)
+}
+
 func (s *Suite) TestRuleInvalidGeneration(c *check.C) {
 	err := h.LoadACLPolicy("./tests/acls/acl_policy_invalid.hujson")
 	c.Assert(err, check.NotNil)
@@ -44,7 +159,7 @@ func (s *Suite) TestBasicRule(c *check.C) {
 	err := h.LoadACLPolicy("./tests/acls/acl_policy_basic_1.hujson")
 	c.Assert(err, check.IsNil)
 
-	rules, err := h.generateACLRules()
+	rules, err := h.generateACLRules(h.loadACL().policy)
 	c.Assert(err, check.IsNil)
 	c.Assert(rules, check.NotNil)
 }
@@ -53,7 +168,7 @@ func (s *Suite) TestPortRange(c *check.C) {
 	err := h.LoadACLPolicy("./tests/acls/acl_policy_basic_range.hujson")
 	c.Assert(err, check.IsNil)
 
-	rules, err := h.generateACLRules()
+	rules, err := h.generateACLRules(h.loadACL().policy)
 	c.Assert(err, check.IsNil)
 	c.Assert(rules, check.NotNil)
 
@@ -67,7 +182,7 @@ func (s *Suite) TestPortWildcard(c *check.C) {
 	err := h.LoadACLPolicy("./tests/acls/acl_policy_basic_wildcards.hujson")
 	c.Assert(err, check.IsNil)
 
-	rules, err := h.generateACLRules()
+	rules, err := h.generateACLRules(h.loadACL().policy)
 	c.Assert(err, check.IsNil)
 	c.Assert(rules, check.NotNil)
 
@@ -83,12 +198,12 @@ func (s *Suite) TestPortNamespace(c *check.C) {
 	n, err := h.CreateNamespace("testnamespace")
 	c.Assert(err, check.IsNil)
 
-	pak, err := h.CreatePreAuthKey(n.Name, false, false, nil)
+	pak, err := h.CreatePreAuthKey(n.Name, false, false, nil, nil)
 	c.Assert(err, check.IsNil)
 
 	_, err = h.GetMachine("testnamespace", "testmachine")
 	c.Assert(err, check.NotNil)
-	ip, _ := h.getAvailableIP()
+	ip, _ := nextFreeIP(h.ipPrefixes()[0], map[netaddr.IP]bool{}, nil)
 	m := Machine{
 		ID:             0,
 		MachineKey:     "foo",
@@ -106,7 +221,7 @@ func (s *Suite) TestPortNamespace(c *check.C) {
 	err = h.LoadACLPolicy("./tests/acls/acl_policy_basic_namespace_as_user.hujson")
 	c.Assert(err, check.IsNil)
 
-	rules, err := h.generateACLRules()
+	rules, err := h.generateACLRules(h.loadACL().policy)
 	c.Assert(err, check.IsNil)
 	c.Assert(rules, check.NotNil)
 
@@ -123,12 +238,12 @@ func (s *Suite) TestPortGroup(c *check.C) {
 	n, err := h.CreateNamespace("testnamespace")
 	c.Assert(err, check.IsNil)
 
-	pak, err := h.CreatePreAuthKey(n.Name, false, false, nil)
+	pak, err := h.CreatePreAuthKey(n.Name, false, false, nil, nil)
 	c.Assert(err, check.IsNil)
 
 	_, err = h.GetMachine("testnamespace", "testmachine")
 	c.Assert(err, check.NotNil)
-	ip, _ := h.getAvailableIP()
+	ip, _ := nextFreeIP(h.ipPrefixes()[0], map[netaddr.IP]bool{}, nil)
 	m := Machine{
 		ID:             0,
 		MachineKey:     "foo",
@@ -146,7 +261,7 @@ func (s *Suite) TestPortGroup(c *check.C) {
 	err = h.LoadACLPolicy("./tests/acls/acl_policy_basic_groups.hujson")
 	c.Assert(err, check.IsNil)
 
-	rules, err := h.generateACLRules()
+	rules, err := h.generateACLRules(h.loadACL().policy)
 	c.Assert(err, check.IsNil)
 	c.Assert(rules, check.NotNil)
 
@@ -158,3 +273,197 @@ func (s *Suite) TestPortGroup(c *check.C) {
 	c.Assert((*rules)[0].SrcIPs[0], check.Not(check.Equals), "not an ip")
 	c.Assert((*rules)[0].SrcIPs[0], check.Equals, ip.String())
 }
+
+func (s *Suite) TestCheckACL(c *check.C) {
+	r, err := h.CheckACL("10.0.0.1", "10.0.0.2", 22)
+	c.Assert(err, check.IsNil)
+	c.Assert(r.Allowed, check.Equals, true) // no policy, allow all
+
+	err = h.LoadACLPolicy("./tests/acls/acl_policy_basic_1.hujson")
+	c.Assert(err, check.IsNil)
+
+	r, err = h.CheckACL("192.168.1.10", "host-1", 80)
+	c.Assert(err, check.IsNil)
+	c.Assert(r.Allowed, check.Equals, true)
+	c.Assert(r.RuleIndex, check.Equals, 0)
+
+	r, err = h.CheckACL("subnet-1", "1.2.3.4", 22)
+	c.Assert(err, check.IsNil)
+	c.Assert(r.Allowed, check.Equals, true)
+
+	r, err = h.CheckACL("subnet-1", "1.2.3.4", 23)
+	c.Assert(err, check.IsNil)
+	c.Assert(r.Allowed, check.Equals, false)
+	c.Assert(r.RuleIndex, check.Equals, -1)
+
+	r, err = h.CheckACL("10.0.0.1", "host-1", 80)
+	c.Assert(err, check.IsNil)
+	c.Assert(r.Allowed, check.Equals, false)
+
+	_, err = h.CheckACL("not-a-node", "host-1", 80)
+	c.Assert(err, check.NotNil)
+}
+
+func (s *Suite) TestDiffACLPolicy(c *check.C) {
+	n, err := h.CreateNamespace("test")
+	c.Assert(err, check.IsNil)
+	for i, ip := range []string{"100.64.0.1", "100.64.0.2"} {
+		m := Machine{
+			MachineKey:     fmt.Sprintf("machine-%d", i),
+			NodeKey:        fmt.Sprintf("node-%d", i),
+			IPAddress:      ip,
+			Name:           fmt.Sprintf("testmachine%d", i),
+			NamespaceID:    n.ID,
+			Registered:     true,
+			RegisterMethod: "cli",
+		}
+		h.db.Save(&m)
+	}
+
+	// No policy allows everything, this one only allows subnet-1 and host-1
+	diff, err := h.DiffACLPolicy("./tests/acls/acl_policy_basic_1.hujson")
+	c.Assert(err, check.IsNil)
+	c.Assert(len(diff.Added), check.Equals, 0)
+	c.Assert(len(diff.Removed), check.Equals, 2)
+	c.Assert(diff.Removed[0].Src, check.Equals, "testmachine0")
+	c.Assert(diff.Removed[0].Dst, check.Equals, "testmachine1")
+	c.Assert(h.loadACL().policy, check.IsNil)
+
+	err = h.LoadACLPolicy("./tests/acls/acl_policy_basic_1.hujson")
+	c.Assert(err, check.IsNil)
+	diff, err = h.DiffACLPolicy("./tests/acls/acl_policy_basic_1.hujson")
+	c.Assert(err, check.IsNil)
+	c.Assert(len(diff.Added), check.Equals, 0)
+	c.Assert(len(diff.Removed), check.Equals, 0)
+
+	_, err = h.DiffACLPolicy("./tests/acls/broken.hujson")
+	c.Assert(err, check.NotNil)
+}
+
+func (s *Suite) TestUnknownACLReferences(c *check.C) {
+	_, err := h.CreateNamespace("testnamespace")
+	c.Assert(err, check.IsNil)
+
+	policy, err := ParseACLPolicy("./tests/acls/acl_policy_unknown_references.hujson", false)
+	c.Assert(err, check.IsNil)
+	unknown, err := h.unknownACLReferences(policy)
+	c.Assert(err, check.IsNil)
+	c.Assert(unknown, check.DeepEquals, []string{
+		`group group:example: unknown namespace "typo-namespace"`,
+		`tag owners of tag:web: unknown group "group:missing"`,
+		`ACL 0 users: unknown namespace "other-namespace"`,
+	})
+
+	// Only logged by default, the unknown namespaces match nothing
+	err = h.LoadACLPolicy("./tests/acls/acl_policy_unknown_references.hujson")
+	c.Assert(err, check.IsNil)
+	c.Assert(h.loadACL().policy, check.NotNil)
+
+	h.cfg.ACLPolicyStrict = true
+	h.acl.Store(&aclState{rules: &tailcfg.FilterAllowAll})
+	err = h.LoadACLPolicy("./tests/acls/acl_policy_unknown_references.hujson")
+	c.Assert(err, check.ErrorMatches, "the ACL policy references unknown namespaces or groups: .*typo-namespace.*")
+	c.Assert(h.loadACL().policy, check.IsNil)
+
+	err = h.LoadACLPolicy("./tests/acls/acl_policy_basic_groups.hujson")
+	c.Assert(err, check.IsNil)
+}
+
+func (s *Suite) TestNestedGroups(c *check.C) {
+	n, err := h.CreateNamespace("testnamespace")
+	c.Assert(err, check.IsNil)
+
+	m := Machine{
+		MachineKey:     "foo",
+		NodeKey:        "bar",
+		DiscoKey:       "faa",
+		Name:           "testmachine",
+		NamespaceID:    n.ID,
+		Registered:     true,
+		RegisterMethod: "cli",
+		IPAddress:      "100.64.0.1",
+	}
+	h.db.Save(&m)
+
+	err = h.LoadACLPolicy("./tests/acls/acl_policy_nested_groups.hujson")
+	c.Assert(err, check.IsNil)
+	c.Assert(*h.loadACL().rules, check.HasLen, 1)
+	c.Assert((*h.loadACL().rules)[0].SrcIPs, check.DeepEquals, []string{"100.64.0.1"})
+
+	namespaces, err := h.loadACL().policy.groupNamespaces("group:admins")
+	c.Assert(err, check.IsNil)
+	c.Assert(namespaces, check.DeepEquals, []string{"testnamespace"})
+
+	_, err = ParseACLPolicy("./tests/acls/acl_policy_group_cycle.hujson", false)
+	c.Assert(err, check.ErrorMatches, "group contains itself: group:.*")
+}
+
+func (s *Suite) TestSSHRules(c *check.C) {
+	_, err := h.CreateNamespace("test")
+	c.Assert(err, check.IsNil)
+
+	err = h.LoadACLPolicy("./tests/acls/acl_policy_ssh.hujson")
+	c.Assert(err, check.IsNil)
+	policy := h.loadACL().policy
+	c.Assert(policy.SSH, check.HasLen, 2)
+	c.Assert(policy.SSH[1].Dst, check.DeepEquals, []string{"autogroup:self"})
+	unknown, err := h.unknownACLReferences(policy)
+	c.Assert(err, check.IsNil)
+	c.Assert(unknown, check.HasLen, 0)
+
+	valid := SSH{Action: "accept", Src: []string{"test"}, Dst: []string{"tag:server"}, Users: []string{"root"}}
+	c.Assert(validateSSHRule(valid), check.IsNil)
+	for _, r := range []SSH{
+		{Action: "drop", Src: valid.Src, Dst: valid.Dst, Users: valid.Users},
+		{Action: "accept", Src: valid.Src, Dst: valid.Dst, Users: valid.Users, CheckPeriod: "1h"},
+		{Action: "check", Src: valid.Src, Dst: valid.Dst, Users: valid.Users, CheckPeriod: "soon"},
+		{Action: "accept", Dst: valid.Dst, Users: valid.Users},
+		{Action: "accept", Src: []string{"100.64.0.1"}, Dst: valid.Dst, Users: valid.Users},
+		{Action: "accept", Src: valid.Src, Dst: []string{"*"}, Users: valid.Users},
+		{Action: "accept", Src: valid.Src, Dst: []string{"group:admins"}, Users: valid.Users},
+		{Action: "accept", Src: valid.Src, Dst: valid.Dst, Users: []string{"Not A User"}},
+	} {
+		err := validateSSHRule(r)
+		c.Assert(errors.Is(err, errorInvalidSSHRule), check.Equals, true, check.Commentf("%+v", r))
+	}
+}
+
+func (s *Suite) TestNodeAttrs(c *check.C) {
+	n, err := h.CreateNamespace("test")
+	c.Assert(err, check.IsNil)
+
+	err = h.LoadACLPolicy("./tests/acls/acl_policy_node_attrs.hujson")
+	c.Assert(err, check.IsNil)
+	policy := h.loadACL().policy
+	c.Assert(policy.NodeAttrs, check.HasLen, 3)
+	unknown, err := h.unknownACLReferences(policy)
+	c.Assert(err, check.IsNil)
+	c.Assert(unknown, check.HasLen, 0)
+
+	m := Machine{
+		IPAddress: "100.64.0.1",
+		Namespace: *n,
+		Tags:      datatypes.JSON([]byte(`["tag:connector"]`)),
+	}
+	caps, err := h.nodeCapabilities(policy, m)
+	c.Assert(err, check.IsNil)
+	c.Assert(caps, check.DeepEquals, []string{"funnel", "https://tailscale.com/cap/file-sharing"})
+
+	m = Machine{IPAddress: "100.64.1.1", Namespace: Namespace{Name: "other"}}
+	caps, err = h.nodeCapabilities(policy, m)
+	c.Assert(err, check.IsNil)
+	c.Assert(caps, check.DeepEquals, []string{"mullvad"})
+
+	validated := ACLPolicy{TagOwners: TagOwners{"tag:connector": {"test"}}}
+	c.Assert(validated.validateNodeAttr(NodeAttr{Target: []string{"tag:connector", "10.0.0.0/8"}, Attr: []string{"funnel"}}), check.IsNil)
+	for _, a := range []NodeAttr{
+		{Attr: []string{"funnel"}},
+		{Target: []string{"*"}},
+		{Target: []string{"tag:unowned"}, Attr: []string{"funnel"}},
+		{Target: []string{"Not A Namespace"}, Attr: []string{"funnel"}},
+		{Target: []string{"*"}, Attr: []string{"two words"}},
+	} {
+		err := validated.validateNodeAttr(a)
+		c.Assert(errors.Is(err, errorInvalidNodeAttr), check.Equals, true, check.Commentf("%+v", a))
+	}
+}
@@ -9,18 +9,61 @@ import (
 
 // ACLPolicy represents a Tailscale ACL Policy
 type ACLPolicy struct {
-	Groups    Groups    `json:"Groups"`
-	Hosts     Hosts     `json:"Hosts"`
-	TagOwners TagOwners `json:"TagOwners"`
-	ACLs      []ACL     `json:"ACLs"`
-	Tests     []ACLTest `json:"Tests"`
+	Groups    Groups     `json:"Groups" yaml:"Groups"`
+	Hosts     Hosts      `json:"Hosts" yaml:"Hosts"`
+	TagOwners TagOwners  `json:"TagOwners" yaml:"TagOwners"`
+	ACLs      []ACL      `json:"ACLs" yaml:"ACLs"`
+	Tests     []ACLTest  `json:"Tests" yaml:"Tests"`
+	SSH       []SSH      `json:"SSH" yaml:"SSH"`
+	NodeAttrs []NodeAttr `json:"NodeAttrs" yaml:"NodeAttrs"`
+
+	AutoApprovers AutoApprovers `json:"AutoApprovers" yaml:"AutoApprovers"`
+
+	// fingerprint is the SHA-256 of the policy file, or of the names and
+	// fingerprints of the files of a directory, to tell which version of the
+	// policy is loaded
+	fingerprint string
+
+	// aclOrigins and groupFiles tell where the ACLs and the groups come from
+	// when the policy is merged from a directory
+	aclOrigins      []string
+	sshOrigins      []string
+	nodeAttrOrigins []string
+	groupFiles      map[string]string
+}
+
+// AutoApprovers lists who can advertise routes that are enabled without an
+// admin
+type AutoApprovers struct {
+	// Routes maps the prefixes to the namespaces, groups and tags whose
+	// machines get the routes within them approved
+	Routes map[string][]string `json:"Routes" yaml:"Routes"`
 }
 
 // ACL is a basic rule for the ACL Policy
 type ACL struct {
-	Action string   `json:"Action"`
-	Users  []string `json:"Users"`
-	Ports  []string `json:"Ports"`
+	Action string   `json:"Action" yaml:"Action"`
+	Users  []string `json:"Users" yaml:"Users"`
+	Ports  []string `json:"Ports" yaml:"Ports"`
+}
+
+// SSH is a rule of the Tailscale SSH section of the ACL policy: the machines
+// of Src can connect as Users to the machines of Dst
+type SSH struct {
+	// Action is accept, or check to require a recent authentication
+	Action string   `json:"Action" yaml:"Action"`
+	Src    []string `json:"Src" yaml:"Src"`
+	Dst    []string `json:"Dst" yaml:"Dst"`
+	Users  []string `json:"Users" yaml:"Users"`
+	// CheckPeriod is how long a check lasts, 12h by default
+	CheckPeriod string `json:"CheckPeriod,omitempty" yaml:"CheckPeriod,omitempty"`
+}
+
+// NodeAttr grants capabilities to the machines of Target, sent to them in
+// their own node of the netmap
+type NodeAttr struct {
+	Target []string `json:"Target" yaml:"Target"`
+	Attr   []string `json:"Attr" yaml:"Attr"`
 }
 
 // Groups references a series of alias in the ACL rules
@@ -34,19 +77,33 @@ type TagOwners map[string][]string
 
 // ACLTest is not implemented, but should be use to check if a certain rule is allowed
 type ACLTest struct {
-	User  string   `json:"User"`
-	Allow []string `json:"Allow"`
-	Deny  []string `json:"Deny,omitempty"`
+	User  string   `json:"User" yaml:"User"`
+	Allow []string `json:"Allow" yaml:"Allow"`
+	Deny  []string `json:"Deny,omitempty" yaml:"Deny,omitempty"`
 }
 
 // UnmarshalJSON allows to parse the Hosts directly into netaddr objects
 func (h *Hosts) UnmarshalJSON(data []byte) error {
-	hosts := Hosts{}
 	hs := make(map[string]string)
 	err := hujson.Unmarshal(data, &hs)
 	if err != nil {
 		return err
 	}
+	return h.parse(hs)
+}
+
+// UnmarshalYAML allows to parse the Hosts directly into netaddr objects
+func (h *Hosts) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	hs := make(map[string]string)
+	err := unmarshal(&hs)
+	if err != nil {
+		return err
+	}
+	return h.parse(hs)
+}
+
+func (h *Hosts) parse(hs map[string]string) error {
+	hosts := Hosts{}
 	for k, v := range hs {
 		if !strings.Contains(v, "/") {
 			v = v + "/32"
@@ -63,7 +120,7 @@ func (h *Hosts) UnmarshalJSON(data []byte) error {
 
 // IsZero is perhaps a bit naive here
 func (p ACLPolicy) IsZero() bool {
-	if len(p.Groups) == 0 && len(p.Hosts) == 0 && len(p.ACLs) == 0 {
+	if len(p.Groups) == 0 && len(p.Hosts) == 0 && len(p.ACLs) == 0 && len(p.SSH) == 0 && len(p.NodeAttrs) == 0 {
 		return true
 	}
 	return false
@@ -4,14 +4,13 @@ import (
 	"encoding/binary"
 	"encoding/json"
 	"errors"
-	"fmt"
 	"io"
-	"log"
 	"net/http"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/klauspost/compress/zstd"
+	"github.com/rs/zerolog/log"
 	"gorm.io/datatypes"
 	"gorm.io/gorm"
 	"inet.af/netaddr"
@@ -34,50 +33,53 @@ func (h *Headscale) RegisterWebAPI(c *gin.Context) {
 		return
 	}
 
-	// spew.Dump(c.Params)
-
-	c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(fmt.Sprintf(`
-	<html>
-	<body>
-	<h1>headscale</h1>
-	<p>
-		Run the command below in the headscale server to add this machine to your network:
-	</p>
-
-	<p>
-		<code>
-			<b>headscale -n NAMESPACE nodes register %s</b>
-		</code>
-	</p>
-
-	</body>
-	</html>
-
-	`, mKeyStr)))
+	h.renderRegistrationPage(c, "register", registrationPage{MachineKey: mKeyStr})
 }
 
 // RegistrationHandler handles the actual registration process of a machine
 // Endpoint /machine/:id
 func (h *Headscale) RegistrationHandler(c *gin.Context) {
+	if h.isShuttingDown() {
+		c.String(http.StatusServiceUnavailable, "Shutting down")
+		return
+	}
 	body, _ := io.ReadAll(c.Request.Body)
 	mKeyStr := c.Param("id")
 	mKey, err := wgkey.ParseHex(mKeyStr)
 	if err != nil {
-		log.Printf("Cannot parse machine key: %s", err)
+		log.Error().
+			Err(err).
+			Msg("Cannot parse machine key")
 		c.String(http.StatusInternalServerError, "Sad!")
 		return
 	}
 	req := tailcfg.RegisterRequest{}
 	err = decode(body, &req, &mKey, h.privateKey)
 	if err != nil {
-		log.Printf("Cannot decode message: %s", err)
+		log.Error().
+			Err(err).
+			Msg("Cannot decode message")
 		c.String(http.StatusInternalServerError, "Very sad!")
 		return
 	}
 
 	var m Machine
-	if result := h.db.Preload("Namespace").First(&m, "machine_key = ?", mKey.HexString()); errors.Is(result.Error, gorm.ErrRecordNotFound) {
-		log.Println("New Machine!")
+	result := h.db.Preload("Namespace").First(&m, "machine_key = ?", mKey.HexString())
+	// Only the machines already registered carry on during a maintenance
+	if !m.Registered {
+		if err := h.checkMaintenance(); err != nil {
+			log.Warn().
+				Str("machine", req.Hostinfo.Hostname).
+				Err(err).
+				Msg("Refusing the registration")
+			c.String(http.StatusServiceUnavailable, err.Error())
+			return
+		}
+	}
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		log.Info().
+			Str("machine", req.Hostinfo.Hostname).
+			Msg("New machine")
 		m = Machine{
 			Expiry:     &req.Expiry,
 			MachineKey: mKey.HexString(),
@@ -85,11 +87,39 @@ func (h *Headscale) RegistrationHandler(c *gin.Context) {
 			NodeKey:    wgkey.Key(req.NodeKey).HexString(),
 		}
 		if err := h.db.Create(&m).Error; err != nil {
-			log.Printf("Could not create row: %s", err)
+			log.Error().
+				Err(err).
+				Msg("Could not create row")
 			return
 		}
 	}
 
+	if m.Registered && m.isExpired() {
+		log.Info().
+			Str("machine", m.Name).
+			Msg("Machine key has expired, it has to be authenticated again")
+		m.Registered = false
+		h.db.Save(&m)
+	}
+
+	// Already authenticated, it is not given another AuthURL or key
+	if m.Pending {
+		log.Info().
+			Str("machine", m.Name).
+			Msg("The machine is waiting for approval")
+		resp := tailcfg.RegisterResponse{MachineAuthorized: false, User: *m.Namespace.toUser()}
+		respBody, err := encode(resp, &mKey, h.privateKey)
+		if err != nil {
+			log.Error().
+				Err(err).
+				Msg("Cannot encode message")
+			c.String(http.StatusInternalServerError, "")
+			return
+		}
+		c.Data(200, "application/json; charset=utf-8", respBody)
+		return
+	}
+
 	if !m.Registered && req.Auth.AuthKey != "" {
 		h.handleAuthKey(c, h.db, mKey, req, m)
 		return
@@ -100,13 +130,17 @@ func (h *Headscale) RegistrationHandler(c *gin.Context) {
 	// We have the updated key!
 	if m.NodeKey == wgkey.Key(req.NodeKey).HexString() {
 		if m.Registered {
-			log.Printf("[%s] Client is registered and we have the current NodeKey. All clear to /map", m.Name)
+			log.Info().
+				Str("machine", m.Name).
+				Msg("Client is registered and we have the current NodeKey. All clear to /map")
 			resp.AuthURL = ""
 			resp.MachineAuthorized = true
 			resp.User = *m.Namespace.toUser()
 			respBody, err := encode(resp, &mKey, h.privateKey)
 			if err != nil {
-				log.Printf("Cannot encode message: %s", err)
+				log.Error().
+					Err(err).
+					Msg("Cannot encode message")
 				c.String(http.StatusInternalServerError, "")
 				return
 			}
@@ -114,12 +148,15 @@ func (h *Headscale) RegistrationHandler(c *gin.Context) {
 			return
 		}
 
-		log.Printf("[%s] Not registered and not NodeKey rotation. Sending a authurl to register", m.Name)
-		resp.AuthURL = fmt.Sprintf("%s/register?key=%s",
-			h.cfg.ServerURL, mKey.HexString())
+		log.Info().
+			Str("machine", m.Name).
+			Msg("Not registered and not NodeKey rotation. Sending a authurl to register")
+		resp.AuthURL = h.authURL(mKey)
 		respBody, err := encode(resp, &mKey, h.privateKey)
 		if err != nil {
-			log.Printf("Cannot encode message: %s", err)
+			log.Error().
+				Err(err).
+				Msg("Cannot encode message")
 			c.String(http.StatusInternalServerError, "")
 			return
 		}
@@ -129,15 +166,36 @@ func (h *Headscale) RegistrationHandler(c *gin.Context) {
 
 	// The NodeKey we have matches OldNodeKey, which means this is a refresh after an key expiration
 	if m.NodeKey == wgkey.Key(req.OldNodeKey).HexString() {
-		log.Printf("[%s] We have the OldNodeKey in the database. This is a key refresh", m.Name)
-		m.NodeKey = wgkey.Key(req.NodeKey).HexString()
-		h.db.Save(&m)
+		// A registered machine rotating its key stays authorized, e.g. after
+		// nodes refresh-key; after an expiry it has to be authenticated again
+		if m.Registered {
+			log.Info().
+				Str("machine", m.Name).
+				Msg("The machine is rotating its NodeKey")
+			if err := h.rotateNodeKey(&m, wgkey.Key(req.NodeKey).HexString()); err != nil {
+				log.Error().
+					Str("machine", m.Name).
+					Err(err).
+					Msg("Cannot rotate the NodeKey")
+				c.String(http.StatusInternalServerError, "")
+				return
+			}
+			resp.MachineAuthorized = true
+		} else {
+			log.Info().
+				Str("machine", m.Name).
+				Msg("We have the OldNodeKey in the database. This is a key refresh")
+			m.NodeKey = wgkey.Key(req.NodeKey).HexString()
+			h.db.Save(&m)
+			resp.AuthURL = h.authURL(mKey)
+		}
 
-		resp.AuthURL = ""
 		resp.User = *m.Namespace.toUser()
 		respBody, err := encode(resp, &mKey, h.privateKey)
 		if err != nil {
-			log.Printf("Cannot encode message: %s", err)
+			log.Error().
+				Err(err).
+				Msg("Cannot encode message")
 			c.String(http.StatusInternalServerError, "Extremely sad!")
 			return
 		}
@@ -148,25 +206,40 @@ func (h *Headscale) RegistrationHandler(c *gin.Context) {
 	// We arrive here after a client is restarted without finalizing the authentication flow or
 	// when headscale is stopped in the middle of the auth process.
 	if m.Registered {
-		log.Printf("[%s] The node is sending us a new NodeKey, but machine is registered. All clear for /map", m.Name)
+		log.Info().
+			Str("machine", m.Name).
+			Msg("The node is sending us a new NodeKey, but machine is registered. All clear for /map")
+		// Machines registered with nodes register before they first connected
+		if m.NodeKey == "" {
+			m.NodeKey = wgkey.Key(req.NodeKey).HexString()
+			if m.Name == "" {
+				m.Name = req.Hostinfo.Hostname
+			}
+			h.db.Save(&m)
+		}
 		resp.AuthURL = ""
 		resp.MachineAuthorized = true
 		resp.User = *m.Namespace.toUser()
 		respBody, err := encode(resp, &mKey, h.privateKey)
 		if err != nil {
-			log.Printf("Cannot encode message: %s", err)
+			log.Error().
+				Err(err).
+				Msg("Cannot encode message")
 			c.String(http.StatusInternalServerError, "")
 			return
 		}
 		c.Data(200, "application/json; charset=utf-8", respBody)
 		return
 	}
-	log.Printf("[%s] The node is sending us a new NodeKey, sending auth url", m.Name)
-	resp.AuthURL = fmt.Sprintf("%s/register?key=%s",
-		h.cfg.ServerURL, mKey.HexString())
+	log.Info().
+		Str("machine", m.Name).
+		Msg("The node is sending us a new NodeKey, sending auth url")
+	resp.AuthURL = h.authURL(mKey)
 	respBody, err := encode(resp, &mKey, h.privateKey)
 	if err != nil {
-		log.Printf("Cannot encode message: %s", err)
+		log.Error().
+			Err(err).
+			Msg("Cannot encode message")
 		c.String(http.StatusInternalServerError, "")
 		return
 	}
@@ -187,21 +260,37 @@ func (h *Headscale) PollNetMapHandler(c *gin.Context) {
 	mKeyStr := c.Param("id")
 	mKey, err := wgkey.ParseHex(mKeyStr)
 	if err != nil {
-		log.Printf("Cannot parse client key: %s", err)
+		log.Error().
+			Err(err).
+			Msg("Cannot parse client key")
 		c.String(http.StatusBadRequest, "")
 		return
 	}
 	req := tailcfg.MapRequest{}
 	err = decode(body, &req, &mKey, h.privateKey)
 	if err != nil {
-		log.Printf("Cannot decode message: %s", err)
+		log.Error().
+			Err(err).
+			Msg("Cannot decode message")
 		c.String(http.StatusBadRequest, "")
 		return
 	}
 
 	var m Machine
 	if result := h.db.Preload("Namespace").First(&m, "machine_key = ?", mKey.HexString()); errors.Is(result.Error, gorm.ErrRecordNotFound) {
-		log.Printf("Ignoring request, cannot find machine with key %s", mKey.HexString())
+		log.Warn().
+			Str("machine_key", mKey.HexString()).
+			Msg("Ignoring request, cannot find machine")
+		c.String(http.StatusUnauthorized, "")
+		return
+	}
+
+	// Not registered yet, waiting for approval, or asked to authenticate again
+	// with nodes reauth
+	if !m.Registered {
+		log.Info().
+			Str("machine", m.Name).
+			Msg("Ignoring request, the machine has to be authenticated")
 		c.String(http.StatusUnauthorized, "")
 		return
 	}
@@ -227,6 +316,13 @@ func (h *Headscale) PollNetMapHandler(c *gin.Context) {
 	}
 	h.db.Save(&m)
 
+	if err := h.autoApproveRoutes(&m); err != nil {
+		log.Error().
+			Str("machine", m.Name).
+			Err(err).
+			Msg("Cannot enable the auto approved routes")
+	}
+
 	pollData := make(chan []byte, 1)
 	update := make(chan []byte, 1)
 	cancelKeepAlive := make(chan []byte, 1)
@@ -236,7 +332,9 @@ func (h *Headscale) PollNetMapHandler(c *gin.Context) {
 	h.clientsPolling[m.ID] = update
 	h.pollMu.Unlock()
 
-	data, err := h.getMapResponse(mKey, req, m)
+	// The updates of this poll are sent as deltas of its initial map
+	session := newMapSession(req)
+	data, err := h.getMapResponse(mKey, req, m, session)
 	if err != nil {
 		c.String(http.StatusInternalServerError, ":(")
 		return
@@ -247,84 +345,177 @@ func (h *Headscale) PollNetMapHandler(c *gin.Context) {
 	// empty endpoints to peers)
 
 	// Details on the protocol can be found in https://github.com/tailscale/tailscale/blob/main/tailcfg/tailcfg.go#L696
-	log.Printf("[%s] ReadOnly=%t   OmitPeers=%t    Stream=%t", m.Name, req.ReadOnly, req.OmitPeers, req.Stream)
+	log.Debug().
+		Str("machine", m.Name).
+		Bool("readonly", req.ReadOnly).
+		Bool("omit_peers", req.OmitPeers).
+		Bool("stream", req.Stream).
+		Msg("Client map request")
 
 	if req.ReadOnly {
-		log.Printf("[%s] Client is starting up. Asking for DERP map", m.Name)
+		log.Info().
+			Str("machine", m.Name).
+			Msg("Client is starting up. Asking for DERP map")
 		c.Data(200, "application/json; charset=utf-8", *data)
 		return
 	}
 	if req.OmitPeers && !req.Stream {
-		log.Printf("[%s] Client sent endpoint update and is ok with a response without peer list", m.Name)
+		log.Info().
+			Str("machine", m.Name).
+			Msg("Client sent endpoint update and is ok with a response without peer list")
 		c.Data(200, "application/json; charset=utf-8", *data)
 		return
 	} else if req.OmitPeers && req.Stream {
-		log.Printf("[%s] Warning, ignoring request, don't know how to handle it", m.Name)
+		log.Warn().
+			Str("machine", m.Name).
+			Msg("Warning, ignoring request, don't know how to handle it")
 		c.String(http.StatusBadRequest, "")
 		return
 	}
 
-	log.Printf("[%s] Client is ready to access the tailnet", m.Name)
-	log.Printf("[%s] Sending initial map", m.Name)
+	log.Info().
+		Str("machine", m.Name).
+		Msg("Client is ready to access the tailnet")
+	log.Debug().
+		Str("machine", m.Name).
+		Msg("Sending initial map")
 	pollData <- *data
 
-	log.Printf("[%s] Notifying peers", m.Name)
+	log.Debug().
+		Str("machine", m.Name).
+		Msg("Notifying peers")
 	peers, _ := h.getPeers(m)
 	h.pollMu.Lock()
 	for _, p := range *peers {
 		pUp, ok := h.clientsPolling[uint64(p.ID)]
 		if ok {
-			log.Printf("[%s] Notifying peer %s (%s)", m.Name, p.Name, p.Addresses[0])
+			log.Debug().
+				Str("machine", m.Name).
+				Str("peer", p.Name).
+				Str("address", p.Addresses[0].String()).
+				Msg("Notifying peer")
 			pUp <- []byte{}
 		} else {
-			log.Printf("[%s] Peer %s does not appear to be polling", m.Name, p.Name)
+			log.Debug().
+				Str("machine", m.Name).
+				Str("peer", p.Name).
+				Msg("Peer does not appear to be polling")
 		}
 	}
 	h.pollMu.Unlock()
 
 	go h.keepAlive(cancelKeepAlive, pollData, mKey, req, m)
 
+	// Only last_seen is written while polling: saving m would overwrite the
+	// changes made since, and bump the version of the cached peers
+	stopPolling := func() {
+		now := time.Now().UTC()
+		m.LastSeen = &now
+		h.db.Model(&m).UpdateColumn("last_seen", now)
+		h.pollMu.Lock()
+		cancelKeepAlive <- []byte{}
+		delete(h.clientsPolling, m.ID)
+		close(update)
+		h.pollMu.Unlock()
+	}
+	closing := h.pollShutdown(c.Request.Context().Done())
+	// m is reloaded on each update, the poll gets the expired key if it was
+	// started after the key refresh was requested
+	refreshRequested := m.KeyRefreshRequestedAt != nil
+
 	c.Stream(func(w io.Writer) bool {
 		select {
 		case data := <-pollData:
-			log.Printf("[%s] Sending data (%d bytes)", m.Name, len(data))
+			log.Debug().
+				Str("machine", m.Name).
+				Int("bytes", len(data)).
+				Msg("Sending data")
 			_, err := w.Write(data)
 			if err != nil {
-				log.Printf("[%s] Cannot write data: %s", m.Name, err)
+				log.Error().
+					Str("machine", m.Name).
+					Err(err).
+					Msg("Cannot write data")
 			}
 			now := time.Now().UTC()
 			m.LastSeen = &now
-			h.db.Save(&m)
+			h.db.Model(&m).UpdateColumn("last_seen", now)
 			return true
 
 		case <-update:
-			log.Printf("[%s] Received a request for update", m.Name)
-			data, err := h.getMapResponse(mKey, req, m)
+			log.Debug().
+				Str("machine", m.Name).
+				Msg("Received a request for update")
+			if !h.isMachineRegistered(m.ID) {
+				log.Info().
+					Str("machine", m.Name).
+					Msg("Closing the connection, the machine has to be authenticated again")
+				stopPolling()
+				return false
+			}
+			// The next poll gets the expired key, this one was started before
+			if !refreshRequested && h.isKeyRefreshRequested(m.ID) {
+				log.Info().
+					Str("machine", m.Name).
+					Msg("Closing the connection, the machine has to rotate its node key")
+				stopPolling()
+				return false
+			}
+			// It may have been moved, renamed, or given another address,
+			// expiry or routes since the poll started
+			current, err := h.GetMachineByID(m.ID)
+			if err != nil {
+				log.Error().
+					Str("machine", m.Name).
+					Err(err).
+					Msg("Could not reload the machine")
+				return true
+			}
+			m = *current
+			data, err := h.getMapResponse(mKey, req, m, session)
 			if err != nil {
-				log.Printf("[%s] Could not get the map update: %s", m.Name, err)
+				log.Error().
+					Str("machine", m.Name).
+					Err(err).
+					Msg("Could not get the map update")
+				return true
 			}
 			_, err = w.Write(*data)
 			if err != nil {
-				log.Printf("[%s] Could not write the map response: %s", m.Name, err)
+				log.Error().
+					Str("machine", m.Name).
+					Err(err).
+					Msg("Could not write the map response")
 			}
+			netMapUpdatesSent.Inc()
 			return true
 
 		case <-c.Request.Context().Done():
-			log.Printf("[%s] The client has closed the connection", m.Name)
-			now := time.Now().UTC()
-			m.LastSeen = &now
-			h.db.Save(&m)
-			h.pollMu.Lock()
-			cancelKeepAlive <- []byte{}
-			delete(h.clientsPolling, m.ID)
-			close(update)
-			h.pollMu.Unlock()
+			log.Info().
+				Str("machine", m.Name).
+				Msg("The client has closed the connection")
+			stopPolling()
+			return false
+
+		case <-closing:
+			// The client reconnects once the server is back
+			log.Info().
+				Str("machine", m.Name).
+				Msg("Closing the connection, the server is shutting down")
+			stopPolling()
 			return false
 
 		}
 	})
 }
 
+func (h *Headscale) keepAliveInterval() time.Duration {
+	if h.cfg.KeepAliveInterval > 0 {
+		return h.cfg.KeepAliveInterval
+	}
+	return defaultKeepAliveInterval
+}
+
 func (h *Headscale) keepAlive(cancel chan []byte, pollData chan []byte, mKey wgkey.Key, req tailcfg.MapRequest, m Machine) {
 	for {
 		select {
@@ -335,50 +526,72 @@ func (h *Headscale) keepAlive(cancel chan []byte, pollData chan []byte, mKey wgk
 			h.pollMu.Lock()
 			data, err := h.getMapKeepAliveResponse(mKey, req, m)
 			if err != nil {
-				log.Printf("Error generating the keep alive msg: %s", err)
+				log.Error().
+					Err(err).
+					Msg("Error generating the keep alive msg")
 				return
 			}
-			log.Printf("[%s] Sending keepalive", m.Name)
+			log.Debug().
+				Str("machine", m.Name).
+				Msg("Sending keepalive")
 			pollData <- *data
 			h.pollMu.Unlock()
-			time.Sleep(60 * time.Second)
+			time.Sleep(h.keepAliveInterval())
 		}
 	}
 }
 
-func (h *Headscale) getMapResponse(mKey wgkey.Key, req tailcfg.MapRequest, m Machine) (*[]byte, error) {
-	node, err := m.toNode()
-	if err != nil {
-		log.Printf("Cannot convert to node: %s", err)
-		return nil, err
-	}
-	peers, err := h.getPeers(m)
-	if err != nil {
-		log.Printf("Cannot fetch peers: %s", err)
-		return nil, err
-	}
-
-	profile := tailcfg.UserProfile{
+// getUserProfiles returns the profiles of the namespace of the machine, and
+// of the namespaces of the peers shared with it
+func (h *Headscale) getUserProfiles(m Machine, peers []*tailcfg.Node) ([]tailcfg.UserProfile, error) {
+	profiles := []tailcfg.UserProfile{{
 		ID:          tailcfg.UserID(m.NamespaceID),
 		LoginName:   m.Namespace.Name,
 		DisplayName: m.Namespace.Name,
+	}}
+	ids := []uint{}
+	seen := map[tailcfg.UserID]bool{profiles[0].ID: true}
+	for _, p := range peers {
+		if !seen[p.User] {
+			seen[p.User] = true
+			ids = append(ids, uint(p.User))
+		}
+	}
+	if len(ids) == 0 {
+		return profiles, nil
 	}
 
-	resp := tailcfg.MapResponse{
-		KeepAlive:    false,
-		Node:         node,
-		Peers:        *peers,
-		DNS:          []netaddr.IP{},
-		SearchPaths:  []string{},
-		Domain:       "headscale.net",
-		PacketFilter: *h.aclRules,
-		DERPMap:      h.cfg.DerpMap,
-		UserProfiles: []tailcfg.UserProfile{profile},
+	namespaces := []Namespace{}
+	if err := h.db.Where("id IN (?)", ids).Order("id").Find(&namespaces).Error; err != nil {
+		return nil, err
 	}
+	for _, n := range namespaces {
+		profiles = append(profiles, tailcfg.UserProfile{
+			ID:          tailcfg.UserID(n.ID),
+			LoginName:   n.Name,
+			DisplayName: n.Name,
+		})
+	}
+	return profiles, nil
+}
+
+// getMapResponse encodes the netmap of the machine for the client, as a
+// delta of the one last sent in session
+func (h *Headscale) getMapResponse(mKey wgkey.Key, req tailcfg.MapRequest, m Machine, session *mapSession) (*[]byte, error) {
+	start := time.Now()
+	defer func() {
+		netMapGenerationDuration.Observe(time.Since(start).Seconds())
+	}()
+
+	resp, err := h.generateMapResponse(m)
+	if err != nil {
+		return nil, err
+	}
+	resp = session.update(resp)
 
 	var respBody []byte
 	if req.Compress == "zstd" {
-		src, _ := json.Marshal(resp)
+		src, _ := json.Marshal(*resp)
 		encoder, _ := zstd.NewWriter(nil)
 		srcCompressed := encoder.EncodeAll(src, nil)
 		respBody, err = encodeMsg(srcCompressed, &mKey, h.privateKey)
@@ -386,7 +599,7 @@ func (h *Headscale) getMapResponse(mKey wgkey.Key, req tailcfg.MapRequest, m Mac
 			return nil, err
 		}
 	} else {
-		respBody, err = encode(resp, &mKey, h.privateKey)
+		respBody, err = encode(*resp, &mKey, h.privateKey)
 		if err != nil {
 			return nil, err
 		}
@@ -399,6 +612,87 @@ func (h *Headscale) getMapResponse(mKey wgkey.Key, req tailcfg.MapRequest, m Mac
 	return &data, nil
 }
 
+// generateMapResponse builds the netmap of the machine, before it is encoded
+// for the client
+func (h *Headscale) generateMapResponse(m Machine) (*tailcfg.MapResponse, error) {
+	node, err := m.toNode()
+	if err != nil {
+		log.Error().
+			Err(err).
+			Msg("Cannot convert to node")
+		return nil, err
+	}
+	peers, err := h.getPeers(m)
+	if err != nil {
+		log.Error().
+			Err(err).
+			Msg("Cannot fetch peers")
+		return nil, err
+	}
+	_, nodes, err := h.getNamespacePeers(m.NamespaceID)
+	if err != nil {
+		log.Error().
+			Err(err).
+			Msg("Cannot get the MagicDNS names")
+		return nil, err
+	}
+	if n, ok := nodes[m.ID]; ok {
+		node.Name = n.Name
+	}
+	// The client registers a new node key once its own has expired, the
+	// peers keep the real expiry
+	if m.KeyRefreshRequestedAt != nil {
+		node.KeyExpiry = *m.KeyRefreshRequestedAt
+	}
+	// The capabilities and the packet filter come from the same policy
+	acl := h.loadACL()
+	// Only the machine itself gets its capabilities
+	node.Capabilities, err = h.nodeCapabilities(acl.policy, m)
+	if err != nil {
+		log.Error().
+			Err(err).
+			Msg("Cannot get the capabilities of the node attributes")
+		return nil, err
+	}
+	domain := "headscale.net"
+	if h.cfg.BaseDomain != "" {
+		domain = h.cfg.BaseDomain
+	}
+
+	profiles, err := h.getUserProfiles(m, *peers)
+	if err != nil {
+		log.Error().
+			Err(err).
+			Msg("Cannot get the user profiles")
+		return nil, err
+	}
+
+	resp := tailcfg.MapResponse{
+		KeepAlive:    false,
+		Node:         node,
+		Peers:        *peers,
+		DNS:          []netaddr.IP{},
+		SearchPaths:  []string{},
+		Domain:       domain,
+		DNSConfig:    h.getDNSConfig(m),
+		PacketFilter: *acl.rules,
+		DERPMap:      h.getNamespaceDERPMap(m.Namespace),
+		UserProfiles: profiles,
+	}
+	return &resp, nil
+}
+
+// GetMachineNetMap returns the netmap the machine gets at its next map
+// request: its peers, their routes, the DNS configuration, the DERP map and
+// the packet filter of the ACLs
+func (h *Headscale) GetMachineNetMap(id uint64) (*tailcfg.MapResponse, error) {
+	m, err := h.GetMachineByID(id)
+	if err != nil {
+		return nil, err
+	}
+	return h.generateMapResponse(*m)
+}
+
 func (h *Headscale) getMapKeepAliveResponse(mKey wgkey.Key, req tailcfg.MapRequest, m Machine) (*[]byte, error) {
 	resp := tailcfg.MapResponse{
 		KeepAlive: true,
@@ -429,39 +723,82 @@ func (h *Headscale) handleAuthKey(c *gin.Context, db *gorm.DB, idKey wgkey.Key,
 	resp := tailcfg.RegisterResponse{}
 	pak, err := h.checkKeyValidity(req.Auth.AuthKey)
 	if err != nil {
+		log.Error().
+			Str("machine", m.Name).
+			Err(err).
+			Msg("Failed authentication via AuthKey")
 		resp.MachineAuthorized = false
 		respBody, err := encode(resp, &idKey, h.privateKey)
 		if err != nil {
-			log.Printf("Cannot encode message: %s", err)
+			log.Error().
+				Err(err).
+				Msg("Cannot encode message")
 			c.String(http.StatusInternalServerError, "")
 			return
 		}
 		c.Data(200, "application/json; charset=utf-8", respBody)
-		log.Printf("[%s] Failed authentication via AuthKey", m.Name)
 		return
 	}
-	ip, err := h.getAvailableIP()
+	err = h.checkNamespaceQuota(&pak.Namespace)
+	if err != nil {
+		log.Error().
+			Str("machine", m.Name).
+			Str("namespace", pak.Namespace.Name).
+			Err(err).
+			Msg("Cannot register machine in namespace")
+		c.String(http.StatusForbidden, err.Error())
+		return
+	}
+
+	// Machines authenticating again after their key expired keep their IP address
+	err = h.assignIPAddresses(&m)
 	if err != nil {
-		log.Println(err)
+		log.Error().
+			Str("machine", m.Name).
+			Err(err).
+			Msg("Cannot allocate an IP address")
 		return
 	}
+	if expiry := h.getMachineExpiry(); expiry != nil {
+		m.Expiry = expiry
+	}
 
 	m.AuthKeyID = uint(pak.ID)
-	m.IPAddress = ip.String()
 	m.NamespaceID = pak.NamespaceID
 	m.NodeKey = wgkey.Key(req.NodeKey).HexString() // we update it just in case
-	m.Registered = true
+	now := time.Now().UTC()
+	m.Pending = h.cfg.NodeApprovalRequired
+	m.Registered = !m.Pending
 	m.RegisterMethod = "authKey"
+	m.RegisteredAt = &now
 	db.Save(&m)
+	if err := h.applyPreAuthKeyTags(&m, pak); err != nil {
+		log.Error().
+			Str("machine", m.Name).
+			Err(err).
+			Msg("Cannot apply the tags of the pre-auth key")
+	}
 
-	resp.MachineAuthorized = true
+	// Without an AuthURL, the clients of the pending machines wait for the
+	// approval
+	resp.MachineAuthorized = m.Registered
 	resp.User = *pak.Namespace.toUser()
 	respBody, err := encode(resp, &idKey, h.privateKey)
 	if err != nil {
-		log.Printf("Cannot encode message: %s", err)
+		log.Error().
+			Err(err).
+			Msg("Cannot encode message")
 		c.String(http.StatusInternalServerError, "Extremely sad!")
 		return
 	}
 	c.Data(200, "application/json; charset=utf-8", respBody)
-	log.Printf("[%s] Successfully authenticated via AuthKey", m.Name)
+	if m.Pending {
+		log.Info().
+			Str("machine", m.Name).
+			Msg("Successfully authenticated via AuthKey, the machine is waiting for approval")
+		return
+	}
+	log.Info().
+		Str("machine", m.Name).
+		Msg("Successfully authenticated via AuthKey")
 }
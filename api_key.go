@@ -0,0 +1,127 @@
+package headscale
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+const apiKeyPrefixLength = 10
+const apiKeySecretLength = 32
+
+const errorAPIKeyNotFound = Error("API key not found")
+const errorAPIKeyExpired = Error("API key expired")
+const errorAPIKeyInvalid = Error("invalid API key")
+
+// APIKey describes a key used to authenticate against the management API.
+//
+// Only the prefix and a bcrypt hash of the key are stored, so the full key
+// is only known when it is created.
+type APIKey struct {
+	ID     uint64 `gorm:"primary_key"`
+	Prefix string `gorm:"uniqueIndex"`
+	Hash   []byte `json:"-" yaml:"-"`
+
+	CreatedAt  *time.Time
+	Expiration *time.Time
+	LastSeen   *time.Time
+}
+
+// CreateAPIKey creates a new APIKey, and returns it along with the full key
+// (PREFIX.SECRET), which is not stored anywhere
+func (h *Headscale) CreateAPIKey(expiration *time.Time) (_ string, _ *APIKey, err error) {
+	prefix, err := h.generateKey()
+	if err != nil {
+		return "", nil, err
+	}
+	prefix = prefix[:apiKeyPrefixLength]
+	defer func() { h.audit("apikey.create", "prefix:"+prefix, err) }()
+	if err = h.checkMaintenance(); err != nil {
+		return "", nil, err
+	}
+	secret, err := h.generateKey()
+	if err != nil {
+		return "", nil, err
+	}
+	secret = secret[:apiKeySecretLength]
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(secret), bcrypt.DefaultCost)
+	if err != nil {
+		return "", nil, err
+	}
+
+	now := time.Now().UTC()
+	k := APIKey{
+		Prefix:     prefix,
+		Hash:       hash,
+		CreatedAt:  &now,
+		Expiration: expiration,
+	}
+	if err := h.db.Save(&k).Error; err != nil {
+		return "", nil, err
+	}
+
+	return fmt.Sprintf("%s.%s", prefix, secret), &k, nil
+}
+
+// ListAPIKeys returns the list of APIKeys
+func (h *Headscale) ListAPIKeys() (*[]APIKey, error) {
+	keys := []APIKey{}
+	if err := h.db.Find(&keys).Error; err != nil {
+		return nil, err
+	}
+	return &keys, nil
+}
+
+// GetAPIKey finds an APIKey by its prefix
+func (h *Headscale) GetAPIKey(prefix string) (*APIKey, error) {
+	k := APIKey{}
+	if result := h.db.First(&k, "prefix = ?", prefix); errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return nil, errorAPIKeyNotFound
+	}
+	return &k, nil
+}
+
+// ExpireAPIKey expires an APIKey right away, so it is no longer accepted
+func (h *Headscale) ExpireAPIKey(prefix string) (_ *APIKey, err error) {
+	defer func() { h.audit("apikey.expire", "prefix:"+prefix, err) }()
+	if err = h.checkMaintenance(); err != nil {
+		return nil, err
+	}
+	k, err := h.GetAPIKey(prefix)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	k.Expiration = &now
+	if err := h.db.Save(k).Error; err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// ValidateAPIKey checks a full key (PREFIX.SECRET) against the stored hash,
+// and records when the key was last used
+func (h *Headscale) ValidateAPIKey(key string) error {
+	parts := strings.SplitN(key, ".", 2)
+	if len(parts) != 2 {
+		return errorAPIKeyInvalid
+	}
+	k, err := h.GetAPIKey(parts[0])
+	if err != nil {
+		return err
+	}
+	if k.Expiration != nil && k.Expiration.Before(time.Now()) {
+		return errorAPIKeyExpired
+	}
+	if err := bcrypt.CompareHashAndPassword(k.Hash, []byte(parts[1])); err != nil {
+		return errorAPIKeyInvalid
+	}
+
+	now := time.Now().UTC()
+	return h.db.Model(k).Update("last_seen", now).Error
+}
@@ -0,0 +1,55 @@
+package headscale
+
+import (
+	"strings"
+	"time"
+
+	"gopkg.in/check.v1"
+)
+
+func (*Suite) TestCreateAPIKey(c *check.C) {
+	key, k, err := h.CreateAPIKey(nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(strings.HasPrefix(key, k.Prefix+"."), check.Equals, true)
+
+	// Only the hash of the key is stored
+	c.Assert(strings.Contains(string(k.Hash), strings.SplitN(key, ".", 2)[1]), check.Equals, false)
+
+	keys, err := h.ListAPIKeys()
+	c.Assert(err, check.IsNil)
+	c.Assert(len(*keys), check.Equals, 1)
+
+	err = h.ValidateAPIKey(key)
+	c.Assert(err, check.IsNil)
+
+	k, err = h.GetAPIKey(k.Prefix)
+	c.Assert(err, check.IsNil)
+	c.Assert(k.LastSeen, check.NotNil)
+}
+
+func (*Suite) TestValidateAPIKey(c *check.C) {
+	err := h.ValidateAPIKey("bogus")
+	c.Assert(err, check.Equals, errorAPIKeyInvalid)
+
+	err = h.ValidateAPIKey("bogus.bogus")
+	c.Assert(err, check.Equals, errorAPIKeyNotFound)
+
+	key, k, err := h.CreateAPIKey(nil)
+	c.Assert(err, check.IsNil)
+
+	err = h.ValidateAPIKey(k.Prefix + ".wrong")
+	c.Assert(err, check.Equals, errorAPIKeyInvalid)
+
+	_, err = h.ExpireAPIKey(k.Prefix)
+	c.Assert(err, check.IsNil)
+
+	err = h.ValidateAPIKey(key)
+	c.Assert(err, check.Equals, errorAPIKeyExpired)
+
+	expiration := time.Now().Add(time.Hour)
+	key, _, err = h.CreateAPIKey(&expiration)
+	c.Assert(err, check.IsNil)
+
+	err = h.ValidateAPIKey(key)
+	c.Assert(err, check.IsNil)
+}
@@ -1,18 +1,28 @@
 package headscale
 
 import (
+	"crypto/tls"
 	"errors"
 	"fmt"
-	"log"
+	"html/template"
 	"net/http"
+	"net/url"
 	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/acme"
 	"golang.org/x/crypto/acme/autocert"
+	"google.golang.org/grpc"
 	"gorm.io/gorm"
+	"inet.af/netaddr"
+	"tailscale.com/derp"
+	"tailscale.com/derp/derphttp"
 	"tailscale.com/tailcfg"
 	"tailscale.com/types/wgkey"
 )
@@ -23,7 +33,72 @@ type Config struct {
 	Addr                           string
 	PrivateKeyPath                 string
 	DerpMap                        *tailcfg.DERPMap
+	DerpMapPaths                   []string
+	DerpMapFetchTimeout            time.Duration
+	DerpMapCacheDir                string
+	DerpUpdateFrequency            time.Duration
 	EphemeralNodeInactivityTimeout time.Duration
+	MetricsAddr                    string
+	MaxMachinesPerNamespace        int
+	NodeKeyExpiry                  time.Duration
+
+	// DerpServerEnabled runs a DERP server on the main listener, added to the
+	// DERP map as region DerpServerRegionID, with its STUN server listening on
+	// DerpServerSTUNAddr if set
+	DerpServerEnabled    bool
+	DerpServerRegionID   int
+	DerpServerRegionCode string
+	DerpServerRegionName string
+	DerpServerSTUNAddr   string
+
+	// DerpAddressFamily, ipv4 or ipv6, restricts the nodes of the DERP map
+	// to that address family, see FilterDERPMapFamily
+	DerpAddressFamily string
+
+	// DerpVerifyEndpoints probes the relays and STUN ports of the DERP map
+	// when it is loaded, and logs the unreachable ones
+	DerpVerifyEndpoints bool
+
+	// KeepAliveInterval is the interval of the keepalives sent on the map
+	// polls, and PollTimeout how long a machine is online after the last one
+	KeepAliveInterval time.Duration
+	PollTimeout       time.Duration
+
+	// IPPrefixes are the ranges the addresses of the machines are allocated
+	// from, at most one IPv4 and one IPv6 prefix
+	IPPrefixes []netaddr.IPPrefix
+	// IPAllocationExclude are the addresses of IPPrefixes never handed out
+	// to the new machines, reserved for gateways or static addresses
+	IPAllocationExclude []netaddr.IPPrefix
+	// DisableIPv4 and DisableIPv6 stop assigning addresses of that family,
+	// the machines keep the ones they already have
+	DisableIPv4 bool
+	DisableIPv6 bool
+
+	MagicDNS         bool
+	BaseDomain       string
+	DNSNameservers   []netaddr.IP
+	DNSSearchDomains []string
+	DNSSplit         map[string][]netaddr.IP
+	DNSExtraRecords  []tailcfg.DNSRecord
+
+	// DNSUseNamespaceSearchDomains adds the MagicDNS domain of the namespace
+	// of each machine to its search domains, so the bare hostnames resolve
+	DNSUseNamespaceSearchDomains bool
+
+	GRPCAddr     string
+	GRPCAPIToken string
+	// GRPCSocketPath is a Unix socket serving the gRPC API without
+	// authentication, the permissions of the socket controlling the access
+	GRPCSocketPath string
+
+	OIDCIssuer         string
+	OIDCClientID       string
+	OIDCClientSecret   string
+	OIDCScopes         []string
+	OIDCNamespaceClaim string
+	OIDCNamespaceMap   map[string]string
+	OIDCAllowedDomains []string
 
 	DBtype string
 	DBpath string
@@ -32,13 +107,103 @@ type Config struct {
 	DBname string
 	DBuser string
 	DBpass string
+	// DBURL is a PostgreSQL connection URL, used instead of the fields above
+	DBURL string
+
+	DBSSLMode     string
+	DBSSLRootCert string
+	DBSSLCert     string
+	DBSSLKey      string
+
+	// Connection pool settings, 0 keeps the database/sql defaults
+	DBMaxOpenConns    int
+	DBMaxIdleConns    int
+	DBConnMaxLifetime time.Duration
+	// DBConnectTimeout is how long the startup waits for the database to
+	// accept connections, 0 gives up after the first attempt
+	DBConnectTimeout time.Duration
+
+	// DBAutoMigrate applies the pending migrations at startup. Otherwise they
+	// are applied with headscale db migrate, and the server refuses to start
+	// until then.
+	DBAutoMigrate bool
 
 	TLSLetsEncryptHostname      string
 	TLSLetsEncryptCacheDir      string
 	TLSLetsEncryptChallengeType string
+	// TLSLetsEncryptCA is the ACME directory URL, e.g. the Let's Encrypt
+	// staging environment or another ACME CA
+	TLSLetsEncryptCA string
+
+	// DNS provider used for the DNS-01 challenge, cloudflare or route53
+	TLSLetsEncryptDNSProvider         string
+	TLSLetsEncryptCloudflareAPIToken  string
+	TLSLetsEncryptRoute53HostedZoneID string
 
 	TLSCertPath string
 	TLSKeyPath  string
+
+	// TLSMinVersion and TLSCipherSuites apply to both the certificate files
+	// and Let's Encrypt. No cipher suites keeps the Go defaults.
+	TLSMinVersion   uint16
+	TLSCipherSuites []uint16
+
+	// HTTPReadTimeout bounds the reading of the request headers, and
+	// HTTPWriteTimeout the handling of the requests but the long-polls, see
+	// http.go. MaxRequestBodyBytes limits the request bodies. 0 disables them.
+	HTTPReadTimeout     time.Duration
+	HTTPWriteTimeout    time.Duration
+	HTTPIdleTimeout     time.Duration
+	MaxRequestBodyBytes int64
+
+	// ShutdownTimeout is how long the requests in flight are given to
+	// complete when the server is stopped
+	ShutdownTimeout time.Duration
+
+	// RegistrationRateLimit is the number of requests per second each source
+	// IP can make to the registration endpoints, in bursts of up to
+	// RegistrationRateBurst. 0 disables the limit.
+	RegistrationRateLimit float64
+	RegistrationRateBurst int
+
+	// AuditLogPath is the file the administrative changes are appended to,
+	// one JSON object per line. Empty disables the audit log.
+	AuditLogPath string
+
+	// ACLPolicyStrict refuses a policy referencing unknown namespaces or
+	// groups, which are otherwise only logged
+	ACLPolicyStrict bool
+	// ACLPolicyLenient ignores the unknown fields of the policy files
+	// instead of refusing them
+	ACLPolicyLenient bool
+
+	// WebhookURL receives a JSON POST when a machine is registered, deleted,
+	// comes online or goes offline, signed with WebhookSecret if set
+	WebhookURL    string
+	WebhookSecret string
+
+	// RegistrationTemplatePath redefines the registration pages shown in the
+	// browser, see templates.go
+	RegistrationTemplatePath string
+
+	// GCInterval runs GarbageCollect periodically, 0 disables it.
+	// GCMachineInactivity is how long a machine must not have been seen to
+	// be collected, 0 keeps the machines.
+	GCInterval          time.Duration
+	GCMachineInactivity time.Duration
+
+	// APIAllowedOrigins are the origins of the browsers allowed to call the
+	// administration endpoints, see cors.go. Empty keeps them same-origin.
+	APIAllowedOrigins []string
+
+	// NodeApprovalRequired keeps the machines authenticated with a pre-auth
+	// key or OIDC pending, out of the netmaps, until an admin approves them
+	// with nodes approve
+	NodeApprovalRequired bool
+
+	// MaintenanceMode refuses the changes of the admins and the registrations
+	// of new machines, see maintenance.go. It is read again on SIGHUP.
+	MaintenanceMode bool
 }
 
 // Headscale represents the base app of the service
@@ -51,11 +216,36 @@ type Headscale struct {
 	publicKey  *wgkey.Key
 	privateKey *wgkey.Private
 
-	aclPolicy *ACLPolicy
-	aclRules  *[]tailcfg.FilterRule
+	// acl holds the *aclState in use. It is replaced as a whole, and aclMu
+	// serializes the changes so none is lost.
+	acl   atomic.Value
+	aclMu sync.Mutex
+
+	// maintenanceMu guards cfg.MaintenanceMode, reloaded while serving
+	maintenanceMu sync.Mutex
+
+	derpMu  sync.Mutex
+	derpMap *tailcfg.DERPMap
+	// derpServer is the embedded DERP server, nil unless DerpServerEnabled
+	derpServer *derp.Server
+
+	lastExpiryCheck time.Time
+
+	oidc oidcState
+
+	auditLog *auditLog
+
+	registrationTemplates *template.Template
+
+	peers peersCache
 
 	pollMu         sync.Mutex
 	clientsPolling map[uint64]chan []byte // this is by all means a hackity hack
+
+	// shutdown is closed when the server starts shutting down
+	shutdown         chan struct{}
+	grpcServer       *grpc.Server
+	grpcSocketServer *grpc.Server
 }
 
 // NewHeadscale returns the Headscale app
@@ -73,10 +263,13 @@ func NewHeadscale(cfg Config) (*Headscale, error) {
 	var dbString string
 	switch cfg.DBtype {
 	case "postgres":
-		dbString = fmt.Sprintf("host=%s port=%d dbname=%s user=%s password=%s sslmode=disable", cfg.DBhost,
-			cfg.DBport, cfg.DBname, cfg.DBuser, cfg.DBpass)
+		dbString = postgresDSN(cfg)
 	case "sqlite3":
 		dbString = cfg.DBpath
+		if cfg.DBpath == SQLiteMemoryPath {
+			// The connections of the pool share the same database
+			dbString = "file::memory:?cache=shared"
+		}
 	default:
 		return nil, errors.New("unsupported DB")
 	}
@@ -87,24 +280,97 @@ func NewHeadscale(cfg Config) (*Headscale, error) {
 		dbString:   dbString,
 		privateKey: privKey,
 		publicKey:  &pubKey,
-		aclRules:   &tailcfg.FilterAllowAll, // default allowall
+	}
+
+	if cfg.DerpServerEnabled {
+		h.derpServer = h.newDERPServer()
+	}
+	if derpMap, err := h.servedDERPMap(cfg.DerpMap); err != nil {
+		// Reported by configtest, the clients still get a map
+		log.Error().
+			Err(err).
+			Msg("Could not restrict the DERP map to the address family, serving all the addresses")
+		h.derpMap = h.withEmbeddedDERP(cfg.DerpMap)
+	} else {
+		h.derpMap = derpMap
 	}
 
 	err = h.initDB()
 	if err != nil {
 		return nil, err
 	}
+	if cfg.AuditLogPath != "" {
+		h.auditLog, err = openAuditLog(cfg.AuditLogPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := h.loadULAPrefix(); err != nil {
+		return nil, err
+	}
+	h.registrationTemplates, err = loadRegistrationTemplates(cfg.RegistrationTemplatePath)
+	if err != nil {
+		return nil, fmt.Errorf("registration_template_path: %w", err)
+	}
 
 	h.clientsPolling = make(map[uint64]chan []byte)
+	h.oidc.states = make(map[string]oidcPendingRegistration)
+	h.shutdown = make(chan struct{})
 	return &h, nil
 }
 
+// postgresDSN builds the connection string of the PostgreSQL database
+func postgresDSN(cfg Config) string {
+	if cfg.DBURL != "" {
+		return cfg.DBURL
+	}
+	sslMode := cfg.DBSSLMode
+	if sslMode == "" {
+		sslMode = "disable"
+	}
+	dsn := fmt.Sprintf("host=%s port=%d dbname=%s user=%s password=%s sslmode=%s", cfg.DBhost,
+		cfg.DBport, cfg.DBname, cfg.DBuser, cfg.DBpass, sslMode)
+	if cfg.DBSSLRootCert != "" {
+		dsn += fmt.Sprintf(" sslrootcert=%s", cfg.DBSSLRootCert)
+	}
+	if cfg.DBSSLCert != "" {
+		dsn += fmt.Sprintf(" sslcert=%s", cfg.DBSSLCert)
+	}
+	if cfg.DBSSLKey != "" {
+		dsn += fmt.Sprintf(" sslkey=%s", cfg.DBSSLKey)
+	}
+	return dsn
+}
+
+// basePath is the path of ServerURL, under which all the routes are
+// served, so headscale can be behind a reverse proxy on a subpath
+func (h *Headscale) basePath() string {
+	u, err := url.Parse(h.cfg.ServerURL)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSuffix(u.Path, "/")
+}
+
 // Redirect to our TLS url
 func (h *Headscale) redirect(w http.ResponseWriter, req *http.Request) {
-	target := h.cfg.ServerURL + req.URL.RequestURI()
+	// The request URI already holds the base path
+	target := strings.TrimSuffix(strings.TrimSuffix(h.cfg.ServerURL, "/"), h.basePath()) + req.URL.RequestURI()
 	http.Redirect(w, req, target, http.StatusFound)
 }
 
+// notifyAllClients asks all the clients currently polling to fetch an updated map
+func (h *Headscale) notifyAllClients() {
+	h.pollMu.Lock()
+	defer h.pollMu.Unlock()
+	for _, update := range h.clientsPolling {
+		select {
+		case update <- []byte{}:
+		default: // there is already an update pending for this client
+		}
+	}
+}
+
 // ExpireEphemeralNodes deletes ephemeral machine records that have not been
 // seen for longer than h.cfg.EphemeralNodeInactivityTimeout
 func (h *Headscale) ExpireEphemeralNodes(milliSeconds int64) {
@@ -115,23 +381,37 @@ func (h *Headscale) ExpireEphemeralNodes(milliSeconds int64) {
 }
 
 func (h *Headscale) expireEphemeralNodesWorker() {
+	// They are removed once the maintenance ends
+	if h.checkMaintenance() != nil {
+		return
+	}
 	namespaces, err := h.ListNamespaces()
 	if err != nil {
-		log.Printf("Error listing namespaces: %s", err)
+		log.Error().
+			Err(err).
+			Msg("Error listing namespaces")
 		return
 	}
 	for _, ns := range *namespaces {
 		machines, err := h.ListMachinesInNamespace(ns.Name)
 		if err != nil {
-			log.Printf("Error listing machines in namespace %s: %s", ns.Name, err)
+			log.Error().
+				Str("namespace", ns.Name).
+				Err(err).
+				Msg("Error listing machines in namespace")
 			return
 		}
 		for _, m := range *machines {
 			if m.AuthKey != nil && m.LastSeen != nil && m.AuthKey.Ephemeral && time.Now().After(m.LastSeen.Add(h.cfg.EphemeralNodeInactivityTimeout)) {
-				log.Printf("[%s] Ephemeral client removed from database\n", m.Name)
+				log.Info().
+					Str("machine", m.Name).
+					Msg("Ephemeral client removed from database")
 				err = h.db.Unscoped().Delete(m).Error
 				if err != nil {
-					log.Printf("[%s] 🤮 Cannot delete ephemeral machine from the database: %s", m.Name, err)
+					log.Error().
+						Str("machine", m.Name).
+						Err(err).
+						Msg("🤮 Cannot delete ephemeral machine from the database")
 				}
 			}
 		}
@@ -140,53 +420,152 @@ func (h *Headscale) expireEphemeralNodesWorker() {
 
 // Serve launches a GIN server with the Headscale API
 func (h *Headscale) Serve() error {
-	r := gin.Default()
-	r.GET("/key", h.KeyHandler)
+	pending, err := h.PendingMigrations()
+	if err != nil {
+		return err
+	}
+	if len(pending) > 0 {
+		return errorSchemaPending
+	}
+	if err := h.checkIPPrefixes(); err != nil {
+		return err
+	}
+
+	engine := gin.Default()
+	engine.Use(prometheusMiddleware())
+	r := engine.Group(h.basePath())
+	h.registerMetrics()
+	if h.cfg.DerpVerifyEndpoints {
+		go h.verifyDERPEndpoints()
+	}
+	if h.cfg.MetricsAddr != "" {
+		go func() {
+			log.Fatal().
+				Err(http.ListenAndServe(h.cfg.MetricsAddr, promhttp.Handler())).
+				Msg("Metrics listener stopped")
+		}()
+	} else {
+		h.handleAPI(r, "/metrics", gin.WrapH(promhttp.Handler()))
+	}
+
+	if h.cfg.GRPCAddr != "" {
+		go func() {
+			log.Fatal().
+				Err(h.serveGRPC()).
+				Msg("gRPC API listener stopped")
+		}()
+	}
+	if h.cfg.GRPCSocketPath != "" {
+		// Listening right away reports an unusable path at startup
+		l, err := h.listenGRPCSocket()
+		if err != nil {
+			return err
+		}
+		go func() {
+			log.Fatal().
+				Err(h.serveGRPCSocket(l)).
+				Msg("gRPC socket listener stopped")
+		}()
+	}
+
+	if h.derpServer != nil {
+		// The clients connect to /derp whatever the path of server_url
+		engine.GET("/derp", gin.WrapH(derphttp.Handler(h.derpServer)))
+		engine.GET("/derp/probe", h.DERPProbeHandler)
+		if h.cfg.DerpServerSTUNAddr != "" {
+			pc, err := h.listenSTUN()
+			if err != nil {
+				return err
+			}
+			go func() {
+				log.Fatal().
+					Err(serveSTUN(pc)).
+					Msg("STUN listener stopped")
+			}()
+		}
+	}
+
+	h.handleAPI(r, "/health", h.HealthHandler)
+	h.handleAPI(r, "/ready", h.ReadyHandler)
+	limit := h.registrationRateLimit()
+	r.GET("/key", limit, h.KeyHandler)
 	r.GET("/register", h.RegisterWebAPI)
 	r.POST("/machine/:id/map", h.PollNetMapHandler)
-	r.POST("/machine/:id", h.RegistrationHandler)
-	var err error
+	r.POST("/machine/:id", limit, h.RegistrationHandler)
+	if h.cfg.OIDCIssuer != "" {
+		r.GET("/oidc/register/:mkey", h.RegisterOIDC)
+		r.GET("/oidc/callback", h.OIDCCallback)
+	}
+
+	s := h.httpServer(engine)
+	serve := s.ListenAndServe
 	if h.cfg.TLSLetsEncryptHostname != "" {
 		if !strings.HasPrefix(h.cfg.ServerURL, "https://") {
-			log.Println("WARNING: listening with TLS but ServerURL does not start with https://")
+			log.Warn().Msg("Listening with TLS but ServerURL does not start with https://")
 		}
 
 		m := autocert.Manager{
 			Prompt:     autocert.AcceptTOS,
 			HostPolicy: autocert.HostWhitelist(h.cfg.TLSLetsEncryptHostname),
 			Cache:      autocert.DirCache(h.cfg.TLSLetsEncryptCacheDir),
+			Client:     &acme.Client{DirectoryURL: h.cfg.TLSLetsEncryptCA},
 		}
-		s := &http.Server{
-			Addr:      h.cfg.Addr,
-			TLSConfig: m.TLSConfig(),
-			Handler:   r,
-		}
-		if h.cfg.TLSLetsEncryptChallengeType == "TLS-ALPN-01" {
+		s.TLSConfig = h.tlsConfig(m.TLSConfig())
+		switch h.cfg.TLSLetsEncryptChallengeType {
+		case "TLS-ALPN-01":
 			// Configuration via autocert with TLS-ALPN-01 (https://tools.ietf.org/html/rfc8737)
 			// The RFC requires that the validation is done on port 443; in other words, headscale
 			// must be configured to run on port 443.
-			err = s.ListenAndServeTLS("", "")
-		} else if h.cfg.TLSLetsEncryptChallengeType == "HTTP-01" {
+		case "HTTP-01":
 			// Configuration via autocert with HTTP-01. This requires listening on
 			// port 80 for the certificate validation in addition to the headscale
 			// service, which can be configured to run on any other port.
 			go func() {
-				log.Fatal(http.ListenAndServe(":http", m.HTTPHandler(http.HandlerFunc(h.redirect))))
+				log.Fatal().
+					Err(http.ListenAndServe(":http", m.HTTPHandler(http.HandlerFunc(h.redirect)))).
+					Msg("HTTP-01 challenge listener stopped")
 			}()
-			err = s.ListenAndServeTLS("", "")
-		} else {
+		case "DNS-01":
+			// Configuration via lego with DNS-01, the challenge is answered with a
+			// TXT record created through the API of the DNS provider, so headscale
+			// does not need to be reachable from the Internet.
+			cm, err := h.newDNS01CertManager()
+			if err != nil {
+				return err
+			}
+			go cm.renewLoop()
+			s.TLSConfig = h.tlsConfig(&tls.Config{GetCertificate: cm.getCertificate})
+		default:
 			return errors.New("unknown value for TLSLetsEncryptChallengeType")
 		}
+		serve = func() error { return s.ListenAndServeTLS("", "") }
 	} else if h.cfg.TLSCertPath == "" {
 		if !strings.HasPrefix(h.cfg.ServerURL, "http://") {
-			log.Println("WARNING: listening without TLS but ServerURL does not start with http://")
+			log.Warn().Msg("Listening without TLS but ServerURL does not start with http://")
 		}
-		err = r.Run(h.cfg.Addr)
 	} else {
 		if !strings.HasPrefix(h.cfg.ServerURL, "https://") {
-			log.Println("WARNING: listening with TLS but ServerURL does not start with https://")
+			log.Warn().Msg("Listening with TLS but ServerURL does not start with https://")
+		}
+		certs, err := newCertFileLoader(h.cfg.TLSCertPath, h.cfg.TLSKeyPath)
+		if err != nil {
+			return err
 		}
-		err = r.RunTLS(h.cfg.Addr, h.cfg.TLSCertPath, h.cfg.TLSKeyPath)
+		s.TLSConfig = h.tlsConfig(&tls.Config{GetCertificate: certs.getCertificate})
+		serve = func() error { return s.ListenAndServeTLS("", "") }
+	}
+
+	return h.serveUntilSignal(s, serve)
+}
+
+// tlsConfig applies the configured TLS version and cipher suites
+func (h *Headscale) tlsConfig(cfg *tls.Config) *tls.Config {
+	cfg.MinVersion = h.cfg.TLSMinVersion
+	if cfg.MinVersion == 0 {
+		cfg.MinVersion = tls.VersionTLS12
+	}
+	if len(h.cfg.TLSCipherSuites) > 0 {
+		cfg.CipherSuites = h.cfg.TLSCipherSuites
 	}
-	return err
+	return cfg
 }
@@ -0,0 +1,80 @@
+package headscale
+
+import (
+	"encoding/json"
+	"os"
+	"os/user"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// AuditEvent is a line of the audit log, written for every administrative
+// change whether it succeeded or not
+type AuditEvent struct {
+	Time   time.Time `json:"time"`
+	Actor  string    `json:"actor"`
+	Action string    `json:"action"`
+	Target string    `json:"target"`
+	Result string    `json:"result"`
+	Error  string    `json:"error,omitempty"`
+}
+
+// auditLog appends the events as JSON lines to audit_log_path. The file is
+// opened in append mode, so the server and the CLI can write to it at the
+// same time.
+type auditLog struct {
+	mu    sync.Mutex
+	file  *os.File
+	actor string
+}
+
+func openAuditLog(path string) (*auditLog, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return &auditLog{file: f, actor: auditActor()}, nil
+}
+
+// auditActor is the system user running headscale, as the API keys and the
+// clients are not known by the methods changing the database
+func auditActor() string {
+	u, err := user.Current()
+	if err != nil {
+		return "unknown"
+	}
+	hostname, _ := os.Hostname()
+	return u.Username + "@" + hostname
+}
+
+// audit records the result of an administrative action, if audit_log_path
+// is set
+func (h *Headscale) audit(action string, target string, err error) {
+	if h.auditLog == nil {
+		return
+	}
+	event := AuditEvent{
+		Time:   time.Now().UTC(),
+		Actor:  h.auditLog.actor,
+		Action: action,
+		Target: target,
+		Result: "success",
+	}
+	if err != nil {
+		event.Result = "failure"
+		event.Error = err.Error()
+	}
+	b, _ := json.Marshal(event)
+
+	h.auditLog.mu.Lock()
+	defer h.auditLog.mu.Unlock()
+	if _, err := h.auditLog.file.Write(append(b, '\n')); err != nil {
+		log.Error().
+			Str("action", action).
+			Str("target", target).
+			Err(err).
+			Msg("Could not write to the audit log")
+	}
+}
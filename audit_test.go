@@ -0,0 +1,45 @@
+package headscale
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+
+	"gopkg.in/check.v1"
+)
+
+func (s *Suite) TestAuditLog(c *check.C) {
+	var err error
+	h.auditLog, err = openAuditLog(tmpDir + "/audit.log")
+	c.Assert(err, check.IsNil)
+	defer func() { h.auditLog = nil }()
+
+	_, err = h.CreateNamespace("test")
+	c.Assert(err, check.IsNil)
+	_, err = h.CreateNamespace("test")
+	c.Assert(err, check.NotNil)
+	pak, err := h.CreatePreAuthKey("test", false, false, nil, nil)
+	c.Assert(err, check.IsNil)
+	// Reads are not logged
+	_, err = h.ListNamespaces()
+	c.Assert(err, check.IsNil)
+
+	f, err := os.Open(tmpDir + "/audit.log")
+	c.Assert(err, check.IsNil)
+	defer f.Close()
+	events := []AuditEvent{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		e := AuditEvent{}
+		c.Assert(json.Unmarshal(scanner.Bytes(), &e), check.IsNil)
+		events = append(events, e)
+	}
+	c.Assert(len(events), check.Equals, 3)
+	c.Assert(events[0].Action, check.Equals, "namespace.create")
+	c.Assert(events[0].Target, check.Equals, "namespace:test")
+	c.Assert(events[0].Result, check.Equals, "success")
+	c.Assert(events[1].Result, check.Equals, "failure")
+	c.Assert(events[1].Error, check.Equals, errorNamespaceExists.Error())
+	c.Assert(events[2].Action, check.Equals, "preauthkey.create")
+	c.Assert(events[2].Target, check.Not(check.Matches), ".*"+pak.Key+".*")
+}
@@ -0,0 +1,58 @@
+package headscale
+
+// BulkResult reports an operation applied to several machines, machine by
+// machine, so a failure on one does not hide what was done to the others
+type BulkResult struct {
+	Succeeded []uint64
+	Failed    []BulkFailure
+	// Skipped are the machines not attempted, after a failure with failFast
+	Skipped []uint64
+}
+
+// BulkFailure is a machine a bulk operation failed on, and why
+type BulkFailure struct {
+	ID    uint64
+	Error string
+}
+
+// FailedIDs are the machines to run the operation on again
+func (r *BulkResult) FailedIDs() []uint64 {
+	ids := []uint64{}
+	for _, f := range r.Failed {
+		ids = append(ids, f.ID)
+	}
+	return append(ids, r.Skipped...)
+}
+
+// RunBulk applies fn to each of ids and collects the results. It goes on
+// past the failures, unless failFast where it stops at the first one and
+// reports the remaining ids as skipped.
+func RunBulk(ids []uint64, failFast bool, fn func(id uint64) error) *BulkResult {
+	result := BulkResult{Succeeded: []uint64{}, Failed: []BulkFailure{}, Skipped: []uint64{}}
+	for i, id := range ids {
+		if err := fn(id); err != nil {
+			result.Failed = append(result.Failed, BulkFailure{ID: id, Error: err.Error()})
+			if failFast {
+				result.Skipped = append(result.Skipped, ids[i+1:]...)
+				break
+			}
+			continue
+		}
+		result.Succeeded = append(result.Succeeded, id)
+	}
+	return &result
+}
+
+// DeleteMachines deletes the machines of ids, each like DeleteMachine
+func (h *Headscale) DeleteMachines(ids []uint64, failFast bool) *BulkResult {
+	return RunBulk(ids, failFast, h.DeleteMachine)
+}
+
+// TagMachines adds and removes ACL tags of the machines of ids, each like
+// TagMachine
+func (h *Headscale) TagMachines(ids []uint64, add []string, remove []string, failFast bool) *BulkResult {
+	return RunBulk(ids, failFast, func(id uint64) error {
+		_, err := h.TagMachine(id, add, remove)
+		return err
+	})
+}
@@ -2,13 +2,19 @@ package headscale
 
 import (
 	"errors"
+	"fmt"
+	"time"
 
+	"github.com/rs/zerolog/log"
 	"gorm.io/gorm"
 	"tailscale.com/types/wgkey"
 )
 
-// RegisterMachine is executed from the CLI to register a new Machine using its MachineKey
-func (h *Headscale) RegisterMachine(key string, namespace string) (*Machine, error) {
+// RegisterMachine is executed from the CLI to register a new Machine using its MachineKey.
+// The machine is created when it has not contacted headscale yet; it then gets its node
+// key and hostname when it does.
+func (h *Headscale) RegisterMachine(key string, namespace string) (_ *Machine, err error) {
+	defer func() { h.audit("machine.register", "machine_key:"+key+" namespace:"+namespace, err) }()
 	ns, err := h.GetNamespace(namespace)
 	if err != nil {
 		return nil, err
@@ -20,21 +26,92 @@ func (h *Headscale) RegisterMachine(key string, namespace string) (*Machine, err
 
 	m := Machine{}
 	if result := h.db.First(&m, "machine_key = ?", mKey.HexString()); errors.Is(result.Error, gorm.ErrRecordNotFound) {
-		return nil, errors.New("Machine not found")
+		m = Machine{MachineKey: mKey.HexString()}
 	}
 
 	if m.isAlreadyRegistered() {
 		return nil, errors.New("Machine already registered")
 	}
 
-	ip, err := h.getAvailableIP()
+	err = h.registerMachine(&m, ns, "cli")
 	if err != nil {
 		return nil, err
 	}
-	m.IPAddress = ip.String()
+	return &m, nil
+}
+
+const errorMachineNotPending = Error("machine is not waiting for approval")
+
+// registerMachine registers a Machine in a namespace, once it has been
+// authenticated with the given method. With NodeApprovalRequired the machine
+// is left pending instead, unless an admin registered it from the CLI.
+func (h *Headscale) registerMachine(m *Machine, ns *Namespace, method string) error {
+	err := h.checkMaintenance()
+	if err != nil {
+		return err
+	}
+	err = h.checkNamespaceQuota(ns)
+	if err != nil {
+		return err
+	}
+
+	// Machines authenticating again after their key expired keep their IP address
+	err = h.assignIPAddresses(m)
+	if err != nil {
+		return err
+	}
+	if expiry := h.getMachineExpiry(); expiry != nil {
+		m.Expiry = expiry
+	}
 	m.NamespaceID = ns.ID
+	m.Namespace = *ns
+	now := time.Now().UTC()
+	m.Pending = h.cfg.NodeApprovalRequired && method != "cli"
+	m.Registered = !m.Pending
+	m.RegisterMethod = method
+	m.RegisteredAt = &now
+	return h.db.Save(m).Error
+}
+
+// ApproveMachine registers a machine left pending by node_approval_required,
+// and adds it to the netmaps of its peers
+func (h *Headscale) ApproveMachine(id uint64) (_ *Machine, err error) {
+	defer func() { h.audit("machine.approve", fmt.Sprintf("machine:%d", id), err) }()
+	if err = h.checkMaintenance(); err != nil {
+		return nil, err
+	}
+	m, err := h.GetMachineByID(id)
+	if err != nil {
+		return nil, err
+	}
+	if !m.Pending {
+		return nil, errorMachineNotPending
+	}
+	// The pending machines do not count in the quota
+	err = h.checkNamespaceQuota(&m.Namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	err = h.db.Model(m).Updates(map[string]interface{}{"registered": true, "pending": false, "registered_at": now}).Error
+	if err != nil {
+		return nil, err
+	}
 	m.Registered = true
-	m.RegisterMethod = "cli"
-	h.db.Save(&m)
-	return &m, nil
+	m.Pending = false
+	m.RegisteredAt = &now
+
+	// Its tags are expanded to IP addresses in the ACL rules
+	if err := h.updateACLRules(); err != nil {
+		log.Error().
+			Err(err).
+			Msg("Could not regenerate the ACL rules")
+	}
+	peers, err := h.getPeers(*m)
+	if err != nil {
+		return nil, err
+	}
+	h.notifyNodes(*peers)
+	return m, nil
 }
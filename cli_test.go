@@ -28,3 +28,72 @@ func (s *Suite) TestRegisterMachine(c *check.C) {
 	_, err = m2.GetHostInfo()
 	c.Assert(err, check.IsNil)
 }
+
+func (s *Suite) TestRegisterUnknownMachine(c *check.C) {
+	n, err := h.CreateNamespace("test")
+	c.Assert(err, check.IsNil)
+
+	_, err = h.RegisterMachine("not a key", n.Name)
+	c.Assert(err, check.NotNil)
+
+	mKey := "8ce002a935f8c394e55e78fbbb410576575ff8ec5cfa2e627e4b807f1be15b0e"
+	m, err := h.RegisterMachine(mKey, n.Name)
+	c.Assert(err, check.IsNil)
+	c.Assert(m.Registered, check.Equals, true)
+	c.Assert(m.RegisterMethod, check.Equals, "cli")
+	c.Assert(m.IPAddress, check.Not(check.Equals), "")
+
+	_, err = h.RegisterMachine(mKey, n.Name)
+	c.Assert(err, check.ErrorMatches, "Machine already registered")
+
+	// Not sent to the peers until the client connects
+	peers, err := h.getPeers(Machine{MachineKey: "other", NamespaceID: n.ID})
+	c.Assert(err, check.IsNil)
+	c.Assert(len(*peers), check.Equals, 0)
+}
+
+func (s *Suite) TestNodeApprovalRequired(c *check.C) {
+	n, err := h.CreateNamespace("test")
+	c.Assert(err, check.IsNil)
+	h.cfg.NodeApprovalRequired = true
+
+	m := Machine{
+		MachineKey: "8ce002a935f8c394e55e78fbbb410576575ff8ec5cfa2e627e4b807f1be15b0e",
+		NodeKey:    "9d2ba9f7c4267c5bb4f6c8c1de3e6fbd9a8a6e5a10990f0c4d7b8f5e3c2a1b00",
+		Name:       "testmachine",
+	}
+	c.Assert(h.db.Save(&m).Error, check.IsNil)
+	err = h.registerMachine(&m, n, "oidc")
+	c.Assert(err, check.IsNil)
+	c.Assert(m.Pending, check.Equals, true)
+	c.Assert(m.Registered, check.Equals, false)
+	c.Assert(m.IPAddress, check.Not(check.Equals), "")
+
+	pending, err := h.ListMachines(MachineFilter{Pending: true})
+	c.Assert(err, check.IsNil)
+	c.Assert(len(*pending), check.Equals, 1)
+	c.Assert((*pending)[0].ID, check.Equals, m.ID)
+
+	// Not sent to the peers until approved
+	peers, err := h.getPeers(Machine{MachineKey: "other", NamespaceID: n.ID})
+	c.Assert(err, check.IsNil)
+	c.Assert(len(*peers), check.Equals, 0)
+
+	approved, err := h.ApproveMachine(m.ID)
+	c.Assert(err, check.IsNil)
+	c.Assert(approved.Registered, check.Equals, true)
+	c.Assert(approved.Pending, check.Equals, false)
+
+	peers, err = h.getPeers(Machine{MachineKey: "other", NamespaceID: n.ID})
+	c.Assert(err, check.IsNil)
+	c.Assert(len(*peers), check.Equals, 1)
+
+	_, err = h.ApproveMachine(m.ID)
+	c.Assert(err, check.Equals, errorMachineNotPending)
+
+	// The machines registered by an admin are approved at once
+	m2, err := h.RegisterMachine("9ce002a935f8c394e55e78fbbb410576575ff8ec5cfa2e627e4b807f1be15b0e", n.Name)
+	c.Assert(err, check.IsNil)
+	c.Assert(m2.Registered, check.Equals, true)
+	c.Assert(m2.Pending, check.Equals, false)
+}
@@ -0,0 +1,89 @@
+package cli
+
+import (
+	"fmt"
+
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var ACLCmd = &cobra.Command{
+	Use:   "acl",
+	Short: "Inspect the ACL policy of Headscale",
+}
+
+var CheckACLCmd = &cobra.Command{
+	Use:   "check",
+	Short: "Checks whether the ACL policy allows a source to reach a destination port",
+	Run: func(cmd *cobra.Command, args []string) {
+		src, _ := cmd.Flags().GetString("src")
+		dst, _ := cmd.Flags().GetString("dst")
+		port, _ := cmd.Flags().GetUint16("port")
+		o, _ := cmd.Flags().GetString("output")
+
+		setACLPolicyLenient(cmd)
+		h, err := getHeadscaleApp()
+		if err != nil {
+			log.Fatal().Err(err).Msg("Error initializing")
+		}
+		result, err := h.CheckACL(src, dst, port)
+		if o != "" {
+			JsonOutput(result, err, o)
+			return
+		}
+		if err != nil {
+			exitWithError("Error checking the ACL policy", err)
+		}
+		if !result.Allowed {
+			fmt.Printf("Denied: no rule allows %s to reach %s:%d\n", src, dst, port)
+			return
+		}
+		if result.Rule == nil {
+			fmt.Printf("Allowed: there is no ACL policy loaded\n")
+			return
+		}
+		fmt.Printf("Allowed by rule %d (users: %v, ports: %v)\n", result.RuleIndex, result.Rule.Users, result.Rule.Ports)
+	},
+}
+
+var DiffACLCmd = &cobra.Command{
+	Use:   "diff",
+	Short: "Shows which nodes would gain or lose connectivity with the policy given with --file, without loading it",
+	Run: func(cmd *cobra.Command, args []string) {
+		file, _ := cmd.Flags().GetString("file")
+		o, _ := cmd.Flags().GetString("output")
+
+		setACLPolicyLenient(cmd)
+		h, err := getHeadscaleApp()
+		if err != nil {
+			log.Fatal().Err(err).Msg("Error initializing")
+		}
+		diff, err := h.DiffACLPolicy(file)
+		if o != "" {
+			JsonOutput(diff, err, o)
+			return
+		}
+		if err != nil {
+			exitWithError("Error checking the ACL policy", err)
+		}
+		if len(diff.Added) == 0 && len(diff.Removed) == 0 {
+			fmt.Printf("No change in the connectivity between the nodes\n")
+			return
+		}
+		for _, c := range diff.Added {
+			fmt.Printf("+ %s (%d) -> %s (%d)\n", c.Src, c.SrcID, c.Dst, c.DstID)
+		}
+		for _, c := range diff.Removed {
+			fmt.Printf("- %s (%d) -> %s (%d)\n", c.Src, c.SrcID, c.Dst, c.DstID)
+		}
+	},
+}
+
+// setACLPolicyLenient applies --lenient, which overrides acl_policy_lenient
+// in the configuration
+func setACLPolicyLenient(cmd *cobra.Command) {
+	if lenient, _ := cmd.Flags().GetBool("lenient"); lenient {
+		viper.Set("acl_policy_lenient", true)
+	}
+}
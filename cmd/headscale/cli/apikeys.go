@@ -0,0 +1,116 @@
+package cli
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/hako/durafmt"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+)
+
+var APIKeysCmd = &cobra.Command{
+	Use:   "apikeys",
+	Short: "Handle the API keys of the management API",
+}
+
+var ListAPIKeysCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the API keys",
+	Run: func(cmd *cobra.Command, args []string) {
+		o, _ := cmd.Flags().GetString("output")
+
+		h, err := getHeadscaleApp()
+		if err != nil {
+			log.Fatal().Err(err).Msg("Error initializing")
+		}
+		keys, err := h.ListAPIKeys()
+		if o != "" {
+			JsonOutput(keys, err, o)
+			return
+		}
+		if err != nil {
+			exitWithError("Error getting the list of keys", err)
+		}
+		for _, k := range *keys {
+			expiration := "-"
+			if k.Expiration != nil {
+				expiration = k.Expiration.Format("2006-01-02 15:04:05")
+				if !k.Expiration.After(time.Now()) {
+					expiration += " (expired)"
+				}
+			}
+			lastSeen := "-"
+			if k.LastSeen != nil {
+				lastSeen = k.LastSeen.Format("2006-01-02 15:04:05")
+			}
+			fmt.Printf(
+				"prefix: %s, expiration: %s, last_seen: %s, created_at: %s\n",
+				k.Prefix,
+				expiration,
+				lastSeen,
+				k.CreatedAt.Format("2006-01-02 15:04:05"),
+			)
+		}
+	},
+}
+
+var CreateAPIKeyCmd = &cobra.Command{
+	Use:   "create",
+	Short: "Creates a new API key. The key is only shown once",
+	Run: func(cmd *cobra.Command, args []string) {
+		o, _ := cmd.Flags().GetString("output")
+
+		h, err := getHeadscaleApp()
+		if err != nil {
+			log.Fatal().Err(err).Msg("Error initializing")
+		}
+
+		e, _ := cmd.Flags().GetString("expiration")
+		var expiration *time.Time
+		if e != "" {
+			duration, err := durafmt.ParseStringShort(e)
+			if err != nil {
+				log.Fatal().Err(err).Msg("Error parsing expiration")
+			}
+			exp := time.Now().UTC().Add(duration.Duration())
+			expiration = &exp
+		}
+
+		key, k, err := h.CreateAPIKey(expiration)
+		if o != "" {
+			JsonOutput(map[string]interface{}{"Key": key, "APIKey": k}, err, o)
+			return
+		}
+		if err != nil {
+			exitWithError("", err)
+		}
+		fmt.Printf("Key: %s\n", key)
+	},
+}
+
+var ExpireAPIKeyCmd = &cobra.Command{
+	Use:   "expire",
+	Short: "Expires an API key, so it is no longer accepted",
+	Run: func(cmd *cobra.Command, args []string) {
+		prefix, err := cmd.Flags().GetString("prefix")
+		if err != nil {
+			log.Fatal().Err(err).Msg("Error getting prefix")
+		}
+		o, _ := cmd.Flags().GetString("output")
+
+		h, err := getHeadscaleApp()
+		if err != nil {
+			log.Fatal().Err(err).Msg("Error initializing")
+		}
+		k, err := h.ExpireAPIKey(prefix)
+		if o != "" {
+			JsonOutput(k, err, o)
+			return
+		}
+		if err != nil {
+			exitWithError("", err)
+		}
+		fmt.Printf("Key expired\n")
+	},
+}
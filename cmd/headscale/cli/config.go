@@ -0,0 +1,72 @@
+package cli
+
+import (
+	"net/url"
+
+	"github.com/juanfont/headscale"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+const redacted = "REDACTED"
+
+// EffectiveConfig is the configuration headscale runs with, after the
+// defaults, the config file and the environment are merged
+type EffectiveConfig struct {
+	ConfigFile string
+	Config     headscale.Config
+}
+
+var ConfigCmd = &cobra.Command{
+	Use:   "config",
+	Short: "Inspect the configuration",
+}
+
+var ShowConfigCmd = &cobra.Command{
+	Use:   "show",
+	Short: "Prints the configuration in effect, with the secrets redacted",
+	Long: `Prints the configuration headscale runs with, once the defaults, the config file
+and the environment variables are merged, as YAML unless --output says
+otherwise. The passwords, tokens and secrets are replaced by REDACTED.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		o, _ := cmd.Flags().GetString("output")
+		if o == "" {
+			o = "yaml"
+		}
+		JsonOutput(ShowConfig(), nil, o)
+	},
+}
+
+// ShowConfig returns the configuration in effect, with the secrets redacted
+func ShowConfig() EffectiveConfig {
+	return EffectiveConfig{
+		ConfigFile: viper.ConfigFileUsed(),
+		Config:     redactConfig(getHeadscaleConfig()),
+	}
+}
+
+// redactConfig replaces the secrets of cfg, leaving the unset ones empty so
+// they show as not configured
+func redactConfig(cfg headscale.Config) headscale.Config {
+	for _, s := range []*string{
+		&cfg.DBpass,
+		&cfg.GRPCAPIToken,
+		&cfg.OIDCClientSecret,
+		&cfg.TLSLetsEncryptCloudflareAPIToken,
+		&cfg.WebhookSecret,
+	} {
+		if *s != "" {
+			*s = redacted
+		}
+	}
+	if cfg.DBURL != "" {
+		// Keeps the host and the database, only the password is secret
+		u, err := url.Parse(cfg.DBURL)
+		if err != nil {
+			cfg.DBURL = redacted
+		} else {
+			cfg.DBURL = u.Redacted()
+		}
+	}
+	return cfg
+}
@@ -0,0 +1,87 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/juanfont/headscale"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+type configCheck struct {
+	Check  string
+	Passed bool
+	Error  string `json:",omitempty" yaml:",omitempty"`
+}
+
+var ConfigTestCmd = &cobra.Command{
+	Use:   "configtest",
+	Short: "Validates the configuration without starting the server",
+	// configtest loads the configuration by itself, so the errors
+	// are reported as a failed check instead of aborting
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {},
+	Run: func(cmd *cobra.Command, args []string) {
+		o, _ := cmd.Flags().GetString("output")
+
+		checks := []configCheck{}
+		addCheck := func(name string, err error) {
+			c := configCheck{Check: name, Passed: err == nil}
+			if err != nil {
+				c.Error = strings.TrimSpace(err.Error())
+			}
+			checks = append(checks, c)
+		}
+
+		addCheck("config file", LoadConfig(""))
+		setACLPolicyLenient(cmd)
+
+		derpMap, err := headscale.LoadDERPMap(derpMapPaths(), viper.GetDuration("derp_map_fetch_timeout"), absPath(viper.GetString("derp_map_cache_dir")))
+		addCheck("DERP map", err)
+		if err == nil && derpAddressFamily() != "" {
+			_, err := headscale.FilterDERPMapFamily(derpMap, derpAddressFamily())
+			addCheck("DERP address family", err)
+		}
+		if err == nil && viper.GetBool("derp_verify_endpoints") {
+			problems := []string{}
+			for _, e := range headscale.VerifyDERPMap(derpMap, viper.GetDuration("derp_map_fetch_timeout")) {
+				problems = append(problems, e.Error())
+			}
+			err = nil
+			if len(problems) > 0 {
+				err = errors.New(strings.Join(problems, "; "))
+			}
+			addCheck("DERP endpoints", err)
+		}
+
+		if viper.GetString("acl_policy_path") != "" {
+			_, err = headscale.ParseACLPolicy(absPath(viper.GetString("acl_policy_path")), viper.GetBool("acl_policy_lenient"))
+			addCheck("ACL policy", err)
+		}
+
+		failed := false
+		for _, c := range checks {
+			if !c.Passed {
+				failed = true
+			}
+		}
+
+		if o != "" {
+			JsonOutput(checks, nil, o)
+		} else {
+			for _, c := range checks {
+				if c.Passed {
+					fmt.Printf("PASS\t%s\n", c.Check)
+				} else {
+					fmt.Printf("FAIL\t%s: %s\n", c.Check, c.Error)
+				}
+			}
+		}
+
+		if failed {
+			os.Exit(1)
+		}
+	},
+}
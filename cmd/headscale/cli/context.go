@@ -0,0 +1,50 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// commandCtx bounds the database queries and the gRPC calls of the command
+// being run: it is canceled by Ctrl-C, and once its --timeout has passed.
+// serve keeps the background context, it stops on its own signals.
+var (
+	commandCtx     = context.Background()
+	commandTimeout time.Duration
+)
+
+// SetupCommandContext sets up the context of the command about to run, 0
+// leaves it without a deadline
+func SetupCommandContext(timeout time.Duration) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	cancel := context.CancelFunc(func() {})
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	}
+	go func() {
+		// Once canceled, a second Ctrl-C kills the command as usual
+		<-ctx.Done()
+		stop()
+		cancel()
+	}()
+	commandCtx, commandTimeout = ctx, timeout
+}
+
+// commandError tells when err comes from the command being canceled: the
+// database drivers and gRPC report it in their own words
+func commandError(err error) error {
+	if err == nil {
+		return nil
+	}
+	switch commandCtx.Err() {
+	case context.DeadlineExceeded:
+		return fmt.Errorf("timed out after %s: %w", commandTimeout, err)
+	case context.Canceled:
+		return fmt.Errorf("canceled: %w", err)
+	}
+	return err
+}
@@ -0,0 +1,76 @@
+package cli
+
+import (
+	"fmt"
+
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var DBCmd = &cobra.Command{
+	Use:   "db",
+	Short: "Manage the database of Headscale",
+}
+
+var MigrateDBCmd = &cobra.Command{
+	Use:   "migrate",
+	Short: "Applies the pending database migrations",
+	Run: func(cmd *cobra.Command, args []string) {
+		dryRun, _ := cmd.Flags().GetBool("dry-run")
+		o, _ := cmd.Flags().GetString("output")
+
+		// The migrations are applied (or not, with --dry-run) below
+		viper.Set("db_auto_migrate", false)
+		h, err := getHeadscaleApp()
+		if err != nil {
+			log.Fatal().Err(err).Msg("Error initializing")
+		}
+
+		version, err := h.SchemaVersion()
+		if err != nil {
+			log.Fatal().Err(err).Msg("Error getting the schema version")
+		}
+		if dryRun {
+			pending, err := h.PendingMigrations()
+			if o != "" {
+				JsonOutput(pending, err, o)
+				return
+			}
+			if err != nil {
+				exitWithError("", err)
+			}
+			fmt.Printf("Schema version %d, %d pending migration(s)\n", version, len(pending))
+			for _, m := range pending {
+				fmt.Printf("%d\t%s\n", m.Version, m.Description)
+			}
+			return
+		}
+
+		applied, err := h.Migrate()
+		if o != "" {
+			JsonOutput(applied, err, o)
+			return
+		}
+		for _, m := range applied {
+			fmt.Printf("Applied %d\t%s\n", m.Version, m.Description)
+		}
+		if err != nil {
+			exitWithError("", err)
+		}
+		if len(applied) == 0 {
+			fmt.Printf("Schema version %d is up to date\n", version)
+		}
+	},
+}
+
+// SchemaVersion reads the schema version of the database, without applying
+// the pending migrations
+func SchemaVersion() (int, error) {
+	viper.Set("db_auto_migrate", false)
+	h, err := getHeadscaleApp()
+	if err != nil {
+		return 0, err
+	}
+	return h.SchemaVersion()
+}
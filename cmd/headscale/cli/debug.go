@@ -0,0 +1,34 @@
+package cli
+
+import (
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+)
+
+var DebugCmd = &cobra.Command{
+	Use:   "debug",
+	Short: "Troubleshoot what headscale sends to the nodes",
+}
+
+var NetmapDebugCmd = &cobra.Command{
+	Use:   "netmap",
+	Short: "Prints the netmap a node gets at its next map request",
+	Run: func(cmd *cobra.Command, args []string) {
+		id, err := cmd.Flags().GetUint64("identifier")
+		if err != nil {
+			log.Fatal().Err(err).Msg("Error getting identifier")
+		}
+		o, _ := cmd.Flags().GetString("output")
+		// The netmap has no human-readable form
+		if o == "" {
+			o = "json"
+		}
+
+		h, err := getHeadscaleApp()
+		if err != nil {
+			log.Fatal().Err(err).Msg("Error initializing")
+		}
+		netmap, err := h.GetMachineNetMap(id)
+		JsonOutput(netmap, err, o)
+	},
+}
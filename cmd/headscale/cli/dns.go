@@ -0,0 +1,116 @@
+package cli
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/spf13/viper"
+	"inet.af/netaddr"
+	"tailscale.com/tailcfg"
+)
+
+var domainRegexp = regexp.MustCompile(`^([a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?\.)*[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+type extraRecord struct {
+	Name  string
+	Type  string
+	Value string
+}
+
+// normalizeDomain lowercases a domain and drops its trailing dot
+func normalizeDomain(d string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(d)), ".")
+}
+
+func baseDomain() string {
+	return normalizeDomain(viper.GetString("base_domain"))
+}
+
+func dnsNameservers() ([]netaddr.IP, error) {
+	nameservers := []netaddr.IP{}
+	for _, ns := range viper.GetStringSlice("dns_nameservers") {
+		ip, err := netaddr.ParseIP(ns)
+		if err != nil {
+			return nil, fmt.Errorf("dns_nameservers: %q is not an IP address", ns)
+		}
+		nameservers = append(nameservers, ip)
+	}
+	return nameservers, nil
+}
+
+func dnsSearchDomains() ([]string, error) {
+	domains := []string{}
+	for _, d := range viper.GetStringSlice("dns_search_domains") {
+		domain := normalizeDomain(d)
+		if !domainRegexp.MatchString(domain) {
+			return nil, fmt.Errorf("dns_search_domains: %q is not a valid domain", d)
+		}
+		domains = append(domains, domain)
+	}
+	return domains, nil
+}
+
+// dnsSplit reads the dns_split section, mapping domain suffixes to the
+// resolvers used for them
+func dnsSplit() (map[string][]netaddr.IP, error) {
+	routes := map[string][]netaddr.IP{}
+	for d, resolvers := range viper.GetStringMapStringSlice("dns_split") {
+		domain := normalizeDomain(d)
+		if !domainRegexp.MatchString(domain) {
+			return nil, fmt.Errorf("dns_split: %q is not a valid domain", d)
+		}
+		if len(resolvers) == 0 {
+			return nil, fmt.Errorf("dns_split: no resolver set for %s", domain)
+		}
+		for _, r := range resolvers {
+			ip, err := netaddr.ParseIP(strings.TrimSpace(r))
+			if err != nil {
+				return nil, fmt.Errorf("dns_split: resolver %q of %s is not an IP address", r, domain)
+			}
+			routes[domain] = append(routes[domain], ip)
+		}
+	}
+	return routes, nil
+}
+
+// dnsExtraRecords reads the extra_records list. When MagicDNS is enabled,
+// the names of the form host.namespace.base_domain are reserved for the
+// machines.
+func dnsExtraRecords() ([]tailcfg.DNSRecord, error) {
+	var records []extraRecord
+	if err := viper.UnmarshalKey("extra_records", &records); err != nil {
+		return nil, fmt.Errorf("extra_records: %w", err)
+	}
+
+	result := []tailcfg.DNSRecord{}
+	for _, r := range records {
+		name := normalizeDomain(r.Name)
+		if !domainRegexp.MatchString(name) {
+			return nil, fmt.Errorf("extra_records: %q is not a valid domain name", r.Name)
+		}
+		ip, err := netaddr.ParseIP(strings.TrimSpace(r.Value))
+		if err != nil {
+			return nil, fmt.Errorf("extra_records: the value of %s (%q) is not an IP address", name, r.Value)
+		}
+		switch strings.ToUpper(r.Type) {
+		case "", "A", "AAAA":
+		default:
+			return nil, fmt.Errorf("extra_records: unsupported type %q for %s, valid: A, AAAA", r.Type, name)
+		}
+		if (strings.EqualFold(r.Type, "A") && !ip.Is4()) || (strings.EqualFold(r.Type, "AAAA") && !ip.Is6()) {
+			return nil, fmt.Errorf("extra_records: %s is not a valid %s value for %s", ip, strings.ToUpper(r.Type), name)
+		}
+		if viper.GetBool("magic_dns_enabled") && baseDomain() != "" && strings.HasSuffix(name, "."+baseDomain()) &&
+			strings.Count(strings.TrimSuffix(name, "."+baseDomain()), ".") == 1 {
+			return nil, fmt.Errorf("extra_records: %s conflicts with the MagicDNS names of the machines", name)
+		}
+
+		// The clients infer A or AAAA from the value
+		result = append(result, tailcfg.DNSRecord{
+			Name:  name,
+			Value: ip.String(),
+		})
+	}
+	return result, nil
+}
@@ -0,0 +1,66 @@
+package cli
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/hako/durafmt"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+)
+
+var GCCmd = &cobra.Command{
+	Use:   "gc",
+	Short: "Lists, or deletes with --apply, the expired pre-auth keys and the machines inactive for gc_machine_inactivity",
+	Run: func(cmd *cobra.Command, args []string) {
+		dryRun, _ := cmd.Flags().GetBool("dry-run")
+		apply, _ := cmd.Flags().GetBool("apply")
+		inactiveFor, _ := cmd.Flags().GetString("inactive-for")
+		o, _ := cmd.Flags().GetString("output")
+
+		if dryRun && apply {
+			log.Fatal().Msg("--dry-run and --apply cannot be combined")
+		}
+		var inactivity time.Duration
+		if inactiveFor != "" {
+			duration, err := durafmt.ParseStringShort(inactiveFor)
+			if err != nil {
+				log.Fatal().Err(err).Msg("Error parsing duration")
+			}
+			inactivity = duration.Duration()
+		}
+
+		h, err := getAdminClient()
+		if err != nil {
+			log.Fatal().Err(err).Msg("Error initializing")
+		}
+		result, err := h.GarbageCollect(inactivity, apply)
+		if o != "" {
+			JsonOutput(result, err, o)
+			return
+		}
+		if err != nil {
+			exitWithError("Cannot garbage collect", err)
+		}
+
+		verb := "to delete"
+		if result.Applied {
+			verb = "deleted"
+		}
+		fmt.Printf("%d pre-auth key(s) %s:\n", len(result.PreAuthKeys), verb)
+		for _, k := range result.PreAuthKeys {
+			fmt.Printf("%d\t%s\texpired %s\n", k.ID, k.Namespace.Name, k.Expiration.Format("2006-01-02 15:04:05"))
+		}
+		fmt.Printf("%d node(s) %s:\n", len(result.Machines), verb)
+		for _, m := range result.Machines {
+			lastSeen := "never"
+			if m.LastSeen != nil {
+				lastSeen = m.LastSeen.Format("2006-01-02 15:04:05")
+			}
+			fmt.Printf("%d\t%s\t%s\tlast seen %s\n", m.ID, m.Namespace.Name, m.Name, lastSeen)
+		}
+		if !result.Applied {
+			fmt.Printf("Add --apply to delete them\n")
+		}
+	},
+}
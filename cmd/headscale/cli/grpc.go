@@ -0,0 +1,739 @@
+package cli
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"os"
+	"time"
+
+	"github.com/juanfont/headscale"
+	v1 "github.com/juanfont/headscale/gen/go/headscale/v1"
+	"github.com/spf13/viper"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"gorm.io/datatypes"
+	"gorm.io/gorm"
+	"inet.af/netaddr"
+	"tailscale.com/tailcfg"
+)
+
+const grpcTimeout = 10 * time.Second
+
+// adminClient holds the operations exposed by the gRPC API, so the commands
+// work the same against the local database and against a remote headscale
+type adminClient interface {
+	CreateNamespace(name string) (*headscale.Namespace, error)
+	DestroyNamespace(name string) error
+	RenameNamespace(oldName string, newName string) (*headscale.Namespace, error)
+	SetNamespaceMaxMachines(name string, max int) (*headscale.Namespace, error)
+	SetNamespaceDERPRegion(name string, regionID int) (*headscale.Namespace, error)
+	ListNamespacesWithQuota(withCounts bool) (*[]namespaceWithQuota, error)
+	ListMachinesInNamespace(namespace string) (*[]headscale.Machine, error)
+	ListMachines(filter headscale.MachineFilter) (*[]headscale.Machine, error)
+	GetMachineByID(id uint64) (*headscale.Machine, error)
+	RegisterMachine(key string, namespace string) (*headscale.Machine, error)
+	DeleteMachine(id uint64) error
+	DeleteMachines(ids []uint64, failFast bool) *headscale.BulkResult
+	MoveMachineToNamespace(id uint64, namespace string) (*headscale.Machine, error)
+	ExpireMachine(id uint64) (*headscale.Machine, error)
+	ExpireNamespaceMachines(namespace string) (*[]headscale.Machine, error)
+	SetMachineExpiry(id uint64, expiry time.Time) (*headscale.Machine, error)
+	TagMachine(id uint64, add []string, remove []string) (*headscale.Machine, error)
+	TagMachines(ids []uint64, add []string, remove []string, failFast bool) *headscale.BulkResult
+	ClearMachineTags(id uint64) (*headscale.Machine, error)
+	AuditIPs(fix bool) ([]headscale.IPConflict, error)
+	ShareMachine(id uint64, namespace string) (*headscale.Machine, error)
+	UnshareMachine(id uint64, namespace string) (*headscale.Machine, error)
+	RenameMachine(id uint64, name string) (*headscale.Machine, error)
+	ReauthMachine(id uint64) (*headscale.Machine, error)
+	RefreshMachineKey(id uint64) (*headscale.Machine, error)
+	ApproveMachine(id uint64) (*headscale.Machine, error)
+	SetMachineIP(id uint64, ip string) (*headscale.Machine, error)
+	GetMachineRoutes(id uint64) (*[]headscale.Route, error)
+	EnableMachineRoute(id uint64, route string) (*netaddr.IPPrefix, error)
+	EnableAllMachineRoutes(id uint64) ([]netaddr.IPPrefix, error)
+	EnableMachineExitNode(id uint64) (*headscale.Machine, error)
+	GetPreAuthKeys(namespace string) (*[]headscale.PreAuthKey, error)
+	CreatePreAuthKey(namespace string, reusable bool, ephemeral bool, expiration *time.Time, aclTags []string) (*headscale.PreAuthKey, error)
+	ExpirePreAuthKey(namespace string, key string) (*headscale.PreAuthKey, error)
+	GetPreAuthKeyMachines(namespace string, key string) (*[]headscale.Machine, error)
+	GarbageCollect(inactivity time.Duration, apply bool) (*headscale.GCResult, error)
+	GetMaintenanceStatus() (*headscale.MaintenanceStatus, error)
+	SetMaintenanceMode(enabled bool) (*headscale.MaintenanceStatus, error)
+}
+
+// getAdminClient returns a client of the gRPC API if grpc_addr is configured
+// or the socket of grpc_socket_path exists, and otherwise works directly on
+// the database
+func getAdminClient() (adminClient, error) {
+	if viper.GetString("grpc_addr") != "" {
+		return newGRPCAdminClient()
+	}
+	if path := absPath(viper.GetString("grpc_socket_path")); path != "" {
+		if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			return newGRPCSocketAdminClient(path)
+		}
+	}
+	h, err := getHeadscaleApp()
+	if err != nil {
+		return nil, err
+	}
+	return localAdminClient{h}, nil
+}
+
+type localAdminClient struct {
+	*headscale.Headscale
+}
+
+func (l localAdminClient) ListNamespacesWithQuota(withCounts bool) (*[]namespaceWithQuota, error) {
+	namespaces, err := l.ListNamespaces()
+	if err != nil {
+		return nil, err
+	}
+	counts, err := l.CountNamespaces()
+	if err != nil {
+		return nil, err
+	}
+	result := []namespaceWithQuota{}
+	for _, n := range *namespaces {
+		ns := namespaceWithQuota{
+			Namespace:     n,
+			Machines:      counts[n.ID].Machines,
+			MachinesLimit: l.GetNamespaceMachineLimit(&n),
+		}
+		if withCounts {
+			ns.setCounts(counts[n.ID].OnlineMachines, counts[n.ID].PreAuthKeys)
+		}
+		result = append(result, ns)
+	}
+	return &result, nil
+}
+
+type grpcAdminClient struct {
+	client v1.HeadscaleServiceClient
+	token  string
+}
+
+func newGRPCAdminClient() (*grpcAdminClient, error) {
+	creds := grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{}))
+	if viper.GetBool("grpc_insecure") {
+		creds = grpc.WithInsecure()
+	}
+
+	ctx, cancel := context.WithTimeout(commandCtx, grpcTimeout)
+	defer cancel()
+	conn, err := grpc.DialContext(ctx, viper.GetString("grpc_addr"), creds, grpc.WithBlock())
+	if err != nil {
+		return nil, err
+	}
+	return &grpcAdminClient{
+		client: v1.NewHeadscaleServiceClient(conn),
+		token:  viper.GetString("grpc_api_key"),
+	}, nil
+}
+
+// newGRPCSocketAdminClient connects to the Unix socket of a server on the
+// same host, which needs no API key
+func newGRPCSocketAdminClient(path string) (*grpcAdminClient, error) {
+	ctx, cancel := context.WithTimeout(commandCtx, grpcTimeout)
+	defer cancel()
+	conn, err := grpc.DialContext(ctx, "unix://"+path, grpc.WithInsecure(), grpc.WithBlock())
+	if err != nil {
+		return nil, err
+	}
+	return &grpcAdminClient{client: v1.NewHeadscaleServiceClient(conn)}, nil
+}
+
+// context bounds each call by grpcTimeout, or by the --timeout of the whole
+// command if given
+func (g *grpcAdminClient) context() (context.Context, context.CancelFunc) {
+	if commandTimeout > 0 {
+		ctx, cancel := context.WithCancel(commandCtx)
+		return metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+g.token), cancel
+	}
+	ctx, cancel := context.WithTimeout(commandCtx, grpcTimeout)
+	return metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+g.token), cancel
+}
+
+func (g *grpcAdminClient) CreateNamespace(name string) (*headscale.Namespace, error) {
+	ctx, cancel := g.context()
+	defer cancel()
+	resp, err := g.client.CreateNamespace(ctx, &v1.CreateNamespaceRequest{Name: name})
+	if err != nil {
+		return nil, grpcErrorMessage(err)
+	}
+	n := namespaceFromProto(resp.GetNamespace())
+	return &n, nil
+}
+
+func (g *grpcAdminClient) DestroyNamespace(name string) error {
+	ctx, cancel := g.context()
+	defer cancel()
+	_, err := g.client.DeleteNamespace(ctx, &v1.DeleteNamespaceRequest{Name: name})
+	return grpcErrorMessage(err)
+}
+
+func (g *grpcAdminClient) RenameNamespace(oldName string, newName string) (*headscale.Namespace, error) {
+	ctx, cancel := g.context()
+	defer cancel()
+	resp, err := g.client.RenameNamespace(ctx, &v1.RenameNamespaceRequest{OldName: oldName, NewName: newName})
+	if err != nil {
+		return nil, grpcErrorMessage(err)
+	}
+	n := namespaceFromProto(resp.GetNamespace())
+	return &n, nil
+}
+
+func (g *grpcAdminClient) SetNamespaceMaxMachines(name string, max int) (*headscale.Namespace, error) {
+	ctx, cancel := g.context()
+	defer cancel()
+	resp, err := g.client.SetNamespaceQuota(ctx, &v1.SetNamespaceQuotaRequest{Name: name, MaxMachines: int32(max)})
+	if err != nil {
+		return nil, grpcErrorMessage(err)
+	}
+	n := namespaceFromProto(resp.GetNamespace())
+	return &n, nil
+}
+
+func (g *grpcAdminClient) SetNamespaceDERPRegion(name string, regionID int) (*headscale.Namespace, error) {
+	ctx, cancel := g.context()
+	defer cancel()
+	resp, err := g.client.SetNamespaceDERPRegion(ctx, &v1.SetNamespaceDERPRegionRequest{Name: name, RegionId: int32(regionID)})
+	if err != nil {
+		return nil, grpcErrorMessage(err)
+	}
+	n := namespaceFromProto(resp.GetNamespace())
+	return &n, nil
+}
+
+func (g *grpcAdminClient) ListNamespacesWithQuota(withCounts bool) (*[]namespaceWithQuota, error) {
+	ctx, cancel := g.context()
+	defer cancel()
+	resp, err := g.client.ListNamespaces(ctx, &v1.ListNamespacesRequest{})
+	if err != nil {
+		return nil, grpcErrorMessage(err)
+	}
+	result := []namespaceWithQuota{}
+	for _, n := range resp.GetNamespaces() {
+		ns := namespaceWithQuota{
+			Namespace:     namespaceFromProto(n),
+			Machines:      int(n.GetMachines()),
+			MachinesLimit: int(n.GetMachinesLimit()),
+		}
+		if withCounts {
+			ns.setCounts(int(n.GetOnlineMachines()), int(n.GetPreAuthKeys()))
+		}
+		result = append(result, ns)
+	}
+	return &result, nil
+}
+
+func (g *grpcAdminClient) ListMachinesInNamespace(namespace string) (*[]headscale.Machine, error) {
+	return g.ListMachines(headscale.MachineFilter{Namespace: namespace})
+}
+
+func (g *grpcAdminClient) ListMachines(filter headscale.MachineFilter) (*[]headscale.Machine, error) {
+	ctx, cancel := g.context()
+	defer cancel()
+	req := v1.ListMachinesRequest{
+		Namespace: filter.Namespace,
+		Tag:       filter.Tag,
+		Online:    filter.Online,
+		SortBy:    filter.SortBy,
+
+		IncludeShared: filter.IncludeShared,
+		Pending:       filter.Pending,
+	}
+	if filter.LastSeenBefore != nil {
+		req.LastSeenBefore = timestamppb.New(*filter.LastSeenBefore)
+	}
+	resp, err := g.client.ListMachines(ctx, &req)
+	if err != nil {
+		return nil, grpcErrorMessage(err)
+	}
+	machines := []headscale.Machine{}
+	for _, m := range resp.GetMachines() {
+		machines = append(machines, machineFromProto(m))
+	}
+	return &machines, nil
+}
+
+func (g *grpcAdminClient) GetMachineByID(id uint64) (*headscale.Machine, error) {
+	ctx, cancel := g.context()
+	defer cancel()
+	resp, err := g.client.GetMachine(ctx, &v1.GetMachineRequest{MachineId: id})
+	if err != nil {
+		return nil, grpcErrorMessage(err)
+	}
+	m := machineFromProto(resp.GetMachine())
+	return &m, nil
+}
+
+func (g *grpcAdminClient) RegisterMachine(key string, namespace string) (*headscale.Machine, error) {
+	ctx, cancel := g.context()
+	defer cancel()
+	resp, err := g.client.RegisterMachine(ctx, &v1.RegisterMachineRequest{Key: key, Namespace: namespace})
+	if err != nil {
+		return nil, grpcErrorMessage(err)
+	}
+	m := machineFromProto(resp.GetMachine())
+	return &m, nil
+}
+
+func (g *grpcAdminClient) DeleteMachine(id uint64) error {
+	ctx, cancel := g.context()
+	defer cancel()
+	_, err := g.client.DeleteMachine(ctx, &v1.DeleteMachineRequest{MachineId: id})
+	return grpcErrorMessage(err)
+}
+
+// DeleteMachines calls DeleteMachine for each machine, the server updating
+// the peers after each deletion
+func (g *grpcAdminClient) DeleteMachines(ids []uint64, failFast bool) *headscale.BulkResult {
+	return headscale.RunBulk(ids, failFast, g.DeleteMachine)
+}
+
+func (g *grpcAdminClient) MoveMachineToNamespace(id uint64, namespace string) (*headscale.Machine, error) {
+	ctx, cancel := g.context()
+	defer cancel()
+	resp, err := g.client.MoveMachine(ctx, &v1.MoveMachineRequest{MachineId: id, Namespace: namespace})
+	if err != nil {
+		return nil, grpcErrorMessage(err)
+	}
+	m := machineFromProto(resp.GetMachine())
+	return &m, nil
+}
+
+func (g *grpcAdminClient) ExpireMachine(id uint64) (*headscale.Machine, error) {
+	ctx, cancel := g.context()
+	defer cancel()
+	resp, err := g.client.ExpireMachine(ctx, &v1.ExpireMachineRequest{MachineId: id})
+	if err != nil {
+		return nil, grpcErrorMessage(err)
+	}
+	m := machineFromProto(resp.GetMachine())
+	return &m, nil
+}
+
+func (g *grpcAdminClient) ExpireNamespaceMachines(namespace string) (*[]headscale.Machine, error) {
+	ctx, cancel := g.context()
+	defer cancel()
+	resp, err := g.client.ExpireNamespaceMachines(ctx, &v1.ExpireNamespaceMachinesRequest{Namespace: namespace})
+	if err != nil {
+		return nil, grpcErrorMessage(err)
+	}
+	machines := []headscale.Machine{}
+	for _, m := range resp.GetMachines() {
+		machines = append(machines, machineFromProto(m))
+	}
+	return &machines, nil
+}
+
+func (g *grpcAdminClient) SetMachineExpiry(id uint64, expiry time.Time) (*headscale.Machine, error) {
+	ctx, cancel := g.context()
+	defer cancel()
+	resp, err := g.client.SetMachineExpiry(ctx, &v1.SetMachineExpiryRequest{MachineId: id, Expiry: timestamppb.New(expiry)})
+	if err != nil {
+		return nil, grpcErrorMessage(err)
+	}
+	m := machineFromProto(resp.GetMachine())
+	return &m, nil
+}
+
+func (g *grpcAdminClient) TagMachine(id uint64, add []string, remove []string) (*headscale.Machine, error) {
+	ctx, cancel := g.context()
+	defer cancel()
+	resp, err := g.client.TagMachine(ctx, &v1.TagMachineRequest{MachineId: id, Add: add, Remove: remove})
+	if err != nil {
+		return nil, grpcErrorMessage(err)
+	}
+	m := machineFromProto(resp.GetMachine())
+	return &m, nil
+}
+
+// TagMachines calls TagMachine for each machine, like DeleteMachines
+func (g *grpcAdminClient) TagMachines(ids []uint64, add []string, remove []string, failFast bool) *headscale.BulkResult {
+	return headscale.RunBulk(ids, failFast, func(id uint64) error {
+		_, err := g.TagMachine(id, add, remove)
+		return err
+	})
+}
+
+func (g *grpcAdminClient) ClearMachineTags(id uint64) (*headscale.Machine, error) {
+	ctx, cancel := g.context()
+	defer cancel()
+	resp, err := g.client.ClearMachineTags(ctx, &v1.ClearMachineTagsRequest{MachineId: id})
+	if err != nil {
+		return nil, grpcErrorMessage(err)
+	}
+	m := machineFromProto(resp.GetMachine())
+	return &m, nil
+}
+
+func (g *grpcAdminClient) AuditIPs(fix bool) ([]headscale.IPConflict, error) {
+	ctx, cancel := g.context()
+	defer cancel()
+	resp, err := g.client.AuditIPs(ctx, &v1.AuditIPsRequest{Fix: fix})
+	if err != nil {
+		return nil, grpcErrorMessage(err)
+	}
+	conflicts := []headscale.IPConflict{}
+	for _, c := range resp.GetConflicts() {
+		conflicts = append(conflicts, headscale.IPConflict{
+			MachineID:    c.GetMachineId(),
+			Machine:      c.GetMachine(),
+			IPAddress:    c.GetIpAddress(),
+			Problem:      c.GetProblem(),
+			NewIPAddress: c.GetNewIpAddress(),
+		})
+	}
+	// The conflicts found before the failure are returned with it
+	if resp.GetError() != "" {
+		return conflicts, errors.New(resp.GetError())
+	}
+	return conflicts, nil
+}
+
+func (g *grpcAdminClient) ShareMachine(id uint64, namespace string) (*headscale.Machine, error) {
+	ctx, cancel := g.context()
+	defer cancel()
+	resp, err := g.client.ShareMachine(ctx, &v1.ShareMachineRequest{MachineId: id, Namespace: namespace})
+	if err != nil {
+		return nil, grpcErrorMessage(err)
+	}
+	m := machineFromProto(resp.GetMachine())
+	return &m, nil
+}
+
+func (g *grpcAdminClient) UnshareMachine(id uint64, namespace string) (*headscale.Machine, error) {
+	ctx, cancel := g.context()
+	defer cancel()
+	resp, err := g.client.UnshareMachine(ctx, &v1.UnshareMachineRequest{MachineId: id, Namespace: namespace})
+	if err != nil {
+		return nil, grpcErrorMessage(err)
+	}
+	m := machineFromProto(resp.GetMachine())
+	return &m, nil
+}
+
+func (g *grpcAdminClient) RenameMachine(id uint64, name string) (*headscale.Machine, error) {
+	ctx, cancel := g.context()
+	defer cancel()
+	resp, err := g.client.RenameMachine(ctx, &v1.RenameMachineRequest{MachineId: id, Name: name})
+	if err != nil {
+		return nil, grpcErrorMessage(err)
+	}
+	m := machineFromProto(resp.GetMachine())
+	return &m, nil
+}
+
+func (g *grpcAdminClient) ReauthMachine(id uint64) (*headscale.Machine, error) {
+	ctx, cancel := g.context()
+	defer cancel()
+	resp, err := g.client.ReauthMachine(ctx, &v1.ReauthMachineRequest{MachineId: id})
+	if err != nil {
+		return nil, grpcErrorMessage(err)
+	}
+	m := machineFromProto(resp.GetMachine())
+	return &m, nil
+}
+
+func (g *grpcAdminClient) RefreshMachineKey(id uint64) (*headscale.Machine, error) {
+	ctx, cancel := g.context()
+	defer cancel()
+	resp, err := g.client.RefreshMachineKey(ctx, &v1.RefreshMachineKeyRequest{MachineId: id})
+	if err != nil {
+		return nil, grpcErrorMessage(err)
+	}
+	m := machineFromProto(resp.GetMachine())
+	return &m, nil
+}
+
+func (g *grpcAdminClient) ApproveMachine(id uint64) (*headscale.Machine, error) {
+	ctx, cancel := g.context()
+	defer cancel()
+	resp, err := g.client.ApproveMachine(ctx, &v1.ApproveMachineRequest{MachineId: id})
+	if err != nil {
+		return nil, grpcErrorMessage(err)
+	}
+	m := machineFromProto(resp.GetMachine())
+	return &m, nil
+}
+
+func (g *grpcAdminClient) SetMachineIP(id uint64, ip string) (*headscale.Machine, error) {
+	ctx, cancel := g.context()
+	defer cancel()
+	resp, err := g.client.SetMachineIP(ctx, &v1.SetMachineIPRequest{MachineId: id, IpAddress: ip})
+	if err != nil {
+		return nil, grpcErrorMessage(err)
+	}
+	m := machineFromProto(resp.GetMachine())
+	return &m, nil
+}
+
+func (g *grpcAdminClient) GetMachineRoutes(id uint64) (*[]headscale.Route, error) {
+	ctx, cancel := g.context()
+	defer cancel()
+	resp, err := g.client.GetMachineRoutes(ctx, &v1.GetMachineRoutesRequest{MachineId: id})
+	if err != nil {
+		return nil, grpcErrorMessage(err)
+	}
+	routes := []headscale.Route{}
+	for _, r := range resp.GetRoutes() {
+		prefix, err := netaddr.ParseIPPrefix(r.GetPrefix())
+		if err != nil {
+			return nil, err
+		}
+		routes = append(routes, headscale.Route{
+			Prefix:     prefix,
+			Advertised: r.GetAdvertised(),
+			Enabled:    r.GetEnabled(),
+			ExitRoute:  r.GetExitRoute(),
+		})
+	}
+	return &routes, nil
+}
+
+func (g *grpcAdminClient) EnableMachineRoute(id uint64, route string) (*netaddr.IPPrefix, error) {
+	ctx, cancel := g.context()
+	defer cancel()
+	resp, err := g.client.EnableMachineRoute(ctx, &v1.EnableMachineRouteRequest{MachineId: id, Route: route})
+	if err != nil {
+		return nil, grpcErrorMessage(err)
+	}
+	prefix, err := netaddr.ParseIPPrefix(resp.GetRoute())
+	if err != nil {
+		return nil, err
+	}
+	return &prefix, nil
+}
+
+func (g *grpcAdminClient) EnableAllMachineRoutes(id uint64) ([]netaddr.IPPrefix, error) {
+	ctx, cancel := g.context()
+	defer cancel()
+	resp, err := g.client.EnableAllMachineRoutes(ctx, &v1.EnableAllMachineRoutesRequest{MachineId: id})
+	if err != nil {
+		return nil, grpcErrorMessage(err)
+	}
+	routes := []netaddr.IPPrefix{}
+	for _, r := range resp.GetRoutes() {
+		prefix, err := netaddr.ParseIPPrefix(r)
+		if err != nil {
+			return nil, err
+		}
+		routes = append(routes, prefix)
+	}
+	return routes, nil
+}
+
+func (g *grpcAdminClient) EnableMachineExitNode(id uint64) (*headscale.Machine, error) {
+	ctx, cancel := g.context()
+	defer cancel()
+	resp, err := g.client.EnableMachineExitNode(ctx, &v1.EnableMachineExitNodeRequest{MachineId: id})
+	if err != nil {
+		return nil, grpcErrorMessage(err)
+	}
+	m := machineFromProto(resp.GetMachine())
+	return &m, nil
+}
+
+func (g *grpcAdminClient) GetPreAuthKeys(namespace string) (*[]headscale.PreAuthKey, error) {
+	ctx, cancel := g.context()
+	defer cancel()
+	resp, err := g.client.ListPreAuthKeys(ctx, &v1.ListPreAuthKeysRequest{Namespace: namespace})
+	if err != nil {
+		return nil, grpcErrorMessage(err)
+	}
+	// A server older than the scoping of the keys may return them all
+	keys := []headscale.PreAuthKey{}
+	for _, k := range resp.GetPreAuthKeys() {
+		if k.GetNamespace() != namespace {
+			continue
+		}
+		keys = append(keys, preAuthKeyFromProto(k))
+	}
+	return &keys, nil
+}
+
+func (g *grpcAdminClient) CreatePreAuthKey(namespace string, reusable bool, ephemeral bool, expiration *time.Time, aclTags []string) (*headscale.PreAuthKey, error) {
+	ctx, cancel := g.context()
+	defer cancel()
+	req := v1.CreatePreAuthKeyRequest{
+		Namespace: namespace,
+		Reusable:  reusable,
+		Ephemeral: ephemeral,
+		AclTags:   aclTags,
+	}
+	if expiration != nil {
+		req.Expiration = timestamppb.New(*expiration)
+	}
+	resp, err := g.client.CreatePreAuthKey(ctx, &req)
+	if err != nil {
+		return nil, grpcErrorMessage(err)
+	}
+	k := preAuthKeyFromProto(resp.GetPreAuthKey())
+	return &k, nil
+}
+
+func (g *grpcAdminClient) ExpirePreAuthKey(namespace string, key string) (*headscale.PreAuthKey, error) {
+	ctx, cancel := g.context()
+	defer cancel()
+	resp, err := g.client.ExpirePreAuthKey(ctx, &v1.ExpirePreAuthKeyRequest{Namespace: namespace, Key: key})
+	if err != nil {
+		return nil, grpcErrorMessage(err)
+	}
+	k := preAuthKeyFromProto(resp.GetPreAuthKey())
+	return &k, nil
+}
+
+func (g *grpcAdminClient) GetPreAuthKeyMachines(namespace string, key string) (*[]headscale.Machine, error) {
+	ctx, cancel := g.context()
+	defer cancel()
+	resp, err := g.client.ListPreAuthKeyMachines(ctx, &v1.ListPreAuthKeyMachinesRequest{Namespace: namespace, Key: key})
+	if err != nil {
+		return nil, grpcErrorMessage(err)
+	}
+	machines := []headscale.Machine{}
+	for _, m := range resp.GetMachines() {
+		machines = append(machines, machineFromProto(m))
+	}
+	return &machines, nil
+}
+
+func (g *grpcAdminClient) GarbageCollect(inactivity time.Duration, apply bool) (*headscale.GCResult, error) {
+	ctx, cancel := g.context()
+	defer cancel()
+	resp, err := g.client.GarbageCollect(ctx, &v1.GarbageCollectRequest{
+		Apply:                    apply,
+		MachineInactivitySeconds: int64(inactivity / time.Second),
+	})
+	if err != nil {
+		return nil, grpcErrorMessage(err)
+	}
+	result := headscale.GCResult{PreAuthKeys: []headscale.PreAuthKey{}, Machines: []headscale.Machine{}, Applied: resp.GetApplied()}
+	for _, k := range resp.GetPreAuthKeys() {
+		result.PreAuthKeys = append(result.PreAuthKeys, preAuthKeyFromProto(k))
+	}
+	for _, m := range resp.GetMachines() {
+		result.Machines = append(result.Machines, machineFromProto(m))
+	}
+	return &result, nil
+}
+
+func (g *grpcAdminClient) GetMaintenanceStatus() (*headscale.MaintenanceStatus, error) {
+	ctx, cancel := g.context()
+	defer cancel()
+	resp, err := g.client.GetMaintenanceMode(ctx, &v1.GetMaintenanceModeRequest{})
+	if err != nil {
+		return nil, grpcErrorMessage(err)
+	}
+	s := maintenanceStatusFromProto(resp.GetStatus())
+	return &s, nil
+}
+
+func (g *grpcAdminClient) SetMaintenanceMode(enabled bool) (*headscale.MaintenanceStatus, error) {
+	ctx, cancel := g.context()
+	defer cancel()
+	resp, err := g.client.SetMaintenanceMode(ctx, &v1.SetMaintenanceModeRequest{Enabled: enabled})
+	if err != nil {
+		return nil, grpcErrorMessage(err)
+	}
+	s := maintenanceStatusFromProto(resp.GetStatus())
+	return &s, nil
+}
+
+// grpcErrorMessage strips the gRPC status code, so the errors read the same
+// as when working on the local database
+func grpcErrorMessage(err error) error {
+	if err == nil {
+		return nil
+	}
+	return errors.New(status.Convert(err).Message())
+}
+
+func timeFromProto(t *timestamppb.Timestamp) *time.Time {
+	if t == nil {
+		return nil
+	}
+	tt := t.AsTime()
+	return &tt
+}
+
+func maintenanceStatusFromProto(s *v1.MaintenanceStatus) headscale.MaintenanceStatus {
+	return headscale.MaintenanceStatus{Enabled: s.GetEnabled(), Config: s.GetConfig(), Command: s.GetCommand()}
+}
+
+func namespaceFromProto(n *v1.Namespace) headscale.Namespace {
+	return headscale.Namespace{
+		Model: gorm.Model{
+			ID:        uint(n.GetId()),
+			CreatedAt: n.GetCreatedAt().AsTime(),
+		},
+		Name:        n.GetName(),
+		MaxMachines: int(n.GetMaxMachines()),
+
+		PreferredDERPRegion: int(n.GetPreferredDerpRegion()),
+	}
+}
+
+func machineFromProto(m *v1.Machine) headscale.Machine {
+	tags, _ := json.Marshal(m.GetTags())
+	enabledRoutes, _ := json.Marshal(m.GetEnabledRoutes())
+	hi := tailcfg.Hostinfo{}
+	for _, r := range m.GetAdvertisedRoutes() {
+		if prefix, err := netaddr.ParseIPPrefix(r); err == nil {
+			hi.RoutableIPs = append(hi.RoutableIPs, prefix)
+		}
+	}
+	hostinfo, _ := json.Marshal(hi)
+	machine := headscale.Machine{
+		ID:             m.GetId(),
+		MachineKey:     m.GetMachineKey(),
+		NodeKey:        m.GetNodeKey(),
+		DiscoKey:       m.GetDiscoKey(),
+		IPAddress:      m.GetIpAddress(),
+		IPv6Address:    m.GetIpv6Address(),
+		StaticIP:       m.GetStaticIp(),
+		Name:           m.GetName(),
+		GivenName:      m.GetGivenName(),
+		NamespaceID:    uint(m.GetNamespace().GetId()),
+		Namespace:      namespaceFromProto(m.GetNamespace()),
+		Registered:     m.GetRegistered(),
+		Pending:        m.GetPending(),
+		RegisterMethod: m.GetRegisterMethod(),
+		RegisteredAt:   timeFromProto(m.GetRegisteredAt()),
+		LastSeen:       timeFromProto(m.GetLastSeen()),
+		Online:         m.GetOnline(),
+		Shared:         m.GetShared(),
+		Expiry:         timeFromProto(m.GetExpiry()),
+		HostInfo:       datatypes.JSON(hostinfo),
+		EnabledRoutes:  datatypes.JSON(enabledRoutes),
+		Tags:           datatypes.JSON(tags),
+		CreatedAt:      m.GetCreatedAt().AsTime(),
+
+		KeyRefreshRequestedAt: timeFromProto(m.GetKeyRefreshRequestedAt()),
+	}
+	if m.GetEphemeral() {
+		machine.AuthKey = &headscale.PreAuthKey{Ephemeral: true}
+	}
+	return machine
+}
+
+func preAuthKeyFromProto(k *v1.PreAuthKey) headscale.PreAuthKey {
+	tags, _ := json.Marshal(k.GetAclTags())
+	return headscale.PreAuthKey{
+		ID:         k.GetId(),
+		Key:        k.GetKey(),
+		Namespace:  headscale.Namespace{Name: k.GetNamespace()},
+		Reusable:   k.GetReusable(),
+		Ephemeral:  k.GetEphemeral(),
+		Expiration: timeFromProto(k.GetExpiration()),
+		CreatedAt:  timeFromProto(k.GetCreatedAt()),
+		ACLTags:    datatypes.JSON(tags),
+	}
+}
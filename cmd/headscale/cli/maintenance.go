@@ -0,0 +1,81 @@
+package cli
+
+import (
+	"fmt"
+
+	"github.com/juanfont/headscale"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+)
+
+var MaintenanceCmd = &cobra.Command{
+	Use:   "maintenance",
+	Short: "Refuse the changes and the new registrations, e.g. during a backup",
+}
+
+var MaintenanceStatusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Tells whether the server is in maintenance, and why",
+	Run: func(cmd *cobra.Command, args []string) {
+		o, _ := cmd.Flags().GetString("output")
+
+		h, err := getAdminClient()
+		if err != nil {
+			log.Fatal().Err(err).Msg("Error initializing")
+		}
+		status, err := h.GetMaintenanceStatus()
+		if o != "" {
+			JsonOutput(status, err, o)
+			return
+		}
+		if err != nil {
+			exitWithError("Cannot get the maintenance mode", err)
+		}
+		printMaintenanceStatus(status)
+	},
+}
+
+var EnableMaintenanceCmd = &cobra.Command{
+	Use:   "enable",
+	Short: "Starts a maintenance: the netmaps are still served, the changes are refused",
+	Run: func(cmd *cobra.Command, args []string) {
+		setMaintenanceMode(cmd, true)
+	},
+}
+
+var DisableMaintenanceCmd = &cobra.Command{
+	Use:   "disable",
+	Short: "Ends a maintenance started with maintenance enable",
+	Run: func(cmd *cobra.Command, args []string) {
+		setMaintenanceMode(cmd, false)
+	},
+}
+
+func setMaintenanceMode(cmd *cobra.Command, enabled bool) {
+	o, _ := cmd.Flags().GetString("output")
+
+	h, err := getAdminClient()
+	if err != nil {
+		log.Fatal().Err(err).Msg("Error initializing")
+	}
+	status, err := h.SetMaintenanceMode(enabled)
+	if o != "" {
+		JsonOutput(status, err, o)
+		return
+	}
+	if err != nil {
+		exitWithError("Cannot set the maintenance mode", err)
+	}
+	printMaintenanceStatus(status)
+}
+
+func printMaintenanceStatus(status *headscale.MaintenanceStatus) {
+	switch {
+	case status.Config:
+		fmt.Printf("In maintenance, set by maintenance_mode in the configuration\n")
+	case status.Command:
+		fmt.Printf("In maintenance, until headscale maintenance disable\n")
+	default:
+		fmt.Printf("Not in maintenance\n")
+	}
+}
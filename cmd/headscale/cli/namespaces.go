@@ -2,12 +2,28 @@ package cli
 
 import (
 	"fmt"
-	"log"
-	"strings"
+	"strconv"
 
+	"github.com/juanfont/headscale"
+	"github.com/rs/zerolog/log"
 	"github.com/spf13/cobra"
 )
 
+// namespaceWithQuota adds the machine count and limit to the namespace
+// listing, and with --with-counts the online machines and pre-auth keys
+type namespaceWithQuota struct {
+	headscale.Namespace
+	Machines       int
+	MachinesLimit  int
+	OnlineMachines *int `json:",omitempty" yaml:",omitempty"`
+	PreAuthKeys    *int `json:",omitempty" yaml:",omitempty"`
+}
+
+func (n *namespaceWithQuota) setCounts(online int, preAuthKeys int) {
+	n.OnlineMachines = &online
+	n.PreAuthKeys = &preAuthKeys
+}
+
 var NamespaceCmd = &cobra.Command{
 	Use:   "namespaces",
 	Short: "Manage the namespaces of Headscale",
@@ -24,18 +40,17 @@ var CreateNamespaceCmd = &cobra.Command{
 	},
 	Run: func(cmd *cobra.Command, args []string) {
 		o, _ := cmd.Flags().GetString("output")
-		h, err := getHeadscaleApp()
+		h, err := getAdminClient()
 		if err != nil {
-			log.Fatalf("Error initializing: %s", err)
+			log.Fatal().Err(err).Msg("Error initializing")
 		}
 		namespace, err := h.CreateNamespace(args[0])
-		if strings.HasPrefix(o, "json") {
+		if o != "" {
 			JsonOutput(namespace, err, o)
 			return
 		}
 		if err != nil {
-			fmt.Printf("Error creating namespace: %s\n", err)
-			return
+			exitWithError("Error creating namespace", err)
 		}
 		fmt.Printf("Namespace created\n")
 	},
@@ -52,18 +67,17 @@ var DestroyNamespaceCmd = &cobra.Command{
 	},
 	Run: func(cmd *cobra.Command, args []string) {
 		o, _ := cmd.Flags().GetString("output")
-		h, err := getHeadscaleApp()
+		h, err := getAdminClient()
 		if err != nil {
-			log.Fatalf("Error initializing: %s", err)
+			log.Fatal().Err(err).Msg("Error initializing")
 		}
 		err = h.DestroyNamespace(args[0])
-		if strings.HasPrefix(o, "json") {
+		if o != "" {
 			JsonOutput(map[string]string{"Result": "Namespace destroyed"}, err, o)
 			return
 		}
 		if err != nil {
-			fmt.Printf("Error destroying namespace: %s\n", err)
-			return
+			exitWithError("Error destroying namespace", err)
 		}
 		fmt.Printf("Namespace destroyed\n")
 	},
@@ -73,23 +87,128 @@ var ListNamespacesCmd = &cobra.Command{
 	Use:   "list",
 	Short: "List all the namespaces",
 	Run: func(cmd *cobra.Command, args []string) {
+		withCounts, _ := cmd.Flags().GetBool("with-counts")
 		o, _ := cmd.Flags().GetString("output")
-		h, err := getHeadscaleApp()
+		h, err := getAdminClient()
 		if err != nil {
-			log.Fatalf("Error initializing: %s", err)
+			log.Fatal().Err(err).Msg("Error initializing")
 		}
-		namespaces, err := h.ListNamespaces()
-		if strings.HasPrefix(o, "json") {
-			JsonOutput(namespaces, err, o)
+		result, err := h.ListNamespacesWithQuota(withCounts)
+		if o != "" {
+			JsonOutput(result, err, o)
 			return
 		}
 		if err != nil {
-			fmt.Println(err)
+			exitWithError("", err)
+		}
+		if withCounts {
+			fmt.Printf("ID\tName\tMachines\tOnline\tPre-auth keys\tDERP region\n")
+		} else {
+			fmt.Printf("ID\tName\tMachines\tDERP region\n")
+		}
+		for _, n := range *result {
+			limit := "unlimited"
+			if n.MachinesLimit > 0 {
+				limit = strconv.Itoa(n.MachinesLimit)
+			}
+			region := "-"
+			if n.PreferredDERPRegion != 0 {
+				region = strconv.Itoa(n.PreferredDERPRegion)
+			}
+			if withCounts {
+				fmt.Printf("%d\t%s\t%d/%s\t\t%d\t%d\t\t%s\n", n.ID, n.Name, n.Machines, limit, *n.OnlineMachines, *n.PreAuthKeys, region)
+				continue
+			}
+			fmt.Printf("%d\t%s\t%d/%s\t\t%s\n", n.ID, n.Name, n.Machines, limit, region)
+		}
+	},
+}
+
+var RenameNamespaceCmd = &cobra.Command{
+	Use:   "rename OLD_NAME NEW_NAME",
+	Short: "Renames a namespace",
+	Args: func(cmd *cobra.Command, args []string) error {
+		if len(args) < 2 {
+			return fmt.Errorf("Missing parameters")
+		}
+		return nil
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		o, _ := cmd.Flags().GetString("output")
+		h, err := getAdminClient()
+		if err != nil {
+			log.Fatal().Err(err).Msg("Error initializing")
+		}
+		namespace, err := h.RenameNamespace(args[0], args[1])
+		if o != "" {
+			JsonOutput(namespace, err, o)
 			return
 		}
-		fmt.Printf("ID\tName\n")
-		for _, n := range *namespaces {
-			fmt.Printf("%d\t%s\n", n.ID, n.Name)
+		if err != nil {
+			exitWithError("Error renaming namespace", err)
+		}
+		fmt.Printf("Namespace renamed\n")
+	},
+}
+
+var SetNamespaceQuotaCmd = &cobra.Command{
+	Use:   "set-quota NAME MAX_MACHINES",
+	Short: "Sets the maximum number of machines of a namespace (0 to use the global limit)",
+	Args: func(cmd *cobra.Command, args []string) error {
+		if len(args) < 2 {
+			return fmt.Errorf("Missing parameters")
+		}
+		return nil
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		o, _ := cmd.Flags().GetString("output")
+		max, err := strconv.Atoi(args[1])
+		if err != nil {
+			log.Fatal().Err(err).Msg("Error parsing the maximum number of machines")
+		}
+		h, err := getAdminClient()
+		if err != nil {
+			log.Fatal().Err(err).Msg("Error initializing")
+		}
+		namespace, err := h.SetNamespaceMaxMachines(args[0], max)
+		if o != "" {
+			JsonOutput(namespace, err, o)
+			return
+		}
+		if err != nil {
+			exitWithError("Error setting the namespace quota", err)
+		}
+		fmt.Printf("Namespace quota updated\n")
+	},
+}
+
+var SetNamespaceDERPRegionCmd = &cobra.Command{
+	Use:   "set-derp-region NAME REGION_ID",
+	Short: "Sets the DERP region preferred by the machines of a namespace (0 to remove the preference)",
+	Args: func(cmd *cobra.Command, args []string) error {
+		if len(args) < 2 {
+			return fmt.Errorf("Missing parameters")
+		}
+		return nil
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		o, _ := cmd.Flags().GetString("output")
+		regionID, err := strconv.Atoi(args[1])
+		if err != nil {
+			log.Fatal().Err(err).Msg("Error parsing the DERP region ID")
+		}
+		h, err := getAdminClient()
+		if err != nil {
+			log.Fatal().Err(err).Msg("Error initializing")
+		}
+		namespace, err := h.SetNamespaceDERPRegion(args[0], regionID)
+		if o != "" {
+			JsonOutput(namespace, err, o)
+			return
+		}
+		if err != nil {
+			exitWithError("Error setting the DERP region of the namespace", err)
 		}
+		fmt.Printf("Namespace DERP region updated\n")
 	},
 }
@@ -2,10 +2,15 @@ package cli
 
 import (
 	"fmt"
-	"log"
+	"os"
+	"strconv"
 	"strings"
+	"text/tabwriter"
 	"time"
 
+	"github.com/hako/durafmt"
+	"github.com/juanfont/headscale"
+	"github.com/rs/zerolog/log"
 	"github.com/spf13/cobra"
 )
 
@@ -15,33 +20,41 @@ var NodeCmd = &cobra.Command{
 }
 
 var RegisterCmd = &cobra.Command{
-	Use:   "register machineID",
+	Use:   "register --key machineKey",
 	Short: "Registers a machine to your network",
+	Long: `Registers a machine to your network, by the machine key shown in the
+registration URL or in the logs of the client. The machine is created if
+headscale has not heard from it yet, and is authorized when it connects.`,
 	Args: func(cmd *cobra.Command, args []string) error {
-		if len(args) < 1 {
-			return fmt.Errorf("Missing parameters")
+		k, _ := cmd.Flags().GetString("key")
+		if len(args) > 1 || (k == "" && len(args) == 0) || (k != "" && len(args) == 1) {
+			return fmt.Errorf("Set the machine key with --key")
 		}
 		return nil
 	},
 	Run: func(cmd *cobra.Command, args []string) {
 		n, err := cmd.Flags().GetString("namespace")
 		if err != nil {
-			log.Fatalf("Error getting namespace: %s", err)
+			log.Fatal().Err(err).Msg("Error getting namespace")
 		}
 		o, _ := cmd.Flags().GetString("output")
+		// The key used to be given as an argument
+		k, _ := cmd.Flags().GetString("key")
+		if k == "" {
+			k = args[0]
+		}
 
-		h, err := getHeadscaleApp()
+		h, err := getAdminClient()
 		if err != nil {
-			log.Fatalf("Error initializing: %s", err)
+			log.Fatal().Err(err).Msg("Error initializing")
 		}
-		m, err := h.RegisterMachine(args[0], n)
-		if strings.HasPrefix(o, "json") {
+		m, err := h.RegisterMachine(k, n)
+		if o != "" {
 			JsonOutput(m, err, o)
 			return
 		}
 		if err != nil {
-			fmt.Printf("Cannot register machine: %s\n", err)
-			return
+			exitWithError("Cannot register machine", err)
 		}
 		fmt.Printf("Machine registered\n")
 	},
@@ -49,40 +62,734 @@ var RegisterCmd = &cobra.Command{
 
 var ListNodesCmd = &cobra.Command{
 	Use:   "list",
-	Short: "List the nodes in a given namespace",
+	Short: "List the nodes, of all the namespaces or of the one given with --namespace",
 	Run: func(cmd *cobra.Command, args []string) {
 		n, err := cmd.Flags().GetString("namespace")
 		if err != nil {
-			log.Fatalf("Error getting namespace: %s", err)
+			log.Fatal().Err(err).Msg("Error getting namespace")
 		}
+		tag, _ := cmd.Flags().GetString("tag")
+		online, _ := cmd.Flags().GetBool("online")
+		pending, _ := cmd.Flags().GetBool("pending")
+		sortBy, _ := cmd.Flags().GetString("sort")
+		before, _ := cmd.Flags().GetString("last-seen-before")
 		o, _ := cmd.Flags().GetString("output")
+		names, _ := cmd.Flags().GetStringSlice("columns")
+		columns, err := selectNodeColumns(names)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Error parsing columns")
+		}
+
+		filter := headscale.MachineFilter{
+			Namespace: n,
+			Tag:       tag,
+			Online:    online,
+			SortBy:    sortBy,
+			Pending:   pending,
+			// The nodes shared in are listed with the namespace
+			IncludeShared: n != "",
+		}
+		if before != "" {
+			duration, err := durafmt.ParseStringShort(before)
+			if err != nil {
+				log.Fatal().Err(err).Msg("Error parsing duration")
+			}
+			t := time.Now().UTC().Add(-duration.Duration())
+			filter.LastSeenBefore = &t
+		}
 
-		h, err := getHeadscaleApp()
+		h, err := getAdminClient()
 		if err != nil {
-			log.Fatalf("Error initializing: %s", err)
+			log.Fatal().Err(err).Msg("Error initializing")
 		}
-		machines, err := h.ListMachinesInNamespace(n)
-		if strings.HasPrefix(o, "json") {
+		machines, err := h.ListMachines(filter)
+		if o != "" {
 			JsonOutput(machines, err, o)
 			return
 		}
 
 		if err != nil {
-			log.Fatalf("Error getting nodes: %s", err)
+			log.Fatal().Err(err).Msg("Error getting nodes")
 		}
 
-		fmt.Printf("name\t\tlast seen\t\tephemeral\n")
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 1, '\t', 0)
+		headers := make([]string, len(columns))
+		for i, col := range columns {
+			headers[i] = col.header
+		}
+		fmt.Fprintln(w, strings.Join(headers, "\t"))
 		for _, m := range *machines {
-			var ephemeral bool
-			if m.AuthKey != nil && m.AuthKey.Ephemeral {
-				ephemeral = true
+			values := make([]string, len(columns))
+			for i, col := range columns {
+				values[i] = col.value(m)
+			}
+			fmt.Fprintln(w, strings.Join(values, "\t"))
+		}
+		w.Flush()
+	},
+}
+
+// nodeColumn is a column of the table printed by nodes list
+type nodeColumn struct {
+	name   string
+	header string
+	value  func(m headscale.Machine) string
+}
+
+var nodeColumns = []nodeColumn{
+	{"id", "ID", func(m headscale.Machine) string { return strconv.FormatUint(m.ID, 10) }},
+	{"name", "name", func(m headscale.Machine) string { return m.DisplayName() }},
+	{"hostname", "hostname", func(m headscale.Machine) string { return m.Name }},
+	{"namespace", "namespace", func(m headscale.Machine) string {
+		if m.Shared {
+			return m.Namespace.Name + " (shared)"
+		}
+		return m.Namespace.Name
+	}},
+	{"ip", "IP addresses", func(m headscale.Machine) string { return strings.Join(m.IPAddresses(), ",") }},
+	{"ipv4", "IPv4", func(m headscale.Machine) string { return m.IPAddress }},
+	{"ipv6", "IPv6", func(m headscale.Machine) string { return m.IPv6Address }},
+	{"last_seen", "last seen", func(m headscale.Machine) string {
+		if m.LastSeen == nil {
+			return "never"
+		}
+		return m.LastSeen.Format("2006-01-02 15:04:05")
+	}},
+	{"online", "online", func(m headscale.Machine) string { return strconv.FormatBool(m.Online) }},
+	{"ephemeral", "ephemeral", func(m headscale.Machine) string {
+		return strconv.FormatBool(m.AuthKey != nil && m.AuthKey.Ephemeral)
+	}},
+	{"exit_node", "exit node", func(m headscale.Machine) string { return strconv.FormatBool(m.IsExitNode()) }},
+	{"tags", "tags", func(m headscale.Machine) string {
+		tags, _ := m.GetTags()
+		return strings.Join(tags, ",")
+	}},
+	{"pending", "pending", func(m headscale.Machine) string { return strconv.FormatBool(m.Pending) }},
+	{"node_key", "node key", func(m headscale.Machine) string { return m.NodeKeyFingerprint() }},
+	{"machine_key", "machine key", func(m headscale.Machine) string { return m.PublicKeys().MachineKey }},
+}
+
+// defaultNodeColumns are printed when --columns is not given
+var defaultNodeColumns = []string{"id", "name", "hostname", "namespace", "ip", "last_seen", "online", "ephemeral", "exit_node", "tags", "node_key"}
+
+// selectNodeColumns returns the columns in the order of names
+func selectNodeColumns(names []string) ([]nodeColumn, error) {
+	if len(names) == 0 {
+		names = defaultNodeColumns
+	}
+	columns := []nodeColumn{}
+	for _, name := range names {
+		found := false
+		for _, col := range nodeColumns {
+			if col.name == strings.TrimSpace(name) {
+				columns = append(columns, col)
+				found = true
+				break
+			}
+		}
+		if !found {
+			valid := make([]string, len(nodeColumns))
+			for i, col := range nodeColumns {
+				valid[i] = col.name
+			}
+			return nil, fmt.Errorf("unknown column %q, the columns are %s", name, strings.Join(valid, ", "))
+		}
+	}
+	return columns, nil
+}
+
+// nodeKeys are the public keys of a node, printed by nodes show
+type nodeKeys struct {
+	ID        uint64
+	Name      string
+	Namespace string
+	headscale.MachineKeys
+	NodeKeyFingerprint string
+}
+
+var ShowNodeCmd = &cobra.Command{
+	Use:   "show",
+	Short: "Prints the public keys of a node, to check the identity of the device",
+	Run: func(cmd *cobra.Command, args []string) {
+		id, err := cmd.Flags().GetUint64("identifier")
+		if err != nil {
+			log.Fatal().Err(err).Msg("Error getting identifier")
+		}
+		o, _ := cmd.Flags().GetString("output")
+
+		h, err := getAdminClient()
+		if err != nil {
+			log.Fatal().Err(err).Msg("Error initializing")
+		}
+		m, err := h.GetMachineByID(id)
+		var keys *nodeKeys
+		if err == nil {
+			keys = &nodeKeys{
+				ID:                 m.ID,
+				Name:               m.DisplayName(),
+				Namespace:          m.Namespace.Name,
+				MachineKeys:        m.PublicKeys(),
+				NodeKeyFingerprint: m.NodeKeyFingerprint(),
+			}
+		}
+		if o != "" {
+			JsonOutput(keys, err, o)
+			return
+		}
+		if err != nil {
+			exitWithError("Cannot get machine", err)
+		}
+		fmt.Printf("ID:          %d\n", keys.ID)
+		fmt.Printf("name:        %s\n", keys.Name)
+		fmt.Printf("namespace:   %s\n", keys.Namespace)
+		fmt.Printf("machine key: %s\n", keys.MachineKey)
+		fmt.Printf("node key:    %s\n", keys.NodeKey)
+		fmt.Printf("disco key:   %s\n", keys.DiscoKey)
+	},
+}
+
+var MoveNodeCmd = &cobra.Command{
+	Use:   "move",
+	Short: "Moves a node to the namespace given with --namespace",
+	Run: func(cmd *cobra.Command, args []string) {
+		n, err := cmd.Flags().GetString("namespace")
+		if err != nil {
+			log.Fatal().Err(err).Msg("Error getting namespace")
+		}
+		id, err := cmd.Flags().GetUint64("identifier")
+		if err != nil {
+			log.Fatal().Err(err).Msg("Error getting identifier")
+		}
+		o, _ := cmd.Flags().GetString("output")
+
+		h, err := getAdminClient()
+		if err != nil {
+			log.Fatal().Err(err).Msg("Error initializing")
+		}
+		m, err := h.MoveMachineToNamespace(id, n)
+		if o != "" {
+			JsonOutput(m, err, o)
+			return
+		}
+		if err != nil {
+			exitWithError("Cannot move machine", err)
+		}
+		fmt.Printf("Machine moved to namespace %s\n", n)
+	},
+}
+
+var ShareNodeCmd = &cobra.Command{
+	Use:   "share",
+	Short: "Shares a node with the namespace given with --namespace, it keeps its own namespace",
+	Run: func(cmd *cobra.Command, args []string) {
+		n, err := cmd.Flags().GetString("namespace")
+		if err != nil {
+			log.Fatal().Err(err).Msg("Error getting namespace")
+		}
+		id, err := cmd.Flags().GetUint64("identifier")
+		if err != nil {
+			log.Fatal().Err(err).Msg("Error getting identifier")
+		}
+		o, _ := cmd.Flags().GetString("output")
+
+		h, err := getAdminClient()
+		if err != nil {
+			log.Fatal().Err(err).Msg("Error initializing")
+		}
+		m, err := h.ShareMachine(id, n)
+		if o != "" {
+			JsonOutput(m, err, o)
+			return
+		}
+		if err != nil {
+			exitWithError("Cannot share machine", err)
+		}
+		fmt.Printf("Machine shared with namespace %s\n", n)
+	},
+}
+
+var UnshareNodeCmd = &cobra.Command{
+	Use:   "unshare",
+	Short: "Stops sharing a node with the namespace given with --namespace",
+	Run: func(cmd *cobra.Command, args []string) {
+		n, err := cmd.Flags().GetString("namespace")
+		if err != nil {
+			log.Fatal().Err(err).Msg("Error getting namespace")
+		}
+		id, err := cmd.Flags().GetUint64("identifier")
+		if err != nil {
+			log.Fatal().Err(err).Msg("Error getting identifier")
+		}
+		o, _ := cmd.Flags().GetString("output")
+
+		h, err := getAdminClient()
+		if err != nil {
+			log.Fatal().Err(err).Msg("Error initializing")
+		}
+		m, err := h.UnshareMachine(id, n)
+		if o != "" {
+			JsonOutput(m, err, o)
+			return
+		}
+		if err != nil {
+			exitWithError("Cannot unshare machine", err)
+		}
+		fmt.Printf("Machine no longer shared with namespace %s\n", n)
+	},
+}
+
+var RenameNodeCmd = &cobra.Command{
+	Use:   "rename",
+	Short: "Sets the name of a node, used instead of its hostname",
+	Run: func(cmd *cobra.Command, args []string) {
+		id, err := cmd.Flags().GetUint64("identifier")
+		if err != nil {
+			log.Fatal().Err(err).Msg("Error getting identifier")
+		}
+		name, _ := cmd.Flags().GetString("name")
+		o, _ := cmd.Flags().GetString("output")
+
+		h, err := getAdminClient()
+		if err != nil {
+			log.Fatal().Err(err).Msg("Error initializing")
+		}
+		m, err := h.RenameMachine(id, name)
+		if o != "" {
+			JsonOutput(m, err, o)
+			return
+		}
+		if err != nil {
+			exitWithError("Cannot rename machine", err)
+		}
+		fmt.Printf("Machine %s (hostname %s) renamed\n", m.DisplayName(), m.Name)
+	},
+}
+
+var ReauthNodeCmd = &cobra.Command{
+	Use:   "reauth",
+	Short: "Invalidates the key of a node, so it has to be authenticated again, keeping its IP, tags and routes",
+	Run: func(cmd *cobra.Command, args []string) {
+		id, err := cmd.Flags().GetUint64("identifier")
+		if err != nil {
+			log.Fatal().Err(err).Msg("Error getting identifier")
+		}
+		o, _ := cmd.Flags().GetString("output")
+
+		h, err := getAdminClient()
+		if err != nil {
+			log.Fatal().Err(err).Msg("Error initializing")
+		}
+		m, err := h.ReauthMachine(id)
+		if o != "" {
+			JsonOutput(m, err, o)
+			return
+		}
+		if err != nil {
+			exitWithError("Cannot reauth machine", err)
+		}
+		fmt.Printf("Machine %s has to be authenticated again\n", m.DisplayName())
+	},
+}
+
+var RefreshNodeKeyCmd = &cobra.Command{
+	Use:   "refresh-key",
+	Short: "Requires a node to rotate its node key, keeping its record, IP, tags and routes",
+	Run: func(cmd *cobra.Command, args []string) {
+		id, err := cmd.Flags().GetUint64("identifier")
+		if err != nil {
+			log.Fatal().Err(err).Msg("Error getting identifier")
+		}
+		o, _ := cmd.Flags().GetString("output")
+
+		h, err := getAdminClient()
+		if err != nil {
+			log.Fatal().Err(err).Msg("Error initializing")
+		}
+		m, err := h.RefreshMachineKey(id)
+		if o != "" {
+			JsonOutput(m, err, o)
+			return
+		}
+		if err != nil {
+			exitWithError("Cannot refresh the key of the machine", err)
+		}
+		fmt.Printf("Machine %s has to rotate its node key\n", m.DisplayName())
+	},
+}
+
+var ApproveNodeCmd = &cobra.Command{
+	Use:   "approve",
+	Short: "Approves a node waiting for approval, so it joins the network",
+	Run: func(cmd *cobra.Command, args []string) {
+		id, err := cmd.Flags().GetUint64("identifier")
+		if err != nil {
+			log.Fatal().Err(err).Msg("Error getting identifier")
+		}
+		o, _ := cmd.Flags().GetString("output")
+
+		h, err := getAdminClient()
+		if err != nil {
+			log.Fatal().Err(err).Msg("Error initializing")
+		}
+		m, err := h.ApproveMachine(id)
+		if o != "" {
+			JsonOutput(m, err, o)
+			return
+		}
+		if err != nil {
+			exitWithError("Cannot approve machine", err)
+		}
+		fmt.Printf("Machine %s approved in namespace %s\n", m.DisplayName(), m.Namespace.Name)
+	},
+}
+
+var SetNodeIPCmd = &cobra.Command{
+	Use:   "set-ip",
+	Short: "Gives a node a static IP address in ip_prefixes, in place of its address of the same family",
+	Run: func(cmd *cobra.Command, args []string) {
+		id, err := cmd.Flags().GetUint64("identifier")
+		if err != nil {
+			log.Fatal().Err(err).Msg("Error getting identifier")
+		}
+		ip, _ := cmd.Flags().GetString("ip")
+		o, _ := cmd.Flags().GetString("output")
+
+		h, err := getAdminClient()
+		if err != nil {
+			log.Fatal().Err(err).Msg("Error initializing")
+		}
+		m, err := h.SetMachineIP(id, ip)
+		if o != "" {
+			JsonOutput(m, err, o)
+			return
+		}
+		if err != nil {
+			exitWithError("Cannot set the IP address of the machine", err)
+		}
+		fmt.Printf("Machine %s now has the addresses %s\n", m.DisplayName(), strings.Join(m.IPAddresses(), ", "))
+	},
+}
+
+var DeleteNodeCmd = &cobra.Command{
+	Use:   "delete",
+	Short: "Deletes nodes, by ID or by namespace and inactivity",
+	Run: func(cmd *cobra.Command, args []string) {
+		identifiers, err := cmd.Flags().GetUintSlice("identifier")
+		if err != nil {
+			log.Fatal().Err(err).Msg("Error getting identifier")
+		}
+		namespace, _ := cmd.Flags().GetString("namespace")
+		before, _ := cmd.Flags().GetString("before")
+		force, _ := cmd.Flags().GetBool("force")
+		failFast, _ := cmd.Flags().GetBool("fail-fast")
+		o, _ := cmd.Flags().GetString("output")
+
+		if len(identifiers) == 0 && before == "" {
+			log.Fatal().Msg("Set --identifier, or --namespace and --before")
+		}
+		if before != "" && (namespace == "" || len(identifiers) > 0) {
+			log.Fatal().Msg("--before requires --namespace, and cannot be combined with --identifier")
+		}
+
+		h, err := getAdminClient()
+		if err != nil {
+			log.Fatal().Err(err).Msg("Error initializing")
+		}
+
+		targets := []headscale.Machine{}
+		if before != "" {
+			duration, err := durafmt.ParseStringShort(before)
+			if err != nil {
+				log.Fatal().Err(err).Msg("Error parsing duration")
+			}
+			machines, err := h.ListMachinesInNamespace(namespace)
+			if err != nil {
+				log.Fatal().Err(err).Msg("Error getting nodes")
+			}
+			cutoff := time.Now().UTC().Add(-duration.Duration())
+			for _, m := range *machines {
+				// Machines that were never seen count from their creation
+				lastSeen := m.CreatedAt
+				if m.LastSeen != nil {
+					lastSeen = *m.LastSeen
+				}
+				if lastSeen.Before(cutoff) {
+					targets = append(targets, m)
+				}
+			}
+		} else {
+			for _, id := range identifiers {
+				targets = append(targets, headscale.Machine{ID: uint64(id)})
+			}
+		}
+
+		// Deleting more than one machine at once must be confirmed
+		bulk := before != "" || len(identifiers) > 1
+		if bulk && !force {
+			if o != "" {
+				JsonOutput(nil, fmt.Errorf("%d node(s) match, add --force to delete them", len(targets)), o)
+				return
+			}
+			printNodesToDelete(targets)
+			fmt.Printf("Add --force to delete them\n")
+			return
+		}
+		if o == "" && bulk {
+			printNodesToDelete(targets)
+		}
+
+		// DeleteMachine updates the peers of each deleted machine
+		result := h.DeleteMachines(machineIDs(targets), failFast)
+		bulkOutput(result, "delete", "deleted", o)
+	},
+}
+
+func printNodesToDelete(machines []headscale.Machine) {
+	fmt.Printf("%d node(s) to delete:\n", len(machines))
+	for _, m := range machines {
+		if m.Name == "" {
+			fmt.Printf("%d\n", m.ID)
+			continue
+		}
+		lastSeen := "never"
+		if m.LastSeen != nil {
+			lastSeen = m.LastSeen.Format("2006-01-02 15:04:05")
+		}
+		fmt.Printf("%d\t%s\tlast seen %s\n", m.ID, m.Name, lastSeen)
+	}
+}
+
+// bulkOutput prints the result of an operation on several machines, and
+// exits with a non-zero status if it failed on some of them
+func bulkOutput(result *headscale.BulkResult, verb string, done string, o string) {
+	if o != "" {
+		JsonOutput(result, nil, o)
+	} else {
+		fmt.Printf("%d node(s) %s\n", len(result.Succeeded), done)
+		for _, f := range result.Failed {
+			fmt.Printf("Cannot %s machine %d: %s\n", verb, f.ID, f.Error)
+		}
+		if len(result.Skipped) > 0 {
+			fmt.Printf("%d node(s) not attempted after the failure (--fail-fast)\n", len(result.Skipped))
+		}
+		if ids := result.FailedIDs(); len(ids) > 0 {
+			retry := []string{}
+			for _, id := range ids {
+				retry = append(retry, strconv.FormatUint(id, 10))
+			}
+			fmt.Printf("Retry them with --identifier %s\n", strings.Join(retry, ","))
+		}
+	}
+	if len(result.Failed) > 0 {
+		os.Exit(1)
+	}
+}
+
+func machineIDs(machines []headscale.Machine) []uint64 {
+	ids := []uint64{}
+	for _, m := range machines {
+		ids = append(ids, m.ID)
+	}
+	return ids
+}
+
+var ExpireNodeCmd = &cobra.Command{
+	Use:   "expire",
+	Short: "Expires the key of a node, so it has to be authenticated again",
+	Run: func(cmd *cobra.Command, args []string) {
+		id, err := cmd.Flags().GetUint64("identifier")
+		if err != nil {
+			log.Fatal().Err(err).Msg("Error getting identifier")
+		}
+		o, _ := cmd.Flags().GetString("output")
+
+		h, err := getAdminClient()
+		if err != nil {
+			log.Fatal().Err(err).Msg("Error initializing")
+		}
+		m, err := h.ExpireMachine(id)
+		if o != "" {
+			JsonOutput(m, err, o)
+			return
+		}
+		if err != nil {
+			exitWithError("Cannot expire machine", err)
+		}
+		fmt.Printf("Machine expired\n")
+	},
+}
+
+var ExpireNamespaceNodesCmd = &cobra.Command{
+	Use:   "expire-all",
+	Short: "Expires the keys of all the nodes of a namespace, e.g. to offboard its owner",
+	Run: func(cmd *cobra.Command, args []string) {
+		namespace, err := cmd.Flags().GetString("namespace")
+		if err != nil {
+			log.Fatal().Err(err).Msg("Error getting namespace")
+		}
+		force, _ := cmd.Flags().GetBool("force")
+		o, _ := cmd.Flags().GetString("output")
+
+		h, err := getAdminClient()
+		if err != nil {
+			log.Fatal().Err(err).Msg("Error initializing")
+		}
+
+		if !force {
+			machines, err := h.ListMachinesInNamespace(namespace)
+			if err != nil {
+				log.Fatal().Err(err).Msg("Error getting nodes")
+			}
+			if o != "" {
+				JsonOutput(machineIDs(*machines), fmt.Errorf("%d node(s) in namespace %s, add --force to expire them", len(*machines), namespace), o)
+				return
 			}
-			var lastSeen time.Time
-			if m.LastSeen != nil {
-				lastSeen = *m.LastSeen
+			fmt.Printf("%d node(s) in namespace %s:\n", len(*machines), namespace)
+			for _, m := range *machines {
+				fmt.Printf("%d\t%s\n", m.ID, m.Name)
 			}
-			fmt.Printf("%s\t%s\t%t\n", m.Name, lastSeen.Format("2006-01-02 15:04:05"), ephemeral)
+			fmt.Printf("Add --force to expire them\n")
+			return
+		}
+
+		machines, err := h.ExpireNamespaceMachines(namespace)
+		if o != "" {
+			JsonOutput(machines, err, o)
+			return
+		}
+		if err != nil {
+			exitWithError("Cannot expire the machines", err)
+		}
+		fmt.Printf("%d node(s) expired\n", len(*machines))
+	},
+}
+
+var SetNodeExpiryCmd = &cobra.Command{
+	Use:   "set-expiry",
+	Short: "Sets when the key of a node expires, counting from now",
+	Run: func(cmd *cobra.Command, args []string) {
+		id, err := cmd.Flags().GetUint64("identifier")
+		if err != nil {
+			log.Fatal().Err(err).Msg("Error getting identifier")
+		}
+		d, _ := cmd.Flags().GetString("duration")
+		duration, err := durafmt.ParseStringShort(d)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Error parsing duration")
 		}
+		o, _ := cmd.Flags().GetString("output")
 
+		h, err := getAdminClient()
+		if err != nil {
+			log.Fatal().Err(err).Msg("Error initializing")
+		}
+		m, err := h.SetMachineExpiry(id, time.Now().UTC().Add(duration.Duration()))
+		if o != "" {
+			JsonOutput(m, err, o)
+			return
+		}
+		if err != nil {
+			exitWithError("Cannot set machine expiry", err)
+		}
+		fmt.Printf("Machine expires at %s\n", m.Expiry.Format("2006-01-02 15:04:05"))
+	},
+}
+
+var TagNodeCmd = &cobra.Command{
+	Use:     "tag",
+	Aliases: []string{"set-tags"},
+	Short:   "Adds or removes ACL tags of nodes, or clears them with --clear",
+	Run: func(cmd *cobra.Command, args []string) {
+		identifiers, err := cmd.Flags().GetUintSlice("identifier")
+		if err != nil {
+			log.Fatal().Err(err).Msg("Error getting identifier")
+		}
+		add, _ := cmd.Flags().GetStringSlice("add")
+		remove, _ := cmd.Flags().GetStringSlice("remove")
+		clearTags, _ := cmd.Flags().GetBool("clear")
+		failFast, _ := cmd.Flags().GetBool("fail-fast")
+		o, _ := cmd.Flags().GetString("output")
+
+		h, err := getAdminClient()
+		if err != nil {
+			log.Fatal().Err(err).Msg("Error initializing")
+		}
+		var m *headscale.Machine
+		tag := func(id uint64) error {
+			var err error
+			if clearTags {
+				// --add then sets the tags of the node from scratch
+				m, err = h.ClearMachineTags(id)
+			}
+			if err == nil && (!clearTags || len(add) > 0) {
+				m, err = h.TagMachine(id, add, remove)
+			}
+			return err
+		}
+
+		if len(identifiers) > 1 {
+			ids := []uint64{}
+			for _, id := range identifiers {
+				ids = append(ids, uint64(id))
+			}
+			var result *headscale.BulkResult
+			if clearTags {
+				result = headscale.RunBulk(ids, failFast, tag)
+			} else {
+				result = h.TagMachines(ids, add, remove, failFast)
+			}
+			bulkOutput(result, "tag", "tagged", o)
+			return
+		}
+
+		err = tag(uint64(identifiers[0]))
+		if o != "" {
+			JsonOutput(m, err, o)
+			return
+		}
+		if err != nil {
+			exitWithError("Cannot tag machine", err)
+		}
+		tags, _ := m.GetTags()
+		fmt.Printf("Machine tags: %s\n", strings.Join(tags, ", "))
+	},
+}
+
+var AuditIPsCmd = &cobra.Command{
+	Use:     "audit-ips",
+	Aliases: []string{"backfill-ips"},
+	Short:   "Reports the machines with a missing, duplicate or out of range IP address",
+	Run: func(cmd *cobra.Command, args []string) {
+		fix, _ := cmd.Flags().GetBool("fix")
+		o, _ := cmd.Flags().GetString("output")
+
+		h, err := getAdminClient()
+		if err != nil {
+			log.Fatal().Err(err).Msg("Error initializing")
+		}
+		conflicts, err := h.AuditIPs(fix)
+		if o != "" {
+			JsonOutput(conflicts, err, o)
+			return
+		}
+		if err != nil && len(conflicts) == 0 {
+			exitWithError("Cannot audit the IP addresses", err)
+		}
+
+		if len(conflicts) == 0 {
+			fmt.Printf("No conflict found\n")
+			return
+		}
+		fmt.Printf("ID\tname\t\tIP address\tproblem\t\tnew IP address\n")
+		for _, c := range conflicts {
+			fmt.Printf("%d\t%s\t%s\t%s\t%s\n", c.MachineID, c.Machine, c.IPAddress, c.Problem, c.NewIPAddress)
+		}
+		// The conflicts found before the failure are listed first
+		if err != nil {
+			exitWithError("Cannot audit the IP addresses", err)
+		}
+		if !fix {
+			fmt.Printf("Add --fix to assign new addresses to these machines\n")
+		}
 	},
 }
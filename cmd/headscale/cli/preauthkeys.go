@@ -2,11 +2,11 @@ package cli
 
 import (
 	"fmt"
-	"log"
 	"strings"
 	"time"
 
 	"github.com/hako/durafmt"
+	"github.com/rs/zerolog/log"
 	"github.com/spf13/cobra"
 )
 
@@ -21,28 +21,33 @@ var ListPreAuthKeys = &cobra.Command{
 	Run: func(cmd *cobra.Command, args []string) {
 		n, err := cmd.Flags().GetString("namespace")
 		if err != nil {
-			log.Fatalf("Error getting namespace: %s", err)
+			log.Fatal().Err(err).Msg("Error getting namespace")
 		}
 		o, _ := cmd.Flags().GetString("output")
 
-		h, err := getHeadscaleApp()
+		h, err := getAdminClient()
 		if err != nil {
-			log.Fatalf("Error initializing: %s", err)
+			log.Fatal().Err(err).Msg("Error initializing")
 		}
 		keys, err := h.GetPreAuthKeys(n)
-		if strings.HasPrefix(o, "json") {
+		if o != "" {
 			JsonOutput(keys, err, o)
 			return
 		}
 
 		if err != nil {
-			fmt.Printf("Error getting the list of keys: %s\n", err)
-			return
+			exitWithError("Error getting the list of keys", err)
 		}
 		for _, k := range *keys {
 			expiration := "-"
+			remaining := "-"
 			if k.Expiration != nil {
 				expiration = k.Expiration.Format("2006-01-02 15:04:05")
+				if k.Expiration.After(time.Now()) {
+					remaining = durafmt.Parse(time.Until(*k.Expiration)).LimitFirstN(2).String()
+				} else {
+					remaining = "expired"
+				}
 			}
 
 			var reusable string
@@ -52,14 +57,21 @@ var ListPreAuthKeys = &cobra.Command{
 				reusable = fmt.Sprintf("%v", k.Reusable)
 			}
 
+			tags := "-"
+			if t, _ := k.GetACLTags(); len(t) > 0 {
+				tags = strings.Join(t, ",")
+			}
+
 			fmt.Printf(
-				"key: %s, namespace: %s, reusable: %s, ephemeral: %v, expiration: %s, created_at: %s\n",
+				"key: %s, namespace: %s, reusable: %s, ephemeral: %v, expiration: %s, remaining: %s, created_at: %s, tags: %s\n",
 				k.Key,
 				k.Namespace.Name,
 				reusable,
 				k.Ephemeral,
 				expiration,
+				remaining,
 				k.CreatedAt.Format("2006-01-02 15:04:05"),
+				tags,
 			)
 		}
 	},
@@ -71,13 +83,13 @@ var CreatePreAuthKeyCmd = &cobra.Command{
 	Run: func(cmd *cobra.Command, args []string) {
 		n, err := cmd.Flags().GetString("namespace")
 		if err != nil {
-			log.Fatalf("Error getting namespace: %s", err)
+			log.Fatal().Err(err).Msg("Error getting namespace")
 		}
 		o, _ := cmd.Flags().GetString("output")
 
-		h, err := getHeadscaleApp()
+		h, err := getAdminClient()
 		if err != nil {
-			log.Fatalf("Error initializing: %s", err)
+			log.Fatal().Err(err).Msg("Error initializing")
 		}
 		reusable, _ := cmd.Flags().GetBool("reusable")
 		ephemeral, _ := cmd.Flags().GetBool("ephemeral")
@@ -87,21 +99,105 @@ var CreatePreAuthKeyCmd = &cobra.Command{
 		if e != "" {
 			duration, err := durafmt.ParseStringShort(e)
 			if err != nil {
-				log.Fatalf("Error parsing expiration: %s", err)
+				log.Fatal().Err(err).Msg("Error parsing expiration")
 			}
 			exp := time.Now().UTC().Add(duration.Duration())
 			expiration = &exp
 		}
 
-		k, err := h.CreatePreAuthKey(n, reusable, ephemeral, expiration)
-		if strings.HasPrefix(o, "json") {
+		tags, _ := cmd.Flags().GetStringSlice("tags")
+		k, err := h.CreatePreAuthKey(n, reusable, ephemeral, expiration, tags)
+		if o != "" {
 			JsonOutput(k, err, o)
 			return
 		}
 		if err != nil {
-			fmt.Println(err)
-			return
+			exitWithError("", err)
 		}
 		fmt.Printf("Key: %s\n", k.Key)
 	},
 }
+
+var ExpirePreAuthKeyCmd = &cobra.Command{
+	Use:   "expire --key KEY",
+	Short: "Expires a preauthkey, so it can no longer be used",
+	Long: `Expires a preauthkey right away, so it can no longer be used to register
+machines. The machines already registered with it are kept.`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		k, _ := cmd.Flags().GetString("key")
+		if len(args) > 1 || (k == "" && len(args) == 0) || (k != "" && len(args) == 1) {
+			return fmt.Errorf("Set the preauthkey with --key")
+		}
+		return nil
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		n, err := cmd.Flags().GetString("namespace")
+		if err != nil {
+			log.Fatal().Err(err).Msg("Error getting namespace")
+		}
+		o, _ := cmd.Flags().GetString("output")
+
+		h, err := getAdminClient()
+		if err != nil {
+			log.Fatal().Err(err).Msg("Error initializing")
+		}
+		// The key used to be given as an argument
+		key, _ := cmd.Flags().GetString("key")
+		if key == "" {
+			key = args[0]
+		}
+		k, err := h.ExpirePreAuthKey(n, key)
+		if o != "" {
+			JsonOutput(k, err, o)
+			return
+		}
+		if err != nil {
+			exitWithError("", err)
+		}
+		fmt.Printf("Key expired at %s\n", k.Expiration.Format("2006-01-02 15:04:05"))
+	},
+}
+
+var PreAuthKeyMachinesCmd = &cobra.Command{
+	Use:   "machines --key KEY",
+	Short: "Lists the machines registered with a preauthkey",
+	Run: func(cmd *cobra.Command, args []string) {
+		n, err := cmd.Flags().GetString("namespace")
+		if err != nil {
+			log.Fatal().Err(err).Msg("Error getting namespace")
+		}
+		key, _ := cmd.Flags().GetString("key")
+		o, _ := cmd.Flags().GetString("output")
+
+		h, err := getAdminClient()
+		if err != nil {
+			log.Fatal().Err(err).Msg("Error initializing")
+		}
+		machines, err := h.GetPreAuthKeyMachines(n, key)
+		if o != "" {
+			JsonOutput(machines, err, o)
+			return
+		}
+		if err != nil {
+			exitWithError("Error getting the machines of the key", err)
+		}
+
+		if len(*machines) == 0 {
+			fmt.Printf("No machine registered with this key\n")
+			return
+		}
+		fmt.Printf("ID\tname\t\tIP addresses\tregistered at\t\tcreated at\t\tlast seen\n")
+		for _, m := range *machines {
+			registeredAt := "unknown\t\t"
+			if m.RegisteredAt != nil {
+				registeredAt = m.RegisteredAt.Format("2006-01-02 15:04:05")
+			}
+			lastSeen := "never"
+			if m.LastSeen != nil {
+				lastSeen = m.LastSeen.Format("2006-01-02 15:04:05")
+			}
+			fmt.Printf("%d\t%s\t%s\t%s\t%s\t%s\n", m.ID, m.DisplayName(), strings.Join(m.IPAddresses(), ","), registeredAt,
+				m.CreatedAt.Format("2006-01-02 15:04:05"), lastSeen)
+		}
+	},
+}
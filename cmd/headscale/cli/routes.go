@@ -2,9 +2,8 @@ package cli
 
 import (
 	"fmt"
-	"log"
-	"strings"
 
+	"github.com/rs/zerolog/log"
 	"github.com/spf13/cobra"
 )
 
@@ -14,71 +13,124 @@ var RoutesCmd = &cobra.Command{
 }
 
 var ListRoutesCmd = &cobra.Command{
-	Use:   "list NODE",
-	Short: "List the routes exposed by this node",
-	Args: func(cmd *cobra.Command, args []string) error {
-		if len(args) < 1 {
-			return fmt.Errorf("Missing parameters")
-		}
-		return nil
-	},
+	Use:   "list",
+	Short: "List the routes advertised by a node, and whether they are enabled",
 	Run: func(cmd *cobra.Command, args []string) {
-		n, err := cmd.Flags().GetString("namespace")
+		id, err := cmd.Flags().GetUint64("identifier")
 		if err != nil {
-			log.Fatalf("Error getting namespace: %s", err)
+			log.Fatal().Err(err).Msg("Error getting identifier")
 		}
 		o, _ := cmd.Flags().GetString("output")
 
-		h, err := getHeadscaleApp()
+		h, err := getAdminClient()
 		if err != nil {
-			log.Fatalf("Error initializing: %s", err)
+			log.Fatal().Err(err).Msg("Error initializing")
 		}
-		routes, err := h.GetNodeRoutes(n, args[0])
+		routes, err := h.GetMachineRoutes(id)
 
-		if strings.HasPrefix(o, "json") {
+		if o != "" {
 			JsonOutput(routes, err, o)
 			return
 		}
 
 		if err != nil {
-			fmt.Println(err)
-			return
+			exitWithError("", err)
 		}
 
-		fmt.Println(routes)
+		fmt.Printf("Route\t\tAdvertised\tEnabled\tExit route\n")
+		for _, r := range *routes {
+			fmt.Printf("%s\t%t\t\t%t\t%t\n", r.Prefix, r.Advertised, r.Enabled, r.ExitRoute)
+		}
 	},
 }
 
 var EnableRouteCmd = &cobra.Command{
-	Use:   "enable node-name route",
-	Short: "Allows exposing a route declared by this node to the rest of the nodes",
-	Args: func(cmd *cobra.Command, args []string) error {
-		if len(args) < 2 {
-			return fmt.Errorf("Missing parameters")
+	Use:   "enable",
+	Short: "Allows exposing a route advertised by a node to the rest of the nodes",
+	Run: func(cmd *cobra.Command, args []string) {
+		id, err := cmd.Flags().GetUint64("identifier")
+		if err != nil {
+			log.Fatal().Err(err).Msg("Error getting identifier")
 		}
-		return nil
+		r, err := cmd.Flags().GetString("route")
+		if err != nil {
+			log.Fatal().Err(err).Msg("Error getting route")
+		}
+		o, _ := cmd.Flags().GetString("output")
+
+		h, err := getAdminClient()
+		if err != nil {
+			log.Fatal().Err(err).Msg("Error initializing")
+		}
+		route, err := h.EnableMachineRoute(id, r)
+		if o != "" {
+			JsonOutput(route, err, o)
+			return
+		}
+
+		if err != nil {
+			exitWithError("", err)
+		}
+		fmt.Printf("Enabled route %s\n", route)
 	},
+}
+
+var ApproveAllRoutesCmd = &cobra.Command{
+	Use:   "approve-all",
+	Short: "Enables all the subnet routes advertised by a node",
 	Run: func(cmd *cobra.Command, args []string) {
-		n, err := cmd.Flags().GetString("namespace")
+		id, err := cmd.Flags().GetUint64("identifier")
 		if err != nil {
-			log.Fatalf("Error getting namespace: %s", err)
+			log.Fatal().Err(err).Msg("Error getting identifier")
 		}
 		o, _ := cmd.Flags().GetString("output")
 
-		h, err := getHeadscaleApp()
+		h, err := getAdminClient()
 		if err != nil {
-			log.Fatalf("Error initializing: %s", err)
+			log.Fatal().Err(err).Msg("Error initializing")
 		}
-		route, err := h.EnableNodeRoute(n, args[0], args[1])
-		if strings.HasPrefix(o, "json") {
-			JsonOutput(route, err, o)
+		routes, err := h.EnableAllMachineRoutes(id)
+		if o != "" {
+			JsonOutput(routes, err, o)
 			return
 		}
 
 		if err != nil {
-			fmt.Println(err)
+			exitWithError("", err)
+		}
+		if len(routes) == 0 {
+			fmt.Println("The node does not advertise any subnet route")
 			return
 		}
-		fmt.Printf("Enabled route %s\n", route)
+		for _, r := range routes {
+			fmt.Printf("Enabled route %s\n", r)
+		}
+	},
+}
+
+var EnableExitNodeCmd = &cobra.Command{
+	Use:   "enable-exit-node",
+	Short: "Approves a node advertising itself as an exit node",
+	Run: func(cmd *cobra.Command, args []string) {
+		id, err := cmd.Flags().GetUint64("identifier")
+		if err != nil {
+			log.Fatal().Err(err).Msg("Error getting identifier")
+		}
+		o, _ := cmd.Flags().GetString("output")
+
+		h, err := getAdminClient()
+		if err != nil {
+			log.Fatal().Err(err).Msg("Error initializing")
+		}
+		m, err := h.EnableMachineExitNode(id)
+		if o != "" {
+			JsonOutput(m, err, o)
+			return
+		}
+
+		if err != nil {
+			exitWithError("", err)
+		}
+		fmt.Printf("Machine %s approved as exit node\n", m.Name)
 	},
 }
@@ -1,9 +1,14 @@
 package cli
 
 import (
-	"log"
+	"os"
+	"os/signal"
+	"syscall"
 
+	"github.com/juanfont/headscale"
+	"github.com/rs/zerolog/log"
 	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
 )
 
 var ServeCmd = &cobra.Command{
@@ -13,14 +18,43 @@ var ServeCmd = &cobra.Command{
 		return nil
 	},
 	Run: func(cmd *cobra.Command, args []string) {
+		setACLPolicyLenient(cmd)
 		h, err := getHeadscaleApp()
 		if err != nil {
-			log.Fatalf("Error initializing: %s", err)
+			log.Fatal().Err(err).Msg("Error initializing")
 		}
 		go h.ExpireEphemeralNodes(5000)
+		go h.UpdateDERPMapPeriodically()
+		go h.ExpireMachines(5000)
+		go h.NotifyMachineEvents()
+		go h.GarbageCollectPeriodically()
+		if viper.GetString("acl_policy_path") != "" {
+			go h.ReloadACLPolicyOnSIGHUP(absPath(viper.GetString("acl_policy_path")))
+		}
+		go reloadMaintenanceModeOnSIGHUP(h)
 		err = h.Serve()
 		if err != nil {
-			log.Fatalf("Error initializing: %s", err)
+			log.Fatal().Err(err).Msg("Error initializing")
 		}
 	},
 }
+
+// reloadMaintenanceModeOnSIGHUP reads maintenance_mode again from the
+// configuration file every time the process receives a SIGHUP
+func reloadMaintenanceModeOnSIGHUP(h *headscale.Headscale) {
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGHUP)
+	for range sigc {
+		if err := viper.ReadInConfig(); err != nil {
+			log.Error().
+				Err(err).
+				Msg("Could not read the configuration again, the maintenance mode is unchanged")
+			continue
+		}
+		enabled := viper.GetBool("maintenance_mode")
+		h.SetMaintenanceModeConfig(enabled)
+		log.Info().
+			Bool("maintenance_mode", enabled).
+			Msg("Maintenance mode reloaded")
+	}
+}
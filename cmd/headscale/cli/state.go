@@ -0,0 +1,74 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/juanfont/headscale"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+)
+
+var StateCmd = &cobra.Command{
+	Use:   "state",
+	Short: "Export and import the content of the database, to back it up or move it to another engine",
+}
+
+var ExportStateCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Writes the namespaces, nodes, routes and preauthkeys to a JSON file",
+	Run: func(cmd *cobra.Command, args []string) {
+		path, _ := cmd.Flags().GetString("file")
+		h, err := getHeadscaleApp()
+		if err != nil {
+			log.Fatal().Err(err).Msg("Error initializing")
+		}
+
+		state, err := h.ExportState()
+		if err != nil {
+			exitWithError("Error exporting the state", err)
+		}
+		j, err := json.MarshalIndent(state, "", "\t")
+		if err != nil {
+			log.Fatal().Err(err).Msg("Cannot marshal the state")
+		}
+		// The state holds the preauthkeys and the keys of the nodes
+		err = os.WriteFile(path, append(j, '\n'), 0o600)
+		if err != nil {
+			exitWithError("Error writing the state", err)
+		}
+		fmt.Printf("Exported %d namespaces, %d nodes and %d preauthkeys to %s\n",
+			len(state.Namespaces), len(state.Machines), len(state.PreAuthKeys), path)
+	},
+}
+
+var ImportStateCmd = &cobra.Command{
+	Use:   "import",
+	Short: "Loads a state written by state export into the database",
+	Run: func(cmd *cobra.Command, args []string) {
+		path, _ := cmd.Flags().GetString("input")
+		force, _ := cmd.Flags().GetBool("force")
+
+		content, err := os.ReadFile(path)
+		if err != nil {
+			exitWithError("Error reading the state", err)
+		}
+		state := headscale.State{}
+		err = json.Unmarshal(content, &state)
+		if err != nil {
+			exitWithError("Error parsing the state", err)
+		}
+
+		h, err := getHeadscaleApp()
+		if err != nil {
+			log.Fatal().Err(err).Msg("Error initializing")
+		}
+		err = h.ImportState(&state, force)
+		if err != nil {
+			exitWithError("Error importing the state", err)
+		}
+		fmt.Printf("Imported %d namespaces, %d nodes and %d preauthkeys\n",
+			len(state.Namespaces), len(state.Machines), len(state.PreAuthKeys))
+	},
+}
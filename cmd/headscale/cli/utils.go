@@ -1,20 +1,22 @@
 package cli
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
-	"log"
+	"net"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
 	"time"
 
 	"github.com/juanfont/headscale"
+	"github.com/rs/zerolog/log"
 	"github.com/spf13/viper"
 	"gopkg.in/yaml.v2"
-	"tailscale.com/tailcfg"
+	"inet.af/netaddr"
 )
 
 type ErrorOutput struct {
@@ -35,6 +37,38 @@ func LoadConfig(path string) error {
 
 	viper.SetDefault("tls_letsencrypt_cache_dir", "/var/www/.cache")
 	viper.SetDefault("tls_letsencrypt_challenge_type", "HTTP-01")
+	viper.SetDefault("tls_letsencrypt_ca", "https://acme-v02.api.letsencrypt.org/directory")
+	viper.SetDefault("tls_min_version", "1.2")
+	viper.SetDefault("node_keepalive_interval", "60s")
+	viper.SetDefault("derp_map_fetch_timeout", "10s")
+	viper.SetDefault("derp_update_frequency", "24h")
+	viper.SetDefault("derp_server_region_id", 999)
+	viper.SetDefault("derp_server_region_code", "headscale")
+	viper.SetDefault("derp_server_region_name", "Headscale Embedded DERP")
+	viper.SetDefault("derp_server_stun_listen_addr", "0.0.0.0:3478")
+	viper.SetDefault("log_level", "info")
+	viper.SetDefault("log_format", "text")
+	viper.SetDefault("oidc_namespace_claim", "email")
+	viper.SetDefault("magic_dns_enabled", false)
+	viper.SetDefault("dns_use_namespace_search_domains", true)
+	viper.SetDefault("db_auto_migrate", true)
+	viper.SetDefault("db_ssl_mode", "disable")
+	viper.SetDefault("db_max_open_conns", 10)
+	viper.SetDefault("db_max_idle_conns", 5)
+	viper.SetDefault("db_conn_max_lifetime", "1h")
+	viper.SetDefault("db_connect_timeout", "30s")
+	viper.SetDefault("shutdown_timeout", "30s")
+	viper.SetDefault("gc_interval", "0")
+	viper.SetDefault("gc_machine_inactivity", "2160h")
+	viper.SetDefault("http_read_timeout", "10s")
+	viper.SetDefault("http_write_timeout", "30s")
+	viper.SetDefault("http_idle_timeout", "120s")
+	viper.SetDefault("max_request_body_bytes", 1<<20)
+	viper.SetDefault("registration_rate_limit", 5)
+	viper.SetDefault("registration_rate_burst", 30)
+	viper.SetDefault("ip_prefixes", []string{"100.64.0.0/10"})
+	viper.SetDefault("assign_ipv4", true)
+	viper.SetDefault("assign_ipv6", true)
 
 	err := viper.ReadInConfig()
 	if err != nil {
@@ -43,6 +77,15 @@ func LoadConfig(path string) error {
 
 	// Collect any validation errors and return them all at once
 	var errorText string
+
+	for _, missing := range expandConfigEnv() {
+		errorText += fmt.Sprintf("Fatal config error: environment variable %s is referenced in the config but not set\n", missing)
+	}
+
+	for _, err := range readSecretFiles() {
+		errorText += fmt.Sprintf("Fatal config error: %s\n", err)
+	}
+
 	if (viper.GetString("tls_letsencrypt_hostname") != "") && ((viper.GetString("tls_cert_path") != "") || (viper.GetString("tls_key_path") != "")) {
 		errorText += "Fatal config error: set either tls_letsencrypt_hostname or tls_cert_path/tls_key_path, not both\n"
 	}
@@ -51,13 +94,187 @@ func LoadConfig(path string) error {
 		errorText += "Fatal config error: when using tls_letsencrypt_hostname with TLS-ALPN-01 as challenge type, listen_addr must end in :443\n"
 	}
 
-	if (viper.GetString("tls_letsencrypt_challenge_type") != "HTTP-01") && (viper.GetString("tls_letsencrypt_challenge_type") != "TLS-ALPN-01") {
-		errorText += "Fatal config error: the only supported values for tls_letsencrypt_challenge_type are HTTP-01 and TLS-ALPN-01\n"
+	if _, err := tlsMinVersion(); err != nil {
+		errorText += fmt.Sprintf("Fatal config error: %s\n", err)
+	}
+	if _, err := tlsCipherSuites(); err != nil {
+		errorText += fmt.Sprintf("Fatal config error: %s\n", err)
+	}
+
+	if (viper.GetString("tls_letsencrypt_challenge_type") != "HTTP-01") && (viper.GetString("tls_letsencrypt_challenge_type") != "TLS-ALPN-01") && (viper.GetString("tls_letsencrypt_challenge_type") != "DNS-01") {
+		errorText += "Fatal config error: the only supported values for tls_letsencrypt_challenge_type are HTTP-01, TLS-ALPN-01 and DNS-01\n"
+	}
+
+	if u, err := url.Parse(viper.GetString("tls_letsencrypt_ca")); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		errorText += fmt.Sprintf("Fatal config error: tls_letsencrypt_ca (%s) must be the http(s) URL of an ACME directory\n", viper.GetString("tls_letsencrypt_ca"))
+	}
+
+	if (viper.GetString("tls_letsencrypt_hostname") != "") && (viper.GetString("tls_letsencrypt_challenge_type") == "DNS-01") {
+		switch viper.GetString("tls_letsencrypt_dns_provider") {
+		case "cloudflare":
+			if viper.GetString("tls_letsencrypt_cloudflare_api_token") == "" {
+				errorText += "Fatal config error: tls_letsencrypt_cloudflare_api_token must be set when tls_letsencrypt_dns_provider is cloudflare\n"
+			}
+		case "route53":
+		default:
+			errorText += "Fatal config error: with DNS-01 as challenge type, tls_letsencrypt_dns_provider must be cloudflare or route53\n"
+		}
 	}
 
 	if !strings.HasPrefix(viper.GetString("server_url"), "http://") && !strings.HasPrefix(viper.GetString("server_url"), "https://") {
 		errorText += "Fatal config error: server_url must start with https:// or http://\n"
+	} else if u, err := url.Parse(viper.GetString("server_url")); err != nil {
+		errorText += fmt.Sprintf("Fatal config error: server_url is not a valid URL: %s\n", err)
+	} else if u.Host == "" || u.RawQuery != "" || u.Fragment != "" || u.User != nil {
+		errorText += "Fatal config error: server_url must only have a scheme, a host and an optional path\n"
+	} else if strings.ContainsAny(u.Path, ":*") || strings.Contains(u.Path, "//") {
+		// Every route is served under the path, gin would read these as parameters
+		errorText += fmt.Sprintf("Fatal config error: the path of server_url (%s) must not contain ':', '*' or empty segments\n", u.Path)
+	}
+
+	if w := viper.GetString("webhook_url"); w != "" && !strings.HasPrefix(w, "http://") && !strings.HasPrefix(w, "https://") {
+		errorText += "Fatal config error: webhook_url must start with https:// or http://\n"
+	}
+
+	// The keepalives are sent on every long poll, and the poll timeout must
+	// leave room for them
+	if viper.GetDuration("node_keepalive_interval") < 5*time.Second {
+		errorText += fmt.Sprintf("Fatal config error: node_keepalive_interval (%s) is set too low, must be at least 5s\n", viper.GetString("node_keepalive_interval"))
+	}
+	if pollTimeout() <= viper.GetDuration("node_keepalive_interval") {
+		errorText += fmt.Sprintf("Fatal config error: node_poll_timeout (%s) must be more than node_keepalive_interval (%s)\n", pollTimeout(), viper.GetDuration("node_keepalive_interval"))
+	}
+
+	// The ephemeral nodes must not be deleted while they are still polling
+	minInactivityTimeout := pollTimeout()
+	if viper.GetDuration("ephemeral_node_inactivity_timeout") <= minInactivityTimeout {
+		errorText += fmt.Sprintf("Fatal config error: ephemeral_node_inactivity_timeout (%s) is set too low, must be more than %s\n", viper.GetString("ephemeral_node_inactivity_timeout"), minInactivityTimeout)
+	}
+
+	if viper.GetString("oidc_issuer") != "" && (viper.GetString("oidc_client_id") == "" || viper.GetString("oidc_client_secret") == "") {
+		errorText += "Fatal config error: oidc_client_id and oidc_client_secret must be set when oidc_issuer is set\n"
+	}
+
+	if dbURL := viper.GetString("db_url"); dbURL != "" {
+		if viper.GetString("db_type") != "postgres" {
+			errorText += "Fatal config error: db_url can only be used with db_type postgres\n"
+		}
+		if u, err := url.Parse(dbURL); err != nil {
+			errorText += "Fatal config error: db_url is not a valid URL\n"
+		} else if u.Scheme != "postgres" && u.Scheme != "postgresql" {
+			errorText += "Fatal config error: db_url must start with postgres:// or postgresql://\n"
+		}
+		// The connection string holds all of them, they would be ignored
+		for _, key := range []string{"db_host", "db_port", "db_name", "db_user", "db_pass", "db_ssl_root_cert", "db_ssl_cert", "db_ssl_key"} {
+			if viper.GetString(key) != "" {
+				errorText += fmt.Sprintf("Fatal config error: set either db_url or %s, not both\n", key)
+			}
+		}
+		if viper.GetString("db_ssl_mode") != "disable" {
+			errorText += "Fatal config error: set sslmode in db_url rather than db_ssl_mode\n"
+		}
+	}
+
+	switch viper.GetString("db_ssl_mode") {
+	case "disable", "require":
+	case "verify-ca", "verify-full":
+		if viper.GetString("db_ssl_root_cert") == "" {
+			errorText += fmt.Sprintf("Fatal config error: db_ssl_root_cert must be set when db_ssl_mode is %s\n", viper.GetString("db_ssl_mode"))
+		} else if _, err := os.Stat(absPath(viper.GetString("db_ssl_root_cert"))); err != nil {
+			errorText += fmt.Sprintf("Fatal config error: db_ssl_root_cert: %s\n", err)
+		}
+	default:
+		errorText += "Fatal config error: the only supported values for db_ssl_mode are disable, require, verify-ca and verify-full\n"
+	}
+
+	if viper.GetFloat64("registration_rate_limit") < 0 {
+		errorText += "Fatal config error: registration_rate_limit cannot be negative, 0 disables the limit\n"
+	}
+	if viper.GetFloat64("registration_rate_limit") > 0 && viper.GetInt("registration_rate_burst") < 1 {
+		errorText += "Fatal config error: registration_rate_burst must be at least 1\n"
+	}
+	if viper.GetDuration("http_read_timeout") < 0 || viper.GetDuration("http_write_timeout") < 0 ||
+		viper.GetDuration("http_idle_timeout") < 0 || viper.GetInt64("max_request_body_bytes") < 0 {
+		errorText += "Fatal config error: http_read_timeout, http_write_timeout, http_idle_timeout and max_request_body_bytes cannot be negative, 0 disables them\n"
+	}
+	if viper.GetInt("db_max_open_conns") < 0 || viper.GetInt("db_max_idle_conns") < 0 || viper.GetDuration("db_conn_max_lifetime") < 0 {
+		errorText += "Fatal config error: db_max_open_conns, db_max_idle_conns and db_conn_max_lifetime cannot be negative\n"
+	}
+	if viper.GetDuration("db_connect_timeout") < 0 {
+		errorText += "Fatal config error: db_connect_timeout cannot be negative, 0 disables the retries\n"
+	}
+
+	// The machines still polling must not be collected
+	if viper.GetDuration("gc_interval") < 0 {
+		errorText += "Fatal config error: gc_interval cannot be negative, 0 disables the garbage collection\n"
+	}
+	if inactivity := viper.GetDuration("gc_machine_inactivity"); inactivity < 0 || (inactivity > 0 && inactivity <= pollTimeout()) {
+		errorText += fmt.Sprintf("Fatal config error: gc_machine_inactivity (%s) must be more than %s, or 0 to keep the machines\n", viper.GetString("gc_machine_inactivity"), pollTimeout())
+	}
+
+	for _, o := range viper.GetStringSlice("api_allowed_origins") {
+		if o == "*" {
+			continue
+		}
+		if u, err := url.Parse(o); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.Path != "" || u.RawQuery != "" {
+			errorText += fmt.Sprintf("Fatal config error: api_allowed_origins: %q is not an origin like https://admin.example.com, or *\n", o)
+		}
+	}
+
+	if viper.GetBool("derp_ipv4_only") && viper.GetBool("derp_ipv6_only") {
+		errorText += "Fatal config error: derp_ipv4_only and derp_ipv6_only cannot be combined\n"
+	}
+
+	for _, err := range checkListenAddrs() {
+		errorText += fmt.Sprintf("Fatal config error: %s\n", err)
 	}
+
+	if prefixes, err := ipPrefixes(); err != nil {
+		errorText += fmt.Sprintf("Fatal config error: %s\n", err)
+	} else if _, err := ipAllocationExclude(prefixes); err != nil {
+		errorText += fmt.Sprintf("Fatal config error: %s\n", err)
+	}
+
+	if viper.GetBool("derp_server_enabled") {
+		// The clients only connect to DERP servers over TLS
+		if !strings.HasPrefix(viper.GetString("server_url"), "https://") {
+			errorText += "Fatal config error: derp_server_enabled requires a server_url starting with https://\n"
+		}
+		if viper.GetInt("derp_server_region_id") < 1 {
+			errorText += "Fatal config error: derp_server_region_id must be a positive integer\n"
+		}
+		if addr := viper.GetString("derp_server_stun_listen_addr"); addr != "" {
+			if _, _, err := net.SplitHostPort(addr); err != nil {
+				errorText += fmt.Sprintf("Fatal config error: derp_server_stun_listen_addr: %s\n", err)
+			}
+		}
+	}
+
+	if viper.GetBool("magic_dns_enabled") && viper.GetString("base_domain") == "" {
+		errorText += "Fatal config error: base_domain must be set when magic_dns_enabled is true\n"
+	}
+
+	if viper.GetString("base_domain") != "" && !domainRegexp.MatchString(baseDomain()) {
+		errorText += fmt.Sprintf("Fatal config error: base_domain (%s) is not a valid domain\n", viper.GetString("base_domain"))
+	}
+	if _, err := dnsNameservers(); err != nil {
+		errorText += fmt.Sprintf("Fatal config error: %s\n", err)
+	}
+	if _, err := dnsSearchDomains(); err != nil {
+		errorText += fmt.Sprintf("Fatal config error: %s\n", err)
+	}
+	if _, err := dnsSplit(); err != nil {
+		errorText += fmt.Sprintf("Fatal config error: %s\n", err)
+	}
+	if _, err := dnsExtraRecords(); err != nil {
+		errorText += fmt.Sprintf("Fatal config error: %s\n", err)
+	}
+
+	err = headscale.SetupLogging(viper.GetString("log_level"), viper.GetString("log_format"))
+	if err != nil {
+		errorText += fmt.Sprintf("Fatal config error: %s\n", err)
+	}
+
 	if errorText != "" {
 		return errors.New(strings.TrimSuffix(errorText, "\n"))
 	} else {
@@ -65,6 +282,128 @@ func LoadConfig(path string) error {
 	}
 }
 
+// secretKeys are the config keys that can also be read from a file, with
+// the same key suffixed by _file
+var secretKeys = []string{"db_pass", "db_url", "oidc_client_secret", "grpc_api_token", "grpc_api_key", "tls_letsencrypt_cloudflare_api_token"}
+
+// readSecretFiles replaces the secrets set with a _file key by the contents
+// of the file, as mounted by Docker or Kubernetes secrets. It returns the
+// errors found.
+func readSecretFiles() []error {
+	errs := []error{}
+	for _, key := range secretKeys {
+		path := viper.GetString(key + "_file")
+		if path == "" {
+			continue
+		}
+		if viper.GetString(key) != "" {
+			errs = append(errs, fmt.Errorf("set either %s or %s_file, not both", key, key))
+			continue
+		}
+		content, err := os.ReadFile(absPath(path))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s_file: %w", key, err))
+			continue
+		}
+		viper.Set(key, strings.TrimRight(string(content), "\r\n"))
+	}
+	return errs
+}
+
+// isWildcardHost tells whether a listener on host accepts the connections
+// to every address
+func isWildcardHost(host string) bool {
+	ip := net.ParseIP(host)
+	return host == "" || (ip != nil && ip.IsUnspecified())
+}
+
+// checkListenAddrs checks that the addresses the server listens on are valid
+// host:port, and that no two listeners get the same port on the same
+// interface. It returns the errors found.
+func checkListenAddrs() []error {
+	type listener struct {
+		key  string
+		addr string
+		host string
+		port int
+	}
+	candidates := []listener{}
+	for _, key := range []string{"listen_addr", "metrics_listen_addr", "grpc_listen_addr"} {
+		if addr := viper.GetString(key); addr != "" {
+			candidates = append(candidates, listener{key: key, addr: addr})
+		}
+	}
+	if viper.GetString("tls_letsencrypt_hostname") != "" && viper.GetString("tls_letsencrypt_challenge_type") == "HTTP-01" {
+		candidates = append(candidates, listener{key: "the HTTP-01 challenge", addr: ":http"})
+	}
+
+	errs := []error{}
+	listeners := []listener{}
+	for _, l := range candidates {
+		host, port, err := net.SplitHostPort(l.addr)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s (%s) must be a host:port: %w", l.key, l.addr, err))
+			continue
+		}
+		l.host = host
+		l.port, err = net.LookupPort("tcp", port)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s (%s) has an invalid port: %w", l.key, l.addr, err))
+			continue
+		}
+		for _, other := range listeners {
+			if other.port == l.port && (other.host == l.host || isWildcardHost(other.host) || isWildcardHost(l.host)) {
+				errs = append(errs, fmt.Errorf("%s (%s) collides with %s (%s)", l.key, l.addr, other.key, other.addr))
+			}
+		}
+		listeners = append(listeners, l)
+	}
+	return errs
+}
+
+// expandConfigEnv substitutes ${VAR} and $VAR references in every string value
+// read by viper with the contents of the environment, and $$ with a literal $.
+// It returns the names of the referenced variables that are not set.
+func expandConfigEnv() []string {
+	missing := []string{}
+	seen := map[string]bool{}
+	mapping := func(name string) string {
+		// os.Expand reads $$ as a reference to the variable named $
+		if name == "$" {
+			return "$"
+		}
+		v, ok := os.LookupEnv(name)
+		if !ok && !seen[name] {
+			seen[name] = true
+			missing = append(missing, name)
+		}
+		return v
+	}
+
+	for _, key := range viper.AllKeys() {
+		switch v := viper.Get(key).(type) {
+		case string:
+			if strings.Contains(v, "$") {
+				viper.Set(key, os.Expand(v, mapping))
+			}
+		case []interface{}:
+			values := make([]interface{}, len(v))
+			changed := false
+			for i, item := range v {
+				values[i] = item
+				if str, ok := item.(string); ok && strings.Contains(str, "$") {
+					values[i] = os.Expand(str, mapping)
+					changed = true
+				}
+			}
+			if changed {
+				viper.Set(key, values)
+			}
+		}
+	}
+	return missing
+}
+
 func absPath(path string) string {
 	// If a relative path is provided, prefix it with the the directory where
 	// the config file was found.
@@ -77,104 +416,398 @@ func absPath(path string) string {
 	return path
 }
 
-func getHeadscaleApp() (*headscale.Headscale, error) {
-	derpMap, err := loadDerpMap(absPath(viper.GetString("derp_map_path")))
-	if err != nil {
-		log.Printf("Could not load DERP servers map file: %s", err)
+// dbPath returns the path of the SQLite database, which is in memory with
+// ":memory:"
+func dbPath() string {
+	if viper.GetString("db_path") == headscale.SQLiteMemoryPath {
+		return headscale.SQLiteMemoryPath
 	}
+	return absPath(viper.GetString("db_path"))
+}
 
-	// Minimum inactivity time out is keepalive timeout (60s) plus a few seconds
-	// to avoid races
-	minInactivityTimeout, _ := time.ParseDuration("65s")
-	if viper.GetDuration("ephemeral_node_inactivity_timeout") <= minInactivityTimeout {
-		err = fmt.Errorf("ephemeral_node_inactivity_timeout (%s) is set too low, must be more than %s\n", viper.GetString("ephemeral_node_inactivity_timeout"), minInactivityTimeout)
-		return nil, err
+// getHeadscaleConfig builds the headscale.Config of the loaded configuration
+func getHeadscaleConfig() headscale.Config {
+	derpMap, err := headscale.LoadDERPMap(derpMapPaths(), viper.GetDuration("derp_map_fetch_timeout"), absPath(viper.GetString("derp_map_cache_dir")))
+	if err != nil {
+		log.Error().Err(err).Msg("Could not load DERP servers map file")
 	}
 
+	// Checked by LoadConfig
+	prefixes, _ := ipPrefixes()
+	excluded, _ := ipAllocationExclude(prefixes)
+	tlsVersion, _ := tlsMinVersion()
+	cipherSuites, _ := tlsCipherSuites()
+	nameservers, _ := dnsNameservers()
+	searchDomains, _ := dnsSearchDomains()
+	splitDNS, _ := dnsSplit()
+	extraRecords, _ := dnsExtraRecords()
+
 	cfg := headscale.Config{
-		ServerURL:      viper.GetString("server_url"),
+		ServerURL:      strings.TrimSuffix(viper.GetString("server_url"), "/"),
 		Addr:           viper.GetString("listen_addr"),
+		MetricsAddr:    viper.GetString("metrics_listen_addr"),
 		PrivateKeyPath: absPath(viper.GetString("private_key_path")),
 		DerpMap:        derpMap,
 
+		DerpMapPaths:        derpMapPaths(),
+		DerpMapFetchTimeout: viper.GetDuration("derp_map_fetch_timeout"),
+		DerpMapCacheDir:     absPath(viper.GetString("derp_map_cache_dir")),
+		DerpUpdateFrequency: viper.GetDuration("derp_update_frequency"),
+		DerpVerifyEndpoints: viper.GetBool("derp_verify_endpoints"),
+		DerpAddressFamily:   derpAddressFamily(),
+
+		DerpServerEnabled:    viper.GetBool("derp_server_enabled"),
+		DerpServerRegionID:   viper.GetInt("derp_server_region_id"),
+		DerpServerRegionCode: viper.GetString("derp_server_region_code"),
+		DerpServerRegionName: viper.GetString("derp_server_region_name"),
+		DerpServerSTUNAddr:   viper.GetString("derp_server_stun_listen_addr"),
+
 		EphemeralNodeInactivityTimeout: viper.GetDuration("ephemeral_node_inactivity_timeout"),
+		KeepAliveInterval:              viper.GetDuration("node_keepalive_interval"),
+		PollTimeout:                    pollTimeout(),
+		MaxMachinesPerNamespace:        viper.GetInt("max_machines_per_namespace"),
+		NodeKeyExpiry:                  viper.GetDuration("node_key_expiry"),
+
+		IPPrefixes:          prefixes,
+		IPAllocationExclude: excluded,
+		DisableIPv4:         !viper.GetBool("assign_ipv4"),
+		DisableIPv6:         !viper.GetBool("assign_ipv6"),
+
+		MagicDNS:   viper.GetBool("magic_dns_enabled"),
+		BaseDomain: baseDomain(),
+
+		DNSNameservers:   nameservers,
+		DNSSearchDomains: searchDomains,
+		DNSSplit:         splitDNS,
+		DNSExtraRecords:  extraRecords,
+
+		DNSUseNamespaceSearchDomains: viper.GetBool("dns_use_namespace_search_domains"),
+
+		GRPCAddr:       viper.GetString("grpc_listen_addr"),
+		GRPCAPIToken:   viper.GetString("grpc_api_token"),
+		GRPCSocketPath: absPath(viper.GetString("grpc_socket_path")),
+
+		OIDCIssuer:         viper.GetString("oidc_issuer"),
+		OIDCClientID:       viper.GetString("oidc_client_id"),
+		OIDCClientSecret:   viper.GetString("oidc_client_secret"),
+		OIDCScopes:         viper.GetStringSlice("oidc_scopes"),
+		OIDCNamespaceClaim: viper.GetString("oidc_namespace_claim"),
+		OIDCNamespaceMap:   viper.GetStringMapString("oidc_namespace_map"),
+		OIDCAllowedDomains: oidcAllowedDomains(),
 
 		DBtype: viper.GetString("db_type"),
-		DBpath: absPath(viper.GetString("db_path")),
+		DBpath: dbPath(),
 		DBhost: viper.GetString("db_host"),
 		DBport: viper.GetInt("db_port"),
 		DBname: viper.GetString("db_name"),
 		DBuser: viper.GetString("db_user"),
 		DBpass: viper.GetString("db_pass"),
+		DBURL:  viper.GetString("db_url"),
+
+		DBSSLMode:     viper.GetString("db_ssl_mode"),
+		DBSSLRootCert: absPath(viper.GetString("db_ssl_root_cert")),
+		DBSSLCert:     absPath(viper.GetString("db_ssl_cert")),
+		DBSSLKey:      absPath(viper.GetString("db_ssl_key")),
+
+		DBMaxOpenConns:    viper.GetInt("db_max_open_conns"),
+		DBMaxIdleConns:    viper.GetInt("db_max_idle_conns"),
+		DBConnMaxLifetime: viper.GetDuration("db_conn_max_lifetime"),
+		DBConnectTimeout:  viper.GetDuration("db_connect_timeout"),
+
+		DBAutoMigrate: viper.GetBool("db_auto_migrate"),
 
 		TLSLetsEncryptHostname:      viper.GetString("tls_letsencrypt_hostname"),
 		TLSLetsEncryptCacheDir:      absPath(viper.GetString("tls_letsencrypt_cache_dir")),
 		TLSLetsEncryptChallengeType: viper.GetString("tls_letsencrypt_challenge_type"),
+		TLSLetsEncryptCA:            viper.GetString("tls_letsencrypt_ca"),
+
+		TLSLetsEncryptDNSProvider:         viper.GetString("tls_letsencrypt_dns_provider"),
+		TLSLetsEncryptCloudflareAPIToken:  viper.GetString("tls_letsencrypt_cloudflare_api_token"),
+		TLSLetsEncryptRoute53HostedZoneID: viper.GetString("tls_letsencrypt_route53_hosted_zone_id"),
 
 		TLSCertPath: absPath(viper.GetString("tls_cert_path")),
 		TLSKeyPath:  absPath(viper.GetString("tls_key_path")),
+
+		TLSMinVersion:   tlsVersion,
+		TLSCipherSuites: cipherSuites,
+
+		HTTPReadTimeout:     viper.GetDuration("http_read_timeout"),
+		HTTPWriteTimeout:    viper.GetDuration("http_write_timeout"),
+		HTTPIdleTimeout:     viper.GetDuration("http_idle_timeout"),
+		MaxRequestBodyBytes: viper.GetInt64("max_request_body_bytes"),
+
+		ShutdownTimeout: viper.GetDuration("shutdown_timeout"),
+
+		RegistrationRateLimit: viper.GetFloat64("registration_rate_limit"),
+		RegistrationRateBurst: viper.GetInt("registration_rate_burst"),
+
+		AuditLogPath: absPath(viper.GetString("audit_log_path")),
+
+		ACLPolicyStrict:  viper.GetBool("acl_policy_strict"),
+		ACLPolicyLenient: viper.GetBool("acl_policy_lenient"),
+
+		WebhookURL:    viper.GetString("webhook_url"),
+		WebhookSecret: viper.GetString("webhook_secret"),
+
+		RegistrationTemplatePath: absPath(viper.GetString("registration_template_path")),
+
+		GCInterval:          viper.GetDuration("gc_interval"),
+		GCMachineInactivity: viper.GetDuration("gc_machine_inactivity"),
+
+		APIAllowedOrigins: viper.GetStringSlice("api_allowed_origins"),
+
+		NodeApprovalRequired: viper.GetBool("node_approval_required"),
+
+		MaintenanceMode: viper.GetBool("maintenance_mode"),
 	}
+	return cfg
+}
 
-	h, err := headscale.NewHeadscale(cfg)
+func getHeadscaleApp() (*headscale.Headscale, error) {
+	h, err := headscale.NewHeadscale(getHeadscaleConfig())
 	if err != nil {
 		return nil, err
 	}
 
-	// We are doing this here, as in the future could be cool to have it also hot-reload
-
+	// The serve command reloads it on SIGHUP
 	if viper.GetString("acl_policy_path") != "" {
 		err = h.LoadACLPolicy(absPath(viper.GetString("acl_policy_path")))
 		if err != nil {
-			log.Printf("Could not load the ACL policy: %s", err)
+			log.Error().Err(err).Msg("Could not load the ACL policy")
 		}
 	}
 
+	h.SetContext(commandCtx)
 	return h, nil
 }
 
-func loadDerpMap(path string) (*tailcfg.DERPMap, error) {
-	derpFile, err := os.Open(path)
-	if err != nil {
-		return nil, err
+// derpAddressFamily is the family of derp_ipv4_only or derp_ipv6_only, if
+// one is set
+func derpAddressFamily() string {
+	switch {
+	case viper.GetBool("derp_ipv4_only"):
+		return "ipv4"
+	case viper.GetBool("derp_ipv6_only"):
+		return "ipv6"
 	}
-	defer derpFile.Close()
-	var derpMap tailcfg.DERPMap
-	b, err := io.ReadAll(derpFile)
-	if err != nil {
-		return nil, err
+	return ""
+}
+
+// pollTimeout is how long a machine is online after its last keepalive,
+// by default the keepalive interval plus a few seconds to avoid races
+func pollTimeout() time.Duration {
+	if viper.GetString("node_poll_timeout") != "" {
+		return viper.GetDuration("node_poll_timeout")
+	}
+	return viper.GetDuration("node_keepalive_interval") + 5*time.Second
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+func tlsMinVersion() (uint16, error) {
+	v, ok := tlsVersions[viper.GetString("tls_min_version")]
+	if !ok {
+		return 0, fmt.Errorf("tls_min_version: %q is not a valid TLS version, valid: 1.0, 1.1, 1.2, 1.3", viper.GetString("tls_min_version"))
 	}
-	err = yaml.Unmarshal(b, &derpMap)
-	return &derpMap, err
+	return v, nil
+}
+
+// tlsCipherSuites reads the cipher suites by their Go name (e.g.
+// TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256). The ones known to be insecure are
+// rejected, and the TLS 1.3 ones are not configurable.
+func tlsCipherSuites() ([]uint16, error) {
+	suites := []uint16{}
+	for _, name := range viper.GetStringSlice("tls_cipher_suites") {
+		found := false
+		for _, cs := range tls.CipherSuites() {
+			if cs.Name == strings.TrimSpace(name) {
+				if len(cs.SupportedVersions) == 1 && cs.SupportedVersions[0] == tls.VersionTLS13 {
+					return nil, fmt.Errorf("tls_cipher_suites: %s is a TLS 1.3 cipher suite, these cannot be configured", cs.Name)
+				}
+				suites = append(suites, cs.ID)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("tls_cipher_suites: %q is not a supported cipher suite", name)
+		}
+	}
+	return suites, nil
+}
+
+// ipPrefixes reads the ranges of the tailnet: an IPv4 prefix, and
+// optionally an IPv6 one. Each must leave room for a few machines besides
+// the network (and broadcast) addresses.
+func ipPrefixes() ([]netaddr.IPPrefix, error) {
+	prefixes := []netaddr.IPPrefix{}
+	var has4, has6 bool
+	for _, p := range viper.GetStringSlice("ip_prefixes") {
+		prefix, err := netaddr.ParseIPPrefix(strings.TrimSpace(p))
+		if err != nil {
+			return nil, fmt.Errorf("ip_prefixes: %q is not a valid prefix", p)
+		}
+		prefix = prefix.Masked()
+		switch {
+		case prefix.IP().Is4() && has4, prefix.IP().Is6() && has6:
+			return nil, errors.New("ip_prefixes: only one IPv4 and one IPv6 prefix can be set")
+		case prefix.IP().Is4() && prefix.Bits() > 29:
+			return nil, fmt.Errorf("ip_prefixes: %s is too small, use at least a /29", prefix)
+		case prefix.IP().Is6() && prefix.Bits() > 125:
+			return nil, fmt.Errorf("ip_prefixes: %s is too small, use at least a /125", prefix)
+		}
+		has4 = has4 || prefix.IP().Is4()
+		has6 = has6 || prefix.IP().Is6()
+		prefixes = append(prefixes, prefix)
+	}
+	assign4, assign6 := viper.GetBool("assign_ipv4"), viper.GetBool("assign_ipv6")
+	switch {
+	case !assign4 && !assign6:
+		return nil, errors.New("assign_ipv4 and assign_ipv6 cannot both be false")
+	case assign4 && !has4:
+		return nil, errors.New("ip_prefixes must contain an IPv4 prefix")
+	}
+	return prefixes, nil
+}
+
+// ipAllocationExclude reads the addresses, or the prefixes, of ip_prefixes
+// the new machines are not given. Each must be within one of the prefixes,
+// the generated IPv6 prefix is not known yet.
+func ipAllocationExclude(prefixes []netaddr.IPPrefix) ([]netaddr.IPPrefix, error) {
+	excluded := []netaddr.IPPrefix{}
+	for _, e := range viper.GetStringSlice("ip_allocation_exclude") {
+		e = strings.TrimSpace(e)
+		var prefix netaddr.IPPrefix
+		if ip, err := netaddr.ParseIP(e); err == nil {
+			prefix = netaddr.IPPrefixFrom(ip, ip.BitLen())
+		} else if prefix, err = netaddr.ParseIPPrefix(e); err != nil {
+			return nil, fmt.Errorf("ip_allocation_exclude: %q is not a valid address or prefix", e)
+		}
+		prefix = prefix.Masked()
+		within := false
+		for _, p := range prefixes {
+			if p.Contains(prefix.IP()) && prefix.Bits() >= p.Bits() {
+				within = true
+				break
+			}
+		}
+		if !within {
+			return nil, fmt.Errorf("ip_allocation_exclude: %s is not within ip_prefixes", prefix)
+		}
+		excluded = append(excluded, prefix)
+	}
+	return excluded, nil
+}
+
+// derpMapPaths returns the configured DERP map paths, relative to the config
+// file if they are not URLs. derp_map_path is kept as an alias of derp_map_paths
+// with a single value.
+func derpMapPaths() []string {
+	paths := []string{}
+	if viper.GetString("derp_map_path") != "" {
+		paths = append(paths, viper.GetString("derp_map_path"))
+	}
+	paths = append(paths, viper.GetStringSlice("derp_map_paths")...)
+
+	for i, path := range paths {
+		if !strings.HasPrefix(path, "http://") && !strings.HasPrefix(path, "https://") {
+			paths[i] = absPath(path)
+		}
+	}
+	return paths
+}
+
+// oidcAllowedDomains returns the allowed email domains, lowercased as the
+// domains are compared case-insensitively
+func oidcAllowedDomains() []string {
+	domains := []string{}
+	for _, d := range viper.GetStringSlice("oidc_allowed_domains") {
+		domains = append(domains, strings.ToLower(d))
+	}
+	return domains
 }
 
 func JsonOutput(result interface{}, errResult error, outputFormat string) {
 	var j []byte
 	var err error
+	errResult = commandError(errResult)
 	switch outputFormat {
 	case "json":
 		if errResult != nil {
 			j, err = json.MarshalIndent(ErrorOutput{errResult.Error()}, "", "\t")
 			if err != nil {
-				log.Fatalln(err)
+				log.Fatal().Err(err).Msg("Cannot marshal output")
 			}
 		} else {
 			j, err = json.MarshalIndent(result, "", "\t")
 			if err != nil {
-				log.Fatalln(err)
+				log.Fatal().Err(err).Msg("Cannot marshal output")
 			}
 		}
 	case "json-line":
 		if errResult != nil {
 			j, err = json.Marshal(ErrorOutput{errResult.Error()})
 			if err != nil {
-				log.Fatalln(err)
+				log.Fatal().Err(err).Msg("Cannot marshal output")
 			}
 		} else {
 			j, err = json.Marshal(result)
 			if err != nil {
-				log.Fatalln(err)
+				log.Fatal().Err(err).Msg("Cannot marshal output")
 			}
 		}
+	case "yaml":
+		if errResult != nil {
+			j, err = marshalYAML(ErrorOutput{errResult.Error()})
+			if err != nil {
+				log.Fatal().Err(err).Msg("Cannot marshal output")
+			}
+		} else {
+			j, err = marshalYAML(result)
+			if err != nil {
+				log.Fatal().Err(err).Msg("Cannot marshal output")
+			}
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "unknown output format %q, valid: json, json-line, yaml\n", outputFormat)
+		os.Exit(1)
 	}
 	fmt.Println(string(j))
+
+	// Let scripts detect that the command has failed
+	if errResult != nil {
+		os.Exit(1)
+	}
+}
+
+// exitWithError prints the error of a command run without --output, after
+// msg if set, and exits with a non-zero status like JsonOutput does
+func exitWithError(msg string, err error) {
+	err = commandError(err)
+	if msg != "" {
+		fmt.Printf("%s: %s\n", msg, err)
+	} else {
+		fmt.Println(err)
+	}
+	os.Exit(1)
+}
+
+// marshalYAML goes through JSON first, so the YAML output has the same field names
+// and honors the same custom marshalers (netaddr, datatypes.JSON...) as the JSON output
+func marshalYAML(result interface{}) ([]byte, error) {
+	j, err := json.Marshal(result)
+	if err != nil {
+		return nil, err
+	}
+	var generic interface{}
+	err = yaml.Unmarshal(j, &generic)
+	if err != nil {
+		return nil, err
+	}
+	return yaml.Marshal(generic)
 }
@@ -2,27 +2,69 @@ package main
 
 import (
 	"fmt"
-	"log"
 	"os"
-	"strings"
+	"runtime"
 
+	"github.com/juanfont/headscale"
 	"github.com/juanfont/headscale/cmd/headscale/cli"
+	"github.com/rs/zerolog/log"
 	"github.com/spf13/cobra"
 )
 
-var version = "dev"
+// Set at build time with -ldflags "-X main.version=... -X main.commit=...
+// -X main.buildDate=..."
+var (
+	version   = "dev"
+	commit    = "unknown"
+	buildDate = "unknown"
+)
+
+type versionInfo struct {
+	Version   string
+	Commit    string
+	BuildDate string
+	GoVersion string
+
+	// SchemaVersion is the version of the database, 0 if it cannot be read,
+	// and LatestSchemaVersion the one this binary migrates it to
+	SchemaVersion       int
+	LatestSchemaVersion int
+	SchemaError         string `json:",omitempty"`
+}
 
 var versionCmd = &cobra.Command{
 	Use:   "version",
 	Short: "Print the version.",
-	Long:  "The version of headscale.",
+	Long:  "The version of headscale, how it was built, and the schema version of its database.",
 	Run: func(cmd *cobra.Command, args []string) {
 		o, _ := cmd.Flags().GetString("output")
-		if strings.HasPrefix(o, "json") {
-			cli.JsonOutput(map[string]string{"version": version}, nil, o)
+		info := versionInfo{
+			Version:             version,
+			Commit:              commit,
+			BuildDate:           buildDate,
+			GoVersion:           runtime.Version(),
+			LatestSchemaVersion: headscale.LatestSchemaVersion(),
+		}
+		schema, err := cli.SchemaVersion()
+		if err != nil {
+			info.SchemaError = err.Error()
+		} else {
+			info.SchemaVersion = schema
+		}
+
+		if o != "" {
+			cli.JsonOutput(info, nil, o)
+			return
+		}
+		fmt.Printf("headscale %s\n", info.Version)
+		fmt.Printf("commit:          %s\n", info.Commit)
+		fmt.Printf("build date:      %s\n", info.BuildDate)
+		fmt.Printf("go version:      %s\n", info.GoVersion)
+		if info.SchemaError != "" {
+			fmt.Printf("database schema: unknown (%s), this binary uses %d\n", info.SchemaError, info.LatestSchemaVersion)
 			return
 		}
-		fmt.Println(version)
+		fmt.Printf("database schema: %d, this binary uses %d\n", info.SchemaVersion, info.LatestSchemaVersion)
 	},
 }
 
@@ -34,12 +76,25 @@ headscale is an open source implementation of the Tailscale control server
 
 Juan Font Alonso <juanfontalonso@gmail.com> - 2021
 https://gitlab.com/juanfont/headscale`,
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		err := cli.LoadConfig("")
+		if err != nil {
+			log.Fatal().Err(err).Msg("Error loading config")
+		}
+		// serve stops on its own signals, without a deadline
+		if cmd != cli.ServeCmd {
+			timeout, _ := cmd.Flags().GetDuration("timeout")
+			cli.SetupCommandContext(timeout)
+		}
+	},
 }
 
 func main() {
-	err := cli.LoadConfig("")
+	// Until the config is loaded, log human-readable text at the info level
+	err := headscale.SetupLogging("", "")
 	if err != nil {
-		log.Fatalf(err.Error())
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
 	}
 
 	headscaleCmd.AddCommand(cli.NamespaceCmd)
@@ -47,44 +102,268 @@ func main() {
 	headscaleCmd.AddCommand(cli.PreauthkeysCmd)
 	headscaleCmd.AddCommand(cli.RoutesCmd)
 	headscaleCmd.AddCommand(cli.ServeCmd)
+	headscaleCmd.AddCommand(cli.ConfigTestCmd)
+	headscaleCmd.AddCommand(cli.ConfigCmd)
+	headscaleCmd.AddCommand(cli.ACLCmd)
+	headscaleCmd.AddCommand(cli.APIKeysCmd)
+	headscaleCmd.AddCommand(cli.DBCmd)
+	headscaleCmd.AddCommand(cli.StateCmd)
+	headscaleCmd.AddCommand(cli.DebugCmd)
+	headscaleCmd.AddCommand(cli.GCCmd)
+	headscaleCmd.AddCommand(cli.MaintenanceCmd)
 	headscaleCmd.AddCommand(versionCmd)
 
-	cli.NodeCmd.PersistentFlags().StringP("namespace", "n", "", "Namespace")
-	err = cli.NodeCmd.MarkPersistentFlagRequired("namespace")
-	if err != nil {
-		log.Fatalf(err.Error())
+	// Without --namespace, the nodes of all the namespaces are listed, and
+	// only the nodes given by ID are deleted
+	for _, c := range []*cobra.Command{cli.ListNodesCmd, cli.DeleteNodeCmd} {
+		c.Flags().StringP("namespace", "n", "", "Namespace")
+	}
+	for _, c := range []*cobra.Command{cli.RegisterCmd, cli.MoveNodeCmd, cli.ShareNodeCmd, cli.UnshareNodeCmd, cli.ExpireNamespaceNodesCmd} {
+		c.Flags().StringP("namespace", "n", "", "Namespace")
+		err = c.MarkFlagRequired("namespace")
+		if err != nil {
+			log.Fatal().Err(err).Msg("Error setting up the command line flags")
+		}
 	}
 
 	cli.PreauthkeysCmd.PersistentFlags().StringP("namespace", "n", "", "Namespace")
 	err = cli.PreauthkeysCmd.MarkPersistentFlagRequired("namespace")
 	if err != nil {
-		log.Fatalf(err.Error())
+		log.Fatal().Err(err).Msg("Error setting up the command line flags")
 	}
 
-	cli.RoutesCmd.PersistentFlags().StringP("namespace", "n", "", "Namespace")
-	err = cli.RoutesCmd.MarkPersistentFlagRequired("namespace")
+	cli.RoutesCmd.PersistentFlags().Uint64P("identifier", "i", 0, "Node identifier (ID)")
+	err = cli.RoutesCmd.MarkPersistentFlagRequired("identifier")
+	if err != nil {
+		log.Fatal().Err(err).Msg("Error setting up the command line flags")
+	}
+	cli.EnableRouteCmd.Flags().StringP("route", "r", "", "Route to enable (CIDR)")
+	err = cli.EnableRouteCmd.MarkFlagRequired("route")
 	if err != nil {
-		log.Fatalf(err.Error())
+		log.Fatal().Err(err).Msg("Error setting up the command line flags")
 	}
 
 	cli.NamespaceCmd.AddCommand(cli.CreateNamespaceCmd)
 	cli.NamespaceCmd.AddCommand(cli.ListNamespacesCmd)
 	cli.NamespaceCmd.AddCommand(cli.DestroyNamespaceCmd)
+	cli.NamespaceCmd.AddCommand(cli.RenameNamespaceCmd)
+	cli.NamespaceCmd.AddCommand(cli.SetNamespaceQuotaCmd)
+	cli.NamespaceCmd.AddCommand(cli.SetNamespaceDERPRegionCmd)
+	cli.ListNamespacesCmd.Flags().Bool("with-counts", false, "Also count the online machines and the pre-auth keys of each namespace")
 
 	cli.NodeCmd.AddCommand(cli.ListNodesCmd)
 	cli.NodeCmd.AddCommand(cli.RegisterCmd)
+	cli.RegisterCmd.Flags().StringP("key", "k", "", "Machine key of the machine to register")
+	cli.NodeCmd.AddCommand(cli.MoveNodeCmd)
+	cli.NodeCmd.AddCommand(cli.ShareNodeCmd)
+	cli.NodeCmd.AddCommand(cli.UnshareNodeCmd)
+	cli.NodeCmd.AddCommand(cli.DeleteNodeCmd)
+	cli.NodeCmd.AddCommand(cli.RenameNodeCmd)
+	cli.NodeCmd.AddCommand(cli.ReauthNodeCmd)
+	cli.NodeCmd.AddCommand(cli.RefreshNodeKeyCmd)
+	cli.NodeCmd.AddCommand(cli.ShowNodeCmd)
+	cli.NodeCmd.AddCommand(cli.ApproveNodeCmd)
+	cli.NodeCmd.AddCommand(cli.SetNodeIPCmd)
+	cli.NodeCmd.AddCommand(cli.AuditIPsCmd)
+	cli.NodeCmd.AddCommand(cli.ExpireNodeCmd)
+	cli.NodeCmd.AddCommand(cli.ExpireNamespaceNodesCmd)
+	cli.NodeCmd.AddCommand(cli.SetNodeExpiryCmd)
+	cli.NodeCmd.AddCommand(cli.TagNodeCmd)
 
 	cli.RoutesCmd.AddCommand(cli.ListRoutesCmd)
 	cli.RoutesCmd.AddCommand(cli.EnableRouteCmd)
+	cli.RoutesCmd.AddCommand(cli.ApproveAllRoutesCmd)
+	cli.RoutesCmd.AddCommand(cli.EnableExitNodeCmd)
+
+	cli.ACLCmd.AddCommand(cli.CheckACLCmd)
+	cli.ACLCmd.AddCommand(cli.DiffACLCmd)
+
+	cli.APIKeysCmd.AddCommand(cli.ListAPIKeysCmd)
+	cli.APIKeysCmd.AddCommand(cli.CreateAPIKeyCmd)
+	cli.APIKeysCmd.AddCommand(cli.ExpireAPIKeyCmd)
+
+	cli.DBCmd.AddCommand(cli.MigrateDBCmd)
+	cli.MigrateDBCmd.Flags().Bool("dry-run", false, "Only print the pending migrations")
+
+	cli.MaintenanceCmd.AddCommand(cli.MaintenanceStatusCmd)
+	cli.MaintenanceCmd.AddCommand(cli.EnableMaintenanceCmd)
+	cli.MaintenanceCmd.AddCommand(cli.DisableMaintenanceCmd)
+
+	cli.ConfigCmd.AddCommand(cli.ShowConfigCmd)
+
+	cli.GCCmd.Flags().Bool("dry-run", false, "Only list what would be deleted (the default)")
+	cli.GCCmd.Flags().Bool("apply", false, "Delete the listed pre-auth keys and nodes")
+	cli.GCCmd.Flags().String("inactive-for", "", "Delete the nodes not seen for this long (30d, 12h...) instead of gc_machine_inactivity")
+
+	cli.DebugCmd.AddCommand(cli.NetmapDebugCmd)
+	cli.NetmapDebugCmd.Flags().Uint64P("identifier", "i", 0, "Node identifier (ID)")
+	err = cli.NetmapDebugCmd.MarkFlagRequired("identifier")
+	if err != nil {
+		log.Fatal().Err(err).Msg("Error setting up the command line flags")
+	}
+
+	cli.StateCmd.AddCommand(cli.ExportStateCmd)
+	cli.StateCmd.AddCommand(cli.ImportStateCmd)
+	cli.ExportStateCmd.Flags().StringP("file", "f", "", "File to write the state to")
+	err = cli.ExportStateCmd.MarkFlagRequired("file")
+	if err != nil {
+		log.Fatal().Err(err).Msg("Error setting up the command line flags")
+	}
+	cli.ImportStateCmd.Flags().StringP("input", "i", "", "File to read the state from")
+	err = cli.ImportStateCmd.MarkFlagRequired("input")
+	if err != nil {
+		log.Fatal().Err(err).Msg("Error setting up the command line flags")
+	}
+	cli.ImportStateCmd.Flags().Bool("force", false, "Replace the content of a database that is not empty")
 
 	cli.PreauthkeysCmd.AddCommand(cli.ListPreAuthKeys)
 	cli.PreauthkeysCmd.AddCommand(cli.CreatePreAuthKeyCmd)
+	cli.PreauthkeysCmd.AddCommand(cli.ExpirePreAuthKeyCmd)
+	cli.PreauthkeysCmd.AddCommand(cli.PreAuthKeyMachinesCmd)
+
+	cli.ExpirePreAuthKeyCmd.Flags().StringP("key", "k", "", "Preauthkey")
+
+	cli.PreAuthKeyMachinesCmd.Flags().StringP("key", "k", "", "Preauthkey")
+	err = cli.PreAuthKeyMachinesCmd.MarkFlagRequired("key")
+	if err != nil {
+		log.Fatal().Err(err).Msg("Error setting up the command line flags")
+	}
 
 	cli.CreatePreAuthKeyCmd.PersistentFlags().Bool("reusable", false, "Make the preauthkey reusable")
 	cli.CreatePreAuthKeyCmd.PersistentFlags().Bool("ephemeral", false, "Preauthkey for ephemeral nodes")
 	cli.CreatePreAuthKeyCmd.Flags().StringP("expiration", "e", "", "Human-readable expiration of the key (30m, 24h, 365d...)")
+	cli.CreatePreAuthKeyCmd.Flags().StringSlice("tags", []string{}, "ACL tags given to the nodes registered with the key, owned by the namespace")
+
+	cli.CreateAPIKeyCmd.Flags().StringP("expiration", "e", "90d", "Human-readable expiration of the key (30m, 24h, 365d...)")
+	cli.ExpireAPIKeyCmd.Flags().StringP("prefix", "p", "", "API key prefix")
+	err = cli.ExpireAPIKeyCmd.MarkFlagRequired("prefix")
+	if err != nil {
+		log.Fatal().Err(err).Msg("Error setting up the command line flags")
+	}
+
+	cli.MoveNodeCmd.Flags().Uint64P("identifier", "i", 0, "Node identifier (ID)")
+	err = cli.MoveNodeCmd.MarkFlagRequired("identifier")
+	if err != nil {
+		log.Fatal().Err(err).Msg("Error setting up the command line flags")
+	}
+	cli.ShareNodeCmd.Flags().Uint64P("identifier", "i", 0, "Node identifier (ID)")
+	err = cli.ShareNodeCmd.MarkFlagRequired("identifier")
+	if err != nil {
+		log.Fatal().Err(err).Msg("Error setting up the command line flags")
+	}
+	cli.UnshareNodeCmd.Flags().Uint64P("identifier", "i", 0, "Node identifier (ID)")
+	err = cli.UnshareNodeCmd.MarkFlagRequired("identifier")
+	if err != nil {
+		log.Fatal().Err(err).Msg("Error setting up the command line flags")
+	}
+
+	cli.ListNodesCmd.Flags().String("tag", "", "Only list the nodes with this tag (e.g. tag:server)")
+	cli.ListNodesCmd.Flags().Bool("online", false, "Only list the nodes currently connected")
+	cli.ListNodesCmd.Flags().String("last-seen-before", "", "Only list the nodes not seen for this long (30d, 12h...)")
+	cli.ListNodesCmd.Flags().Bool("pending", false, "Only list the nodes waiting for approval (see node_approval_required)")
+	cli.ListNodesCmd.Flags().String("sort", "id", "Sort by id, name, last-seen or ip")
+	cli.ListNodesCmd.Flags().StringSlice("columns", nil, "Columns of the table and their order (id,name,hostname,namespace,ip,ipv4,ipv6,last_seen,online,ephemeral,exit_node,tags,pending,node_key,machine_key)")
+
+	cli.AuditIPsCmd.Flags().Bool("fix", false, "Assign new addresses to the machines with a conflict")
+
+	cli.RenameNodeCmd.Flags().Uint64P("identifier", "i", 0, "Node identifier (ID)")
+	err = cli.RenameNodeCmd.MarkFlagRequired("identifier")
+	if err != nil {
+		log.Fatal().Err(err).Msg("Error setting up the command line flags")
+	}
+	cli.RenameNodeCmd.Flags().String("name", "", "New name (a DNS label), empty to use the hostname again")
+
+	cli.ReauthNodeCmd.Flags().Uint64P("identifier", "i", 0, "Node identifier (ID)")
+	err = cli.ReauthNodeCmd.MarkFlagRequired("identifier")
+	if err != nil {
+		log.Fatal().Err(err).Msg("Error setting up the command line flags")
+	}
+
+	cli.RefreshNodeKeyCmd.Flags().Uint64P("identifier", "i", 0, "Node identifier (ID)")
+	err = cli.RefreshNodeKeyCmd.MarkFlagRequired("identifier")
+	if err != nil {
+		log.Fatal().Err(err).Msg("Error setting up the command line flags")
+	}
+
+	cli.ShowNodeCmd.Flags().Uint64P("identifier", "i", 0, "Node identifier (ID)")
+	err = cli.ShowNodeCmd.MarkFlagRequired("identifier")
+	if err != nil {
+		log.Fatal().Err(err).Msg("Error setting up the command line flags")
+	}
+
+	cli.ApproveNodeCmd.Flags().Uint64P("identifier", "i", 0, "Node identifier (ID)")
+	err = cli.ApproveNodeCmd.MarkFlagRequired("identifier")
+	if err != nil {
+		log.Fatal().Err(err).Msg("Error setting up the command line flags")
+	}
+
+	cli.SetNodeIPCmd.Flags().Uint64P("identifier", "i", 0, "Node identifier (ID)")
+	err = cli.SetNodeIPCmd.MarkFlagRequired("identifier")
+	if err != nil {
+		log.Fatal().Err(err).Msg("Error setting up the command line flags")
+	}
+	cli.SetNodeIPCmd.Flags().String("ip", "", "IPv4 or IPv6 address in ip_prefixes")
+	err = cli.SetNodeIPCmd.MarkFlagRequired("ip")
+	if err != nil {
+		log.Fatal().Err(err).Msg("Error setting up the command line flags")
+	}
+
+	cli.DeleteNodeCmd.Flags().UintSliceP("identifier", "i", []uint{}, "Node identifiers (IDs), repeated or comma-separated")
+	cli.DeleteNodeCmd.Flags().String("before", "", "With --namespace, delete the nodes not seen for this long (30d, 12h...)")
+	cli.DeleteNodeCmd.Flags().Bool("force", false, "Confirm the deletion of several nodes")
+	cli.DeleteNodeCmd.Flags().Bool("fail-fast", false, "Stop at the first node that cannot be deleted")
+
+	cli.ExpireNodeCmd.Flags().Uint64P("identifier", "i", 0, "Node identifier (ID)")
+	err = cli.ExpireNodeCmd.MarkFlagRequired("identifier")
+	if err != nil {
+		log.Fatal().Err(err).Msg("Error setting up the command line flags")
+	}
+
+	cli.ExpireNamespaceNodesCmd.Flags().Bool("force", false, "Confirm the expiry of all the nodes of the namespace")
+
+	cli.SetNodeExpiryCmd.Flags().Uint64P("identifier", "i", 0, "Node identifier (ID)")
+	err = cli.SetNodeExpiryCmd.MarkFlagRequired("identifier")
+	if err != nil {
+		log.Fatal().Err(err).Msg("Error setting up the command line flags")
+	}
+	cli.SetNodeExpiryCmd.Flags().StringP("duration", "d", "", "Human-readable time until the key expires (30m, 24h, 90d...)")
+	err = cli.SetNodeExpiryCmd.MarkFlagRequired("duration")
+	if err != nil {
+		log.Fatal().Err(err).Msg("Error setting up the command line flags")
+	}
+
+	cli.TagNodeCmd.Flags().UintSliceP("identifier", "i", []uint{}, "Node identifiers (IDs), repeated or comma-separated")
+	err = cli.TagNodeCmd.MarkFlagRequired("identifier")
+	if err != nil {
+		log.Fatal().Err(err).Msg("Error setting up the command line flags")
+	}
+	cli.TagNodeCmd.Flags().StringSlice("add", []string{}, "Tags to add (e.g. tag:server)")
+	cli.TagNodeCmd.Flags().StringSlice("remove", []string{}, "Tags to remove")
+	cli.TagNodeCmd.Flags().Bool("clear", false, "Remove all the tags, before adding the ones given with --add")
+	cli.TagNodeCmd.Flags().Bool("fail-fast", false, "With several nodes, stop at the first one that fails")
+
+	cli.CheckACLCmd.Flags().String("src", "", "Source (namespace, tag, group, host, IP or node name)")
+	cli.CheckACLCmd.Flags().String("dst", "", "Destination (namespace, tag, group, host, IP or node name)")
+	cli.CheckACLCmd.Flags().Uint16("port", 0, "Destination port")
+	for _, f := range []string{"src", "dst", "port"} {
+		err = cli.CheckACLCmd.MarkFlagRequired(f)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Error setting up the command line flags")
+		}
+	}
+
+	cli.DiffACLCmd.Flags().StringP("file", "f", "", "Candidate ACL policy file")
+	err = cli.DiffACLCmd.MarkFlagRequired("file")
+	if err != nil {
+		log.Fatal().Err(err).Msg("Error setting up the command line flags")
+	}
+
+	for _, cmd := range []*cobra.Command{cli.ServeCmd, cli.ConfigTestCmd, cli.ACLCmd} {
+		cmd.PersistentFlags().Bool("lenient", false, "Ignore the unknown fields of the ACL policy, like acl_policy_lenient")
+	}
 
-	headscaleCmd.PersistentFlags().StringP("output", "o", "", "Output format. Empty for human-readable, 'json' or 'json-line'")
+	headscaleCmd.PersistentFlags().StringP("output", "o", "", "Output format. Empty for human-readable, 'json', 'json-line' or 'yaml'")
+	headscaleCmd.PersistentFlags().Duration("timeout", 0, "Cancel the command if it has not completed after this long (e.g. 30s), 0 waits for it")
 
 	if err := headscaleCmd.Execute(); err != nil {
 		fmt.Println(err)
@@ -0,0 +1,70 @@
+package headscale
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	corsAllowedMethods = "GET, POST, PUT, PATCH, DELETE"
+	corsAllowedHeaders = "Authorization, Content-Type"
+	corsMaxAge         = "600"
+)
+
+// handleAPI registers a GET handler of the administration endpoints, which
+// the browsers can call from the origins of APIAllowedOrigins. The control
+// endpoints of the Tailscale clients are registered directly, without CORS.
+func (h *Headscale) handleAPI(r gin.IRoutes, path string, handler gin.HandlerFunc) {
+	r.GET(path, h.corsHandler, handler)
+	r.OPTIONS(path, h.corsPreflightHandler)
+}
+
+// allowedOrigin returns the Access-Control-Allow-Origin of the origin of a
+// request, and whether it is allowed
+func (h *Headscale) allowedOrigin(origin string) (string, bool) {
+	if origin == "" {
+		return "", false
+	}
+	for _, o := range h.cfg.APIAllowedOrigins {
+		if o == "*" {
+			return "*", true
+		}
+		if strings.EqualFold(o, origin) {
+			return origin, true
+		}
+	}
+	return "", false
+}
+
+// corsHandler adds the CORS headers to the responses to the allowed origins.
+// The other origins get no header, and the browsers hide the responses from
+// them, like from the same-origin policy.
+func (h *Headscale) corsHandler(c *gin.Context) {
+	if len(h.cfg.APIAllowedOrigins) == 0 {
+		return
+	}
+	c.Header("Vary", "Origin")
+	if allowed, ok := h.allowedOrigin(c.GetHeader("Origin")); ok {
+		c.Header("Access-Control-Allow-Origin", allowed)
+	}
+}
+
+// corsPreflightHandler answers the OPTIONS requests the browsers send before
+// the cross-origin requests with a method or headers of their own
+func (h *Headscale) corsPreflightHandler(c *gin.Context) {
+	if len(h.cfg.APIAllowedOrigins) > 0 {
+		c.Header("Vary", "Origin")
+	}
+	allowed, ok := h.allowedOrigin(c.GetHeader("Origin"))
+	if !ok {
+		c.AbortWithStatus(http.StatusForbidden)
+		return
+	}
+	c.Header("Access-Control-Allow-Origin", allowed)
+	c.Header("Access-Control-Allow-Methods", corsAllowedMethods)
+	c.Header("Access-Control-Allow-Headers", corsAllowedHeaders)
+	c.Header("Access-Control-Max-Age", corsMaxAge)
+	c.AbortWithStatus(http.StatusNoContent)
+}
@@ -0,0 +1,49 @@
+package headscale
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/gin-gonic/gin"
+	"gopkg.in/check.v1"
+)
+
+func (s *Suite) TestCORS(c *check.C) {
+	h.cfg.APIAllowedOrigins = []string{"https://admin.example.com"}
+	defer func() { h.cfg.APIAllowedOrigins = nil }()
+
+	engine := gin.New()
+	h.handleAPI(engine, "/health", h.HealthHandler)
+	engine.GET("/key", h.KeyHandler)
+	serve := func(method, path, origin string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(method, path, nil)
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		engine.ServeHTTP(w, req)
+		return w
+	}
+
+	w := serve(http.MethodGet, "/health", "https://admin.example.com")
+	c.Assert(w.Code, check.Equals, http.StatusOK)
+	c.Assert(w.Header().Get("Access-Control-Allow-Origin"), check.Equals, "https://admin.example.com")
+
+	w = serve(http.MethodOptions, "/health", "https://admin.example.com")
+	c.Assert(w.Code, check.Equals, http.StatusNoContent)
+	c.Assert(w.Header().Get("Access-Control-Allow-Methods"), check.Equals, corsAllowedMethods)
+
+	w = serve(http.MethodGet, "/health", "https://evil.example.com")
+	c.Assert(w.Code, check.Equals, http.StatusOK)
+	c.Assert(w.Header().Get("Access-Control-Allow-Origin"), check.Equals, "")
+	w = serve(http.MethodOptions, "/health", "https://evil.example.com")
+	c.Assert(w.Code, check.Equals, http.StatusForbidden)
+
+	// The control endpoints of the clients have no CORS
+	w = serve(http.MethodOptions, "/key", "https://admin.example.com")
+	c.Assert(w.Header().Get("Access-Control-Allow-Origin"), check.Equals, "")
+
+	h.cfg.APIAllowedOrigins = []string{"*"}
+	w = serve(http.MethodGet, "/health", "https://any.example.com")
+	c.Assert(w.Header().Get("Access-Control-Allow-Origin"), check.Equals, "*")
+}
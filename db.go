@@ -1,15 +1,28 @@
 package headscale
 
 import (
+	"context"
 	"errors"
+	"time"
 
+	"github.com/rs/zerolog/log"
 	"gorm.io/driver/postgres"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 	"gorm.io/gorm/logger"
 )
 
-const dbVersion = "1"
+// SQLiteMemoryPath as the path of the SQLite database keeps it in memory, for
+// tests and demos. Nothing is written to disk, and it is lost when headscale
+// stops.
+const SQLiteMemoryPath = ":memory:"
+
+// The backoff between the attempts to connect to the database doubles from
+// dbConnectFirstBackoff up to dbConnectMaxBackoff
+const (
+	dbConnectFirstBackoff = 500 * time.Millisecond
+	dbConnectMaxBackoff   = 10 * time.Second
+)
 
 // KV is a key-value store in a psql table. For future use...
 type KV struct {
@@ -17,8 +30,10 @@ type KV struct {
 	Value string
 }
 
+// initDB opens the database and, with DBAutoMigrate, brings its schema up to
+// date
 func (h *Headscale) initDB() error {
-	db, err := h.openDB()
+	db, err := h.connectDB()
 	if err != nil {
 		return err
 	}
@@ -27,48 +42,97 @@ func (h *Headscale) initDB() error {
 	if h.dbType == "postgres" {
 		db.Exec("create extension if not exists \"uuid-ossp\";")
 	}
-	err = db.AutoMigrate(&Machine{})
+	err = db.AutoMigrate(&SchemaMigration{})
 	if err != nil {
 		return err
 	}
-	err = db.AutoMigrate(&KV{})
+
+	// A newer schema could be corrupted by this version, even without migrating
+	version, err := h.SchemaVersion()
 	if err != nil {
 		return err
 	}
-	err = db.AutoMigrate(&Namespace{})
-	if err != nil {
+	if version > latestSchemaVersion() {
+		return errorSchemaTooNew
+	}
+
+	if h.cfg.DBAutoMigrate {
+		_, err = h.Migrate()
 		return err
 	}
-	err = db.AutoMigrate(&PreAuthKey{})
+	return nil
+}
+
+// SetContext makes the database queries fail once ctx is done, so the
+// commands of the CLI can be canceled or bounded by a timeout. The queries in
+// flight are interrupted by the drivers.
+func (h *Headscale) SetContext(ctx context.Context) {
+	h.db = h.db.WithContext(ctx)
+}
+
+// connectDB opens the database and checks it answers a ping, retrying with an
+// exponential backoff for up to DBConnectTimeout, e.g. while PostgreSQL starts
+// in the same compose project or pod
+func (h *Headscale) connectDB() (*gorm.DB, error) {
+	deadline := time.Now().Add(h.cfg.DBConnectTimeout)
+	backoff := dbConnectFirstBackoff
+	for attempt := 1; ; attempt++ {
+		db, err := h.openDB()
+		if err == nil {
+			err = pingDB(db)
+			if err == nil {
+				return db, nil
+			}
+			if sqlDB, dbErr := db.DB(); dbErr == nil {
+				sqlDB.Close()
+			}
+		}
+		if time.Now().Add(backoff).After(deadline) {
+			return nil, err
+		}
+		log.Warn().
+			Str("db_type", h.dbType).
+			Int("attempt", attempt).
+			Dur("retry_in", backoff).
+			Err(err).
+			Msg("Cannot connect to the database")
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > dbConnectMaxBackoff {
+			backoff = dbConnectMaxBackoff
+		}
+	}
+}
+
+func pingDB(db *gorm.DB) error {
+	sqlDB, err := db.DB()
 	if err != nil {
 		return err
 	}
-
-	err = h.setValue("db_version", dbVersion)
-	return err
+	return sqlDB.Ping()
 }
 
 func (h *Headscale) openDB() (*gorm.DB, error) {
 	var db *gorm.DB
 	var err error
 
-	var log logger.Interface
+	var dbLogger logger.Interface
 	if h.dbDebug {
-		log = logger.Default
+		dbLogger = logger.Default
 	} else {
-		log = logger.Default.LogMode(logger.Silent)
+		dbLogger = logger.Default.LogMode(logger.Silent)
 	}
 
 	switch h.dbType {
 	case "sqlite3":
 		db, err = gorm.Open(sqlite.Open(h.dbString), &gorm.Config{
 			DisableForeignKeyConstraintWhenMigrating: true,
-			Logger:                                   log,
+			Logger:                                   dbLogger,
 		})
 	case "postgres":
 		db, err = gorm.Open(postgres.Open(h.dbString), &gorm.Config{
 			DisableForeignKeyConstraintWhenMigrating: true,
-			Logger:                                   log,
+			Logger:                                   dbLogger,
 		})
 	}
 
@@ -76,6 +140,28 @@ func (h *Headscale) openDB() (*gorm.DB, error) {
 		return nil, err
 	}
 
+	sqlDB, err := db.DB()
+	if err != nil {
+		return nil, err
+	}
+	if h.cfg.DBMaxOpenConns > 0 {
+		sqlDB.SetMaxOpenConns(h.cfg.DBMaxOpenConns)
+	}
+	if h.cfg.DBMaxIdleConns > 0 {
+		sqlDB.SetMaxIdleConns(h.cfg.DBMaxIdleConns)
+	}
+	if h.cfg.DBConnMaxLifetime > 0 {
+		sqlDB.SetConnMaxLifetime(h.cfg.DBConnMaxLifetime)
+	}
+	if h.dbType == "sqlite3" && h.cfg.DBpath == SQLiteMemoryPath {
+		// The in-memory database is dropped with its last connection, and the
+		// connections of a shared cache lock each other's tables: a single
+		// connection, never closed, is kept
+		sqlDB.SetMaxOpenConns(1)
+		sqlDB.SetMaxIdleConns(1)
+		sqlDB.SetConnMaxLifetime(0)
+	}
+
 	return db, nil
 }
 
@@ -0,0 +1,41 @@
+package headscale
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"time"
+
+	"gopkg.in/check.v1"
+)
+
+func (s *Suite) TestConnectDBRetries(c *check.C) {
+	app := Headscale{
+		cfg:      Config{DBConnectTimeout: 1200 * time.Millisecond},
+		dbType:   "sqlite3",
+		dbString: filepath.Join(c.MkDir(), "missing", "headscale.db"),
+	}
+	start := time.Now()
+	_, err := app.connectDB()
+	c.Assert(err, check.NotNil)
+	// Retried after 0.5s, then the 1s backoff would pass the timeout
+	c.Assert(time.Since(start) >= dbConnectFirstBackoff, check.Equals, true)
+	c.Assert(time.Since(start) < app.cfg.DBConnectTimeout, check.Equals, true)
+
+	app.cfg.DBConnectTimeout = 0
+	app.dbString = filepath.Join(c.MkDir(), "headscale.db")
+	db, err := app.connectDB()
+	c.Assert(err, check.IsNil)
+	c.Assert(pingDB(db), check.IsNil)
+}
+
+func (s *Suite) TestSetContext(c *check.C) {
+	ctx, cancel := context.WithCancel(context.Background())
+	h.SetContext(ctx)
+	_, err := h.CreateNamespace("test")
+	c.Assert(err, check.IsNil)
+
+	cancel()
+	_, err = h.ListNamespaces()
+	c.Assert(errors.Is(err, context.Canceled), check.Equals, true)
+}
@@ -0,0 +1,382 @@
+package headscale
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v2"
+	"inet.af/netaddr"
+	"tailscale.com/tailcfg"
+)
+
+const errorDERPMapEmpty = Error("DERP map has no regions")
+const errorDERPMapInvalid = Error("invalid DERP map")
+const errorDERPRegionNotFound = Error("DERP region not found in the DERP map")
+
+// derpMapURLCache keeps the last DERP map successfully fetched from each URL,
+// so we can keep serving it if the URL is temporarily unreachable
+var derpMapURLCache = struct {
+	sync.Mutex
+	maps map[string]*tailcfg.DERPMap
+}{maps: map[string]*tailcfg.DERPMap{}}
+
+// LoadDERPMap loads the DERP maps from the given paths and merges their regions.
+// Regions from later paths override the ones with the same ID from earlier paths.
+// The maps fetched from URLs are saved in cacheDir, if not empty, to be used
+// when the URL cannot be fetched after a restart.
+func LoadDERPMap(paths []string, timeout time.Duration, cacheDir string) (*tailcfg.DERPMap, error) {
+	derpMap := tailcfg.DERPMap{
+		Regions: map[int]*tailcfg.DERPRegion{},
+	}
+	for _, path := range paths {
+		m, err := loadDERPMapFromPath(path, timeout, cacheDir)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		for id, region := range m.Regions {
+			// Overriding a region is fine as long as it is the same region
+			if prev, ok := derpMap.Regions[id]; ok && prev.RegionCode != region.RegionCode {
+				log.Warn().
+					Int("region", id).
+					Str("region_code", region.RegionCode).
+					Str("previous_region_code", prev.RegionCode).
+					Str("path", path).
+					Msg("DERP region collides with an already loaded region, overriding it")
+			}
+			derpMap.Regions[id] = region
+		}
+	}
+
+	// The map is returned even if it is not valid, as it might still be usable
+	return &derpMap, validateDERPMap(&derpMap)
+}
+
+// validateDERPMap checks the DERP map has at least one region, that each
+// region has an ID matching its key and at least one node with a hostname, and
+// that the STUN-only nodes do not disable STUN
+func validateDERPMap(derpMap *tailcfg.DERPMap) error {
+	if len(derpMap.Regions) == 0 {
+		return errorDERPMapEmpty
+	}
+
+	ids := make([]int, 0, len(derpMap.Regions))
+	for id := range derpMap.Regions {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	problems := []string{}
+	for _, id := range ids {
+		region := derpMap.Regions[id]
+		if region == nil {
+			problems = append(problems, fmt.Sprintf("region %d is empty", id))
+			continue
+		}
+		if region.RegionID != id {
+			problems = append(problems, fmt.Sprintf("region %d has regionid %d", id, region.RegionID))
+		}
+		if len(region.Nodes) == 0 {
+			problems = append(problems, fmt.Sprintf("region %d has no nodes", id))
+		}
+		for i, node := range region.Nodes {
+			if node == nil || node.HostName == "" {
+				problems = append(problems, fmt.Sprintf("node %d of region %d has no hostname", i, id))
+				continue
+			}
+			if node.STUNOnly && node.STUNPort < 0 {
+				problems = append(problems, fmt.Sprintf("node %d of region %d is STUN-only with STUN disabled", i, id))
+			}
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("%w: %s", errorDERPMapInvalid, strings.Join(problems, ", "))
+	}
+	return nil
+}
+
+// loadDERPMapFromPath loads a DERP map from a local file or, if path is an http://
+// or https:// URL, fetches it using the given timeout
+func loadDERPMapFromPath(path string, timeout time.Duration, cacheDir string) (*tailcfg.DERPMap, error) {
+	if isURL(path) {
+		return loadDERPMapFromURL(path, timeout, cacheDir)
+	}
+
+	derpFile, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer derpFile.Close()
+	b, err := io.ReadAll(derpFile)
+	if err != nil {
+		return nil, err
+	}
+	return parseDERPMap(b)
+}
+
+func isURL(path string) bool {
+	return strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://")
+}
+
+// loadDERPMapFromURL fetches a DERP map, and falls back to the last copy
+// fetched by this process, then to the one saved in cacheDir
+func loadDERPMapFromURL(url string, timeout time.Duration, cacheDir string) (*tailcfg.DERPMap, error) {
+	derpMap, err := fetchDERPMap(url, timeout)
+
+	derpMapURLCache.Lock()
+	defer derpMapURLCache.Unlock()
+	if err != nil {
+		if cached, ok := derpMapURLCache.maps[url]; ok {
+			log.Warn().
+				Str("url", url).
+				Err(err).
+				Msg("Could not fetch DERP map, using the copy fetched before")
+			return cached, nil
+		}
+		if cacheDir != "" {
+			cached, cacheErr := loadDERPMapFromPath(derpMapCachePath(cacheDir, url), timeout, "")
+			if cacheErr == nil {
+				log.Warn().
+					Str("url", url).
+					Str("cache", derpMapCachePath(cacheDir, url)).
+					Err(err).
+					Msg("Could not fetch DERP map, using the copy saved on disk")
+				derpMapURLCache.maps[url] = cached
+				return cached, nil
+			}
+		}
+		return nil, err
+	}
+
+	log.Info().
+		Str("url", url).
+		Msg("DERP map fetched")
+	derpMapURLCache.maps[url] = derpMap
+	if cacheDir != "" {
+		if err := saveDERPMapCache(cacheDir, url, derpMap); err != nil {
+			log.Error().
+				Str("url", url).
+				Err(err).
+				Msg("Could not save the DERP map to disk")
+		}
+	}
+	return derpMap, nil
+}
+
+// derpMapCachePath is the file the map fetched from url is saved to
+func derpMapCachePath(cacheDir string, url string) string {
+	sum := sha256.Sum256([]byte(url))
+	return filepath.Join(cacheDir, "derpmap-"+hex.EncodeToString(sum[:8])+".json")
+}
+
+func saveDERPMapCache(cacheDir string, url string, derpMap *tailcfg.DERPMap) error {
+	if err := os.MkdirAll(cacheDir, 0o700); err != nil {
+		return err
+	}
+	b, err := json.Marshal(derpMap)
+	if err != nil {
+		return err
+	}
+	// Written to a temporary file first, so a crash does not leave a
+	// truncated copy behind
+	path := derpMapCachePath(cacheDir, url)
+	if err := os.WriteFile(path+".tmp", b, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+func fetchDERPMap(url string, timeout time.Duration) (*tailcfg.DERPMap, error) {
+	client := http.Client{Timeout: timeout}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status fetching DERP map: %s", resp.Status)
+	}
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return parseDERPMap(b)
+}
+
+// parseDERPMap unmarshals a DERP map, either in our YAML format or in the JSON
+// format published by Tailscale
+func parseDERPMap(b []byte) (*tailcfg.DERPMap, error) {
+	var derpMap tailcfg.DERPMap
+	var err error
+	if strings.HasPrefix(strings.TrimSpace(string(b)), "{") {
+		err = json.Unmarshal(b, &derpMap)
+	} else {
+		err = yaml.Unmarshal(b, &derpMap)
+	}
+	return &derpMap, err
+}
+
+// FilterDERPMapFamily returns a copy of derpMap whose nodes are only reached
+// over family, ipv4 or ipv6: their address of the other family is set to
+// "none", so the clients do not look it up, and the nodes without an address
+// of the family are removed. It fails if a region is left without nodes.
+// An empty family returns derpMap.
+func FilterDERPMapFamily(derpMap *tailcfg.DERPMap, family string) (*tailcfg.DERPMap, error) {
+	if derpMap == nil || family == "" {
+		return derpMap, nil
+	}
+
+	m := tailcfg.DERPMap{
+		Regions:            map[int]*tailcfg.DERPRegion{},
+		OmitDefaultRegions: derpMap.OmitDefaultRegions,
+	}
+	empty := []int{}
+	for id, region := range derpMap.Regions {
+		if region == nil {
+			continue
+		}
+		r := *region
+		r.Nodes = []*tailcfg.DERPNode{}
+		for _, node := range region.Nodes {
+			if node == nil {
+				continue
+			}
+			n := *node
+			if family == "ipv6" {
+				if !derpAddressUsable(n.IPv6, false) {
+					continue
+				}
+				n.IPv4 = "none"
+			} else {
+				if !derpAddressUsable(n.IPv4, true) {
+					continue
+				}
+				n.IPv6 = "none"
+			}
+			r.Nodes = append(r.Nodes, &n)
+		}
+		if len(r.Nodes) == 0 {
+			empty = append(empty, id)
+		}
+		m.Regions[id] = &r
+	}
+
+	if len(empty) > 0 {
+		sort.Ints(empty)
+		problems := []string{}
+		for _, id := range empty {
+			problems = append(problems, fmt.Sprintf("region %d has no %s node", id, family))
+		}
+		return nil, fmt.Errorf("%w: %s", errorDERPMapInvalid, strings.Join(problems, ", "))
+	}
+	return &m, nil
+}
+
+// derpAddressUsable tells if a node can be reached at its IPv4 (or IPv6)
+// field: empty uses the DNS records of its hostname, anything but an address
+// of the family disables it
+func derpAddressUsable(address string, ipv4 bool) bool {
+	if address == "" {
+		return true
+	}
+	ip, err := netaddr.ParseIP(address)
+	return err == nil && ip.Is4() == ipv4
+}
+
+// servedDERPMap is the DERP map sent to the clients: derpMap with the
+// region of the embedded DERP server, restricted to DerpAddressFamily
+func (h *Headscale) servedDERPMap(derpMap *tailcfg.DERPMap) (*tailcfg.DERPMap, error) {
+	return FilterDERPMapFamily(h.withEmbeddedDERP(derpMap), h.cfg.DerpAddressFamily)
+}
+
+func (h *Headscale) getDERPMap() *tailcfg.DERPMap {
+	h.derpMu.Lock()
+	defer h.derpMu.Unlock()
+	return h.derpMap
+}
+
+// getNamespaceDERPMap returns the DERP map sent to the machines of a
+// namespace. Its preferred region is not applied: marking the other regions
+// Avoid would keep the clients off them when it is down, and this version of
+// tailcfg has no softer hint, such as a region score, the clients pick their
+// home region by latency.
+func (h *Headscale) getNamespaceDERPMap(n Namespace) *tailcfg.DERPMap {
+	derpMap := h.getDERPMap()
+	if derpMap == nil {
+		return nil
+	}
+	// A region left empty in a DERP map file is not sent
+	for _, region := range derpMap.Regions {
+		if region == nil {
+			return withoutNilDERPRegions(derpMap)
+		}
+	}
+	return derpMap
+}
+
+// withoutNilDERPRegions copies the DERP map without its nil regions, the
+// shared map is not modified
+func withoutNilDERPRegions(derpMap *tailcfg.DERPMap) *tailcfg.DERPMap {
+	m := tailcfg.DERPMap{
+		Regions:            map[int]*tailcfg.DERPRegion{},
+		OmitDefaultRegions: derpMap.OmitDefaultRegions,
+	}
+	for id, region := range derpMap.Regions {
+		if region != nil {
+			m.Regions[id] = region
+		}
+	}
+	return &m
+}
+
+// UpdateDERPMapPeriodically reloads the DERP map from h.cfg.DerpMapPaths every
+// h.cfg.DerpUpdateFrequency, and sends the new map to the connected clients
+func (h *Headscale) UpdateDERPMapPeriodically() {
+	if len(h.cfg.DerpMapPaths) == 0 || h.cfg.DerpUpdateFrequency <= 0 {
+		return
+	}
+	ticker := time.NewTicker(h.cfg.DerpUpdateFrequency)
+	for range ticker.C {
+		h.updateDERPMapWorker()
+	}
+}
+
+func (h *Headscale) updateDERPMapWorker() {
+	derpMap, err := LoadDERPMap(h.cfg.DerpMapPaths, h.cfg.DerpMapFetchTimeout, h.cfg.DerpMapCacheDir)
+	if err != nil {
+		log.Error().
+			Err(err).
+			Msg("Could not reload the DERP map, keeping the current one")
+		return
+	}
+	derpMap, err = h.servedDERPMap(derpMap)
+	if err != nil {
+		log.Error().
+			Err(err).
+			Msg("Could not restrict the DERP map to the address family, keeping the current one")
+		return
+	}
+
+	h.derpMu.Lock()
+	h.derpMap = derpMap
+	h.derpMu.Unlock()
+
+	log.Info().
+		Strs("paths", h.cfg.DerpMapPaths).
+		Msg("DERP map reloaded")
+	h.notifyAllClients()
+	if h.cfg.DerpVerifyEndpoints {
+		h.verifyDERPEndpoints()
+	}
+}
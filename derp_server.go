@@ -0,0 +1,159 @@
+package headscale
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+	"tailscale.com/derp"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+)
+
+const stunXorMappedAddress = 0x0020
+
+// newDERPServer returns the embedded DERP server, with the private key of
+// headscale
+func (h *Headscale) newDERPServer() *derp.Server {
+	return derp.NewServer(key.Private(*h.privateKey), func(format string, args ...interface{}) {
+		log.Debug().Msgf("DERP: "+format, args...)
+	})
+}
+
+// embeddedDERPRegion is the region of the embedded DERP server, reached at
+// the host of server_url like the clients reach headscale
+func (h *Headscale) embeddedDERPRegion() (*tailcfg.DERPRegion, error) {
+	u, err := url.Parse(h.cfg.ServerURL)
+	if err != nil {
+		return nil, err
+	}
+	node := tailcfg.DERPNode{
+		Name:     fmt.Sprintf("%da", h.cfg.DerpServerRegionID),
+		RegionID: h.cfg.DerpServerRegionID,
+		HostName: u.Hostname(),
+		STUNPort: -1,
+	}
+	// DERPTestPort is the only way to set the DERP port of a node in this
+	// version of tailcfg, the clients skip the TLS verification with it
+	if port := u.Port(); port != "" && port != "443" {
+		node.DERPTestPort, err = strconv.Atoi(port)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if h.cfg.DerpServerSTUNAddr != "" {
+		_, port, err := net.SplitHostPort(h.cfg.DerpServerSTUNAddr)
+		if err != nil {
+			return nil, err
+		}
+		node.STUNPort, err = strconv.Atoi(port)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &tailcfg.DERPRegion{
+		RegionID:   h.cfg.DerpServerRegionID,
+		RegionCode: h.cfg.DerpServerRegionCode,
+		RegionName: h.cfg.DerpServerRegionName,
+		Nodes:      []*tailcfg.DERPNode{&node},
+	}, nil
+}
+
+// withEmbeddedDERP returns a copy of derpMap with the region of the embedded
+// DERP server, if it is enabled
+func (h *Headscale) withEmbeddedDERP(derpMap *tailcfg.DERPMap) *tailcfg.DERPMap {
+	if h.derpServer == nil {
+		return derpMap
+	}
+	region, err := h.embeddedDERPRegion()
+	if err != nil {
+		log.Error().
+			Err(err).
+			Msg("Cannot add the embedded DERP server to the DERP map")
+		return derpMap
+	}
+
+	m := tailcfg.DERPMap{Regions: map[int]*tailcfg.DERPRegion{}}
+	if derpMap != nil {
+		m.OmitDefaultRegions = derpMap.OmitDefaultRegions
+		for id, r := range derpMap.Regions {
+			m.Regions[id] = r
+		}
+	}
+	if _, ok := m.Regions[region.RegionID]; ok {
+		log.Warn().
+			Int("region", region.RegionID).
+			Msg("The region of the embedded DERP server overrides a region of the DERP map")
+	}
+	m.Regions[region.RegionID] = region
+	return &m
+}
+
+// DERPProbeHandler answers the probes of the clients and of
+// derp_verify_endpoints, like derper
+func (h *Headscale) DERPProbeHandler(c *gin.Context) {
+	c.Header("Access-Control-Allow-Origin", "*")
+	c.String(http.StatusOK, "")
+}
+
+// listenSTUN opens the STUN port of the embedded DERP server, so an unusable
+// address is reported at startup
+func (h *Headscale) listenSTUN() (net.PacketConn, error) {
+	return net.ListenPacket("udp", h.cfg.DerpServerSTUNAddr)
+}
+
+// serveSTUN answers the STUN binding requests with the address they come
+// from, until pc is closed
+func serveSTUN(pc net.PacketConn) error {
+	b := make([]byte, 1500)
+	for {
+		n, addr, err := pc.ReadFrom(b)
+		if err != nil {
+			return err
+		}
+		udpAddr, ok := addr.(*net.UDPAddr)
+		if !ok || n < 20 || binary.BigEndian.Uint16(b[0:]) != stunBindRequest ||
+			binary.BigEndian.Uint32(b[4:]) != stunMagicCookie {
+			continue
+		}
+		if _, err := pc.WriteTo(stunResponse(b[8:20], udpAddr), addr); err != nil {
+			log.Debug().
+				Err(err).
+				Msg("Cannot answer the STUN request")
+		}
+	}
+}
+
+// stunResponse is a binding success with the XOR-MAPPED-ADDRESS of addr
+func stunResponse(txID []byte, addr *net.UDPAddr) []byte {
+	ip, family := addr.IP.To4(), byte(0x01)
+	if ip == nil {
+		ip, family = addr.IP.To16(), 0x02
+	}
+	xor := make([]byte, 16)
+	binary.BigEndian.PutUint32(xor, stunMagicCookie)
+	copy(xor[4:], txID)
+
+	value := make([]byte, 4+len(ip))
+	value[1] = family
+	binary.BigEndian.PutUint16(value[2:], uint16(addr.Port)^uint16(stunMagicCookie>>16))
+	for i := range ip {
+		value[4+i] = ip[i] ^ xor[i]
+	}
+
+	resp := make([]byte, 20, 20+4+len(value))
+	binary.BigEndian.PutUint16(resp[0:], stunBindSuccess)
+	binary.BigEndian.PutUint16(resp[2:], uint16(4+len(value)))
+	binary.BigEndian.PutUint32(resp[4:], stunMagicCookie)
+	copy(resp[8:], txID)
+	attr := make([]byte, 4)
+	binary.BigEndian.PutUint16(attr[0:], stunXorMappedAddress)
+	binary.BigEndian.PutUint16(attr[2:], uint16(len(value)))
+	resp = append(resp, attr...)
+	return append(resp, value...)
+}
@@ -0,0 +1,339 @@
+package headscale
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+
+	"gopkg.in/check.v1"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/wgkey"
+)
+
+func (s *Suite) TestLoadDERPMapFromFile(c *check.C) {
+	derpMap, err := LoadDERPMap([]string{"./derp.yaml"}, time.Second, "")
+	c.Assert(err, check.IsNil)
+	c.Assert(len(derpMap.Regions) > 0, check.Equals, true)
+
+	_, err = LoadDERPMap([]string{"./does-not-exist.yaml"}, time.Second, "")
+	c.Assert(err, check.NotNil)
+}
+
+func (s *Suite) TestLoadDERPMapFromURL(c *check.C) {
+	derpYaml, err := os.ReadFile("./derp.yaml")
+	c.Assert(err, check.IsNil)
+
+	available := true
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !available {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write(derpYaml)
+	}))
+	defer ts.Close()
+
+	derpMap, err := LoadDERPMap([]string{ts.URL}, time.Second, "")
+	c.Assert(err, check.IsNil)
+	c.Assert(len(derpMap.Regions) > 0, check.Equals, true)
+
+	// The cached copy is used when the URL is not available
+	available = false
+	cached, err := LoadDERPMap([]string{ts.URL}, time.Second, "")
+	c.Assert(err, check.IsNil)
+	c.Assert(cached, check.DeepEquals, derpMap)
+
+	_, err = LoadDERPMap([]string{ts.URL + "/not-cached"}, time.Second, "")
+	c.Assert(err, check.NotNil)
+}
+
+func (s *Suite) TestLoadDERPMapFromDiskCache(c *check.C) {
+	derpYaml, err := os.ReadFile("./derp.yaml")
+	c.Assert(err, check.IsNil)
+
+	available := true
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !available {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write(derpYaml)
+	}))
+	defer ts.Close()
+
+	cacheDir := tmpDir + "/derp_cache"
+	derpMap, err := LoadDERPMap([]string{ts.URL}, time.Second, cacheDir)
+	c.Assert(err, check.IsNil)
+
+	// As after a restart with the URL unreachable
+	available = false
+	derpMapURLCache.Lock()
+	derpMapURLCache.maps = map[string]*tailcfg.DERPMap{}
+	derpMapURLCache.Unlock()
+	cached, err := LoadDERPMap([]string{ts.URL}, time.Second, cacheDir)
+	c.Assert(err, check.IsNil)
+	c.Assert(len(cached.Regions), check.Equals, len(derpMap.Regions))
+	for id, region := range derpMap.Regions {
+		c.Assert(cached.Regions[id].RegionCode, check.Equals, region.RegionCode)
+	}
+}
+
+func (s *Suite) TestUpdateDERPMapWorker(c *check.C) {
+	h.cfg.DerpMapPaths = []string{"./does-not-exist.yaml"}
+	h.updateDERPMapWorker()
+	c.Assert(h.getDERPMap(), check.IsNil)
+
+	h.cfg.DerpMapPaths = []string{"./derp.yaml"}
+	h.updateDERPMapWorker()
+	c.Assert(h.getDERPMap(), check.NotNil)
+}
+
+func (s *Suite) TestMergeDERPMaps(c *check.C) {
+	tmpDir, err := os.MkdirTemp("", "headscale-derp")
+	c.Assert(err, check.IsNil)
+	defer os.RemoveAll(tmpDir)
+
+	custom := filepath.Join(tmpDir, "custom.yaml")
+	err = os.WriteFile(custom, []byte(`
+regions:
+  1:
+    regionid: 1
+    regioncode: nyc
+    regionname: Overridden NYC
+    nodes:
+    - name: 1a
+      regionid: 1
+      hostname: derp.example.com
+  900:
+    regionid: 900
+    regioncode: custom
+    regionname: Custom
+    nodes:
+    - name: 900a
+      regionid: 900
+      hostname: derp.example.com
+`), 0644)
+	c.Assert(err, check.IsNil)
+
+	upstream, err := LoadDERPMap([]string{"./derp.yaml"}, time.Second, "")
+	c.Assert(err, check.IsNil)
+
+	derpMap, err := LoadDERPMap([]string{"./derp.yaml", custom}, time.Second, "")
+	c.Assert(err, check.IsNil)
+	c.Assert(len(derpMap.Regions), check.Equals, len(upstream.Regions)+1)
+	c.Assert(derpMap.Regions[1].RegionName, check.Equals, "Overridden NYC")
+	c.Assert(derpMap.Regions[900].RegionCode, check.Equals, "custom")
+}
+
+func (s *Suite) TestValidateDERPMap(c *check.C) {
+	tmpDir, err := os.MkdirTemp("", "headscale-derp")
+	c.Assert(err, check.IsNil)
+	defer os.RemoveAll(tmpDir)
+
+	empty := filepath.Join(tmpDir, "empty.yaml")
+	err = os.WriteFile(empty, []byte("regions:\n"), 0644)
+	c.Assert(err, check.IsNil)
+
+	_, err = LoadDERPMap([]string{empty}, time.Second, "")
+	c.Assert(err, check.Equals, errorDERPMapEmpty)
+
+	malformed := filepath.Join(tmpDir, "malformed.yaml")
+	err = os.WriteFile(malformed, []byte(`
+regions:
+  900:
+    regionid: 901
+    regioncode: custom
+    nodes:
+    - name: 900a
+      regionid: 900
+  901:
+    regionid: 901
+    regioncode: empty
+`), 0644)
+	c.Assert(err, check.IsNil)
+
+	derpMap, err := LoadDERPMap([]string{malformed}, time.Second, "")
+	c.Assert(derpMap, check.NotNil)
+	c.Assert(errors.Is(err, errorDERPMapInvalid), check.Equals, true)
+	c.Assert(err, check.ErrorMatches, "invalid DERP map: region 900 has regionid 901, node 0 of region 900 has no hostname, region 901 has no nodes")
+}
+
+func (s *Suite) TestNamespaceDERPRegion(c *check.C) {
+	h.derpMap = &tailcfg.DERPMap{
+		Regions: map[int]*tailcfg.DERPRegion{
+			1: {RegionID: 1, RegionCode: "nyc"},
+			2: {RegionID: 2, RegionCode: "fra"},
+		},
+	}
+	n, err := h.CreateNamespace("test")
+	c.Assert(err, check.IsNil)
+
+	// No preference
+	c.Assert(h.getNamespaceDERPMap(*n), check.Equals, h.derpMap)
+
+	_, err = h.SetNamespaceDERPRegion(n.Name, 3)
+	c.Assert(err, check.Equals, errorDERPRegionNotFound)
+
+	n, err = h.SetNamespaceDERPRegion(n.Name, 2)
+	c.Assert(err, check.IsNil)
+	n, err = h.GetNamespace(n.Name)
+	c.Assert(err, check.IsNil)
+	c.Assert(n.PreferredDERPRegion, check.Equals, 2)
+
+	// The other regions stay usable, for the machines to fail over
+	derpMap := h.getNamespaceDERPMap(*n)
+	c.Assert(derpMap.Regions[1].Avoid, check.Equals, false)
+	c.Assert(derpMap.Regions[2].Avoid, check.Equals, false)
+
+	// An empty region is left out, the shared map is not modified
+	h.derpMap.Regions[3] = nil
+	derpMap = h.getNamespaceDERPMap(*n)
+	c.Assert(derpMap.Regions, check.HasLen, 2)
+	c.Assert(h.derpMap.Regions, check.HasLen, 3)
+
+	n, err = h.SetNamespaceDERPRegion(n.Name, 0)
+	c.Assert(err, check.IsNil)
+	delete(h.derpMap.Regions, 3)
+	c.Assert(h.getNamespaceDERPMap(*n), check.Equals, h.derpMap)
+}
+
+func (s *Suite) TestVerifyDERPMap(c *check.C) {
+	stun, err := net.ListenPacket("udp", "127.0.0.1:0")
+	c.Assert(err, check.IsNil)
+	defer stun.Close()
+	go func() {
+		b := make([]byte, 1500)
+		for {
+			n, addr, err := stun.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			resp := make([]byte, 20)
+			binary.BigEndian.PutUint16(resp[0:], stunBindSuccess)
+			copy(resp[4:], b[4:n])
+			stun.WriteTo(resp, addr)
+		}
+	}()
+
+	// Nothing listens on the port of the relay
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, check.IsNil)
+	relayPort := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	derpMap := &tailcfg.DERPMap{Regions: map[int]*tailcfg.DERPRegion{
+		900: {RegionID: 900, Nodes: []*tailcfg.DERPNode{
+			{Name: "stun", RegionID: 900, HostName: "localhost", IPv4: "127.0.0.1", STUNOnly: true, STUNPort: stun.LocalAddr().(*net.UDPAddr).Port},
+			{Name: "relay", RegionID: 900, HostName: "127.0.0.1", STUNPort: -1, DERPTestPort: relayPort},
+		}},
+	}}
+	c.Assert(validateDERPMap(derpMap), check.IsNil)
+	errs := VerifyDERPMap(derpMap, time.Second)
+	c.Assert(errs, check.HasLen, 1)
+	c.Assert(errs[0], check.ErrorMatches, "region 900 node relay: relay unreachable: .*")
+
+	// The host name is probed when the IPv4 is disabled
+	probe := &tailcfg.DERPNode{HostName: "127.0.0.1", IPv4: "none", STUNPort: stun.LocalAddr().(*net.UDPAddr).Port}
+	c.Assert(probeSTUN(probe, time.Second), check.IsNil)
+
+	derpMap.Regions[900].Nodes[0].STUNPort = -1
+	c.Assert(errors.Is(validateDERPMap(derpMap), errorDERPMapInvalid), check.Equals, true)
+}
+
+func (s *Suite) TestProbeDERPRelay(c *check.C) {
+	status := http.StatusOK
+	relay := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer relay.Close()
+
+	// The certificate is not verified with DERPTestPort, like in the clients
+	node := &tailcfg.DERPNode{HostName: "127.0.0.1", DERPTestPort: relay.Listener.Addr().(*net.TCPAddr).Port}
+	c.Assert(probeDERPRelay(node, time.Second), check.IsNil)
+
+	status = http.StatusNotFound
+	c.Assert(probeDERPRelay(node, time.Second), check.ErrorMatches, "unexpected status 404 Not Found")
+}
+
+func (s *Suite) TestEmbeddedDERP(c *check.C) {
+	derpMap, err := LoadDERPMap([]string{"./derp.yaml"}, time.Second, "")
+	c.Assert(err, check.IsNil)
+	c.Assert(h.withEmbeddedDERP(derpMap), check.Equals, derpMap)
+
+	privKey, err := wgkey.NewPrivate()
+	c.Assert(err, check.IsNil)
+	h.privateKey = &privKey
+	h.cfg.ServerURL = "https://headscale.example.com:8443/vpn"
+	h.cfg.DerpServerRegionID = 999
+	h.cfg.DerpServerRegionCode = "headscale"
+	h.cfg.DerpServerSTUNAddr = "127.0.0.1:3478"
+	h.derpServer = h.newDERPServer()
+	defer h.derpServer.Close()
+
+	m := h.withEmbeddedDERP(derpMap)
+	c.Assert(m.Regions, check.HasLen, len(derpMap.Regions)+1)
+	c.Assert(derpMap.Regions[999], check.IsNil)
+	c.Assert(validateDERPMap(m), check.IsNil)
+	node := m.Regions[999].Nodes[0]
+	c.Assert(node.HostName, check.Equals, "headscale.example.com")
+	c.Assert(node.DERPTestPort, check.Equals, 8443)
+	c.Assert(node.STUNPort, check.Equals, 3478)
+
+	h.cfg.DerpServerSTUNAddr = "127.0.0.1:0"
+	pc, err := h.listenSTUN()
+	c.Assert(err, check.IsNil)
+	defer pc.Close()
+	go serveSTUN(pc)
+	probe := &tailcfg.DERPNode{HostName: "localhost", IPv4: "127.0.0.1", STUNPort: pc.LocalAddr().(*net.UDPAddr).Port}
+	c.Assert(probeSTUN(probe, time.Second), check.IsNil)
+}
+
+func (s *Suite) TestFilterDERPMapFamily(c *check.C) {
+	derpMap := &tailcfg.DERPMap{
+		Regions: map[int]*tailcfg.DERPRegion{
+			1: {
+				RegionID: 1,
+				Nodes: []*tailcfg.DERPNode{
+					{Name: "1a", RegionID: 1, HostName: "derp1a.example.com", IPv4: "192.0.2.1", IPv6: "2001:db8::1"},
+					{Name: "1b", RegionID: 1, HostName: "derp1b.example.com", IPv4: "192.0.2.2", IPv6: "none"},
+				},
+			},
+			2: {
+				RegionID: 2,
+				Nodes: []*tailcfg.DERPNode{
+					{Name: "2a", RegionID: 2, HostName: "derp2a.example.com"},
+				},
+			},
+		},
+	}
+
+	m, err := FilterDERPMapFamily(derpMap, "")
+	c.Assert(err, check.IsNil)
+	c.Assert(m, check.Equals, derpMap)
+
+	m, err = FilterDERPMapFamily(derpMap, "ipv6")
+	c.Assert(err, check.IsNil)
+	c.Assert(m.Regions[1].Nodes, check.HasLen, 1)
+	c.Assert(m.Regions[1].Nodes[0].IPv4, check.Equals, "none")
+	c.Assert(m.Regions[1].Nodes[0].IPv6, check.Equals, "2001:db8::1")
+	// Reached through the DNS
+	c.Assert(m.Regions[2].Nodes[0].IPv4, check.Equals, "none")
+	c.Assert(m.Regions[2].Nodes[0].IPv6, check.Equals, "")
+	// The loaded map is not modified
+	c.Assert(derpMap.Regions[1].Nodes, check.HasLen, 2)
+	c.Assert(derpMap.Regions[1].Nodes[0].IPv4, check.Equals, "192.0.2.1")
+
+	m, err = FilterDERPMapFamily(derpMap, "ipv4")
+	c.Assert(err, check.IsNil)
+	c.Assert(m.Regions[1].Nodes, check.HasLen, 2)
+	c.Assert(m.Regions[1].Nodes[0].IPv6, check.Equals, "none")
+
+	derpMap.Regions[2].Nodes[0].IPv6 = "none"
+	_, err = FilterDERPMapFamily(derpMap, "ipv6")
+	c.Assert(err, check.ErrorMatches, "invalid DERP map: region 2 has no ipv6 node")
+}
@@ -0,0 +1,174 @@
+package headscale
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"tailscale.com/tailcfg"
+)
+
+// derpProbeTimeout bounds each probe of a DERP node
+const derpProbeTimeout = 5 * time.Second
+
+const (
+	defaultSTUNPort = 3478
+	stunMagicCookie = 0x2112A442
+	stunBindRequest = 0x0001
+	stunBindSuccess = 0x0101
+)
+
+// VerifyDERPMap probes the DERP nodes of the map: the relay of the nodes that
+// are not STUN-only, and the STUN port of the nodes that do not disable it
+// with a negative stunport. It returns the unreachable endpoints, ordered by
+// region and node.
+func VerifyDERPMap(derpMap *tailcfg.DERPMap, timeout time.Duration) []error {
+	type probe struct {
+		region int
+		node   int
+		err    error
+	}
+	probes := []*probe{}
+	var wg sync.WaitGroup
+	for id, region := range derpMap.Regions {
+		if region == nil {
+			continue
+		}
+		for i, node := range region.Nodes {
+			if node == nil {
+				continue
+			}
+			if !node.STUNOnly {
+				p := &probe{region: id, node: i}
+				probes = append(probes, p)
+				wg.Add(1)
+				go func(node *tailcfg.DERPNode) {
+					defer wg.Done()
+					if err := probeDERPRelay(node, timeout); err != nil {
+						p.err = fmt.Errorf("region %d node %s: relay unreachable: %w", node.RegionID, node.Name, err)
+					}
+				}(node)
+			}
+			if node.STUNPort >= 0 {
+				p := &probe{region: id, node: i}
+				probes = append(probes, p)
+				wg.Add(1)
+				go func(node *tailcfg.DERPNode) {
+					defer wg.Done()
+					if err := probeSTUN(node, timeout); err != nil {
+						p.err = fmt.Errorf("region %d node %s: STUN unreachable: %w", node.RegionID, node.Name, err)
+					}
+				}(node)
+			}
+		}
+	}
+	wg.Wait()
+
+	sort.SliceStable(probes, func(i, j int) bool {
+		if probes[i].region != probes[j].region {
+			return probes[i].region < probes[j].region
+		}
+		return probes[i].node < probes[j].node
+	})
+	errs := []error{}
+	for _, p := range probes {
+		if p.err != nil {
+			errs = append(errs, p.err)
+		}
+	}
+	return errs
+}
+
+// probeDERPRelay requests /derp/probe, which derper answers, over HTTPS like
+// the clients. DERPTestPort replaces 443 if set, the clients then skip the
+// verification of the certificate, and so does the probe.
+func probeDERPRelay(node *tailcfg.DERPNode, timeout time.Duration) error {
+	host := node.HostName
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if node.DERPTestPort != 0 {
+		host = net.JoinHostPort(host, strconv.Itoa(node.DERPTestPort))
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	client := http.Client{Timeout: timeout, Transport: transport}
+	resp, err := client.Get("https://" + host + "/derp/probe")
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols && (resp.StatusCode < 200 || resp.StatusCode > 299) {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// probeSTUN sends a STUN binding request to the node, at its IPv4 address if
+// set, else at its IPv6 address, and waits for the answer. "none" disables
+// an address family for the node.
+func probeSTUN(node *tailcfg.DERPNode, timeout time.Duration) error {
+	host := node.HostName
+	switch {
+	case node.IPv4 != "" && node.IPv4 != "none":
+		host = node.IPv4
+	case node.IPv6 != "" && node.IPv6 != "none":
+		host = node.IPv6
+	}
+	port := node.STUNPort
+	if port == 0 {
+		port = defaultSTUNPort
+	}
+	conn, err := net.DialTimeout("udp", net.JoinHostPort(host, strconv.Itoa(port)), timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return err
+	}
+
+	req := make([]byte, 20)
+	binary.BigEndian.PutUint16(req[0:], stunBindRequest)
+	binary.BigEndian.PutUint32(req[4:], stunMagicCookie)
+	if _, err := rand.Read(req[8:]); err != nil {
+		return err
+	}
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+	resp := make([]byte, 1500)
+	n, err := conn.Read(resp)
+	if err != nil {
+		return err
+	}
+	if n < 20 || binary.BigEndian.Uint16(resp[0:]) != stunBindSuccess || !bytes.Equal(resp[8:20], req[8:20]) {
+		return fmt.Errorf("invalid STUN response")
+	}
+	return nil
+}
+
+// verifyDERPEndpoints logs the unreachable endpoints of the current DERP map
+func (h *Headscale) verifyDERPEndpoints() {
+	derpMap := h.getDERPMap()
+	if derpMap == nil {
+		return
+	}
+	errs := VerifyDERPMap(derpMap, derpProbeTimeout)
+	for _, err := range errs {
+		log.Warn().
+			Err(err).
+			Msg("DERP endpoint unreachable")
+	}
+	if len(errs) == 0 {
+		log.Info().
+			Int("regions", len(derpMap.Regions)).
+			Msg("DERP endpoints verified")
+	}
+}
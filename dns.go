@@ -0,0 +1,125 @@
+package headscale
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"tailscale.com/tailcfg"
+)
+
+var dnsLabelInvalidChars = regexp.MustCompile(`[^a-z0-9-]+`)
+
+// getMagicDNSNames returns the MagicDNS name (hostname.namespace.base_domain)
+// of every registered machine in a namespace, indexed by machine ID.
+//
+// Machines sharing a hostname get a numeric suffix in the order they were
+// created, so the names are stable as long as the older machines are kept.
+// The map is empty when MagicDNS is disabled.
+func (h *Headscale) getMagicDNSNames(namespaceID uint) (map[uint64]string, error) {
+	names := map[uint64]string{}
+	if !h.cfg.MagicDNS {
+		return names, nil
+	}
+
+	ns := Namespace{}
+	if err := h.db.First(&ns, "id = ?", namespaceID).Error; err != nil {
+		return nil, err
+	}
+	machines := []Machine{}
+	if err := h.db.Where("namespace_id = ? AND registered", namespaceID).Order("id").Find(&machines).Error; err != nil {
+		return nil, err
+	}
+
+	// The given names are unique in the namespace, the hostnames get a suffix
+	// if they collide with them or between each other
+	used := map[string]bool{}
+	for _, m := range machines {
+		if m.GivenName != "" {
+			used[m.GivenName] = true
+			names[m.ID] = fmt.Sprintf("%s.%s.", m.GivenName, h.namespaceDomain(ns.Name))
+		}
+	}
+	for _, m := range machines {
+		if m.GivenName != "" {
+			continue
+		}
+		label := dnsLabel(m.Name)
+		name := label
+		for i := 1; used[name]; i++ {
+			name = fmt.Sprintf("%s-%d", label, i)
+		}
+		used[name] = true
+		names[m.ID] = fmt.Sprintf("%s.%s.", name, h.namespaceDomain(ns.Name))
+	}
+	return names, nil
+}
+
+// getDNSConfig returns the DNS configuration sent to a machine in its netmap,
+// or nil if there is nothing to configure
+func (h *Headscale) getDNSConfig(m Machine) *tailcfg.DNSConfig {
+	if !h.cfg.MagicDNS && len(h.cfg.DNSNameservers) == 0 && len(h.cfg.DNSSearchDomains) == 0 &&
+		len(h.cfg.DNSSplit) == 0 && len(h.cfg.DNSExtraRecords) == 0 {
+		return nil
+	}
+
+	dnsConfig := tailcfg.DNSConfig{
+		Nameservers:  h.cfg.DNSNameservers,
+		ExtraRecords: h.cfg.DNSExtraRecords,
+		Proxied:      h.cfg.MagicDNS,
+	}
+	if h.cfg.MagicDNS {
+		// Short names are looked up in the namespace of the machine first
+		if h.cfg.DNSUseNamespaceSearchDomains {
+			dnsConfig.Domains = append(dnsConfig.Domains, h.namespaceDomain(m.Namespace.Name))
+		}
+		dnsConfig.Domains = append(dnsConfig.Domains, h.cfg.BaseDomain)
+	}
+	dnsConfig.Domains = uniqueDomains(append(dnsConfig.Domains, h.cfg.DNSSearchDomains...))
+
+	// Split DNS: the names under these domains are resolved by their own
+	// resolvers, the others keep using the default ones
+	if len(h.cfg.DNSSplit) > 0 {
+		dnsConfig.Routes = map[string][]tailcfg.DNSResolver{}
+		for domain, resolvers := range h.cfg.DNSSplit {
+			for _, ip := range resolvers {
+				dnsConfig.Routes[domain] = append(dnsConfig.Routes[domain], tailcfg.DNSResolver{Addr: ip.String()})
+			}
+		}
+	}
+	return &dnsConfig
+}
+
+// namespaceDomain is the domain of the MagicDNS names of a namespace. The
+// namespace names are valid DNS labels, except for the ones created before
+// they were checked.
+func (h *Headscale) namespaceDomain(namespaceName string) string {
+	return fmt.Sprintf("%s.%s", dnsLabel(namespaceName), h.cfg.BaseDomain)
+}
+
+// uniqueDomains removes the repeated search domains, keeping the first one,
+// as dns_search_domains can list the MagicDNS domains too
+func uniqueDomains(domains []string) []string {
+	seen := map[string]bool{}
+	unique := []string{}
+	for _, d := range domains {
+		key := strings.TrimSuffix(strings.ToLower(d), ".")
+		if !seen[key] {
+			seen[key] = true
+			unique = append(unique, d)
+		}
+	}
+	return unique
+}
+
+// dnsLabel turns a hostname into a valid DNS label
+func dnsLabel(hostname string) string {
+	label := strings.Trim(dnsLabelInvalidChars.ReplaceAllString(strings.ToLower(hostname), "-"), "-")
+	if len(label) > 63 {
+		label = strings.Trim(label[:63], "-")
+	}
+	if label == "" {
+		label = "machine"
+	}
+	return label
+}
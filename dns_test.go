@@ -0,0 +1,99 @@
+package headscale
+
+import (
+	"fmt"
+
+	"gopkg.in/check.v1"
+	"inet.af/netaddr"
+	"tailscale.com/tailcfg"
+)
+
+func (s *Suite) TestMagicDNSNames(c *check.C) {
+	n, err := h.CreateNamespace("myteam")
+	c.Assert(err, check.IsNil)
+
+	for i, name := range []string{"laptop", "Laptop", "my_desktop", "laptop-1"} {
+		m := Machine{
+			ID:             uint64(i + 1),
+			MachineKey:     fmt.Sprintf("key%d", i),
+			Name:           name,
+			NamespaceID:    n.ID,
+			Registered:     true,
+			RegisterMethod: "cli",
+		}
+		h.db.Save(&m)
+	}
+
+	names, err := h.getMagicDNSNames(n.ID)
+	c.Assert(err, check.IsNil)
+	c.Assert(len(names), check.Equals, 0)
+
+	h.cfg.MagicDNS = true
+	h.cfg.BaseDomain = "example.com"
+	h.cfg.DNSUseNamespaceSearchDomains = true
+	defer func() {
+		h.cfg.MagicDNS = false
+		h.cfg.BaseDomain = ""
+		h.cfg.DNSUseNamespaceSearchDomains = false
+	}()
+
+	names, err = h.getMagicDNSNames(n.ID)
+	c.Assert(err, check.IsNil)
+	c.Assert(names[1], check.Equals, "laptop.myteam.example.com.")
+	c.Assert(names[2], check.Equals, "laptop-1.myteam.example.com.")
+	c.Assert(names[3], check.Equals, "my-desktop.myteam.example.com.")
+	c.Assert(names[4], check.Equals, "laptop-1-1.myteam.example.com.")
+
+	m, err := h.GetMachineByID(1)
+	c.Assert(err, check.IsNil)
+	dnsConfig := h.getDNSConfig(*m)
+	c.Assert(dnsConfig.Proxied, check.Equals, true)
+	c.Assert(dnsConfig.Domains, check.DeepEquals, []string{"myteam.example.com", "example.com"})
+
+	c.Assert(len(dnsConfig.Nameservers), check.Equals, 0)
+
+	// The search domains already given are not repeated
+	h.cfg.DNSSearchDomains = []string{"Example.com.", "corp.example.org"}
+	defer func() { h.cfg.DNSSearchDomains = nil }()
+	dnsConfig = h.getDNSConfig(*m)
+	c.Assert(dnsConfig.Domains, check.DeepEquals, []string{"myteam.example.com", "example.com", "corp.example.org"})
+
+	// The bare hostnames are then not looked up in the namespace
+	h.cfg.DNSUseNamespaceSearchDomains = false
+	dnsConfig = h.getDNSConfig(*m)
+	c.Assert(dnsConfig.Domains, check.DeepEquals, []string{"example.com", "corp.example.org"})
+}
+
+func (s *Suite) TestDNSConfigWithoutMagicDNS(c *check.C) {
+	c.Assert(h.getDNSConfig(Machine{}), check.IsNil)
+
+	h.cfg.DNSNameservers = []netaddr.IP{netaddr.MustParseIP("1.1.1.1")}
+	h.cfg.DNSSearchDomains = []string{"corp.example.org"}
+	h.cfg.DNSExtraRecords = []tailcfg.DNSRecord{{Name: "git.internal", Value: "10.0.0.5"}}
+	defer func() {
+		h.cfg.DNSNameservers = nil
+		h.cfg.DNSSearchDomains = nil
+		h.cfg.DNSExtraRecords = nil
+	}()
+
+	dnsConfig := h.getDNSConfig(Machine{})
+	c.Assert(dnsConfig, check.NotNil)
+	c.Assert(dnsConfig.Proxied, check.Equals, false)
+	c.Assert(dnsConfig.Nameservers, check.DeepEquals, h.cfg.DNSNameservers)
+	c.Assert(dnsConfig.Domains, check.DeepEquals, []string{"corp.example.org"})
+	c.Assert(dnsConfig.ExtraRecords, check.DeepEquals, h.cfg.DNSExtraRecords)
+}
+
+func (s *Suite) TestSplitDNS(c *check.C) {
+	h.cfg.DNSSplit = map[string][]netaddr.IP{
+		"corp.example.com": {netaddr.MustParseIP("10.0.0.53"), netaddr.MustParseIP("10.0.1.53")},
+	}
+	defer func() { h.cfg.DNSSplit = nil }()
+
+	dnsConfig := h.getDNSConfig(Machine{})
+	c.Assert(dnsConfig, check.NotNil)
+	c.Assert(len(dnsConfig.Nameservers), check.Equals, 0)
+	c.Assert(dnsConfig.Routes, check.DeepEquals, map[string][]tailcfg.DNSResolver{
+		"corp.example.com": {{Addr: "10.0.0.53"}, {Addr: "10.0.1.53"}},
+	})
+}
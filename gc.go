@@ -0,0 +1,129 @@
+package headscale
+
+import (
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+)
+
+// GCResult lists the pre-auth keys and the machines removed by
+// GarbageCollect, or that it would remove without apply
+type GCResult struct {
+	PreAuthKeys []PreAuthKey
+	Machines    []Machine
+	Applied     bool
+}
+
+// GarbageCollect lists the expired pre-auth keys and the machines not seen
+// for longer than inactivity (counting from their creation if they were
+// never seen), and with apply deletes them. inactivity 0 uses
+// GCMachineInactivity, and the machines are kept if it is 0 too.
+//
+// The expired keys still used by a machine that is kept are kept as well, the
+// machine refers to them. The listing and the deletion are done in the same
+// transaction, so a dry run lists what apply removes.
+func (h *Headscale) GarbageCollect(inactivity time.Duration, apply bool) (_ *GCResult, err error) {
+	if apply {
+		defer func() { h.audit("gc.apply", "database", err) }()
+		if err = h.checkMaintenance(); err != nil {
+			return nil, err
+		}
+	}
+	if inactivity == 0 {
+		inactivity = h.cfg.GCMachineInactivity
+	}
+
+	now := time.Now().UTC()
+	result := GCResult{PreAuthKeys: []PreAuthKey{}, Machines: []Machine{}}
+	err = h.db.Transaction(func(tx *gorm.DB) error {
+		if inactivity > 0 {
+			q := "COALESCE(last_seen, created_at) < ?"
+			if err := tx.Preload("Namespace").Where(q, now.Add(-inactivity)).Order("id").Find(&result.Machines).Error; err != nil {
+				return err
+			}
+		}
+		collected := map[uint64]bool{}
+		machineIDs := []uint64{}
+		for _, m := range result.Machines {
+			collected[m.ID] = true
+			machineIDs = append(machineIDs, m.ID)
+		}
+
+		machines := []Machine{}
+		if err := tx.Select("id", "auth_key_id").Where("auth_key_id <> 0").Find(&machines).Error; err != nil {
+			return err
+		}
+		used := map[uint64]bool{}
+		for _, m := range machines {
+			if !collected[m.ID] {
+				used[uint64(m.AuthKeyID)] = true
+			}
+		}
+		keys := []PreAuthKey{}
+		if err := tx.Preload("Namespace").Where("expiration IS NOT NULL AND expiration < ?", now).Order("id").Find(&keys).Error; err != nil {
+			return err
+		}
+		keyIDs := []uint64{}
+		for _, k := range keys {
+			if !used[k.ID] {
+				result.PreAuthKeys = append(result.PreAuthKeys, k)
+				keyIDs = append(keyIDs, k.ID)
+			}
+		}
+		if !apply {
+			return nil
+		}
+
+		if len(machineIDs) > 0 {
+			if err := tx.Where("machine_id IN ?", machineIDs).Delete(&SharedMachine{}).Error; err != nil {
+				return err
+			}
+			if err := tx.Unscoped().Where("id IN ?", machineIDs).Delete(&Machine{}).Error; err != nil {
+				return err
+			}
+		}
+		if len(keyIDs) > 0 {
+			if err := tx.Where("id IN ?", keyIDs).Delete(&PreAuthKey{}).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	result.Applied = apply
+
+	if apply && (len(result.Machines) > 0 || len(result.PreAuthKeys) > 0) {
+		log.Info().
+			Int("machines", len(result.Machines)).
+			Int("preauthkeys", len(result.PreAuthKeys)).
+			Msg("Garbage collected the inactive machines and the expired pre-auth keys")
+	}
+	// The peers of the deleted machines can be in any namespace, through the
+	// shares
+	if apply && len(result.Machines) > 0 {
+		h.notifyAllClients()
+	}
+	return &result, nil
+}
+
+// GarbageCollectPeriodically runs GarbageCollect every GCInterval, if set
+func (h *Headscale) GarbageCollectPeriodically() {
+	if h.cfg.GCInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(h.cfg.GCInterval)
+	for range ticker.C {
+		// Collected at the first tick after the maintenance
+		if h.checkMaintenance() != nil {
+			continue
+		}
+		if _, err := h.GarbageCollect(0, true); err != nil {
+			log.Error().
+				Err(err).
+				Msg("Could not garbage collect the database")
+		}
+	}
+}
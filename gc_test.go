@@ -0,0 +1,71 @@
+package headscale
+
+import (
+	"fmt"
+	"time"
+
+	"gopkg.in/check.v1"
+)
+
+func (s *Suite) TestGarbageCollect(c *check.C) {
+	n, err := h.CreateNamespace("test")
+	c.Assert(err, check.IsNil)
+
+	now := time.Now().UTC()
+	expired := now.Add(-time.Hour)
+	keys := []PreAuthKey{}
+	for i := 0; i < 3; i++ {
+		k, err := h.CreatePreAuthKey(n.Name, true, false, &expired, nil)
+		c.Assert(err, check.IsNil)
+		keys = append(keys, *k)
+	}
+	_, err = h.CreatePreAuthKey(n.Name, true, false, nil, nil)
+	c.Assert(err, check.IsNil)
+
+	longAgo := now.Add(-100 * 24 * time.Hour)
+	recently := now.Add(-time.Minute)
+	for i, lastSeen := range []*time.Time{&longAgo, &recently, nil} {
+		m := Machine{
+			ID:          uint64(i + 1),
+			MachineKey:  fmt.Sprintf("%064d", i+1),
+			Name:        fmt.Sprintf("machine%d", i+1),
+			NamespaceID: n.ID,
+			Registered:  true,
+			LastSeen:    lastSeen,
+			AuthKeyID:   uint(keys[i].ID),
+		}
+		h.db.Save(&m)
+	}
+	// Never seen, counts from its creation
+	h.db.Model(&Machine{}).Where("id = ?", 3).UpdateColumn("created_at", longAgo)
+
+	// The key of the machine that is kept is kept too
+	result, err := h.GarbageCollect(90*24*time.Hour, false)
+	c.Assert(err, check.IsNil)
+	c.Assert(result.Applied, check.Equals, false)
+	c.Assert(len(result.Machines), check.Equals, 2)
+	c.Assert(result.Machines[0].ID, check.Equals, uint64(1))
+	c.Assert(result.Machines[1].ID, check.Equals, uint64(3))
+	c.Assert(len(result.PreAuthKeys), check.Equals, 2)
+	c.Assert(result.PreAuthKeys[0].ID, check.Equals, keys[0].ID)
+	c.Assert(result.PreAuthKeys[1].ID, check.Equals, keys[2].ID)
+
+	// The dry run did not delete anything, and lists what is deleted
+	applied, err := h.GarbageCollect(90*24*time.Hour, true)
+	c.Assert(err, check.IsNil)
+	c.Assert(applied.Applied, check.Equals, true)
+	c.Assert(len(applied.Machines), check.Equals, len(result.Machines))
+	c.Assert(len(applied.PreAuthKeys), check.Equals, len(result.PreAuthKeys))
+
+	machines, err := h.ListMachinesInNamespace(n.Name)
+	c.Assert(err, check.IsNil)
+	c.Assert(len(*machines), check.Equals, 1)
+	remaining, err := h.GetPreAuthKeys(n.Name)
+	c.Assert(err, check.IsNil)
+	c.Assert(len(*remaining), check.Equals, 2)
+
+	// Without a threshold the machines are kept
+	result, err = h.GarbageCollect(0, false)
+	c.Assert(err, check.IsNil)
+	c.Assert(len(result.Machines), check.Equals, 0)
+}
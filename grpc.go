@@ -0,0 +1,609 @@
+package headscale
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	v1 "github.com/juanfont/headscale/gen/go/headscale/v1"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"gorm.io/gorm"
+)
+
+// headscaleV1APIServer implements the gRPC admin API on top of the same
+// methods used by the CLI
+type headscaleV1APIServer struct {
+	v1.UnimplementedHeadscaleServiceServer
+	h *Headscale
+}
+
+func newHeadscaleV1APIServer(h *Headscale) v1.HeadscaleServiceServer {
+	return headscaleV1APIServer{h: h}
+}
+
+// serveGRPC listens for the gRPC admin API on GRPCAddr. It is served over TLS
+// when a certificate is configured.
+func (h *Headscale) serveGRPC() error {
+	opts := []grpc.ServerOption{
+		grpc.UnaryInterceptor(h.grpcAuthenticationInterceptor),
+	}
+	if h.cfg.TLSCertPath != "" {
+		certs, err := newCertFileLoader(h.cfg.TLSCertPath, h.cfg.TLSKeyPath)
+		if err != nil {
+			return err
+		}
+		creds := credentials.NewTLS(h.tlsConfig(&tls.Config{GetCertificate: certs.getCertificate}))
+		opts = append(opts, grpc.Creds(creds))
+	} else {
+		log.Warn().
+			Str("addr", h.cfg.GRPCAddr).
+			Msg("Serving the gRPC API without TLS, keep it on a trusted network")
+	}
+
+	l, err := net.Listen("tcp", h.cfg.GRPCAddr)
+	if err != nil {
+		return err
+	}
+
+	s := grpc.NewServer(opts...)
+	h.grpcServer = s
+	v1.RegisterHeadscaleServiceServer(s, newHeadscaleV1APIServer(h))
+	log.Info().
+		Str("addr", h.cfg.GRPCAddr).
+		Msg("Serving the gRPC API")
+	return s.Serve(l)
+}
+
+// grpcSocketMode lets the owner and the group of the socket use the API
+const grpcSocketMode = 0o660
+
+// listenGRPCSocket listens on GRPCSocketPath, replacing the socket left by a
+// previous run
+func (h *Headscale) listenGRPCSocket() (net.Listener, error) {
+	path := h.cfg.GRPCSocketPath
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("grpc_socket_path: %s exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("grpc_socket_path: %w", err)
+		}
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("grpc_socket_path: %w", err)
+	}
+	if err := os.Chmod(path, grpcSocketMode); err != nil {
+		l.Close()
+		return nil, fmt.Errorf("grpc_socket_path: %w", err)
+	}
+	return l, nil
+}
+
+// serveGRPCSocket serves the gRPC admin API on the Unix socket. The calls are
+// not authenticated: whoever can write to the socket is an admin.
+func (h *Headscale) serveGRPCSocket(l net.Listener) error {
+	s := grpc.NewServer()
+	h.grpcSocketServer = s
+	v1.RegisterHeadscaleServiceServer(s, newHeadscaleV1APIServer(h))
+	log.Info().
+		Str("path", h.cfg.GRPCSocketPath).
+		Msg("Serving the gRPC API on a Unix socket")
+	return s.Serve(l)
+}
+
+// grpcAuthenticationInterceptor rejects the calls without a valid
+// "authorization: Bearer <token>" metadata entry. The token is either an
+// API key or, if set, the grpc_api_token of the config.
+func (h *Headscale) grpcAuthenticationInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return nil, status.Error(codes.Unauthenticated, "missing metadata")
+	}
+	auth := md.Get("authorization")
+	if len(auth) != 1 || !strings.HasPrefix(auth[0], "Bearer ") {
+		return nil, status.Error(codes.Unauthenticated, "missing bearer token")
+	}
+	token := strings.TrimPrefix(auth[0], "Bearer ")
+	if h.cfg.GRPCAPIToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(h.cfg.GRPCAPIToken)) == 1 {
+		return handler(ctx, req)
+	}
+	if err := h.ValidateAPIKey(token); err != nil {
+		log.Warn().
+			Str("method", info.FullMethod).
+			Err(err).
+			Msg("Rejected gRPC call with an invalid token")
+		return nil, status.Error(codes.Unauthenticated, "invalid token")
+	}
+	return handler(ctx, req)
+}
+
+func (api headscaleV1APIServer) ListNamespaces(ctx context.Context, req *v1.ListNamespacesRequest) (*v1.ListNamespacesResponse, error) {
+	namespaces, err := api.h.ListNamespaces()
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	counts, err := api.h.CountNamespaces()
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	resp := v1.ListNamespacesResponse{}
+	for _, n := range *namespaces {
+		pn := n.toProto()
+		pn.Machines = int32(counts[n.ID].Machines)
+		pn.MachinesLimit = int32(api.h.GetNamespaceMachineLimit(&n))
+		pn.OnlineMachines = int32(counts[n.ID].OnlineMachines)
+		pn.PreAuthKeys = int32(counts[n.ID].PreAuthKeys)
+		resp.Namespaces = append(resp.Namespaces, pn)
+	}
+	return &resp, nil
+}
+
+func (api headscaleV1APIServer) CreateNamespace(ctx context.Context, req *v1.CreateNamespaceRequest) (*v1.CreateNamespaceResponse, error) {
+	n, err := api.h.CreateNamespace(req.GetName())
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &v1.CreateNamespaceResponse{Namespace: n.toProto()}, nil
+}
+
+func (api headscaleV1APIServer) DeleteNamespace(ctx context.Context, req *v1.DeleteNamespaceRequest) (*v1.DeleteNamespaceResponse, error) {
+	err := api.h.DestroyNamespace(req.GetName())
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &v1.DeleteNamespaceResponse{}, nil
+}
+
+func (api headscaleV1APIServer) RenameNamespace(ctx context.Context, req *v1.RenameNamespaceRequest) (*v1.RenameNamespaceResponse, error) {
+	n, err := api.h.RenameNamespace(req.GetOldName(), req.GetNewName())
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &v1.RenameNamespaceResponse{Namespace: n.toProto()}, nil
+}
+
+func (api headscaleV1APIServer) SetNamespaceQuota(ctx context.Context, req *v1.SetNamespaceQuotaRequest) (*v1.SetNamespaceQuotaResponse, error) {
+	n, err := api.h.SetNamespaceMaxMachines(req.GetName(), int(req.GetMaxMachines()))
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &v1.SetNamespaceQuotaResponse{Namespace: n.toProto()}, nil
+}
+
+func (api headscaleV1APIServer) SetNamespaceDERPRegion(ctx context.Context, req *v1.SetNamespaceDERPRegionRequest) (*v1.SetNamespaceDERPRegionResponse, error) {
+	n, err := api.h.SetNamespaceDERPRegion(req.GetName(), int(req.GetRegionId()))
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &v1.SetNamespaceDERPRegionResponse{Namespace: n.toProto()}, nil
+}
+
+func (api headscaleV1APIServer) ListMachines(ctx context.Context, req *v1.ListMachinesRequest) (*v1.ListMachinesResponse, error) {
+	filter := MachineFilter{
+		Namespace: req.GetNamespace(),
+		Tag:       req.GetTag(),
+		Online:    req.GetOnline(),
+		SortBy:    req.GetSortBy(),
+
+		IncludeShared: req.GetIncludeShared(),
+		Pending:       req.GetPending(),
+	}
+	if req.GetLastSeenBefore() != nil {
+		t := req.GetLastSeenBefore().AsTime()
+		filter.LastSeenBefore = &t
+	}
+	machines, err := api.h.ListMachines(filter)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	resp := v1.ListMachinesResponse{}
+	for _, m := range *machines {
+		resp.Machines = append(resp.Machines, m.toProto())
+	}
+	return &resp, nil
+}
+
+func (api headscaleV1APIServer) GetMachine(ctx context.Context, req *v1.GetMachineRequest) (*v1.GetMachineResponse, error) {
+	m, err := api.h.GetMachineByID(req.GetMachineId())
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &v1.GetMachineResponse{Machine: m.toProto()}, nil
+}
+
+func (api headscaleV1APIServer) RegisterMachine(ctx context.Context, req *v1.RegisterMachineRequest) (*v1.RegisterMachineResponse, error) {
+	m, err := api.h.RegisterMachine(req.GetKey(), req.GetNamespace())
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &v1.RegisterMachineResponse{Machine: m.toProto()}, nil
+}
+
+func (api headscaleV1APIServer) DeleteMachine(ctx context.Context, req *v1.DeleteMachineRequest) (*v1.DeleteMachineResponse, error) {
+	err := api.h.DeleteMachine(req.GetMachineId())
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &v1.DeleteMachineResponse{}, nil
+}
+
+func (api headscaleV1APIServer) MoveMachine(ctx context.Context, req *v1.MoveMachineRequest) (*v1.MoveMachineResponse, error) {
+	m, err := api.h.MoveMachineToNamespace(req.GetMachineId(), req.GetNamespace())
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &v1.MoveMachineResponse{Machine: m.toProto()}, nil
+}
+
+func (api headscaleV1APIServer) ExpireMachine(ctx context.Context, req *v1.ExpireMachineRequest) (*v1.ExpireMachineResponse, error) {
+	m, err := api.h.ExpireMachine(req.GetMachineId())
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &v1.ExpireMachineResponse{Machine: m.toProto()}, nil
+}
+
+func (api headscaleV1APIServer) ExpireNamespaceMachines(ctx context.Context, req *v1.ExpireNamespaceMachinesRequest) (*v1.ExpireNamespaceMachinesResponse, error) {
+	machines, err := api.h.ExpireNamespaceMachines(req.GetNamespace())
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	resp := v1.ExpireNamespaceMachinesResponse{}
+	for _, m := range *machines {
+		resp.Machines = append(resp.Machines, m.toProto())
+	}
+	return &resp, nil
+}
+
+func (api headscaleV1APIServer) SetMachineExpiry(ctx context.Context, req *v1.SetMachineExpiryRequest) (*v1.SetMachineExpiryResponse, error) {
+	m, err := api.h.SetMachineExpiry(req.GetMachineId(), req.GetExpiry().AsTime())
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &v1.SetMachineExpiryResponse{Machine: m.toProto()}, nil
+}
+
+func (api headscaleV1APIServer) TagMachine(ctx context.Context, req *v1.TagMachineRequest) (*v1.TagMachineResponse, error) {
+	m, err := api.h.TagMachine(req.GetMachineId(), req.GetAdd(), req.GetRemove())
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &v1.TagMachineResponse{Machine: m.toProto()}, nil
+}
+
+func (api headscaleV1APIServer) ClearMachineTags(ctx context.Context, req *v1.ClearMachineTagsRequest) (*v1.ClearMachineTagsResponse, error) {
+	m, err := api.h.ClearMachineTags(req.GetMachineId())
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &v1.ClearMachineTagsResponse{Machine: m.toProto()}, nil
+}
+
+// AuditIPs returns the conflicts found before a failure along with it, like
+// the local command lists them
+func (api headscaleV1APIServer) AuditIPs(ctx context.Context, req *v1.AuditIPsRequest) (*v1.AuditIPsResponse, error) {
+	conflicts, err := api.h.AuditIPs(req.GetFix())
+	if err != nil && len(conflicts) == 0 {
+		return nil, grpcError(err)
+	}
+	resp := v1.AuditIPsResponse{}
+	for _, c := range conflicts {
+		resp.Conflicts = append(resp.Conflicts, &v1.IPConflict{
+			MachineId:    c.MachineID,
+			Machine:      c.Machine,
+			IpAddress:    c.IPAddress,
+			Problem:      c.Problem,
+			NewIpAddress: c.NewIPAddress,
+		})
+	}
+	if err != nil {
+		resp.Error = err.Error()
+	}
+	return &resp, nil
+}
+
+func (api headscaleV1APIServer) ShareMachine(ctx context.Context, req *v1.ShareMachineRequest) (*v1.ShareMachineResponse, error) {
+	m, err := api.h.ShareMachine(req.GetMachineId(), req.GetNamespace())
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &v1.ShareMachineResponse{Machine: m.toProto()}, nil
+}
+
+func (api headscaleV1APIServer) UnshareMachine(ctx context.Context, req *v1.UnshareMachineRequest) (*v1.UnshareMachineResponse, error) {
+	m, err := api.h.UnshareMachine(req.GetMachineId(), req.GetNamespace())
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &v1.UnshareMachineResponse{Machine: m.toProto()}, nil
+}
+
+func (api headscaleV1APIServer) RenameMachine(ctx context.Context, req *v1.RenameMachineRequest) (*v1.RenameMachineResponse, error) {
+	m, err := api.h.RenameMachine(req.GetMachineId(), req.GetName())
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &v1.RenameMachineResponse{Machine: m.toProto()}, nil
+}
+
+func (api headscaleV1APIServer) ReauthMachine(ctx context.Context, req *v1.ReauthMachineRequest) (*v1.ReauthMachineResponse, error) {
+	m, err := api.h.ReauthMachine(req.GetMachineId())
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &v1.ReauthMachineResponse{Machine: m.toProto()}, nil
+}
+
+func (api headscaleV1APIServer) RefreshMachineKey(ctx context.Context, req *v1.RefreshMachineKeyRequest) (*v1.RefreshMachineKeyResponse, error) {
+	m, err := api.h.RefreshMachineKey(req.GetMachineId())
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &v1.RefreshMachineKeyResponse{Machine: m.toProto()}, nil
+}
+
+func (api headscaleV1APIServer) ApproveMachine(ctx context.Context, req *v1.ApproveMachineRequest) (*v1.ApproveMachineResponse, error) {
+	m, err := api.h.ApproveMachine(req.GetMachineId())
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &v1.ApproveMachineResponse{Machine: m.toProto()}, nil
+}
+
+func (api headscaleV1APIServer) SetMachineIP(ctx context.Context, req *v1.SetMachineIPRequest) (*v1.SetMachineIPResponse, error) {
+	m, err := api.h.SetMachineIP(req.GetMachineId(), req.GetIpAddress())
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &v1.SetMachineIPResponse{Machine: m.toProto()}, nil
+}
+
+func (api headscaleV1APIServer) GetMachineRoutes(ctx context.Context, req *v1.GetMachineRoutesRequest) (*v1.GetMachineRoutesResponse, error) {
+	routes, err := api.h.GetMachineRoutes(req.GetMachineId())
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	resp := v1.GetMachineRoutesResponse{}
+	for _, r := range *routes {
+		resp.Routes = append(resp.Routes, &v1.Route{
+			Prefix:     r.Prefix.String(),
+			Advertised: r.Advertised,
+			Enabled:    r.Enabled,
+			ExitRoute:  r.ExitRoute,
+		})
+	}
+	return &resp, nil
+}
+
+func (api headscaleV1APIServer) EnableMachineRoute(ctx context.Context, req *v1.EnableMachineRouteRequest) (*v1.EnableMachineRouteResponse, error) {
+	route, err := api.h.EnableMachineRoute(req.GetMachineId(), req.GetRoute())
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &v1.EnableMachineRouteResponse{Route: route.String()}, nil
+}
+
+func (api headscaleV1APIServer) EnableAllMachineRoutes(ctx context.Context, req *v1.EnableAllMachineRoutesRequest) (*v1.EnableAllMachineRoutesResponse, error) {
+	routes, err := api.h.EnableAllMachineRoutes(req.GetMachineId())
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	resp := v1.EnableAllMachineRoutesResponse{}
+	for _, r := range routes {
+		resp.Routes = append(resp.Routes, r.String())
+	}
+	return &resp, nil
+}
+
+func (api headscaleV1APIServer) EnableMachineExitNode(ctx context.Context, req *v1.EnableMachineExitNodeRequest) (*v1.EnableMachineExitNodeResponse, error) {
+	m, err := api.h.EnableMachineExitNode(req.GetMachineId())
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &v1.EnableMachineExitNodeResponse{Machine: m.toProto()}, nil
+}
+
+func (api headscaleV1APIServer) ListPreAuthKeys(ctx context.Context, req *v1.ListPreAuthKeysRequest) (*v1.ListPreAuthKeysResponse, error) {
+	keys, err := api.h.GetPreAuthKeys(req.GetNamespace())
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	resp := v1.ListPreAuthKeysResponse{}
+	for _, k := range *keys {
+		resp.PreAuthKeys = append(resp.PreAuthKeys, k.toProto())
+	}
+	return &resp, nil
+}
+
+func (api headscaleV1APIServer) CreatePreAuthKey(ctx context.Context, req *v1.CreatePreAuthKeyRequest) (*v1.CreatePreAuthKeyResponse, error) {
+	var expiration *time.Time
+	if req.GetExpiration() != nil {
+		e := req.GetExpiration().AsTime()
+		expiration = &e
+	}
+	k, err := api.h.CreatePreAuthKey(req.GetNamespace(), req.GetReusable(), req.GetEphemeral(), expiration, req.GetAclTags())
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &v1.CreatePreAuthKeyResponse{PreAuthKey: k.toProto()}, nil
+}
+
+func (api headscaleV1APIServer) ExpirePreAuthKey(ctx context.Context, req *v1.ExpirePreAuthKeyRequest) (*v1.ExpirePreAuthKeyResponse, error) {
+	k, err := api.h.ExpirePreAuthKey(req.GetNamespace(), req.GetKey())
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &v1.ExpirePreAuthKeyResponse{PreAuthKey: k.toProto()}, nil
+}
+
+func (api headscaleV1APIServer) ListPreAuthKeyMachines(ctx context.Context, req *v1.ListPreAuthKeyMachinesRequest) (*v1.ListPreAuthKeyMachinesResponse, error) {
+	machines, err := api.h.GetPreAuthKeyMachines(req.GetNamespace(), req.GetKey())
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	resp := v1.ListPreAuthKeyMachinesResponse{}
+	for _, m := range *machines {
+		resp.Machines = append(resp.Machines, m.toProto())
+	}
+	return &resp, nil
+}
+
+func (api headscaleV1APIServer) GarbageCollect(ctx context.Context, req *v1.GarbageCollectRequest) (*v1.GarbageCollectResponse, error) {
+	inactivity := time.Duration(req.GetMachineInactivitySeconds()) * time.Second
+	result, err := api.h.GarbageCollect(inactivity, req.GetApply())
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	resp := v1.GarbageCollectResponse{Applied: result.Applied}
+	for _, k := range result.PreAuthKeys {
+		resp.PreAuthKeys = append(resp.PreAuthKeys, k.toProto())
+	}
+	for _, m := range result.Machines {
+		resp.Machines = append(resp.Machines, m.toProto())
+	}
+	return &resp, nil
+}
+
+func (api headscaleV1APIServer) GetMaintenanceMode(ctx context.Context, req *v1.GetMaintenanceModeRequest) (*v1.GetMaintenanceModeResponse, error) {
+	status, err := api.h.GetMaintenanceStatus()
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &v1.GetMaintenanceModeResponse{Status: status.toProto()}, nil
+}
+
+func (api headscaleV1APIServer) SetMaintenanceMode(ctx context.Context, req *v1.SetMaintenanceModeRequest) (*v1.SetMaintenanceModeResponse, error) {
+	status, err := api.h.SetMaintenanceMode(req.GetEnabled())
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &v1.SetMaintenanceModeResponse{Status: status.toProto()}, nil
+}
+
+// grpcError maps the headscale errors to gRPC status codes
+func grpcError(err error) error {
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound),
+		errors.Is(err, errorNamespaceNotFound),
+		errors.Is(err, errorAuthKeyNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, errorNamespaceExists),
+		errors.Is(err, errorMachineNameExists),
+		errors.Is(err, errorIPInUse):
+		return status.Error(codes.AlreadyExists, err.Error())
+	case errors.Is(err, errorNamespaceInvalidName),
+		errors.Is(err, errorInvalidTag),
+		errors.Is(err, errorDERPRegionNotFound),
+		errors.Is(err, errorMachineNameInvalid),
+		errors.Is(err, errorMachineSortInvalid),
+		errors.Is(err, errorRouteNotAdvertised),
+		errors.Is(err, errorRouteIsExitRoute),
+		errors.Is(err, errorNotExitNode),
+		errors.Is(err, errorIPInvalid),
+		errors.Is(err, errorIPOutOfPrefixes),
+		errors.Is(err, errorAuthKeyNamespaceRequired):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, errorMaintenance):
+		return status.Error(codes.Unavailable, err.Error())
+	case errors.Is(err, errorNamespaceNotEmpty),
+		errors.Is(err, errorNamespaceQuotaExceeded),
+		errors.Is(err, errorMachineNotPending),
+		errors.Is(err, errorMachineNotRegistered),
+		errors.Is(err, errorMaintenanceInConfig):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	default:
+		return status.Error(codes.Internal, err.Error())
+	}
+}
+
+func timeToProto(t *time.Time) *timestamppb.Timestamp {
+	if t == nil {
+		return nil
+	}
+	return timestamppb.New(*t)
+}
+
+func (n Namespace) toProto() *v1.Namespace {
+	return &v1.Namespace{
+		Id:          uint64(n.ID),
+		Name:        n.Name,
+		CreatedAt:   timestamppb.New(n.CreatedAt),
+		MaxMachines: int32(n.MaxMachines),
+
+		PreferredDerpRegion: int32(n.PreferredDERPRegion),
+	}
+}
+
+func (s MaintenanceStatus) toProto() *v1.MaintenanceStatus {
+	return &v1.MaintenanceStatus{Enabled: s.Enabled, Config: s.Config, Command: s.Command}
+}
+
+func (m Machine) toProto() *v1.Machine {
+	tags, _ := m.GetTags()
+	advertised := []string{}
+	if hi, err := m.GetHostInfo(); err == nil {
+		for _, r := range hi.RoutableIPs {
+			advertised = append(advertised, r.String())
+		}
+	}
+	enabled := []string{}
+	if routes, err := m.getEnabledRoutes(); err == nil {
+		for _, r := range routes {
+			enabled = append(enabled, r.String())
+		}
+	}
+	return &v1.Machine{
+		Id:             m.ID,
+		MachineKey:     m.MachineKey,
+		NodeKey:        m.NodeKey,
+		DiscoKey:       m.DiscoKey,
+		IpAddress:      m.IPAddress,
+		Ipv6Address:    m.IPv6Address,
+		StaticIp:       m.StaticIP,
+		Name:           m.Name,
+		GivenName:      m.GivenName,
+		Namespace:      m.Namespace.toProto(),
+		Registered:     m.Registered,
+		Pending:        m.Pending,
+		RegisterMethod: m.RegisterMethod,
+		RegisteredAt:   timeToProto(m.RegisteredAt),
+		Ephemeral:      m.AuthKey != nil && m.AuthKey.Ephemeral,
+		LastSeen:       timeToProto(m.LastSeen),
+		Online:         m.Online,
+		Shared:         m.Shared,
+		Expiry:         timeToProto(m.Expiry),
+		Tags:           tags,
+		CreatedAt:      timestamppb.New(m.CreatedAt),
+
+		AdvertisedRoutes:      advertised,
+		EnabledRoutes:         enabled,
+		KeyRefreshRequestedAt: timeToProto(m.KeyRefreshRequestedAt),
+	}
+}
+
+func (k PreAuthKey) toProto() *v1.PreAuthKey {
+	tags, _ := k.GetACLTags()
+	return &v1.PreAuthKey{
+		Id:         k.ID,
+		Namespace:  k.Namespace.Name,
+		Key:        k.Key,
+		Reusable:   k.Reusable,
+		Ephemeral:  k.Ephemeral,
+		Expiration: timeToProto(k.Expiration),
+		CreatedAt:  timeToProto(k.CreatedAt),
+		AclTags:    tags,
+	}
+}
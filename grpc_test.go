@@ -0,0 +1,128 @@
+package headscale
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"time"
+
+	v1 "github.com/juanfont/headscale/gen/go/headscale/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"gopkg.in/check.v1"
+)
+
+func (s *Suite) TestGRPCAuthenticationInterceptor(c *check.C) {
+	h.cfg.GRPCAPIToken = "secret"
+	defer func() { h.cfg.GRPCAPIToken = "" }()
+
+	info := &grpc.UnaryServerInfo{FullMethod: "/headscale.v1.HeadscaleService/ListNamespaces"}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return "ok", nil
+	}
+
+	_, err := h.grpcAuthenticationInterceptor(context.Background(), nil, info, handler)
+	c.Assert(status.Code(err), check.Equals, codes.Unauthenticated)
+
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer wrong"))
+	_, err = h.grpcAuthenticationInterceptor(ctx, nil, info, handler)
+	c.Assert(status.Code(err), check.Equals, codes.Unauthenticated)
+
+	ctx = metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer secret"))
+	resp, err := h.grpcAuthenticationInterceptor(ctx, nil, info, handler)
+	c.Assert(err, check.IsNil)
+	c.Assert(resp, check.Equals, "ok")
+
+	key, _, err := h.CreateAPIKey(nil)
+	c.Assert(err, check.IsNil)
+
+	ctx = metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer "+key))
+	resp, err = h.grpcAuthenticationInterceptor(ctx, nil, info, handler)
+	c.Assert(err, check.IsNil)
+	c.Assert(resp, check.Equals, "ok")
+}
+
+func (s *Suite) TestGRPCNamespaces(c *check.C) {
+	api := newHeadscaleV1APIServer(&h)
+	ctx := context.Background()
+
+	created, err := api.CreateNamespace(ctx, &v1.CreateNamespaceRequest{Name: "test"})
+	c.Assert(err, check.IsNil)
+	c.Assert(created.GetNamespace().GetName(), check.Equals, "test")
+
+	_, err = api.CreateNamespace(ctx, &v1.CreateNamespaceRequest{Name: "test"})
+	c.Assert(status.Code(err), check.Equals, codes.AlreadyExists)
+
+	list, err := api.ListNamespaces(ctx, &v1.ListNamespacesRequest{})
+	c.Assert(err, check.IsNil)
+	c.Assert(len(list.GetNamespaces()), check.Equals, 1)
+
+	renamed, err := api.RenameNamespace(ctx, &v1.RenameNamespaceRequest{OldName: "test", NewName: "renamed"})
+	c.Assert(err, check.IsNil)
+	c.Assert(renamed.GetNamespace().GetName(), check.Equals, "renamed")
+
+	quota, err := api.SetNamespaceQuota(ctx, &v1.SetNamespaceQuotaRequest{Name: "renamed", MaxMachines: 3})
+	c.Assert(err, check.IsNil)
+	c.Assert(quota.GetNamespace().GetMaxMachines(), check.Equals, int32(3))
+
+	_, err = api.SetNamespaceDERPRegion(ctx, &v1.SetNamespaceDERPRegionRequest{Name: "bogus", RegionId: 0})
+	c.Assert(status.Code(err), check.Equals, codes.NotFound)
+
+	_, err = api.DeleteNamespace(ctx, &v1.DeleteNamespaceRequest{Name: "bogus"})
+	c.Assert(status.Code(err), check.Equals, codes.NotFound)
+
+	_, err = api.DeleteNamespace(ctx, &v1.DeleteNamespaceRequest{Name: "renamed"})
+	c.Assert(err, check.IsNil)
+}
+
+func (s *Suite) TestGRPCPreAuthKeys(c *check.C) {
+	api := newHeadscaleV1APIServer(&h)
+	ctx := context.Background()
+
+	_, err := h.CreateNamespace("test")
+	c.Assert(err, check.IsNil)
+
+	created, err := api.CreatePreAuthKey(ctx, &v1.CreatePreAuthKeyRequest{Namespace: "test", Reusable: true})
+	c.Assert(err, check.IsNil)
+	c.Assert(created.GetPreAuthKey().GetExpiration(), check.IsNil)
+
+	expired, err := api.ExpirePreAuthKey(ctx, &v1.ExpirePreAuthKeyRequest{Namespace: "test", Key: created.GetPreAuthKey().GetKey()})
+	c.Assert(err, check.IsNil)
+	c.Assert(expired.GetPreAuthKey().GetExpiration(), check.NotNil)
+
+	list, err := api.ListPreAuthKeys(ctx, &v1.ListPreAuthKeysRequest{Namespace: "test"})
+	c.Assert(err, check.IsNil)
+	c.Assert(len(list.GetPreAuthKeys()), check.Equals, 1)
+}
+
+func (s *Suite) TestGRPCSocket(c *check.C) {
+	h.cfg.GRPCSocketPath = filepath.Join(tmpDir, "headscale.sock")
+	defer func() { h.cfg.GRPCSocketPath = "" }()
+
+	l, err := h.listenGRPCSocket()
+	c.Assert(err, check.IsNil)
+	fi, err := os.Stat(h.cfg.GRPCSocketPath)
+	c.Assert(err, check.IsNil)
+	c.Assert(fi.Mode()&os.ModeSocket, check.Not(check.Equals), os.FileMode(0))
+	c.Assert(fi.Mode().Perm(), check.Equals, os.FileMode(grpcSocketMode))
+	go h.serveGRPCSocket(l)
+	defer l.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := grpc.DialContext(ctx, "unix://"+h.cfg.GRPCSocketPath, grpc.WithInsecure(), grpc.WithBlock())
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+
+	// No API key over the socket
+	_, err = v1.NewHeadscaleServiceClient(conn).CreateNamespace(ctx, &v1.CreateNamespaceRequest{Name: "test"})
+	c.Assert(err, check.IsNil)
+	_, err = h.GetNamespace("test")
+	c.Assert(err, check.IsNil)
+
+	h.cfg.GRPCSocketPath = filepath.Join(tmpDir, "headscale_test.db")
+	_, err = h.listenGRPCSocket()
+	c.Assert(err, check.ErrorMatches, "grpc_socket_path: .* exists and is not a socket")
+}
@@ -0,0 +1,39 @@
+package headscale
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// HealthHandler tells whether the process is alive
+// Listens in /health
+func (h *Headscale) HealthHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// ReadyHandler tells whether headscale is ready to serve the clients: the
+// database is reachable and the DERP map is loaded
+// Listens in /ready
+func (h *Headscale) ReadyHandler(c *gin.Context) {
+	failed := []string{}
+
+	// Load balancers stop sending new clients while the server drains
+	if h.isShuttingDown() {
+		failed = append(failed, "shutting_down")
+	}
+
+	db, err := h.db.DB()
+	if err != nil || db.PingContext(c.Request.Context()) != nil {
+		failed = append(failed, "database")
+	}
+	if h.getDERPMap() == nil {
+		failed = append(failed, "derp_map")
+	}
+
+	if len(failed) > 0 {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"status": "not ready", "failed": failed})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ready"})
+}
@@ -0,0 +1,27 @@
+package headscale
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/gin-gonic/gin"
+	"gopkg.in/check.v1"
+	"tailscale.com/tailcfg"
+)
+
+func (s *Suite) TestReadyHandler(c *check.C) {
+	w := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	ctx.Request = httptest.NewRequest(http.MethodGet, "/ready", nil)
+	h.ReadyHandler(ctx)
+	c.Assert(w.Code, check.Equals, http.StatusServiceUnavailable)
+	c.Assert(w.Body.String(), check.Matches, ".*derp_map.*")
+
+	h.derpMap = &tailcfg.DERPMap{}
+
+	w = httptest.NewRecorder()
+	ctx, _ = gin.CreateTestContext(w)
+	ctx.Request = httptest.NewRequest(http.MethodGet, "/ready", nil)
+	h.ReadyHandler(ctx)
+	c.Assert(w.Code, check.Equals, http.StatusOK)
+}
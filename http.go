@@ -0,0 +1,57 @@
+package headscale
+
+import (
+	"net/http"
+	"strings"
+)
+
+// limitRequests bounds the size of the request bodies to MaxRequestBodyBytes
+// and the handling of the requests to HTTPWriteTimeout, except for the
+// long-poll of the netmaps, which stays open as long as the client.
+//
+// The timeouts of http.Server cannot exempt a handler: a read deadline on the
+// connection would also cancel the long-polls once expired. The server only
+// bounds the headers with HTTPReadTimeout, and the bodies are read within the
+// write timeout of the handler.
+func (h *Headscale) limitRequests(next http.Handler) http.Handler {
+	timeout := next
+	if h.cfg.HTTPWriteTimeout > 0 {
+		timeout = http.TimeoutHandler(next, h.cfg.HTTPWriteTimeout, "")
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if limit := h.cfg.MaxRequestBodyBytes; limit > 0 {
+			if r.ContentLength > limit {
+				http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, limit)
+		}
+		// The DERP connections are hijacked and stay open too
+		if h.isLongPoll(r) || (h.derpServer != nil && r.URL.Path == "/derp") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		timeout.ServeHTTP(w, r)
+	})
+}
+
+// isLongPoll tells if r is a map request, POSTed to /machine/:id/map
+func (h *Headscale) isLongPoll(r *http.Request) bool {
+	if r.Method != http.MethodPost {
+		return false
+	}
+	path := strings.TrimPrefix(r.URL.Path, h.basePath())
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	return len(parts) == 3 && parts[0] == "machine" && parts[2] == "map"
+}
+
+// httpServer returns the server of the main listener, with the timeouts of
+// the configuration
+func (h *Headscale) httpServer(handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              h.cfg.Addr,
+		Handler:           h.limitRequests(handler),
+		ReadHeaderTimeout: h.cfg.HTTPReadTimeout,
+		IdleTimeout:       h.cfg.HTTPIdleTimeout,
+	}
+}
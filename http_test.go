@@ -0,0 +1,63 @@
+package headscale
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	"gopkg.in/check.v1"
+)
+
+func (s *Suite) TestLimitRequests(c *check.C) {
+	h.cfg.ServerURL = "https://headscale.example.com/vpn"
+	h.cfg.MaxRequestBodyBytes = 16
+	h.cfg.HTTPWriteTimeout = 50 * time.Millisecond
+
+	handler := h.limitRequests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := io.ReadAll(r.Body); err != nil {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+		if r.URL.Query().Get("slow") != "" {
+			time.Sleep(200 * time.Millisecond)
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	serve := func(method, target, body string) int {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	c.Assert(serve(http.MethodPost, "/vpn/machine/abc", "small"), check.Equals, http.StatusOK)
+	c.Assert(serve(http.MethodPost, "/vpn/machine/abc", strings.Repeat("a", 17)), check.Equals, http.StatusRequestEntityTooLarge)
+
+	// The body size is unknown in advance when chunked
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/vpn/machine/abc", strings.NewReader(strings.Repeat("a", 17)))
+	req.ContentLength = -1
+	handler.ServeHTTP(w, req)
+	c.Assert(w.Code, check.Equals, http.StatusRequestEntityTooLarge)
+
+	c.Assert(serve(http.MethodGet, "/vpn/register?slow=1", ""), check.Equals, http.StatusServiceUnavailable)
+	// The long-polls are not timed out
+	c.Assert(serve(http.MethodPost, "/vpn/machine/abc/map?slow=1", ""), check.Equals, http.StatusOK)
+}
+
+func (s *Suite) TestIsLongPoll(c *check.C) {
+	h.cfg.ServerURL = "http://127.0.0.1:8080"
+	for target, poll := range map[string]bool{
+		"/machine/abc/map": true,
+		"/machine/abc":     false,
+		"/machine/map":     false,
+		"/register":        false,
+	} {
+		req := httptest.NewRequest(http.MethodPost, target, nil)
+		c.Assert(h.isLongPoll(req), check.Equals, poll, check.Commentf(target))
+	}
+	req := httptest.NewRequest(http.MethodGet, "/machine/abc/map", nil)
+	c.Assert(h.isLongPoll(req), check.Equals, false)
+}
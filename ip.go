@@ -0,0 +1,391 @@
+package headscale
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+	"inet.af/netaddr"
+)
+
+const errorNoAvailableIP = Error("no IP address available in the range of the tailnet")
+const errorIPInvalid = Error("invalid IP address")
+const errorIPOutOfPrefixes = Error("the IP address is not in an assigned prefix of ip_prefixes")
+const errorIPInUse = Error("the IP address is already used by another machine")
+const errorIPPrefixesChanged = Error("some machines have an address out of ip_prefixes, keep a range containing them or reassign them with headscale nodes audit-ips --fix")
+
+var defaultIPPrefix = netaddr.MustParseIPPrefix("100.64.0.0/10")
+
+// ulaPrefixKey is the KV key of the IPv6 prefix generated when ip_prefixes
+// has none
+const ulaPrefixKey = "ipv6_ula_prefix"
+
+// ipAllocationMu serializes the allocations of addresses within a process,
+// so two machines registering at the same time do not get the same one
+var ipAllocationMu sync.Mutex
+
+// IPConflict is a problem found in the address of a machine by AuditIPs
+type IPConflict struct {
+	MachineID    uint64
+	Machine      string
+	IPAddress    string
+	Problem      string
+	NewIPAddress string `json:",omitempty" yaml:",omitempty"`
+}
+
+// ipPrefixes returns the ranges of the tailnet, at most one IPv4 and one
+// IPv6 prefix
+func (h *Headscale) ipPrefixes() []netaddr.IPPrefix {
+	if len(h.cfg.IPPrefixes) == 0 {
+		return []netaddr.IPPrefix{defaultIPPrefix}
+	}
+	return h.cfg.IPPrefixes
+}
+
+// loadULAPrefix adds to the ranges of the tailnet the IPv6 prefix generated
+// the first time headscale ran without one in ip_prefixes. It is kept in the
+// database, so the addresses of the machines do not change on restart.
+func (h *Headscale) loadULAPrefix() error {
+	if h.cfg.DisableIPv6 {
+		return nil
+	}
+	for _, p := range h.ipPrefixes() {
+		if p.IP().Is6() {
+			return nil
+		}
+	}
+	// The table is created by the first migration
+	if !h.db.Migrator().HasTable(&KV{}) {
+		return nil
+	}
+
+	generated := false
+	row := KV{}
+	err := h.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.First(&row, "key = ?", ulaPrefixKey).Error
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+		prefix, err := generateULAPrefix()
+		if err != nil {
+			return err
+		}
+		row = KV{Key: ulaPrefixKey, Value: prefix.String()}
+		generated = true
+		return tx.Create(&row).Error
+	})
+	if err != nil {
+		return err
+	}
+	prefix, err := netaddr.ParseIPPrefix(row.Value)
+	if err != nil {
+		return fmt.Errorf("%s in the database: %w", ulaPrefixKey, err)
+	}
+	if generated {
+		log.Info().
+			Str("prefix", prefix.String()).
+			Msg("Generated the IPv6 prefix of the tailnet, add an IPv6 prefix to ip_prefixes to use another one")
+	}
+	h.cfg.IPPrefixes = append(h.ipPrefixes(), prefix)
+	return nil
+}
+
+// generateULAPrefix returns a random RFC 4193 unique local /48, with a
+// 40-bit global ID in fd00::/8
+func generateULAPrefix() (netaddr.IPPrefix, error) {
+	id := make([]byte, 5)
+	if _, err := rand.Read(id); err != nil {
+		return netaddr.IPPrefix{}, err
+	}
+	return netaddr.ParseIPPrefix(fmt.Sprintf("fd%02x:%02x%02x:%02x%02x::/48", id[0], id[1], id[2], id[3], id[4]))
+}
+
+// assignedIPPrefixes returns the ranges of the tailnet of the address
+// families assigned to the machines
+func (h *Headscale) assignedIPPrefixes() []netaddr.IPPrefix {
+	prefixes := []netaddr.IPPrefix{}
+	for _, p := range h.ipPrefixes() {
+		if (p.IP().Is4() && h.cfg.DisableIPv4) || (p.IP().Is6() && h.cfg.DisableIPv6) {
+			continue
+		}
+		prefixes = append(prefixes, p)
+	}
+	return prefixes
+}
+
+// ipColumn is the machines column holding the address in the prefix
+func ipColumn(prefix netaddr.IPPrefix) string {
+	if prefix.IP().Is6() {
+		return "ipv6_address"
+	}
+	return "ip_address"
+}
+
+func (m *Machine) ipAddressIn(prefix netaddr.IPPrefix) *string {
+	if prefix.IP().Is6() {
+		return &m.IPv6Address
+	}
+	return &m.IPAddress
+}
+
+// assignIPAddresses gives the machine a free address in each assigned prefix
+// of the tailnet it does not have an address in yet. Machines authenticating
+// again after their key expired keep their addresses.
+func (h *Headscale) assignIPAddresses(m *Machine) error {
+	ipAllocationMu.Lock()
+	defer ipAllocationMu.Unlock()
+
+	for _, prefix := range h.assignedIPPrefixes() {
+		address := m.ipAddressIn(prefix)
+		if *address != "" {
+			continue
+		}
+		used, err := h.getUsedIPs(ipColumn(prefix))
+		if err != nil {
+			return err
+		}
+		ip, err := nextFreeIP(prefix, used, h.cfg.IPAllocationExclude)
+		if err != nil {
+			return err
+		}
+		*address = ip.String()
+	}
+	return nil
+}
+
+// SetMachineIP gives a Machine the address of an assigned prefix of the
+// tailnet, in place of its address of the same family. The address is then
+// static: the other machines do not get it while it is used, and audit-ips
+// leaves it to this machine when it is shared. The addresses of
+// IPAllocationExclude can be given this way.
+func (h *Headscale) SetMachineIP(id uint64, address string) (_ *Machine, err error) {
+	defer func() { h.audit("machine.set_ip", fmt.Sprintf("machine:%d ip:%s", id, address), err) }()
+	if err = h.checkMaintenance(); err != nil {
+		return nil, err
+	}
+	ip, err := netaddr.ParseIP(address)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", errorIPInvalid, address)
+	}
+	prefix, ok := netaddr.IPPrefix{}, false
+	for _, p := range h.assignedIPPrefixes() {
+		if p.Contains(ip) {
+			prefix, ok = p.Masked(), true
+			break
+		}
+	}
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", errorIPOutOfPrefixes, address)
+	}
+	if ip == prefix.IP() || (ip.Is4() && !prefix.Contains(ip.Next())) {
+		return nil, fmt.Errorf("%w: %s is the network or broadcast address of %s", errorIPInvalid, address, prefix)
+	}
+
+	ipAllocationMu.Lock()
+	defer ipAllocationMu.Unlock()
+
+	m, err := h.GetMachineByID(id)
+	if err != nil {
+		return nil, err
+	}
+	column := ipColumn(prefix)
+	var count int64
+	if err := h.db.Model(&Machine{}).Where(column+" = ? AND id <> ?", ip.String(), m.ID).Count(&count).Error; err != nil {
+		return nil, err
+	}
+	if count > 0 {
+		return nil, fmt.Errorf("%w: %s", errorIPInUse, address)
+	}
+
+	*m.ipAddressIn(prefix) = ip.String()
+	m.StaticIP = true
+	if err := h.db.Model(m).Updates(map[string]interface{}{column: ip.String(), "static_ip": true}).Error; err != nil {
+		return nil, err
+	}
+
+	// The addresses are also used in the ACL rules
+	if err := h.updateACLRules(); err != nil {
+		log.Error().
+			Err(err).
+			Msg("Could not regenerate the ACL rules")
+	}
+	h.notifyAllClients()
+	return m, nil
+}
+
+func (h *Headscale) getUsedIPs(column string) (map[netaddr.IP]bool, error) {
+	addresses := []string{}
+	if err := h.db.Model(&Machine{}).Where(column+" <> ''").Pluck(column, &addresses).Error; err != nil {
+		return nil, err
+	}
+	used := map[netaddr.IP]bool{}
+	for _, a := range addresses {
+		if ip, err := netaddr.ParseIP(a); err == nil {
+			used[ip] = true
+		}
+	}
+	return used, nil
+}
+
+// checkIPPrefixes makes sure the addresses already assigned are still in
+// the ranges of the tailnet, so a change of ip_prefixes does not cut off the
+// machines using them
+func (h *Headscale) checkIPPrefixes() error {
+	machines := []Machine{}
+	if err := h.db.Where("registered").Find(&machines).Error; err != nil {
+		return err
+	}
+	for _, m := range machines {
+		for _, a := range m.IPAddresses() {
+			ip, err := netaddr.ParseIP(a)
+			if err != nil {
+				continue // reported by nodes audit-ips
+			}
+			if !prefixesContain(h.ipPrefixes(), ip) {
+				log.Error().
+					Str("machine", m.Name).
+					Str("ip", a).
+					Msg("The machine has an address out of ip_prefixes")
+				return errorIPPrefixesChanged
+			}
+		}
+	}
+	return nil
+}
+
+func prefixesContain(prefixes []netaddr.IPPrefix, ip netaddr.IP) bool {
+	for _, p := range prefixes {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// nextFreeIP returns the first address of the prefix not in used nor in
+// excluded, skipping the network and broadcast addresses
+func nextFreeIP(prefix netaddr.IPPrefix, used map[netaddr.IP]bool, excluded []netaddr.IPPrefix) (netaddr.IP, error) {
+	prefix = prefix.Masked()
+	for ip := prefix.IP().Next(); prefix.Contains(ip); ip = ip.Next() {
+		if ip.Is4() && !prefix.Contains(ip.Next()) {
+			break // broadcast address
+		}
+		if !used[ip] && !prefixesContain(excluded, ip) {
+			return ip, nil
+		}
+	}
+	return netaddr.IP{}, errorNoAvailableIP
+}
+
+// AuditIPs checks the addresses of the registered machines in each assigned
+// prefix of the tailnet: missing, invalid, out of the prefix, or shared by
+// several machines (in which case the machine given it with SetMachineIP, or
+// else the oldest machine, keeps it). With fix, the
+// machines with a problem get a new address, and the clients are notified.
+func (h *Headscale) AuditIPs(fix bool) (_ []IPConflict, err error) {
+	if fix {
+		defer func() { h.audit("ips.fix", "machines", err) }()
+		if err = h.checkMaintenance(); err != nil {
+			return nil, err
+		}
+	}
+	ipAllocationMu.Lock()
+	defer ipAllocationMu.Unlock()
+
+	machines := []Machine{}
+	if err := h.db.Where("registered").Order("id").Find(&machines).Error; err != nil {
+		return nil, err
+	}
+
+	// The addresses of a family no longer assigned are not missing
+	conflicts := []IPConflict{}
+	for _, prefix := range h.assignedIPPrefixes() {
+		found, err := h.auditIPs(machines, prefix, fix)
+		conflicts = append(conflicts, found...)
+		if err != nil {
+			return conflicts, err
+		}
+	}
+	if !fix || len(conflicts) == 0 {
+		return conflicts, nil
+	}
+
+	// The addresses are also used in the ACL rules
+	if err := h.updateACLRules(); err != nil {
+		log.Error().
+			Err(err).
+			Msg("Could not regenerate the ACL rules")
+	}
+	h.notifyAllClients()
+	return conflicts, nil
+}
+
+// auditIPs checks the addresses of the machines in one prefix of the tailnet
+func (h *Headscale) auditIPs(machines []Machine, prefix netaddr.IPPrefix, fix bool) ([]IPConflict, error) {
+	conflicts := []IPConflict{}
+	owners := map[netaddr.IP]uint64{}
+	// The static addresses are kept by their machine, even if not the oldest
+	for _, m := range machines {
+		ip, err := netaddr.ParseIP(*m.ipAddressIn(prefix))
+		if _, ok := owners[ip]; m.StaticIP && err == nil && prefix.Contains(ip) && !ok {
+			owners[ip] = m.ID
+		}
+	}
+	for _, m := range machines {
+		address := *m.ipAddressIn(prefix)
+		problem := ""
+		ip, err := netaddr.ParseIP(address)
+		switch {
+		case address == "":
+			problem = "missing"
+		case err != nil:
+			problem = "invalid"
+		case !prefix.Contains(ip):
+			problem = "out of range"
+		default:
+			if owner, ok := owners[ip]; ok && owner != m.ID {
+				problem = "duplicate"
+			} else {
+				owners[ip] = m.ID
+			}
+		}
+		if problem != "" {
+			conflicts = append(conflicts, IPConflict{
+				MachineID: m.ID,
+				Machine:   m.Name,
+				IPAddress: address,
+				Problem:   problem,
+			})
+		}
+	}
+	if !fix {
+		return conflicts, nil
+	}
+
+	// The addresses out of range are not reused
+	used := map[netaddr.IP]bool{}
+	for ip := range owners {
+		used[ip] = true
+	}
+	for i, conflict := range conflicts {
+		ip, err := nextFreeIP(prefix, used, h.cfg.IPAllocationExclude)
+		if err != nil {
+			return conflicts, err
+		}
+		err = h.db.Model(&Machine{}).Where("id = ?", conflict.MachineID).Update(ipColumn(prefix), ip.String()).Error
+		if err != nil {
+			return conflicts, err
+		}
+		used[ip] = true
+		conflicts[i].NewIPAddress = ip.String()
+		log.Info().
+			Str("machine", conflict.Machine).
+			Str("old_ip", conflict.IPAddress).
+			Str("new_ip", ip.String()).
+			Msg("Reassigned the IP address of the machine")
+	}
+	return conflicts, nil
+}
@@ -0,0 +1,235 @@
+package headscale
+
+import (
+	"errors"
+	"fmt"
+
+	"gopkg.in/check.v1"
+	"inet.af/netaddr"
+)
+
+func (s *Suite) TestNextFreeIP(c *check.C) {
+	prefix := netaddr.MustParseIPPrefix("10.0.0.0/30")
+
+	ip, err := nextFreeIP(prefix, map[netaddr.IP]bool{}, nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(ip.String(), check.Equals, "10.0.0.1")
+
+	ip, err = nextFreeIP(prefix, map[netaddr.IP]bool{netaddr.MustParseIP("10.0.0.1"): true}, nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(ip.String(), check.Equals, "10.0.0.2")
+
+	// 10.0.0.3 is the broadcast address
+	_, err = nextFreeIP(prefix, map[netaddr.IP]bool{
+		netaddr.MustParseIP("10.0.0.1"): true,
+		netaddr.MustParseIP("10.0.0.2"): true,
+	}, nil)
+	c.Assert(err, check.Equals, errorNoAvailableIP)
+}
+
+func (s *Suite) TestNextFreeIPExclude(c *check.C) {
+	prefix := netaddr.MustParseIPPrefix("10.0.0.0/24")
+	excluded := []netaddr.IPPrefix{
+		netaddr.MustParseIPPrefix("10.0.0.1/32"),
+		netaddr.MustParseIPPrefix("10.0.0.4/30"),
+	}
+
+	ip, err := nextFreeIP(prefix, map[netaddr.IP]bool{}, excluded)
+	c.Assert(err, check.IsNil)
+	c.Assert(ip.String(), check.Equals, "10.0.0.2")
+
+	ip, err = nextFreeIP(prefix, map[netaddr.IP]bool{
+		netaddr.MustParseIP("10.0.0.2"): true,
+		netaddr.MustParseIP("10.0.0.3"): true,
+	}, excluded)
+	c.Assert(err, check.IsNil)
+	c.Assert(ip.String(), check.Equals, "10.0.0.8")
+
+	_, err = nextFreeIP(netaddr.MustParseIPPrefix("10.0.0.0/29"), map[netaddr.IP]bool{}, []netaddr.IPPrefix{
+		netaddr.MustParseIPPrefix("10.0.0.0/29"),
+	})
+	c.Assert(err, check.Equals, errorNoAvailableIP)
+}
+
+func (s *Suite) TestAuditIPs(c *check.C) {
+	n, err := h.CreateNamespace("test")
+	c.Assert(err, check.IsNil)
+
+	for i, ip := range []string{"100.64.0.1", "100.64.0.1", "10.0.0.1", "", "100.64.0.2"} {
+		m := Machine{
+			ID:          uint64(i + 1),
+			MachineKey:  fmt.Sprintf("%064d", i+1),
+			Name:        fmt.Sprintf("machine%d", i+1),
+			IPAddress:   ip,
+			NamespaceID: n.ID,
+			Registered:  true,
+		}
+		h.db.Save(&m)
+	}
+
+	conflicts, err := h.AuditIPs(false)
+	c.Assert(err, check.IsNil)
+	c.Assert(len(conflicts), check.Equals, 3)
+	c.Assert(conflicts[0].MachineID, check.Equals, uint64(2))
+	c.Assert(conflicts[0].Problem, check.Equals, "duplicate")
+	c.Assert(conflicts[1].Problem, check.Equals, "out of range")
+	c.Assert(conflicts[2].Problem, check.Equals, "missing")
+
+	conflicts, err = h.AuditIPs(true)
+	c.Assert(err, check.IsNil)
+	c.Assert(conflicts[0].NewIPAddress, check.Equals, "100.64.0.3")
+	c.Assert(conflicts[1].NewIPAddress, check.Equals, "100.64.0.4")
+	c.Assert(conflicts[2].NewIPAddress, check.Equals, "100.64.0.5")
+
+	conflicts, err = h.AuditIPs(false)
+	c.Assert(err, check.IsNil)
+	c.Assert(len(conflicts), check.Equals, 0)
+
+	m := Machine{}
+	err = h.assignIPAddresses(&m)
+	c.Assert(err, check.IsNil)
+	c.Assert(m.IPAddress, check.Equals, "100.64.0.6")
+}
+
+func (s *Suite) TestAssignIPv6Addresses(c *check.C) {
+	h.cfg.IPPrefixes = []netaddr.IPPrefix{
+		netaddr.MustParseIPPrefix("10.1.0.0/24"),
+		netaddr.MustParseIPPrefix("fd7a:115c:a1e0::/48"),
+	}
+	defer func() { h.cfg.IPPrefixes = nil }()
+
+	n, err := h.CreateNamespace("test")
+	c.Assert(err, check.IsNil)
+
+	m := Machine{
+		ID:          1,
+		MachineKey:  "foo",
+		Name:        "testmachine",
+		NamespaceID: n.ID,
+		Registered:  true,
+	}
+	err = h.assignIPAddresses(&m)
+	c.Assert(err, check.IsNil)
+	c.Assert(m.IPAddress, check.Equals, "10.1.0.1")
+	c.Assert(m.IPv6Address, check.Equals, "fd7a:115c:a1e0::1")
+	c.Assert(m.IPAddresses(), check.DeepEquals, []string{"10.1.0.1", "fd7a:115c:a1e0::1"})
+	h.db.Save(&m)
+
+	// A machine with an address keeps it
+	err = h.assignIPAddresses(&m)
+	c.Assert(err, check.IsNil)
+	c.Assert(m.IPv6Address, check.Equals, "fd7a:115c:a1e0::1")
+
+	m2 := Machine{}
+	err = h.assignIPAddresses(&m2)
+	c.Assert(err, check.IsNil)
+	c.Assert(m2.IPv6Address, check.Equals, "fd7a:115c:a1e0::2")
+
+	c.Assert(h.checkIPPrefixes(), check.IsNil)
+
+	// The new range does not contain the addresses in use
+	h.cfg.IPPrefixes = []netaddr.IPPrefix{netaddr.MustParseIPPrefix("10.2.0.0/24")}
+	c.Assert(h.checkIPPrefixes(), check.Equals, errorIPPrefixesChanged)
+
+	h.cfg.IPPrefixes = []netaddr.IPPrefix{
+		netaddr.MustParseIPPrefix("10.0.0.0/8"),
+		netaddr.MustParseIPPrefix("fd7a:115c:a1e0::/48"),
+	}
+	c.Assert(h.checkIPPrefixes(), check.IsNil)
+}
+
+func (s *Suite) TestAssignIPv6Only(c *check.C) {
+	h.cfg.IPPrefixes = []netaddr.IPPrefix{netaddr.MustParseIPPrefix("fd7a:115c:a1e0::/48")}
+	h.cfg.DisableIPv4 = true
+	defer func() {
+		h.cfg.IPPrefixes = nil
+		h.cfg.DisableIPv4 = false
+	}()
+
+	m := Machine{}
+	err := h.assignIPAddresses(&m)
+	c.Assert(err, check.IsNil)
+	c.Assert(m.IPAddress, check.Equals, "")
+	c.Assert(m.IPv6Address, check.Equals, "fd7a:115c:a1e0::1")
+	c.Assert(m.IPAddresses(), check.DeepEquals, []string{"fd7a:115c:a1e0::1"})
+}
+
+func (s *Suite) TestULAPrefix(c *check.C) {
+	err := h.loadULAPrefix()
+	c.Assert(err, check.IsNil)
+	prefixes := h.ipPrefixes()
+	c.Assert(prefixes, check.HasLen, 2)
+	c.Assert(prefixes[0], check.Equals, defaultIPPrefix)
+	ula := prefixes[1]
+	c.Assert(ula.Bits(), check.Equals, uint8(48))
+	c.Assert(netaddr.MustParseIPPrefix("fd00::/8").Contains(ula.IP()), check.Equals, true)
+
+	// The same prefix is used on restart
+	h.cfg.IPPrefixes = nil
+	err = h.loadULAPrefix()
+	c.Assert(err, check.IsNil)
+	c.Assert(h.ipPrefixes(), check.DeepEquals, prefixes)
+
+	// And moved with the state
+	state, err := h.ExportState()
+	c.Assert(err, check.IsNil)
+	c.Assert(state.IPv6Prefix, check.Equals, ula.String())
+
+	// Nothing is generated with an IPv6 prefix in ip_prefixes
+	configured := []netaddr.IPPrefix{defaultIPPrefix, netaddr.MustParseIPPrefix("fd7a:115c:a1e0::/48")}
+	h.cfg.IPPrefixes = configured
+	err = h.loadULAPrefix()
+	c.Assert(err, check.IsNil)
+	c.Assert(h.ipPrefixes(), check.DeepEquals, configured)
+}
+
+func (s *Suite) TestSetMachineIP(c *check.C) {
+	n, err := h.CreateNamespace("test")
+	c.Assert(err, check.IsNil)
+
+	for i, ip := range []string{"100.64.0.1", "100.64.0.2"} {
+		m := Machine{
+			ID:          uint64(i + 1),
+			MachineKey:  fmt.Sprintf("%064d", i+1),
+			Name:        fmt.Sprintf("machine%d", i+1),
+			IPAddress:   ip,
+			NamespaceID: n.ID,
+			Registered:  true,
+		}
+		h.db.Save(&m)
+	}
+
+	_, err = h.SetMachineIP(2, "100.64.0.1")
+	c.Assert(errors.Is(err, errorIPInUse), check.Equals, true)
+	_, err = h.SetMachineIP(2, "10.0.0.1")
+	c.Assert(errors.Is(err, errorIPOutOfPrefixes), check.Equals, true)
+	_, err = h.SetMachineIP(2, "100.64.0.0")
+	c.Assert(errors.Is(err, errorIPInvalid), check.Equals, true)
+	_, err = h.SetMachineIP(2, "foo")
+	c.Assert(errors.Is(err, errorIPInvalid), check.Equals, true)
+
+	m, err := h.SetMachineIP(2, "100.64.0.10")
+	c.Assert(err, check.IsNil)
+	c.Assert(m.IPAddress, check.Equals, "100.64.0.10")
+	c.Assert(m.StaticIP, check.Equals, true)
+	m, err = h.GetMachineByID(2)
+	c.Assert(err, check.IsNil)
+	c.Assert(m.IPAddress, check.Equals, "100.64.0.10")
+	c.Assert(m.StaticIP, check.Equals, true)
+
+	// The previous address is free again, the static one is not
+	m3 := Machine{}
+	err = h.assignIPAddresses(&m3)
+	c.Assert(err, check.IsNil)
+	c.Assert(m3.IPAddress, check.Equals, "100.64.0.2")
+
+	// The static address is kept by its machine, even shared with an older one
+	h.db.Model(&Machine{}).Where("id = ?", 1).Update("ip_address", "100.64.0.10")
+	conflicts, err := h.AuditIPs(true)
+	c.Assert(err, check.IsNil)
+	c.Assert(len(conflicts), check.Equals, 1)
+	c.Assert(conflicts[0].MachineID, check.Equals, uint64(1))
+	m, err = h.GetMachineByID(2)
+	c.Assert(err, check.IsNil)
+	c.Assert(m.IPAddress, check.Equals, "100.64.0.10")
+}
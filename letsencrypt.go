@@ -0,0 +1,227 @@
+package headscale
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/go-acme/lego/v4/certcrypto"
+	"github.com/go-acme/lego/v4/certificate"
+	"github.com/go-acme/lego/v4/challenge"
+	"github.com/go-acme/lego/v4/lego"
+	"github.com/go-acme/lego/v4/providers/dns/cloudflare"
+	"github.com/go-acme/lego/v4/providers/dns/route53"
+	"github.com/go-acme/lego/v4/registration"
+	"github.com/rs/zerolog/log"
+)
+
+const errorDNSProviderUnknown = Error("unknown DNS provider for the DNS-01 challenge")
+
+// dns01RenewBefore is how long before its expiry a certificate obtained with
+// the DNS-01 challenge is renewed, the same as autocert
+const dns01RenewBefore = 30 * 24 * time.Hour
+
+const dns01CheckInterval = 12 * time.Hour
+
+// acmeUser is the ACME account of headscale, its key is kept in the
+// Let's Encrypt cache directory
+type acmeUser struct {
+	key          crypto.PrivateKey
+	registration *registration.Resource
+}
+
+func (u *acmeUser) GetEmail() string                        { return "" }
+func (u *acmeUser) GetRegistration() *registration.Resource { return u.registration }
+func (u *acmeUser) GetPrivateKey() crypto.PrivateKey        { return u.key }
+
+// dns01CertManager obtains and renews the certificate of
+// TLSLetsEncryptHostname with the DNS-01 challenge, which works without
+// exposing headscale to the Internet. autocert only supports the HTTP-01
+// and TLS-ALPN-01 challenges, so this relies on lego.
+type dns01CertManager struct {
+	h      *Headscale
+	client *lego.Client
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+func (h *Headscale) newDNS01CertManager() (*dns01CertManager, error) {
+	provider, err := h.dnsProvider()
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(h.cfg.TLSLetsEncryptCacheDir, 0o700); err != nil {
+		return nil, err
+	}
+	key, err := loadOrCreateACMEKey(filepath.Join(h.cfg.TLSLetsEncryptCacheDir, "acme_account.key"))
+	if err != nil {
+		return nil, err
+	}
+	user := &acmeUser{key: key}
+
+	config := lego.NewConfig(user)
+	config.CADirURL = h.cfg.TLSLetsEncryptCA
+	if config.CADirURL == "" {
+		config.CADirURL = lego.LEDirectoryProduction
+	}
+	config.Certificate.KeyType = certcrypto.EC256
+	client, err := lego.NewClient(config)
+	if err != nil {
+		return nil, err
+	}
+	if err := client.Challenge.SetDNS01Provider(provider); err != nil {
+		return nil, err
+	}
+
+	// The account is only created the first time
+	user.registration, err = client.Registration.ResolveAccountByKey()
+	if err != nil {
+		user.registration, err = client.Registration.Register(registration.RegisterOptions{TermsOfServiceAgreed: true})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	m := &dns01CertManager{h: h, client: client}
+	if cert, err := tls.LoadX509KeyPair(m.certPath(), m.keyPath()); err == nil {
+		m.cert = &cert
+	}
+	if err := m.renewIfNeeded(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (h *Headscale) dnsProvider() (challenge.Provider, error) {
+	switch h.cfg.TLSLetsEncryptDNSProvider {
+	case "cloudflare":
+		config := cloudflare.NewDefaultConfig()
+		config.AuthToken = h.cfg.TLSLetsEncryptCloudflareAPIToken
+		return cloudflare.NewDNSProviderConfig(config)
+	case "route53":
+		// The AWS credentials are read from the usual environment variables,
+		// shared configuration or instance role
+		config := route53.NewDefaultConfig()
+		if h.cfg.TLSLetsEncryptRoute53HostedZoneID != "" {
+			config.HostedZoneID = h.cfg.TLSLetsEncryptRoute53HostedZoneID
+		}
+		return route53.NewDNSProviderConfig(config)
+	default:
+		return nil, errorDNSProviderUnknown
+	}
+}
+
+func (m *dns01CertManager) certPath() string {
+	return filepath.Join(m.h.cfg.TLSLetsEncryptCacheDir, m.h.cfg.TLSLetsEncryptHostname+".crt")
+}
+
+func (m *dns01CertManager) keyPath() string {
+	return filepath.Join(m.h.cfg.TLSLetsEncryptCacheDir, m.h.cfg.TLSLetsEncryptHostname+".key")
+}
+
+// getCertificate is the GetCertificate of the tls.Config of the server
+func (m *dns01CertManager) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.cert == nil {
+		return nil, errors.New("no certificate obtained yet")
+	}
+	return m.cert, nil
+}
+
+// renewIfNeeded obtains a new certificate when there is none yet, or when
+// the current one is about to expire
+func (m *dns01CertManager) renewIfNeeded() error {
+	m.mu.RLock()
+	cert := m.cert
+	m.mu.RUnlock()
+	if cert != nil && len(cert.Certificate) > 0 {
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err == nil && time.Until(leaf.NotAfter) > dns01RenewBefore {
+			return nil
+		}
+	}
+
+	log.Info().
+		Str("hostname", m.h.cfg.TLSLetsEncryptHostname).
+		Msg("Requesting a certificate with the DNS-01 challenge")
+	res, err := m.client.Certificate.Obtain(certificate.ObtainRequest{
+		Domains: []string{m.h.cfg.TLSLetsEncryptHostname},
+		Bundle:  true,
+	})
+	if err != nil {
+		return err
+	}
+	newCert, err := tls.X509KeyPair(res.Certificate, res.PrivateKey)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(m.certPath(), res.Certificate, 0o600); err != nil {
+		return err
+	}
+	if err := os.WriteFile(m.keyPath(), res.PrivateKey, 0o600); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	m.cert = &newCert
+	m.mu.Unlock()
+	return nil
+}
+
+// renewLoop checks the certificate periodically until the server shuts down
+func (m *dns01CertManager) renewLoop() {
+	ticker := time.NewTicker(dns01CheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.h.shutdown:
+			return
+		case <-ticker.C:
+			if err := m.renewIfNeeded(); err != nil {
+				log.Error().
+					Str("hostname", m.h.cfg.TLSLetsEncryptHostname).
+					Err(err).
+					Msg("Could not renew the certificate")
+			}
+		}
+	}
+}
+
+func loadOrCreateACMEKey(path string) (crypto.PrivateKey, error) {
+	content, err := os.ReadFile(path)
+	if err == nil {
+		block, _ := pem.Decode(content)
+		if block == nil {
+			return nil, errors.New("invalid ACME account key in " + path)
+		}
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	b, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	err = os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: b}), 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
@@ -0,0 +1,43 @@
+package headscale
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+const errorLogFormatInvalid = Error("invalid log format, valid: text, json")
+
+// SetupLogging configures the global logger used across headscale.
+//
+// level is any zerolog level name (debug, info, warn, error...), format is
+// either "text" (human-readable, the default) or "json".
+func SetupLogging(level string, format string) error {
+	return setupLogging(os.Stderr, level, format)
+}
+
+func setupLogging(w io.Writer, level string, format string) error {
+	if level == "" {
+		level = "info"
+	}
+	lvl, err := zerolog.ParseLevel(level)
+	if err != nil {
+		return fmt.Errorf("invalid log level %q: %w", level, err)
+	}
+
+	switch format {
+	case "", "text":
+		w = zerolog.ConsoleWriter{Out: w, TimeFormat: time.RFC3339}
+	case "json":
+	default:
+		return errorLogFormatInvalid
+	}
+
+	zerolog.SetGlobalLevel(lvl)
+	log.Logger = zerolog.New(w).With().Timestamp().Logger()
+	return nil
+}
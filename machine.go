@@ -3,17 +3,28 @@ package headscale
 import (
 	"encoding/json"
 	"fmt"
-	"log"
 	"sort"
 	"strconv"
+	"strings"
 	"time"
 
+	"github.com/rs/zerolog/log"
 	"gorm.io/datatypes"
+	"gorm.io/gorm"
 	"inet.af/netaddr"
 	"tailscale.com/tailcfg"
 	"tailscale.com/types/wgkey"
 )
 
+const errorMachineNameInvalid = Error("machine name must be a valid DNS label (lowercase letters, digits and hyphens, up to 63 characters)")
+const errorMachineNameExists = Error("another machine of the namespace has this name")
+const errorMachineSortInvalid = Error("invalid sort order, valid: id, name, last-seen, ip")
+const errorMachineNotRegistered = Error("machine is not registered")
+
+// defaultKeepAliveInterval is the interval of the keepalives sent to the
+// polling clients, each of them updates the LastSeen of the machine
+const defaultKeepAliveInterval = 60 * time.Second
+
 // Machine is a Headscale client
 type Machine struct {
 	ID          uint64 `gorm:"primary_key"`
@@ -21,32 +32,126 @@ type Machine struct {
 	NodeKey     string
 	DiscoKey    string
 	IPAddress   string
+	IPv6Address string `gorm:"column:ipv6_address"`
+	// StaticIP is set once an address is given with nodes set-ip
+	StaticIP    bool
 	Name        string
+	GivenName   string
 	NamespaceID uint
 	Namespace   Namespace `gorm:"foreignKey:NamespaceID"`
 
 	Registered     bool // temp
 	RegisterMethod string
-	AuthKeyID      uint
-	AuthKey        *PreAuthKey
+	// Pending is set on the machines authenticated while
+	// node_approval_required is enabled, until ApproveMachine. They are not
+	// Registered in the meantime.
+	Pending      bool
+	RegisteredAt *time.Time
+	AuthKeyID    uint
+	AuthKey      *PreAuthKey
 
 	LastSeen *time.Time
 	Expiry   *time.Time
+	// KeyRefreshRequestedAt is set by RefreshMachineKey, until the machine
+	// registers a new node key
+	KeyRefreshRequestedAt *time.Time
+	// Online is not stored, it is derived from LastSeen by ListMachines,
+	// ListMachinesInNamespace and GetMachineByID
+	Online bool `gorm:"-"`
+	// Shared is set by ListMachines on the machines shared in from another
+	// namespace
+	Shared bool `gorm:"-"`
 
 	HostInfo      datatypes.JSON
 	Endpoints     datatypes.JSON
 	EnabledRoutes datatypes.JSON
+	Tags          datatypes.JSON
 
 	CreatedAt time.Time
 	UpdatedAt time.Time
 	DeletedAt *time.Time
 }
 
+// DisplayName is the name given to the machine by the admin (with
+// nodes rename), or its hostname
+func (m Machine) DisplayName() string {
+	if m.GivenName != "" {
+		return m.GivenName
+	}
+	return m.Name
+}
+
+// keyFingerprintLength is the number of hex digits of the node key shown
+// by NodeKeyFingerprint
+const keyFingerprintLength = 16
+
+// MachineKeys are the public keys of a machine, in the form Tailscale shows
+// them (e.g. nodekey:<hex> in tailscale status --json). The private keys
+// never leave the clients.
+type MachineKeys struct {
+	MachineKey string
+	NodeKey    string
+	DiscoKey   string
+}
+
+// PublicKeys returns the keys of the machine, empty for the ones it has not
+// sent yet
+func (m Machine) PublicKeys() MachineKeys {
+	prefixed := func(prefix string, key string) string {
+		if key == "" {
+			return ""
+		}
+		return prefix + key
+	}
+	return MachineKeys{
+		MachineKey: prefixed("mkey:", m.MachineKey),
+		NodeKey:    prefixed("nodekey:", m.NodeKey),
+		DiscoKey:   prefixed("discokey:", m.DiscoKey),
+	}
+}
+
+// NodeKeyFingerprint is the start of the node key, enough to recognize a
+// device, e.g. when approving it
+func (m Machine) NodeKeyFingerprint() string {
+	key := m.PublicKeys().NodeKey
+	if len(key) > len("nodekey:")+keyFingerprintLength {
+		key = key[:len("nodekey:")+keyFingerprintLength]
+	}
+	return key
+}
+
+// IPAddresses returns the addresses of the machine in the tailnet, IPv4
+// first
+func (m Machine) IPAddresses() []string {
+	addresses := []string{}
+	for _, a := range []string{m.IPAddress, m.IPv6Address} {
+		if a != "" {
+			addresses = append(addresses, a)
+		}
+	}
+	return addresses
+}
+
+// firstIPAddress is the IPv4 address of the machine, or its IPv6 address if
+// it only has one
+func (m Machine) firstIPAddress() string {
+	if addresses := m.IPAddresses(); len(addresses) > 0 {
+		return addresses[0]
+	}
+	return ""
+}
+
 // For the time being this method is rather naive
 func (m Machine) isAlreadyRegistered() bool {
 	return m.Registered
 }
 
+// isExpired returns true if the machine key has expired. A zero or empty expiry
+// means the key does not expire.
+func (m Machine) isExpired() bool {
+	return m.Expiry != nil && !m.Expiry.IsZero() && m.Expiry.Before(time.Now())
+}
+
 func (m Machine) toNode() (*tailcfg.Node, error) {
 	nKey, err := wgkey.ParseHex(m.NodeKey)
 	if err != nil {
@@ -69,34 +174,20 @@ func (m Machine) toNode() (*tailcfg.Node, error) {
 	}
 
 	addrs := []netaddr.IPPrefix{}
-	ip, err := netaddr.ParseIPPrefix(fmt.Sprintf("%s/32", m.IPAddress))
-	if err != nil {
-		return nil, err
-	}
-	addrs = append(addrs, ip) // missing the ipv6 ?
-
-	allowedIPs := []netaddr.IPPrefix{}
-	allowedIPs = append(allowedIPs, ip) // we append the node own IP, as it is required by the clients
-
-	routesStr := []string{}
-	if len(m.EnabledRoutes) != 0 {
-		allwIps, err := m.EnabledRoutes.MarshalJSON()
+	for _, a := range m.IPAddresses() {
+		ip, err := netaddr.ParseIP(a)
 		if err != nil {
 			return nil, err
 		}
-		err = json.Unmarshal(allwIps, &routesStr)
-		if err != nil {
-			return nil, err
+		bits := uint8(32)
+		if ip.Is6() {
+			bits = 128
 		}
+		addrs = append(addrs, netaddr.IPPrefixFrom(ip, bits))
 	}
 
-	for _, aip := range routesStr {
-		ip, err := netaddr.ParseIPPrefix(aip)
-		if err != nil {
-			return nil, err
-		}
-		allowedIPs = append(allowedIPs, ip)
-	}
+	allowedIPs := []netaddr.IPPrefix{}
+	allowedIPs = append(allowedIPs, addrs...) // we append the node own IPs, as they are required by the clients
 
 	endpoints := []string{}
 	if len(m.Endpoints) != 0 {
@@ -122,6 +213,21 @@ func (m Machine) toNode() (*tailcfg.Node, error) {
 		}
 	}
 
+	// Only the approved routes the machine is still advertising are sent to
+	// the peers, so they do not route traffic to a machine that dropped them
+	enabledRoutes, err := m.getEnabledRoutes()
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range enabledRoutes {
+		for _, advertised := range hostinfo.RoutableIPs {
+			if r == advertised {
+				allowedIPs = append(allowedIPs, r)
+				break
+			}
+		}
+	}
+
 	var derp string
 	if hostinfo.NetInfo != nil {
 		derp = fmt.Sprintf("127.3.3.40:%d", hostinfo.NetInfo.PreferredDERP)
@@ -129,13 +235,23 @@ func (m Machine) toNode() (*tailcfg.Node, error) {
 		derp = "127.3.3.40:0" // Zero means disconnected or unknown.
 	}
 
+	var keyExpiry time.Time
+	if m.Expiry != nil {
+		keyExpiry = *m.Expiry
+	}
+
+	name := hostinfo.Hostname
+	if m.GivenName != "" {
+		name = m.GivenName
+	}
+
 	n := tailcfg.Node{
 		ID:         tailcfg.NodeID(m.ID),                               // this is the actual ID
 		StableID:   tailcfg.StableNodeID(strconv.FormatUint(m.ID, 10)), // in headscale, unlike tailcontrol server, IDs are permanent
-		Name:       hostinfo.Hostname,
+		Name:       name,
 		User:       tailcfg.UserID(m.NamespaceID),
 		Key:        tailcfg.NodeKey(nKey),
-		KeyExpiry:  *m.Expiry,
+		KeyExpiry:  keyExpiry,
 		Machine:    tailcfg.MachineKey(mKey),
 		DiscoKey:   discoKey,
 		Addresses:  addrs,
@@ -154,18 +270,33 @@ func (m Machine) toNode() (*tailcfg.Node, error) {
 }
 
 func (h *Headscale) getPeers(m Machine) (*[]*tailcfg.Node, error) {
-	machines := []Machine{}
-	if err := h.db.Where("namespace_id = ? AND machine_key <> ? AND registered",
-		m.NamespaceID, m.MachineKey).Find(&machines).Error; err != nil {
-		log.Printf("Error accessing db: %s", err)
+	machines, err := h.getPeerMachines(m)
+	if err != nil {
 		return nil, err
 	}
 
+	// The shared machines keep the MagicDNS names of their namespace
+	nodes := map[uint]map[uint64]*tailcfg.Node{}
 	peers := []*tailcfg.Node{}
+	acl := h.loadACL()
 	for _, mn := range machines {
-		peer, err := mn.toNode()
-		if err != nil {
-			return nil, err
+		// The machines the ACL rules keep apart do not see each other
+		if acl.policy != nil && !aclAllowsPeers(*acl.rules, m, mn) {
+			continue
+		}
+		if _, ok := nodes[mn.NamespaceID]; !ok {
+			_, nodes[mn.NamespaceID], err = h.getNamespacePeers(mn.NamespaceID)
+			if err != nil {
+				return nil, err
+			}
+		}
+		peer, ok := nodes[mn.NamespaceID][mn.ID]
+		if !ok {
+			// Shared after its namespace was loaded
+			peer, err = mn.toNode()
+			if err != nil {
+				return nil, err
+			}
 		}
 		peers = append(peers, peer)
 	}
@@ -173,6 +304,138 @@ func (h *Headscale) getPeers(m Machine) (*[]*tailcfg.Node, error) {
 	return &peers, nil
 }
 
+// getPeerMachines returns the machines sent to m as peers: the other machines
+// of its namespace and the shared ones, if they can connect
+func (h *Headscale) getPeerMachines(m Machine) ([]Machine, error) {
+	namespace, _, err := h.getNamespacePeers(m.NamespaceID)
+	if err != nil {
+		log.Error().
+			Err(err).
+			Msg("Error accessing db")
+		return nil, err
+	}
+	shared, err := h.getSharedPeers(m)
+	if err != nil {
+		return nil, err
+	}
+	machines := make([]Machine, 0, len(namespace)+len(shared))
+	machines = append(machines, namespace...)
+	machines = append(machines, shared...)
+
+	seen := map[uint64]bool{}
+	peers := []Machine{}
+	for _, mn := range machines {
+		// Registered from the CLI, but the client has not connected yet
+		if mn.MachineKey == m.MachineKey || mn.isExpired() || mn.NodeKey == "" || seen[mn.ID] {
+			continue
+		}
+		seen[mn.ID] = true
+		peers = append(peers, mn)
+	}
+	return peers, nil
+}
+
+// MachineFilter selects and orders the machines returned by ListMachines.
+// The zero value returns all the machines, ordered by ID.
+type MachineFilter struct {
+	Namespace string
+	Tag       string
+	// Online only returns the machines seen during the last keepalive interval
+	Online bool
+	// LastSeenBefore only returns the machines not seen since then (or never)
+	LastSeenBefore *time.Time
+	// SortBy is one of id, name, last-seen (most recent first) or ip
+	SortBy string
+	// IncludeShared also returns the machines shared with Namespace
+	IncludeShared bool
+	// Pending only returns the machines waiting for approval
+	Pending bool
+}
+
+// ListMachines returns the machines matching the filter
+func (h *Headscale) ListMachines(f MachineFilter) (*[]Machine, error) {
+	q := h.db.Preload("AuthKey").Preload("Namespace")
+	var namespaceID uint
+	if f.Namespace != "" {
+		n, err := h.GetNamespace(f.Namespace)
+		if err != nil {
+			return nil, err
+		}
+		namespaceID = n.ID
+		if f.IncludeShared {
+			q = q.Where("(namespace_id = ? OR id IN (?))", n.ID,
+				h.db.Model(&SharedMachine{}).Select("machine_id").Where("namespace_id = ?", n.ID))
+		} else {
+			q = q.Where("namespace_id = ?", n.ID)
+		}
+	}
+	if f.Tag != "" {
+		// Tags are stored as a JSON list of strings
+		b, _ := json.Marshal(f.Tag)
+		q = q.Where("tags LIKE ?", "%"+string(b)+"%")
+	}
+	if f.Online {
+		q = q.Where("last_seen > ?", time.Now().UTC().Add(-h.onlineTimeout()))
+	}
+	if f.LastSeenBefore != nil {
+		q = q.Where("last_seen IS NULL OR last_seen < ?", f.LastSeenBefore.UTC())
+	}
+	if f.Pending {
+		q = q.Where("pending")
+	}
+
+	sortByIP := false
+	switch f.SortBy {
+	case "", "id":
+		q = q.Order("id")
+	case "name":
+		q = q.Order("COALESCE(NULLIF(given_name, ''), name)").Order("id")
+	case "last-seen":
+		// The machines never seen come last
+		q = q.Order("last_seen IS NULL").Order("last_seen DESC").Order("id")
+	case "ip":
+		sortByIP = true
+	default:
+		return nil, errorMachineSortInvalid
+	}
+
+	machines := []Machine{}
+	if err := q.Find(&machines).Error; err != nil {
+		return nil, err
+	}
+	for i := range machines {
+		machines[i].Online = h.isOnline(machines[i])
+		if f.IncludeShared && namespaceID != 0 {
+			machines[i].Shared = machines[i].NamespaceID != namespaceID
+		}
+	}
+	// The addresses are stored as text, which does not sort numerically
+	if sortByIP {
+		sort.SliceStable(machines, func(i, j int) bool {
+			a, _ := netaddr.ParseIP(machines[i].firstIPAddress())
+			b, _ := netaddr.ParseIP(machines[j].firstIPAddress())
+			return a.Less(b)
+		})
+	}
+	return &machines, nil
+}
+
+// onlineTimeout is how long after its LastSeen a machine is considered
+// online, node_poll_timeout or by default the keepalive interval plus a few
+// seconds to avoid races
+func (h *Headscale) onlineTimeout() time.Duration {
+	if h.cfg.PollTimeout > 0 {
+		return h.cfg.PollTimeout
+	}
+	return defaultKeepAliveInterval + 5*time.Second
+}
+
+// isOnline tells whether the machine has been seen during the last
+// keepalive interval
+func (h *Headscale) isOnline(m Machine) bool {
+	return m.LastSeen != nil && time.Since(*m.LastSeen) < h.onlineTimeout()
+}
+
 // GetMachine finds a Machine by name and namespace and returns the Machine struct
 func (h *Headscale) GetMachine(namespace string, name string) (*Machine, error) {
 	machines, err := h.ListMachinesInNamespace(namespace)
@@ -188,6 +451,553 @@ func (h *Headscale) GetMachine(namespace string, name string) (*Machine, error)
 	return nil, fmt.Errorf("not found")
 }
 
+// GetMachineByID finds a Machine by ID and returns the Machine struct
+func (h *Headscale) GetMachineByID(id uint64) (*Machine, error) {
+	m := Machine{}
+	if result := h.db.Preload("Namespace").Preload("AuthKey").First(&m, "id = ?", id); result.Error != nil {
+		return nil, result.Error
+	}
+	m.Online = h.isOnline(m)
+	return &m, nil
+}
+
+// MoveMachineToNamespace moves a registered Machine (and its IP address) to another
+// namespace, and updates the peers in both namespaces
+func (h *Headscale) MoveMachineToNamespace(id uint64, namespaceName string) (_ *Machine, err error) {
+	defer func() { h.audit("machine.move", fmt.Sprintf("machine:%d namespace:%s", id, namespaceName), err) }()
+	if err = h.checkMaintenance(); err != nil {
+		return nil, err
+	}
+	m, err := h.GetMachineByID(id)
+	if err != nil {
+		return nil, err
+	}
+	oldPeers, err := h.getPeers(*m)
+	if err != nil {
+		return nil, err
+	}
+
+	err = h.SetMachineNamespace(m, namespaceName)
+	if err != nil {
+		return nil, err
+	}
+	// A share with its new namespace is no longer needed
+	err = h.db.Where("machine_id = ? AND namespace_id = ?", m.ID, m.NamespaceID).Delete(&SharedMachine{}).Error
+	if err != nil {
+		return nil, err
+	}
+
+	// Only keep the enabled routes the machine is still advertising
+	hi, err := m.GetHostInfo()
+	if err != nil {
+		return nil, err
+	}
+	enabledRoutes, err := m.getEnabledRoutes()
+	if err != nil {
+		return nil, err
+	}
+	routes := []string{}
+	for _, r := range enabledRoutes {
+		for _, advertised := range hi.RoutableIPs {
+			if r == advertised {
+				routes = append(routes, r.String())
+				break
+			}
+		}
+	}
+	b, _ := json.Marshal(routes)
+	m.EnabledRoutes = datatypes.JSON(b)
+	h.db.Save(m)
+
+	// Namespaces are expanded to IP addresses in the ACL rules
+	if err := h.updateACLRules(); err != nil {
+		log.Error().
+			Err(err).
+			Msg("Could not regenerate the ACL rules")
+	}
+
+	m, err = h.GetMachineByID(id)
+	if err != nil {
+		return nil, err
+	}
+	newPeers, err := h.getPeers(*m)
+	if err != nil {
+		return nil, err
+	}
+	h.notifyNodes(append(*oldPeers, *newPeers...))
+	h.notifyMachine(m.ID)
+
+	return m, nil
+}
+
+// RenameMachine sets the given name of a Machine, which must be a DNS label
+// unique in its namespace. An empty name reverts to the hostname.
+func (h *Headscale) RenameMachine(id uint64, name string) (_ *Machine, err error) {
+	defer func() { h.audit("machine.rename", fmt.Sprintf("machine:%d name:%s", id, name), err) }()
+	if err = h.checkMaintenance(); err != nil {
+		return nil, err
+	}
+	m, err := h.GetMachineByID(id)
+	if err != nil {
+		return nil, err
+	}
+	if name != "" {
+		if !namespaceNameRegexp.MatchString(name) {
+			return nil, errorMachineNameInvalid
+		}
+		machines := []Machine{}
+		if err := h.db.Where("namespace_id = ? AND id <> ?", m.NamespaceID, m.ID).Find(&machines).Error; err != nil {
+			return nil, err
+		}
+		for _, other := range machines {
+			if strings.EqualFold(other.DisplayName(), name) {
+				return nil, errorMachineNameExists
+			}
+		}
+	}
+
+	m.GivenName = name
+	if err := h.db.Model(m).Update("given_name", name).Error; err != nil {
+		return nil, err
+	}
+
+	peers, err := h.getPeers(*m)
+	if err != nil {
+		return nil, err
+	}
+	h.notifyNodes(*peers)
+	h.notifyMachine(m.ID)
+	return m, nil
+}
+
+// DeleteMachine removes a Machine from the database, and updates its peers
+func (h *Headscale) DeleteMachine(id uint64) (err error) {
+	defer func() { h.audit("machine.delete", fmt.Sprintf("machine:%d", id), err) }()
+	if err = h.checkMaintenance(); err != nil {
+		return err
+	}
+	m, err := h.GetMachineByID(id)
+	if err != nil {
+		return err
+	}
+	peers, err := h.getPeers(*m)
+	if err != nil {
+		return err
+	}
+	if err := h.deleteMachineShares(m.ID); err != nil {
+		return err
+	}
+	if err := h.db.Unscoped().Delete(m).Error; err != nil {
+		return err
+	}
+	h.notifyNodes(*peers)
+	return nil
+}
+
+// ExpireMachine expires the key of a Machine immediately, so it has to be
+// authenticated again
+func (h *Headscale) ExpireMachine(id uint64) (*Machine, error) {
+	return h.SetMachineExpiry(id, time.Now().UTC())
+}
+
+// ReauthMachine invalidates the node key of a Machine, so it has to be
+// authenticated again, e.g. after a suspected compromise. Unlike DeleteMachine
+// the machine keeps its namespace, IP addresses, tags and routes, and unlike
+// ExpireMachine its current key is no longer accepted at all.
+func (h *Headscale) ReauthMachine(id uint64) (_ *Machine, err error) {
+	defer func() { h.audit("machine.reauth", fmt.Sprintf("machine:%d", id), err) }()
+	if err = h.checkMaintenance(); err != nil {
+		return nil, err
+	}
+	m, err := h.GetMachineByID(id)
+	if err != nil {
+		return nil, err
+	}
+	// Its peers are listed before, it no longer has any after
+	peers, err := h.getPeers(*m)
+	if err != nil {
+		return nil, err
+	}
+	if err := h.db.Model(m).Updates(map[string]interface{}{"registered": false, "pending": false, "node_key": ""}).Error; err != nil {
+		return nil, err
+	}
+	m.Registered = false
+	m.Pending = false
+	m.NodeKey = ""
+
+	h.notifyNodes(*peers)
+	// Closes its long-poll, see PollNetMapHandler
+	h.notifyMachine(m.ID)
+	return m, nil
+}
+
+// RefreshMachineKey requires a Machine to rotate its node key. Its next map
+// response tells it its key expired when the refresh was requested, and the
+// client then registers a new key bound to the machine, which keeps its
+// record, IP addresses, tags and routes. The current long-poll is closed so
+// the next one starts at once.
+func (h *Headscale) RefreshMachineKey(id uint64) (_ *Machine, err error) {
+	defer func() { h.audit("machine.refresh_key", fmt.Sprintf("machine:%d", id), err) }()
+	if err = h.checkMaintenance(); err != nil {
+		return nil, err
+	}
+	m, err := h.GetMachineByID(id)
+	if err != nil {
+		return nil, err
+	}
+	if !m.Registered {
+		return nil, errorMachineNotRegistered
+	}
+	now := time.Now().UTC()
+	if err := h.db.Model(m).Update("key_refresh_requested_at", now).Error; err != nil {
+		return nil, err
+	}
+	m.KeyRefreshRequestedAt = &now
+
+	h.notifyMachine(m.ID)
+	return m, nil
+}
+
+// rotateNodeKey gives a registered Machine the new node key it registered
+// in place of its current one, and tells its peers
+func (h *Headscale) rotateNodeKey(m *Machine, nodeKey string) (err error) {
+	defer func() { h.audit("machine.rotate_key", fmt.Sprintf("machine:%d", m.ID), err) }()
+	updates := map[string]interface{}{"node_key": nodeKey, "key_refresh_requested_at": nil}
+	if err := h.db.Model(m).Updates(updates).Error; err != nil {
+		return err
+	}
+	m.NodeKey = nodeKey
+	m.KeyRefreshRequestedAt = nil
+
+	peers, err := h.getPeers(*m)
+	if err != nil {
+		return err
+	}
+	h.notifyNodes(*peers)
+	return nil
+}
+
+// isKeyRefreshRequested tells if the machine has been asked to rotate its
+// node key with RefreshMachineKey, and has not yet
+func (h *Headscale) isKeyRefreshRequested(id uint64) bool {
+	m := Machine{}
+	if err := h.db.Select("key_refresh_requested_at").First(&m, "id = ?", id).Error; err != nil {
+		return false
+	}
+	return m.KeyRefreshRequestedAt != nil
+}
+
+// isMachineRegistered tells if the machine is still registered, it is not
+// once deleted or asked to authenticate again
+func (h *Headscale) isMachineRegistered(id uint64) bool {
+	m := Machine{}
+	if err := h.db.Select("registered").First(&m, "id = ?", id).Error; err != nil {
+		return false
+	}
+	return m.Registered
+}
+
+// ExpireNamespaceMachines expires at once the keys of all the registered
+// machines of a namespace, e.g. when its owner leaves. The machines are kept.
+// The ones that had already expired keep their expiry.
+func (h *Headscale) ExpireNamespaceMachines(namespaceName string) (_ *[]Machine, err error) {
+	defer func() { h.audit("namespace.expire_machines", "namespace:"+namespaceName, err) }()
+	if err = h.checkMaintenance(); err != nil {
+		return nil, err
+	}
+	n, err := h.GetNamespace(namespaceName)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	machines := []Machine{}
+	err = h.db.Transaction(func(tx *gorm.DB) error {
+		q := "namespace_id = ? AND registered AND (expiry IS NULL OR expiry > ?)"
+		if err := tx.Where(q, n.ID, now).Order("id").Find(&machines).Error; err != nil {
+			return err
+		}
+		if len(machines) == 0 {
+			return nil
+		}
+		return tx.Model(&Machine{}).Where(q, n.ID, now).Update("expiry", now).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range machines {
+		machines[i].Expiry = &now
+		peers, err := h.getPeers(machines[i])
+		if err != nil {
+			return nil, err
+		}
+		h.notifyNodes(*peers)
+		h.notifyMachine(machines[i].ID)
+	}
+	return &machines, nil
+}
+
+// SetMachineExpiry sets the time the key of a Machine expires, and updates its peers
+func (h *Headscale) SetMachineExpiry(id uint64, expiry time.Time) (_ *Machine, err error) {
+	defer func() {
+		h.audit("machine.set_expiry", fmt.Sprintf("machine:%d expiry:%s", id, expiry.UTC().Format(time.RFC3339)), err)
+	}()
+	if err = h.checkMaintenance(); err != nil {
+		return nil, err
+	}
+	m, err := h.GetMachineByID(id)
+	if err != nil {
+		return nil, err
+	}
+	m.Expiry = &expiry
+	if err := h.db.Model(m).Update("expiry", expiry).Error; err != nil {
+		return nil, err
+	}
+
+	peers, err := h.getPeers(*m)
+	if err != nil {
+		return nil, err
+	}
+	h.notifyNodes(*peers)
+	h.notifyMachine(m.ID)
+	return m, nil
+}
+
+// getMachineExpiry returns the expiry for a machine being registered now, or
+// nil if the machine keys do not expire
+func (h *Headscale) getMachineExpiry() *time.Time {
+	if h.cfg.NodeKeyExpiry <= 0 {
+		return nil
+	}
+	expiry := time.Now().UTC().Add(h.cfg.NodeKeyExpiry)
+	return &expiry
+}
+
+// ExpireMachines periodically checks for machines whose key has expired, and
+// updates their peers so they are removed from the netmaps
+func (h *Headscale) ExpireMachines(milliSeconds int64) {
+	ticker := time.NewTicker(time.Duration(milliSeconds) * time.Millisecond)
+	for range ticker.C {
+		h.expireMachinesWorker()
+	}
+}
+
+func (h *Headscale) expireMachinesWorker() {
+	now := time.Now()
+	since := h.lastExpiryCheck
+	h.lastExpiryCheck = now
+
+	machines := []Machine{}
+	if err := h.db.Where("registered AND expiry IS NOT NULL AND expiry <= ?", now).Find(&machines).Error; err != nil {
+		log.Error().
+			Err(err).
+			Msg("Error listing expired machines")
+		return
+	}
+	for _, m := range machines {
+		if !m.isExpired() || m.Expiry.Before(since) {
+			continue // zero expiry, or already handled in a previous run
+		}
+		log.Info().
+			Str("machine", m.Name).
+			Msg("Machine key has expired")
+		peers, err := h.getPeers(m)
+		if err != nil {
+			log.Error().
+				Str("machine", m.Name).
+				Err(err).
+				Msg("Cannot get the peers of the expired machine")
+			continue
+		}
+		h.notifyNodes(*peers)
+		h.notifyMachine(m.ID)
+	}
+}
+
+// GetTags returns the ACL tags assigned to the machine from the CLI
+func (m Machine) GetTags() ([]string, error) {
+	tags := []string{}
+	if len(m.Tags) != 0 {
+		b, err := m.Tags.MarshalJSON()
+		if err != nil {
+			return nil, err
+		}
+		err = json.Unmarshal(b, &tags)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return tags, nil
+}
+
+// machineHasTag tells whether the machine has the tag, assigned from the CLI
+// or requested by the client. The tags requested by the client only count if
+// its namespace owns them.
+func (h *Headscale) machineHasTag(policy *ACLPolicy, m Machine, tag string) (bool, error) {
+	tags, err := m.GetTags()
+	if err != nil {
+		return false, err
+	}
+	if containsString(tags, tag) {
+		return true, nil
+	}
+	hostinfo, err := m.GetHostInfo()
+	if err != nil {
+		return false, err
+	}
+	for _, t := range hostinfo.RequestTags {
+		if t == tag && policy.tagOwnedBy(tag, m.Namespace.Name) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// TagMachine adds and removes ACL tags of a Machine. The tags added must be
+// in the TagOwners of the ACL policy, and owned by the namespace of the
+// machine. The ACL rules are generated again, as they expand the tags.
+func (h *Headscale) TagMachine(id uint64, add []string, remove []string) (_ *Machine, err error) {
+	defer func() {
+		h.audit("machine.tag", fmt.Sprintf("machine:%d add:%s remove:%s", id, strings.Join(add, ","), strings.Join(remove, ",")), err)
+	}()
+	if err = h.checkMaintenance(); err != nil {
+		return nil, err
+	}
+	m, err := h.GetMachineByID(id)
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range add {
+		if err := h.checkTagOwner(t, m.Namespace.Name); err != nil {
+			return nil, err
+		}
+	}
+
+	current, err := m.GetTags()
+	if err != nil {
+		return nil, err
+	}
+	tags := []string{}
+	for _, t := range append(current, add...) {
+		if !containsString(tags, t) && !containsString(remove, t) {
+			tags = append(tags, t)
+		}
+	}
+	sort.Strings(tags)
+
+	b, _ := json.Marshal(tags)
+	m.Tags = datatypes.JSON(b)
+	if err := h.db.Model(m).Update("tags", m.Tags).Error; err != nil {
+		return nil, err
+	}
+
+	// Tags are expanded to IP addresses in the ACL rules
+	if err := h.updateACLRules(); err != nil {
+		return nil, err
+	}
+	h.notifyAllClients()
+	return m, nil
+}
+
+// checkTagOwner makes sure the tag is in the TagOwners of the ACL policy,
+// and owned by the namespace
+func (h *Headscale) checkTagOwner(tag string, namespaceName string) error {
+	policy := h.loadACL().policy
+	if policy == nil {
+		return errorInvalidTag
+	}
+	if _, ok := policy.TagOwners[tag]; !ok {
+		return fmt.Errorf("%w: %s is not in the TagOwners of the ACL policy", errorInvalidTag, tag)
+	}
+	if !policy.tagOwnedBy(tag, namespaceName) {
+		return fmt.Errorf("%w: %s is not owned by the namespace %s", errorInvalidTag, tag, namespaceName)
+	}
+	return nil
+}
+
+// ClearMachineTags removes all the ACL tags of a Machine
+func (h *Headscale) ClearMachineTags(id uint64) (*Machine, error) {
+	m, err := h.GetMachineByID(id)
+	if err != nil {
+		return nil, err
+	}
+	tags, err := m.GetTags()
+	if err != nil {
+		return nil, err
+	}
+	return h.TagMachine(id, nil, tags)
+}
+
+// tagOwnedBy tells whether the namespace is one of the owners of the tag in
+// the ACL policy, directly or through a group
+func (p *ACLPolicy) tagOwnedBy(tag string, namespace string) bool {
+	for _, owner := range p.TagOwners[tag] {
+		if owner == namespace {
+			return true
+		}
+		if strings.HasPrefix(owner, "group:") {
+			namespaces, _ := p.groupNamespaces(owner)
+			if containsString(namespaces, namespace) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (m Machine) getEnabledRoutes() ([]netaddr.IPPrefix, error) {
+	routesStr := []string{}
+	if len(m.EnabledRoutes) != 0 {
+		b, err := m.EnabledRoutes.MarshalJSON()
+		if err != nil {
+			return nil, err
+		}
+		err = json.Unmarshal(b, &routesStr)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	routes := []netaddr.IPPrefix{}
+	for _, r := range routesStr {
+		ip, err := netaddr.ParseIPPrefix(r)
+		if err != nil {
+			return nil, err
+		}
+		routes = append(routes, ip)
+	}
+	return routes, nil
+}
+
+// notifyNodes asks the given nodes, if they are polling, to fetch an updated map
+func (h *Headscale) notifyNodes(nodes []*tailcfg.Node) {
+	for _, n := range nodes {
+		h.notifyMachine(uint64(n.ID))
+	}
+}
+
+// notifyMachine asks the machine, if it is polling, to fetch an updated map
+func (h *Headscale) notifyMachine(id uint64) {
+	h.pollMu.Lock()
+	defer h.pollMu.Unlock()
+	if update, ok := h.clientsPolling[id]; ok {
+		select {
+		case update <- []byte{}:
+		default: // there is already an update pending for this client
+		}
+	}
+}
+
 // GetHostInfo returns a Hostinfo struct for the machine
 func (m *Machine) GetHostInfo() (*tailcfg.Hostinfo, error) {
 	hostinfo := tailcfg.Hostinfo{}
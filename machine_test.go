@@ -1,14 +1,20 @@
 package headscale
 
 import (
+	"errors"
+	"fmt"
+	"time"
+
 	"gopkg.in/check.v1"
+	"gorm.io/datatypes"
+	"tailscale.com/tailcfg"
 )
 
 func (s *Suite) TestGetMachine(c *check.C) {
 	n, err := h.CreateNamespace("test")
 	c.Assert(err, check.IsNil)
 
-	pak, err := h.CreatePreAuthKey(n.Name, false, false, nil)
+	pak, err := h.CreatePreAuthKey(n.Name, false, false, nil, nil)
 	c.Assert(err, check.IsNil)
 
 	_, err = h.GetMachine("test", "testmachine")
@@ -34,3 +40,573 @@ func (s *Suite) TestGetMachine(c *check.C) {
 	c.Assert(err, check.IsNil)
 
 }
+
+func (s *Suite) TestMoveMachineToNamespace(c *check.C) {
+	n1, err := h.CreateNamespace("test")
+	c.Assert(err, check.IsNil)
+
+	n2, err := h.CreateNamespace("test2")
+	c.Assert(err, check.IsNil)
+
+	m := Machine{
+		ID:             0,
+		MachineKey:     "foo",
+		NodeKey:        "bar",
+		DiscoKey:       "faa",
+		IPAddress:      "100.64.0.1",
+		Name:           "testmachine",
+		NamespaceID:    n1.ID,
+		Registered:     true,
+		RegisterMethod: "cli",
+	}
+	h.db.Save(&m)
+
+	_, err = h.MoveMachineToNamespace(m.ID, "does-not-exist")
+	c.Assert(err, check.NotNil)
+
+	moved, err := h.MoveMachineToNamespace(m.ID, n2.Name)
+	c.Assert(err, check.IsNil)
+	c.Assert(moved.NamespaceID, check.Equals, n2.ID)
+	c.Assert(moved.Namespace.Name, check.Equals, n2.Name)
+	c.Assert(moved.IPAddress, check.Equals, "100.64.0.1")
+
+	_, err = h.GetMachine("test", "testmachine")
+	c.Assert(err, check.NotNil)
+
+	_, err = h.GetMachine("test2", "testmachine")
+	c.Assert(err, check.IsNil)
+}
+
+func (s *Suite) TestExpireMachine(c *check.C) {
+	n, err := h.CreateNamespace("test")
+	c.Assert(err, check.IsNil)
+
+	m := Machine{
+		ID:             0,
+		MachineKey:     "foo",
+		NodeKey:        "bar",
+		DiscoKey:       "faa",
+		Name:           "testmachine",
+		NamespaceID:    n.ID,
+		Registered:     true,
+		RegisterMethod: "cli",
+	}
+	h.db.Save(&m)
+
+	m1, err := h.GetMachineByID(m.ID)
+	c.Assert(err, check.IsNil)
+	c.Assert(m1.isExpired(), check.Equals, false)
+
+	m1, err = h.SetMachineExpiry(m.ID, time.Now().Add(time.Hour))
+	c.Assert(err, check.IsNil)
+	c.Assert(m1.isExpired(), check.Equals, false)
+
+	_, err = h.ExpireMachine(m.ID)
+	c.Assert(err, check.IsNil)
+
+	m1, err = h.GetMachineByID(m.ID)
+	c.Assert(err, check.IsNil)
+	c.Assert(m1.isExpired(), check.Equals, true)
+
+	h.expireMachinesWorker()
+}
+
+func (s *Suite) TestExpireNamespaceMachines(c *check.C) {
+	n, err := h.CreateNamespace("test")
+	c.Assert(err, check.IsNil)
+	n2, err := h.CreateNamespace("other")
+	c.Assert(err, check.IsNil)
+
+	past := time.Now().UTC().Add(-time.Hour)
+	for i, namespaceID := range []uint{n.ID, n.ID, n.ID, n2.ID} {
+		m := Machine{
+			MachineKey:     fmt.Sprintf("%064x", i),
+			NodeKey:        fmt.Sprintf("%064x", 10+i),
+			DiscoKey:       fmt.Sprintf("%064x", 20+i),
+			Name:           fmt.Sprintf("testmachine%d", i),
+			NamespaceID:    namespaceID,
+			Registered:     true,
+			RegisterMethod: "cli",
+		}
+		if i == 2 {
+			m.Expiry = &past
+		}
+		h.db.Save(&m)
+	}
+
+	expired, err := h.ExpireNamespaceMachines("test")
+	c.Assert(err, check.IsNil)
+	c.Assert(*expired, check.HasLen, 2)
+
+	machines, err := h.ListMachines(MachineFilter{})
+	c.Assert(err, check.IsNil)
+	for _, m := range *machines {
+		c.Assert(m.isExpired(), check.Equals, m.NamespaceID == n.ID)
+	}
+	m, err := h.GetMachineByID((*machines)[2].ID)
+	c.Assert(err, check.IsNil)
+	c.Assert(m.Expiry.Unix(), check.Equals, past.Unix())
+
+	_, err = h.ExpireNamespaceMachines("does-not-exist")
+	c.Assert(err, check.NotNil)
+}
+
+func (s *Suite) TestTagMachine(c *check.C) {
+	n, err := h.CreateNamespace("test")
+	c.Assert(err, check.IsNil)
+
+	m := Machine{
+		ID:             0,
+		MachineKey:     "foo",
+		NodeKey:        "bar",
+		DiscoKey:       "faa",
+		IPAddress:      "100.64.0.1",
+		Name:           "testmachine",
+		NamespaceID:    n.ID,
+		Registered:     true,
+		RegisterMethod: "cli",
+	}
+	h.db.Save(&m)
+
+	// Without a policy there are no valid tags
+	_, err = h.TagMachine(m.ID, []string{"tag:server"}, nil)
+	c.Assert(err, check.NotNil)
+
+	h.acl.Store(&aclState{
+		policy: &ACLPolicy{TagOwners: TagOwners{"tag:server": []string{"test"}}},
+		rules:  &[]tailcfg.FilterRule{},
+	})
+
+	_, err = h.TagMachine(m.ID, []string{"tag:unknown"}, nil)
+	c.Assert(errors.Is(err, errorInvalidTag), check.Equals, true)
+
+	m1, err := h.TagMachine(m.ID, []string{"tag:server"}, nil)
+	c.Assert(err, check.IsNil)
+	tags, err := m1.GetTags()
+	c.Assert(err, check.IsNil)
+	c.Assert(tags, check.DeepEquals, []string{"tag:server"})
+
+	ips, err := h.expandAlias(h.loadACL().policy, "tag:server")
+	c.Assert(err, check.IsNil)
+	c.Assert(*ips, check.DeepEquals, []string{"100.64.0.1"})
+
+	m1, err = h.TagMachine(m.ID, nil, []string{"tag:server"})
+	c.Assert(err, check.IsNil)
+	tags, err = m1.GetTags()
+	c.Assert(err, check.IsNil)
+	c.Assert(tags, check.HasLen, 0)
+}
+
+func (s *Suite) TestTagMachinePeers(c *check.C) {
+	n, err := h.CreateNamespace("test")
+	c.Assert(err, check.IsNil)
+	_, err = h.CreateNamespace("other")
+	c.Assert(err, check.IsNil)
+
+	machines := []Machine{}
+	for i := 1; i <= 2; i++ {
+		m := Machine{
+			MachineKey:     fmt.Sprintf("%064x", i),
+			NodeKey:        fmt.Sprintf("%064x", 10+i),
+			DiscoKey:       fmt.Sprintf("%064x", 20+i),
+			IPAddress:      fmt.Sprintf("100.64.0.%d", i),
+			Name:           fmt.Sprintf("testmachine%d", i),
+			NamespaceID:    n.ID,
+			Registered:     true,
+			RegisterMethod: "cli",
+		}
+		h.db.Save(&m)
+		machines = append(machines, m)
+	}
+	client, server := machines[0], machines[1]
+
+	policy := &ACLPolicy{
+		TagOwners: TagOwners{
+			"tag:client": []string{"test"},
+			"tag:server": []string{"test"},
+			"tag:other":  []string{"other"},
+		},
+		ACLs: []ACL{{Action: "accept", Users: []string{"tag:client"}, Ports: []string{"tag:server:*"}}},
+	}
+	rules, err := h.generateACLRules(policy)
+	c.Assert(err, check.IsNil)
+	h.acl.Store(&aclState{policy: policy, rules: rules})
+
+	// No tag matches the rule yet
+	peers, err := h.getPeers(client)
+	c.Assert(err, check.IsNil)
+	c.Assert(*peers, check.HasLen, 0)
+
+	// Owned by another namespace
+	_, err = h.TagMachine(client.ID, []string{"tag:other"}, nil)
+	c.Assert(errors.Is(err, errorInvalidTag), check.Equals, true)
+
+	_, err = h.TagMachine(client.ID, []string{"tag:client"}, nil)
+	c.Assert(err, check.IsNil)
+	_, err = h.TagMachine(server.ID, []string{"tag:server"}, nil)
+	c.Assert(err, check.IsNil)
+	peers, err = h.getPeers(client)
+	c.Assert(err, check.IsNil)
+	c.Assert(*peers, check.HasLen, 1)
+	c.Assert((*peers)[0].ID, check.Equals, tailcfg.NodeID(server.ID))
+	// The server does not connect to the client, but sees it
+	peers, err = h.getPeers(server)
+	c.Assert(err, check.IsNil)
+	c.Assert(*peers, check.HasLen, 1)
+
+	m, err := h.ClearMachineTags(client.ID)
+	c.Assert(err, check.IsNil)
+	tags, err := m.GetTags()
+	c.Assert(err, check.IsNil)
+	c.Assert(tags, check.HasLen, 0)
+	peers, err = h.getPeers(client)
+	c.Assert(err, check.IsNil)
+	c.Assert(*peers, check.HasLen, 0)
+}
+
+func (s *Suite) TestDeleteMachine(c *check.C) {
+	n, err := h.CreateNamespace("test")
+	c.Assert(err, check.IsNil)
+
+	m := Machine{
+		ID:             0,
+		MachineKey:     "foo",
+		NodeKey:        "bar",
+		DiscoKey:       "faa",
+		IPAddress:      "100.64.0.1",
+		Name:           "testmachine",
+		NamespaceID:    n.ID,
+		Registered:     true,
+		RegisterMethod: "cli",
+	}
+	h.db.Save(&m)
+
+	err = h.DeleteMachine(m.ID)
+	c.Assert(err, check.IsNil)
+
+	_, err = h.GetMachineByID(m.ID)
+	c.Assert(err, check.NotNil)
+
+	err = h.DeleteMachine(m.ID)
+	c.Assert(err, check.NotNil)
+}
+
+func (s *Suite) TestDeleteMachines(c *check.C) {
+	n, err := h.CreateNamespace("test")
+	c.Assert(err, check.IsNil)
+
+	for i := 1; i <= 3; i++ {
+		m := Machine{
+			ID:             uint64(i),
+			MachineKey:     fmt.Sprintf("%064d", i),
+			NodeKey:        fmt.Sprintf("%064d", i),
+			DiscoKey:       fmt.Sprintf("%064d", i),
+			IPAddress:      fmt.Sprintf("100.64.0.%d", i),
+			Name:           fmt.Sprintf("testmachine%d", i),
+			NamespaceID:    n.ID,
+			Registered:     true,
+			RegisterMethod: "cli",
+		}
+		h.db.Save(&m)
+	}
+
+	// 9 does not exist, the others are deleted anyway
+	result := h.DeleteMachines([]uint64{1, 9, 2}, false)
+	c.Assert(result.Succeeded, check.DeepEquals, []uint64{1, 2})
+	c.Assert(result.Failed, check.HasLen, 1)
+	c.Assert(result.Failed[0].ID, check.Equals, uint64(9))
+	c.Assert(result.Skipped, check.HasLen, 0)
+	c.Assert(result.FailedIDs(), check.DeepEquals, []uint64{9})
+
+	result = h.DeleteMachines([]uint64{9, 3}, true)
+	c.Assert(result.Succeeded, check.HasLen, 0)
+	c.Assert(result.Failed, check.HasLen, 1)
+	c.Assert(result.Skipped, check.DeepEquals, []uint64{3})
+	c.Assert(result.FailedIDs(), check.DeepEquals, []uint64{9, 3})
+
+	_, err = h.GetMachineByID(3)
+	c.Assert(err, check.IsNil)
+}
+
+func (s *Suite) TestRenameMachine(c *check.C) {
+	n, err := h.CreateNamespace("test")
+	c.Assert(err, check.IsNil)
+
+	for i, name := range []string{"macbook-pro", "macbook-pro-2"} {
+		m := Machine{
+			ID:             uint64(i + 1),
+			MachineKey:     fmt.Sprintf("%064d", i+1),
+			NodeKey:        fmt.Sprintf("%064d", i+1),
+			DiscoKey:       fmt.Sprintf("%064d", i+1),
+			IPAddress:      fmt.Sprintf("100.64.0.%d", i+1),
+			Name:           name,
+			NamespaceID:    n.ID,
+			Registered:     true,
+			RegisterMethod: "cli",
+		}
+		h.db.Save(&m)
+	}
+
+	_, err = h.RenameMachine(2, "Not_A_Label")
+	c.Assert(err, check.Equals, errorMachineNameInvalid)
+	_, err = h.RenameMachine(2, "macbook-pro")
+	c.Assert(err, check.Equals, errorMachineNameExists)
+
+	m, err := h.RenameMachine(2, "work-laptop")
+	c.Assert(err, check.IsNil)
+	c.Assert(m.DisplayName(), check.Equals, "work-laptop")
+	c.Assert(m.Name, check.Equals, "macbook-pro-2")
+
+	node, err := m.toNode()
+	c.Assert(err, check.IsNil)
+	c.Assert(node.Name, check.Equals, "work-laptop")
+
+	m, err = h.RenameMachine(2, "")
+	c.Assert(err, check.IsNil)
+	c.Assert(m.DisplayName(), check.Equals, "macbook-pro-2")
+}
+
+func (s *Suite) TestListMachinesFilter(c *check.C) {
+	n1, err := h.CreateNamespace("test")
+	c.Assert(err, check.IsNil)
+	n2, err := h.CreateNamespace("other")
+	c.Assert(err, check.IsNil)
+
+	now := time.Now().UTC()
+	old := now.Add(-40 * 24 * time.Hour)
+	machines := []Machine{
+		{Name: "charlie", IPAddress: "100.64.0.10", NamespaceID: n1.ID, LastSeen: &now, Tags: datatypes.JSON(`["tag:server"]`)},
+		{Name: "alpha", IPAddress: "100.64.0.9", NamespaceID: n1.ID, LastSeen: &old},
+		{Name: "bravo", IPAddress: "100.64.0.2", NamespaceID: n1.ID},
+		{Name: "delta", IPAddress: "100.64.0.1", NamespaceID: n2.ID, LastSeen: &now},
+	}
+	for i := range machines {
+		machines[i].ID = uint64(i + 1)
+		machines[i].MachineKey = fmt.Sprintf("%064d", i+1)
+		machines[i].Registered = true
+		h.db.Save(&machines[i])
+	}
+
+	names := func(f MachineFilter) []string {
+		list, err := h.ListMachines(f)
+		c.Assert(err, check.IsNil)
+		result := []string{}
+		for _, m := range *list {
+			result = append(result, m.Name)
+		}
+		return result
+	}
+
+	c.Assert(names(MachineFilter{}), check.DeepEquals, []string{"charlie", "alpha", "bravo", "delta"})
+	c.Assert(names(MachineFilter{Namespace: "test", SortBy: "name"}), check.DeepEquals, []string{"alpha", "bravo", "charlie"})
+	c.Assert(names(MachineFilter{Namespace: "test", SortBy: "ip"}), check.DeepEquals, []string{"bravo", "alpha", "charlie"})
+	c.Assert(names(MachineFilter{Namespace: "test", SortBy: "last-seen"}), check.DeepEquals, []string{"charlie", "alpha", "bravo"})
+	c.Assert(names(MachineFilter{Tag: "tag:server"}), check.DeepEquals, []string{"charlie"})
+	c.Assert(names(MachineFilter{Online: true}), check.DeepEquals, []string{"charlie", "delta"})
+
+	cutoff := now.Add(-30 * 24 * time.Hour)
+	c.Assert(names(MachineFilter{LastSeenBefore: &cutoff}), check.DeepEquals, []string{"alpha", "bravo"})
+
+	_, err = h.ListMachines(MachineFilter{SortBy: "size"})
+	c.Assert(err, check.Equals, errorMachineSortInvalid)
+	_, err = h.ListMachines(MachineFilter{Namespace: "unknown"})
+	c.Assert(err, check.Equals, errorNamespaceNotFound)
+}
+
+func (s *Suite) TestMachineOnline(c *check.C) {
+	n, err := h.CreateNamespace("test")
+	c.Assert(err, check.IsNil)
+
+	recent := time.Now().UTC().Add(-30 * time.Second)
+	stale := time.Now().UTC().Add(-2 * defaultKeepAliveInterval)
+	for i, lastSeen := range []*time.Time{&recent, &stale, nil} {
+		m := Machine{
+			ID:          uint64(i + 1),
+			MachineKey:  fmt.Sprintf("%064d", i+1),
+			Name:        fmt.Sprintf("machine%d", i+1),
+			NamespaceID: n.ID,
+			Registered:  true,
+			LastSeen:    lastSeen,
+		}
+		h.db.Save(&m)
+	}
+
+	m, err := h.GetMachineByID(1)
+	c.Assert(err, check.IsNil)
+	c.Assert(m.Online, check.Equals, true)
+
+	machines, err := h.ListMachinesInNamespace("test")
+	c.Assert(err, check.IsNil)
+	c.Assert((*machines)[0].Online, check.Equals, true)
+	c.Assert((*machines)[1].Online, check.Equals, false)
+	c.Assert((*machines)[2].Online, check.Equals, false)
+
+	// node_poll_timeout is read from the configuration of this Headscale
+	h.cfg.PollTimeout = 3 * defaultKeepAliveInterval
+	machines, err = h.ListMachines(MachineFilter{Online: true})
+	c.Assert(err, check.IsNil)
+	c.Assert(*machines, check.HasLen, 2)
+	c.Assert((*machines)[1].Online, check.Equals, true)
+}
+
+func (s *Suite) TestGetMachineNetMap(c *check.C) {
+	n, err := h.CreateNamespace("test")
+	c.Assert(err, check.IsNil)
+	h.acl.Store(&aclState{rules: &tailcfg.FilterAllowAll})
+
+	machines := []Machine{}
+	for i := 1; i <= 2; i++ {
+		m := Machine{
+			MachineKey:     fmt.Sprintf("%064x", i),
+			NodeKey:        fmt.Sprintf("%064x", 10+i),
+			DiscoKey:       fmt.Sprintf("%064x", 20+i),
+			IPAddress:      fmt.Sprintf("100.64.0.%d", i),
+			Name:           fmt.Sprintf("testmachine%d", i),
+			NamespaceID:    n.ID,
+			Registered:     true,
+			RegisterMethod: "cli",
+		}
+		h.db.Save(&m)
+		machines = append(machines, m)
+	}
+	router := machines[1]
+	router.HostInfo = datatypes.JSON(`{"RoutableIPs":["192.168.1.0/24"]}`)
+	router.EnabledRoutes = datatypes.JSON(`["192.168.1.0/24"]`)
+	h.db.Save(&router)
+
+	netmap, err := h.GetMachineNetMap(machines[0].ID)
+	c.Assert(err, check.IsNil)
+	c.Assert(netmap.Node.ID, check.Equals, tailcfg.NodeID(machines[0].ID))
+	c.Assert(netmap.Peers, check.HasLen, 1)
+	c.Assert(netmap.Peers[0].ID, check.Equals, tailcfg.NodeID(router.ID))
+	found := false
+	for _, ip := range netmap.Peers[0].AllowedIPs {
+		found = found || ip.String() == "192.168.1.0/24"
+	}
+	c.Assert(found, check.Equals, true)
+	c.Assert(netmap.PacketFilter, check.DeepEquals, tailcfg.FilterAllowAll)
+
+	_, err = h.GetMachineNetMap(42)
+	c.Assert(err, check.NotNil)
+}
+
+func (s *Suite) TestReauthMachine(c *check.C) {
+	n, err := h.CreateNamespace("test")
+	c.Assert(err, check.IsNil)
+
+	machines := []Machine{}
+	for i := 1; i <= 2; i++ {
+		m := Machine{
+			MachineKey:     fmt.Sprintf("%064x", i),
+			NodeKey:        fmt.Sprintf("%064x", 10+i),
+			DiscoKey:       fmt.Sprintf("%064x", 20+i),
+			IPAddress:      fmt.Sprintf("100.64.0.%d", i),
+			Name:           fmt.Sprintf("testmachine%d", i),
+			NamespaceID:    n.ID,
+			Registered:     true,
+			RegisterMethod: "cli",
+			Tags:           datatypes.JSON(`["tag:server"]`),
+		}
+		h.db.Save(&m)
+		machines = append(machines, m)
+	}
+
+	m, err := h.ReauthMachine(machines[1].ID)
+	c.Assert(err, check.IsNil)
+	c.Assert(m.Registered, check.Equals, false)
+	c.Assert(h.isMachineRegistered(m.ID), check.Equals, false)
+
+	peers, err := h.getPeers(machines[0])
+	c.Assert(err, check.IsNil)
+	c.Assert(*peers, check.HasLen, 0)
+
+	m, err = h.GetMachineByID(machines[1].ID)
+	c.Assert(err, check.IsNil)
+	c.Assert(m.NodeKey, check.Equals, "")
+	c.Assert(m.IPAddress, check.Equals, "100.64.0.2")
+	tags, err := m.GetTags()
+	c.Assert(err, check.IsNil)
+	c.Assert(tags, check.DeepEquals, []string{"tag:server"})
+
+	// Authenticated again, it keeps its address
+	m, err = h.RegisterMachine(m.MachineKey, "test")
+	c.Assert(err, check.IsNil)
+	c.Assert(m.IPAddress, check.Equals, "100.64.0.2")
+	c.Assert(h.isMachineRegistered(m.ID), check.Equals, true)
+
+	_, err = h.ReauthMachine(42)
+	c.Assert(err, check.NotNil)
+}
+
+func (s *Suite) TestRefreshMachineKey(c *check.C) {
+	n, err := h.CreateNamespace("test")
+	c.Assert(err, check.IsNil)
+	h.acl.Store(&aclState{rules: &tailcfg.FilterAllowAll})
+
+	machines := []Machine{}
+	for i := 1; i <= 2; i++ {
+		m := Machine{
+			MachineKey:     fmt.Sprintf("%064x", i),
+			NodeKey:        fmt.Sprintf("%064x", 10+i),
+			DiscoKey:       fmt.Sprintf("%064x", 20+i),
+			IPAddress:      fmt.Sprintf("100.64.0.%d", i),
+			Name:           fmt.Sprintf("testmachine%d", i),
+			NamespaceID:    n.ID,
+			Registered:     true,
+			RegisterMethod: "cli",
+			Tags:           datatypes.JSON(`["tag:server"]`),
+		}
+		h.db.Save(&m)
+		machines = append(machines, m)
+	}
+
+	m, err := h.RefreshMachineKey(machines[1].ID)
+	c.Assert(err, check.IsNil)
+	c.Assert(m.KeyRefreshRequestedAt, check.NotNil)
+	c.Assert(h.isKeyRefreshRequested(m.ID), check.Equals, true)
+	c.Assert(h.isMachineRegistered(m.ID), check.Equals, true)
+
+	// Its own key has expired, not the one its peers see
+	netmap, err := h.GetMachineNetMap(m.ID)
+	c.Assert(err, check.IsNil)
+	c.Assert(netmap.Node.KeyExpiry.Equal(*m.KeyRefreshRequestedAt), check.Equals, true)
+	netmap, err = h.GetMachineNetMap(machines[0].ID)
+	c.Assert(err, check.IsNil)
+	c.Assert(netmap.Peers, check.HasLen, 1)
+	c.Assert(netmap.Peers[0].KeyExpiry.IsZero(), check.Equals, true)
+
+	err = h.rotateNodeKey(m, fmt.Sprintf("%064x", 42))
+	c.Assert(err, check.IsNil)
+	c.Assert(h.isKeyRefreshRequested(m.ID), check.Equals, false)
+
+	m, err = h.GetMachineByID(machines[1].ID)
+	c.Assert(err, check.IsNil)
+	c.Assert(m.NodeKey, check.Equals, fmt.Sprintf("%064x", 42))
+	c.Assert(m.IPAddress, check.Equals, "100.64.0.2")
+	c.Assert(m.Registered, check.Equals, true)
+	tags, err := m.GetTags()
+	c.Assert(err, check.IsNil)
+	c.Assert(tags, check.DeepEquals, []string{"tag:server"})
+
+	_, err = h.ReauthMachine(m.ID)
+	c.Assert(err, check.IsNil)
+	_, err = h.RefreshMachineKey(m.ID)
+	c.Assert(err, check.Equals, errorMachineNotRegistered)
+
+	_, err = h.RefreshMachineKey(42)
+	c.Assert(err, check.NotNil)
+}
+
+func (s *Suite) TestMachinePublicKeys(c *check.C) {
+	m := Machine{
+		MachineKey: fmt.Sprintf("%064x", 1),
+		NodeKey:    "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef",
+	}
+	keys := m.PublicKeys()
+	c.Assert(keys.MachineKey, check.Equals, "mkey:"+m.MachineKey)
+	c.Assert(keys.NodeKey, check.Equals, "nodekey:"+m.NodeKey)
+	c.Assert(keys.DiscoKey, check.Equals, "")
+	c.Assert(m.NodeKeyFingerprint(), check.Equals, "nodekey:0123456789abcdef")
+
+	c.Assert(Machine{}.NodeKeyFingerprint(), check.Equals, "")
+}
@@ -0,0 +1,76 @@
+package headscale
+
+import (
+	"strconv"
+)
+
+const errorMaintenance = Error("server in maintenance, changes are refused until it ends")
+const errorMaintenanceInConfig = Error("maintenance_mode is set in the configuration")
+
+// maintenanceKey holds the maintenance mode set with SetMaintenanceMode, in
+// the database so the CLI and the servers sharing it all see it
+const maintenanceKey = "maintenance_mode"
+
+// MaintenanceStatus tells whether the server is in maintenance, because of
+// maintenance_mode in the configuration or of SetMaintenanceMode
+type MaintenanceStatus struct {
+	Enabled bool
+	Config  bool
+	Command bool
+}
+
+// GetMaintenanceStatus returns the maintenance mode and where it is set
+func (h *Headscale) GetMaintenanceStatus() (*MaintenanceStatus, error) {
+	// Never set is not in maintenance
+	value, _ := h.getValue(maintenanceKey)
+	h.maintenanceMu.Lock()
+	status := MaintenanceStatus{Config: h.cfg.MaintenanceMode}
+	h.maintenanceMu.Unlock()
+	status.Command = value == "true"
+	status.Enabled = status.Config || status.Command
+	return &status, nil
+}
+
+// SetMaintenanceMode starts or ends the maintenance. It cannot end a
+// maintenance set in the configuration.
+func (h *Headscale) SetMaintenanceMode(enabled bool) (_ *MaintenanceStatus, err error) {
+	action := "maintenance.disable"
+	if enabled {
+		action = "maintenance.enable"
+	}
+	defer func() { h.audit(action, "server", err) }()
+
+	if err = h.setValue(maintenanceKey, strconv.FormatBool(enabled)); err != nil {
+		return nil, err
+	}
+	status, err := h.GetMaintenanceStatus()
+	if err != nil {
+		return nil, err
+	}
+	if !enabled && status.Config {
+		return status, errorMaintenanceInConfig
+	}
+	return status, nil
+}
+
+// SetMaintenanceModeConfig applies maintenance_mode when the configuration
+// is reloaded
+func (h *Headscale) SetMaintenanceModeConfig(enabled bool) {
+	h.maintenanceMu.Lock()
+	defer h.maintenanceMu.Unlock()
+	h.cfg.MaintenanceMode = enabled
+}
+
+// checkMaintenance returns errorMaintenance during a maintenance. It is
+// called before the changes made by the admins and the registrations of new
+// machines; the machines already registered keep polling their netmaps.
+func (h *Headscale) checkMaintenance() error {
+	status, err := h.GetMaintenanceStatus()
+	if err != nil {
+		return err
+	}
+	if status.Enabled {
+		return errorMaintenance
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package headscale
+
+import (
+	"gopkg.in/check.v1"
+)
+
+func (s *Suite) TestMaintenanceMode(c *check.C) {
+	_, err := h.CreateNamespace("test")
+	c.Assert(err, check.IsNil)
+
+	status, err := h.SetMaintenanceMode(true)
+	c.Assert(err, check.IsNil)
+	c.Assert(status.Enabled, check.Equals, true)
+	c.Assert(status.Command, check.Equals, true)
+
+	_, err = h.CreateNamespace("other")
+	c.Assert(err, check.Equals, errorMaintenance)
+	err = h.DestroyNamespace("test")
+	c.Assert(err, check.Equals, errorMaintenance)
+
+	ns, err := h.ListNamespaces()
+	c.Assert(err, check.IsNil)
+	c.Assert(len(*ns), check.Equals, 1)
+
+	status, err = h.SetMaintenanceMode(false)
+	c.Assert(err, check.IsNil)
+	c.Assert(status.Enabled, check.Equals, false)
+
+	_, err = h.CreateNamespace("other")
+	c.Assert(err, check.IsNil)
+}
+
+func (s *Suite) TestMaintenanceModeInConfig(c *check.C) {
+	h.SetMaintenanceModeConfig(true)
+
+	_, err := h.CreateNamespace("test")
+	c.Assert(err, check.Equals, errorMaintenance)
+
+	status, err := h.SetMaintenanceMode(false)
+	c.Assert(err, check.Equals, errorMaintenanceInConfig)
+	c.Assert(status.Enabled, check.Equals, true)
+	c.Assert(status.Config, check.Equals, true)
+
+	h.SetMaintenanceModeConfig(false)
+	_, err = h.CreateNamespace("test")
+	c.Assert(err, check.IsNil)
+}
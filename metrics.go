@@ -0,0 +1,112 @@
+package headscale
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog/log"
+)
+
+const prometheusNamespace = "headscale"
+
+var (
+	httpRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: prometheusNamespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Duration of the HTTP requests (the long polls included)",
+	}, []string{"handler", "method", "code"})
+
+	netMapGenerationDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: prometheusNamespace,
+		Name:      "netmap_generation_duration_seconds",
+		Help:      "Time spent generating the map responses sent to the clients",
+	})
+
+	netMapUpdatesSent = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: prometheusNamespace,
+		Name:      "netmap_updates_sent_total",
+		Help:      "Number of map updates sent to the polling clients",
+	})
+
+	netMapDeltaUpdatesSent = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: prometheusNamespace,
+		Name:      "netmap_delta_updates_sent_total",
+		Help:      "Number of the map updates sent as deltas of the previous map",
+	})
+
+	aclReloads = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: prometheusNamespace,
+		Name:      "acl_reloads_total",
+		Help:      "Number of reloads of the ACL policy",
+	}, []string{"result"})
+
+	registrationRequestsLimited = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: prometheusNamespace,
+		Name:      "registration_requests_limited_total",
+		Help:      "Number of requests to the registration endpoints refused by the rate limit",
+	})
+)
+
+// registerMetrics registers the metrics that are computed on every scrape
+func (h *Headscale) registerMetrics() {
+	collectors := []prometheus.Collector{
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: prometheusNamespace,
+			Name:      "machines_registered",
+			Help:      "Number of registered machines",
+		}, func() float64 {
+			var count int64
+			if err := h.db.Model(&Machine{}).Where("registered").Count(&count).Error; err != nil {
+				log.Error().
+					Err(err).
+					Msg("Error counting the registered machines")
+			}
+			return float64(count)
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: prometheusNamespace,
+			Name:      "machines_online",
+			Help:      "Number of machines currently polling for updates",
+		}, func() float64 {
+			h.pollMu.Lock()
+			defer h.pollMu.Unlock()
+			return float64(len(h.clientsPolling))
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: prometheusNamespace,
+			Name:      "preauth_keys",
+			Help:      "Number of pre-auth keys issued",
+		}, func() float64 {
+			var count int64
+			if err := h.db.Model(&PreAuthKey{}).Count(&count).Error; err != nil {
+				log.Error().
+					Err(err).
+					Msg("Error counting the pre-auth keys")
+			}
+			return float64(count)
+		}),
+	}
+	for _, c := range collectors {
+		if err := prometheus.Register(c); err != nil {
+			log.Error().
+				Err(err).
+				Msg("Could not register metric")
+		}
+	}
+}
+
+// prometheusMiddleware measures the duration of the requests to the gin handlers
+func prometheusMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+		httpRequestDuration.WithLabelValues(
+			c.FullPath(),
+			c.Request.Method,
+			strconv.Itoa(c.Writer.Status()),
+		).Observe(time.Since(start).Seconds())
+	}
+}
@@ -0,0 +1,190 @@
+package headscale
+
+import (
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+)
+
+const errorSchemaTooNew = Error("the database schema is newer than this version of headscale, upgrade headscale")
+const errorSchemaPending = Error("the database schema is out of date, run headscale db migrate")
+
+// SchemaMigration records a migration applied to the database
+type SchemaMigration struct {
+	Version     int `gorm:"primary_key;autoIncrement:false"`
+	Description string
+	AppliedAt   time.Time
+}
+
+type migration struct {
+	version     int
+	description string
+	migrate     func(tx *gorm.DB) error
+}
+
+// migrations are applied in order, each one in a transaction. New schema
+// changes must be appended with the next version, never edited in place.
+var migrations = []migration{
+	{
+		version:     1,
+		description: "Create the machines, namespaces and pre-auth keys tables",
+		migrate: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(&Machine{}, &KV{}, &Namespace{}, &PreAuthKey{})
+		},
+	},
+	{
+		version:     2,
+		description: "Create the API keys table",
+		migrate: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(&APIKey{})
+		},
+	},
+	{
+		version:     3,
+		description: "Add the given name of the machines",
+		migrate: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(&Machine{})
+		},
+	},
+	{
+		version:     4,
+		description: "Add the IPv6 address of the machines",
+		migrate: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(&Machine{})
+		},
+	},
+	{
+		version:     5,
+		description: "Add the registration time of the machines",
+		migrate: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(&Machine{})
+		},
+	},
+	{
+		version:     6,
+		description: "Add the preferred DERP region of the namespaces",
+		migrate: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(&Namespace{})
+		},
+	},
+	{
+		version:     7,
+		description: "Create the shared machines table",
+		migrate: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(&SharedMachine{})
+		},
+	},
+	{
+		version:     8,
+		description: "Add the ACL tags of the pre-auth keys",
+		migrate: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(&PreAuthKey{})
+		},
+	},
+	{
+		version:     9,
+		description: "Add the static IP flag of the machines",
+		migrate: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(&Machine{})
+		},
+	},
+	{
+		version:     10,
+		description: "Add the pending flag of the machines awaiting approval",
+		migrate: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(&Machine{})
+		},
+	},
+	{
+		version:     11,
+		description: "Add the key refresh requests of the machines",
+		migrate: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(&Machine{})
+		},
+	},
+}
+
+// latestSchemaVersion is the schema version expected by this binary
+func latestSchemaVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+// LatestSchemaVersion is the schema version expected by this binary, the one
+// headscale db migrate brings the database to
+func LatestSchemaVersion() int {
+	return latestSchemaVersion()
+}
+
+// SchemaVersion returns the version of the last migration applied to the
+// database, 0 for a new database
+func (h *Headscale) SchemaVersion() (int, error) {
+	var version int
+	err := h.db.Model(&SchemaMigration{}).Select("COALESCE(MAX(version), 0)").Scan(&version).Error
+	return version, err
+}
+
+// PendingMigrations returns the migrations that have not been applied yet
+func (h *Headscale) PendingMigrations() ([]SchemaMigration, error) {
+	version, err := h.SchemaVersion()
+	if err != nil {
+		return nil, err
+	}
+	if version > latestSchemaVersion() {
+		return nil, errorSchemaTooNew
+	}
+
+	pending := []SchemaMigration{}
+	for _, m := range migrations {
+		if m.version > version {
+			pending = append(pending, SchemaMigration{
+				Version:     m.version,
+				Description: m.description,
+			})
+		}
+	}
+	return pending, nil
+}
+
+// Migrate applies the pending migrations and returns them
+func (h *Headscale) Migrate() (_ []SchemaMigration, err error) {
+	defer func() { h.audit("db.migrate", "database", err) }()
+	version, err := h.SchemaVersion()
+	if err != nil {
+		return nil, err
+	}
+	if version > latestSchemaVersion() {
+		return nil, errorSchemaTooNew
+	}
+
+	applied := []SchemaMigration{}
+	for _, m := range migrations {
+		if m.version <= version {
+			continue
+		}
+		sm := SchemaMigration{
+			Version:     m.version,
+			Description: m.description,
+			AppliedAt:   time.Now().UTC(),
+		}
+		err := h.db.Transaction(func(tx *gorm.DB) error {
+			if err := m.migrate(tx); err != nil {
+				return err
+			}
+			return tx.Create(&sm).Error
+		})
+		if err != nil {
+			log.Error().
+				Int("version", m.version).
+				Err(err).
+				Msg("Database migration failed")
+			return applied, err
+		}
+		log.Info().
+			Int("version", m.version).
+			Str("description", m.description).
+			Msg("Applied database migration")
+		applied = append(applied, sm)
+	}
+	return applied, nil
+}
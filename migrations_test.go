@@ -0,0 +1,49 @@
+package headscale
+
+import (
+	"gopkg.in/check.v1"
+)
+
+func (s *Suite) TestMigrations(c *check.C) {
+	version, err := h.SchemaVersion()
+	c.Assert(err, check.IsNil)
+	c.Assert(version, check.Equals, latestSchemaVersion())
+
+	pending, err := h.PendingMigrations()
+	c.Assert(err, check.IsNil)
+	c.Assert(len(pending), check.Equals, 0)
+
+	applied, err := h.Migrate()
+	c.Assert(err, check.IsNil)
+	c.Assert(len(applied), check.Equals, 0)
+}
+
+func (s *Suite) TestPendingMigrations(c *check.C) {
+	h.db.Where("version > ?", 1).Delete(&SchemaMigration{})
+
+	pending, err := h.PendingMigrations()
+	c.Assert(err, check.IsNil)
+	c.Assert(len(pending), check.Equals, latestSchemaVersion()-1)
+	c.Assert(pending[0].Version, check.Equals, 2)
+
+	applied, err := h.Migrate()
+	c.Assert(err, check.IsNil)
+	c.Assert(len(applied), check.Equals, latestSchemaVersion()-1)
+
+	version, err := h.SchemaVersion()
+	c.Assert(err, check.IsNil)
+	c.Assert(version, check.Equals, latestSchemaVersion())
+}
+
+func (s *Suite) TestSchemaTooNew(c *check.C) {
+	err := h.db.Create(&SchemaMigration{Version: latestSchemaVersion() + 1}).Error
+	c.Assert(err, check.IsNil)
+
+	_, err = h.PendingMigrations()
+	c.Assert(err, check.Equals, errorSchemaTooNew)
+	_, err = h.Migrate()
+	c.Assert(err, check.Equals, errorSchemaTooNew)
+
+	err = h.initDB()
+	c.Assert(err, check.Equals, errorSchemaTooNew)
+}
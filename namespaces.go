@@ -2,9 +2,11 @@ package headscale
 
 import (
 	"errors"
-	"log"
+	"fmt"
+	"regexp"
 	"time"
 
+	"github.com/rs/zerolog/log"
 	"gorm.io/gorm"
 	"tailscale.com/tailcfg"
 )
@@ -12,6 +14,11 @@ import (
 const errorNamespaceExists = Error("Namespace already exists")
 const errorNamespaceNotFound = Error("Namespace not found")
 const errorNamespaceNotEmpty = Error("Namespace not empty")
+const errorNamespaceQuotaExceeded = Error("Namespace has reached its maximum number of machines")
+const errorNamespaceInvalidName = Error("Namespace name must be a valid DNS label (lowercase letters, digits and hyphens, up to 63 characters)")
+
+// Namespace names end up in MagicDNS, so they must be valid DNS labels
+var namespaceNameRegexp = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
 
 // Namespace is the way Headscale implements the concept of users in Tailscale
 //
@@ -20,18 +27,36 @@ const errorNamespaceNotEmpty = Error("Namespace not empty")
 type Namespace struct {
 	gorm.Model
 	Name string `gorm:"unique"`
+
+	// MaxMachines overrides Config.MaxMachinesPerNamespace for this namespace.
+	// Zero means the global limit applies.
+	MaxMachines int `gorm:"default:0"`
+
+	// PreferredDERPRegion is the DERP region preferred for the machines of
+	// the namespace, zero for none. It is not sent to the clients yet, see
+	// getNamespaceDERPMap.
+	PreferredDERPRegion int `gorm:"default:0"`
 }
 
 // CreateNamespace creates a new Namespace. Returns error if could not be created
 // or another namespace already exists
-func (h *Headscale) CreateNamespace(name string) (*Namespace, error) {
+func (h *Headscale) CreateNamespace(name string) (_ *Namespace, err error) {
+	defer func() { h.audit("namespace.create", "namespace:"+name, err) }()
+	if err = h.checkMaintenance(); err != nil {
+		return nil, err
+	}
+	if !namespaceNameRegexp.MatchString(name) {
+		return nil, errorNamespaceInvalidName
+	}
 	n := Namespace{}
 	if err := h.db.Where("name = ?", name).First(&n).Error; err == nil {
 		return nil, errorNamespaceExists
 	}
 	n.Name = name
 	if err := h.db.Create(&n).Error; err != nil {
-		log.Printf("Could not create row: %s", err)
+		log.Error().
+			Err(err).
+			Msg("Could not create row")
 		return nil, err
 	}
 	return &n, nil
@@ -39,7 +64,11 @@ func (h *Headscale) CreateNamespace(name string) (*Namespace, error) {
 
 // DestroyNamespace destroys a Namespace. Returns error if the Namespace does
 // not exist or if there are machines associated with it.
-func (h *Headscale) DestroyNamespace(name string) error {
+func (h *Headscale) DestroyNamespace(name string) (err error) {
+	defer func() { h.audit("namespace.destroy", "namespace:"+name, err) }()
+	if err = h.checkMaintenance(); err != nil {
+		return err
+	}
 	n, err := h.GetNamespace(name)
 	if err != nil {
 		return errorNamespaceNotFound
@@ -53,13 +82,57 @@ func (h *Headscale) DestroyNamespace(name string) error {
 		return errorNamespaceNotEmpty
 	}
 
-	if result := h.db.Unscoped().Delete(&n); result.Error != nil {
+	// The machines shared with the namespace stay in theirs
+	if err := h.db.Where("namespace_id = ?", n.ID).Delete(&SharedMachine{}).Error; err != nil {
 		return err
 	}
+	if result := h.db.Unscoped().Delete(&n); result.Error != nil {
+		return result.Error
+	}
 
 	return nil
 }
 
+// RenameNamespace renames a Namespace. Returns error if the Namespace does
+// not exist, or if another Namespace already has the new name.
+//
+// Machines and PreAuthKeys reference the Namespace by ID, so they keep
+// pointing to it after the rename.
+func (h *Headscale) RenameNamespace(oldName string, newName string) (_ *Namespace, err error) {
+	defer func() { h.audit("namespace.rename", "namespace:"+oldName+" to "+newName, err) }()
+	if err = h.checkMaintenance(); err != nil {
+		return nil, err
+	}
+	if !namespaceNameRegexp.MatchString(newName) {
+		return nil, errorNamespaceInvalidName
+	}
+
+	n := Namespace{}
+	err = h.db.Transaction(func(tx *gorm.DB) error {
+		if result := tx.First(&n, "name = ?", oldName); errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return errorNamespaceNotFound
+		}
+		if err := tx.Where("name = ?", newName).First(&Namespace{}).Error; err == nil {
+			return errorNamespaceExists
+		}
+		n.Name = newName
+		return tx.Save(&n).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Namespaces are expanded to IP addresses in the ACL rules, and their
+	// names are part of the MagicDNS names sent to the peers
+	if err := h.updateACLRules(); err != nil {
+		log.Error().
+			Err(err).
+			Msg("Could not regenerate the ACL rules")
+	}
+	h.notifyAllClients()
+	return &n, nil
+}
+
 // GetNamespace fetches a namespace by name
 func (h *Headscale) GetNamespace(name string) (*Namespace, error) {
 	n := Namespace{}
@@ -86,12 +159,146 @@ func (h *Headscale) ListMachinesInNamespace(name string) (*[]Machine, error) {
 	}
 
 	machines := []Machine{}
-	if err := h.db.Preload("AuthKey").Where(&Machine{NamespaceID: n.ID}).Find(&machines).Error; err != nil {
+	if err := h.db.Preload("AuthKey").Preload("Namespace").Where(&Machine{NamespaceID: n.ID}).Find(&machines).Error; err != nil {
 		return nil, err
 	}
+	for i := range machines {
+		machines[i].Online = h.isOnline(machines[i])
+	}
 	return &machines, nil
 }
 
+// SetNamespaceMaxMachines sets the per-namespace override of the maximum number of
+// registered machines. Zero removes the override, so the global limit applies.
+func (h *Headscale) SetNamespaceMaxMachines(name string, max int) (_ *Namespace, err error) {
+	defer func() { h.audit("namespace.set_max_machines", fmt.Sprintf("namespace:%s max:%d", name, max), err) }()
+	if err = h.checkMaintenance(); err != nil {
+		return nil, err
+	}
+	if max < 0 {
+		return nil, errors.New("the maximum number of machines cannot be negative")
+	}
+	n, err := h.GetNamespace(name)
+	if err != nil {
+		return nil, err
+	}
+	n.MaxMachines = max
+	if err := h.db.Save(n).Error; err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+// SetNamespaceDERPRegion sets the DERP region preferred by the machines of the
+// namespace, which must be in the DERP map. Zero removes the preference.
+func (h *Headscale) SetNamespaceDERPRegion(name string, regionID int) (_ *Namespace, err error) {
+	defer func() {
+		h.audit("namespace.set_derp_region", fmt.Sprintf("namespace:%s region:%d", name, regionID), err)
+	}()
+	if err = h.checkMaintenance(); err != nil {
+		return nil, err
+	}
+	if regionID != 0 {
+		derpMap := h.getDERPMap()
+		if derpMap == nil {
+			return nil, errorDERPRegionNotFound
+		}
+		if r, ok := derpMap.Regions[regionID]; !ok || r == nil {
+			return nil, errorDERPRegionNotFound
+		}
+	}
+	n, err := h.GetNamespace(name)
+	if err != nil {
+		return nil, err
+	}
+	n.PreferredDERPRegion = regionID
+	if err := h.db.Save(n).Error; err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+// GetNamespaceMachineLimit returns the maximum number of registered machines
+// allowed in the namespace. Zero means unlimited.
+func (h *Headscale) GetNamespaceMachineLimit(n *Namespace) int {
+	if n.MaxMachines > 0 {
+		return n.MaxMachines
+	}
+	return h.cfg.MaxMachinesPerNamespace
+}
+
+// CountMachinesInNamespace returns the number of registered machines in the namespace
+func (h *Headscale) CountMachinesInNamespace(n *Namespace) (int, error) {
+	var count int64
+	if err := h.db.Model(&Machine{}).Where("namespace_id = ? AND registered", n.ID).Count(&count).Error; err != nil {
+		return 0, err
+	}
+	return int(count), nil
+}
+
+// NamespaceCounts are the registered machines of a namespace, the ones
+// online among them, and its pre-auth keys
+type NamespaceCounts struct {
+	Machines       int
+	OnlineMachines int
+	PreAuthKeys    int
+}
+
+// CountNamespaces returns the counts of all the namespaces by ID, with one
+// aggregate query per table. The machines are online as in Machine.Online.
+func (h *Headscale) CountNamespaces() (map[uint]NamespaceCounts, error) {
+	type count struct {
+		NamespaceID uint
+		Total       int
+		Online      int
+	}
+	counts := map[uint]NamespaceCounts{}
+
+	machines := []count{}
+	err := h.db.Model(&Machine{}).
+		Select("namespace_id, COUNT(*) AS total, SUM(CASE WHEN last_seen > ? THEN 1 ELSE 0 END) AS online", time.Now().UTC().Add(-h.onlineTimeout())).
+		Where("registered").
+		Group("namespace_id").
+		Scan(&machines).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range machines {
+		counts[c.NamespaceID] = NamespaceCounts{Machines: c.Total, OnlineMachines: c.Online}
+	}
+
+	keys := []count{}
+	err = h.db.Model(&PreAuthKey{}).
+		Select("namespace_id, COUNT(*) AS total").
+		Group("namespace_id").
+		Scan(&keys).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range keys {
+		n := counts[c.NamespaceID]
+		n.PreAuthKeys = c.Total
+		counts[c.NamespaceID] = n
+	}
+	return counts, nil
+}
+
+// checkNamespaceQuota returns an error if the namespace cannot take another machine
+func (h *Headscale) checkNamespaceQuota(n *Namespace) error {
+	limit := h.GetNamespaceMachineLimit(n)
+	if limit == 0 {
+		return nil
+	}
+	count, err := h.CountMachinesInNamespace(n)
+	if err != nil {
+		return err
+	}
+	if count >= limit {
+		return fmt.Errorf("%w (%d/%d)", errorNamespaceQuotaExceeded, count, limit)
+	}
+	return nil
+}
+
 // SetMachineNamespace assigns a Machine to a namespace
 func (h *Headscale) SetMachineNamespace(m *Machine, namespaceName string) error {
 	n, err := h.GetNamespace(namespaceName)
@@ -99,7 +306,8 @@ func (h *Headscale) SetMachineNamespace(m *Machine, namespaceName string) error
 		return err
 	}
 	m.NamespaceID = n.ID
-	h.db.Save(&m)
+	m.Namespace = *n
+	h.db.Save(m)
 	return nil
 }
 
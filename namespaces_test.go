@@ -1,7 +1,11 @@
 package headscale
 
 import (
+	"errors"
+	"time"
+
 	"gopkg.in/check.v1"
+	"tailscale.com/tailcfg"
 )
 
 func (s *Suite) TestCreateAndDestroyNamespace(c *check.C) {
@@ -27,7 +31,7 @@ func (s *Suite) TestDestroyNamespaceErrors(c *check.C) {
 	n, err := h.CreateNamespace("test")
 	c.Assert(err, check.IsNil)
 
-	pak, err := h.CreatePreAuthKey(n.Name, false, false, nil)
+	pak, err := h.CreatePreAuthKey(n.Name, false, false, nil, nil)
 	c.Assert(err, check.IsNil)
 
 	m := Machine{
@@ -46,3 +50,138 @@ func (s *Suite) TestDestroyNamespaceErrors(c *check.C) {
 	err = h.DestroyNamespace("test")
 	c.Assert(err, check.Equals, errorNamespaceNotEmpty)
 }
+
+func (s *Suite) TestRenameNamespace(c *check.C) {
+	n, err := h.CreateNamespace("test")
+	c.Assert(err, check.IsNil)
+
+	pak, err := h.CreatePreAuthKey(n.Name, false, false, nil, nil)
+	c.Assert(err, check.IsNil)
+
+	m := Machine{
+		ID:             0,
+		MachineKey:     "foo",
+		NodeKey:        "bar",
+		DiscoKey:       "faa",
+		IPAddress:      "100.64.0.1",
+		Name:           "testmachine",
+		NamespaceID:    n.ID,
+		Registered:     true,
+		RegisterMethod: "authKey",
+		AuthKeyID:      uint(pak.ID),
+	}
+	h.db.Save(&m)
+
+	_, err = h.RenameNamespace("test", "Not_A_DNS_Label")
+	c.Assert(err, check.Equals, errorNamespaceInvalidName)
+
+	_, err = h.RenameNamespace("does-not-exist", "test2")
+	c.Assert(err, check.Equals, errorNamespaceNotFound)
+
+	_, err = h.CreateNamespace("other")
+	c.Assert(err, check.IsNil)
+	_, err = h.RenameNamespace("test", "other")
+	c.Assert(err, check.Equals, errorNamespaceExists)
+
+	// The rules naming the new namespace now match its machine
+	h.acl.Store(&aclState{
+		policy: &ACLPolicy{
+			ACLs: []ACL{{Action: "accept", Users: []string{"renamed"}, Ports: []string{"*:*"}}},
+		},
+		rules: &[]tailcfg.FilterRule{},
+	})
+
+	n2, err := h.RenameNamespace("test", "renamed")
+	c.Assert(err, check.IsNil)
+	c.Assert(n2.ID, check.Equals, n.ID)
+	c.Assert(*h.loadACL().rules, check.HasLen, 1)
+	c.Assert((*h.loadACL().rules)[0].SrcIPs, check.DeepEquals, []string{"100.64.0.1"})
+
+	_, err = h.GetNamespace("test")
+	c.Assert(err, check.Equals, errorNamespaceNotFound)
+
+	_, err = h.GetMachine("renamed", "testmachine")
+	c.Assert(err, check.IsNil)
+
+	keys, err := h.GetPreAuthKeys("renamed")
+	c.Assert(err, check.IsNil)
+	c.Assert(len(*keys), check.Equals, 1)
+}
+
+func (s *Suite) TestCreateNamespaceInvalidName(c *check.C) {
+	_, err := h.CreateNamespace("-test")
+	c.Assert(err, check.Equals, errorNamespaceInvalidName)
+
+	_, err = h.CreateNamespace("test.namespace")
+	c.Assert(err, check.Equals, errorNamespaceInvalidName)
+}
+
+func (s *Suite) TestNamespaceQuota(c *check.C) {
+	n, err := h.CreateNamespace("test")
+	c.Assert(err, check.IsNil)
+	c.Assert(h.GetNamespaceMachineLimit(n), check.Equals, 0)
+	c.Assert(h.checkNamespaceQuota(n), check.IsNil)
+
+	h.cfg.MaxMachinesPerNamespace = 1
+	c.Assert(h.GetNamespaceMachineLimit(n), check.Equals, 1)
+	c.Assert(h.checkNamespaceQuota(n), check.IsNil)
+
+	m := Machine{
+		ID:             0,
+		MachineKey:     "foo",
+		NodeKey:        "bar",
+		DiscoKey:       "faa",
+		Name:           "testmachine",
+		NamespaceID:    n.ID,
+		Registered:     true,
+		RegisterMethod: "cli",
+	}
+	h.db.Save(&m)
+
+	count, err := h.CountMachinesInNamespace(n)
+	c.Assert(err, check.IsNil)
+	c.Assert(count, check.Equals, 1)
+
+	err = h.checkNamespaceQuota(n)
+	c.Assert(errors.Is(err, errorNamespaceQuotaExceeded), check.Equals, true)
+
+	// The per-namespace override takes precedence over the global limit
+	n, err = h.SetNamespaceMaxMachines("test", 2)
+	c.Assert(err, check.IsNil)
+	c.Assert(h.GetNamespaceMachineLimit(n), check.Equals, 2)
+	c.Assert(h.checkNamespaceQuota(n), check.IsNil)
+
+	_, err = h.SetNamespaceMaxMachines("test", -1)
+	c.Assert(err, check.NotNil)
+}
+
+func (s *Suite) TestCountNamespaces(c *check.C) {
+	n1, err := h.CreateNamespace("test1")
+	c.Assert(err, check.IsNil)
+	n2, err := h.CreateNamespace("test2")
+	c.Assert(err, check.IsNil)
+	_, err = h.CreateNamespace("test3")
+	c.Assert(err, check.IsNil)
+
+	now := time.Now().UTC()
+	old := now.Add(-time.Hour)
+	machines := []Machine{
+		{MachineKey: "foo1", Name: "online", NamespaceID: n1.ID, Registered: true, LastSeen: &now},
+		{MachineKey: "foo2", Name: "offline", NamespaceID: n1.ID, Registered: true, LastSeen: &old},
+		{MachineKey: "foo3", Name: "unregistered", NamespaceID: n1.ID, LastSeen: &now},
+		{MachineKey: "foo4", Name: "never-seen", NamespaceID: n2.ID, Registered: true},
+	}
+	for i := range machines {
+		c.Assert(h.db.Save(&machines[i]).Error, check.IsNil)
+	}
+	_, err = h.CreatePreAuthKey("test2", false, false, nil, nil)
+	c.Assert(err, check.IsNil)
+	_, err = h.CreatePreAuthKey("test2", true, false, nil, nil)
+	c.Assert(err, check.IsNil)
+
+	counts, err := h.CountNamespaces()
+	c.Assert(err, check.IsNil)
+	c.Assert(counts[n1.ID], check.Equals, NamespaceCounts{Machines: 2, OnlineMachines: 1})
+	c.Assert(counts[n2.ID], check.Equals, NamespaceCounts{Machines: 1, PreAuthKeys: 2})
+	c.Assert(len(counts), check.Equals, 2)
+}
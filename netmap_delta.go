@@ -0,0 +1,125 @@
+package headscale
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+
+	"tailscale.com/tailcfg"
+)
+
+// deltaMapRequestVersion is the first MapRequest.Version whose clients keep
+// the DNS configuration of the previous map response when it is nil
+const deltaMapRequestVersion = 15
+
+// mapSession is what was last sent on the long poll of a machine. The first
+// map response of the poll is complete; from deltaMapRequestVersion, the
+// updates after it only carry the peers that were added, changed or removed,
+// and leave out the DNS configuration, packet filter, DERP map and user
+// profiles that did not change, which the client keeps from before. A
+// machine reconnecting starts a new poll, and gets a complete map again.
+type mapSession struct {
+	delta bool
+	sent  bool
+
+	peers        map[tailcfg.NodeID][]byte
+	userProfiles map[tailcfg.UserID][]byte
+	dnsConfig    []byte
+	packetFilter []byte
+	derpMap      []byte
+}
+
+func newMapSession(req tailcfg.MapRequest) *mapSession {
+	return &mapSession{delta: req.Stream && req.Version >= deltaMapRequestVersion}
+}
+
+// update returns the map response to send instead of resp, and records resp
+// as sent. It is resp itself for the first response and without deltas,
+// unless the packet filter was emptied.
+func (s *mapSession) update(resp *tailcfg.MapResponse) *tailcfg.MapResponse {
+	peers := map[tailcfg.NodeID][]byte{}
+	for _, p := range resp.Peers {
+		peers[p.ID] = marshalNetMap(p)
+	}
+	userProfiles := map[tailcfg.UserID][]byte{}
+	for _, p := range resp.UserProfiles {
+		userProfiles[p.ID] = marshalNetMap(p)
+	}
+	dnsConfig := marshalNetMap(resp.DNSConfig)
+	packetFilter := marshalNetMap(resp.PacketFilter)
+	derpMap := marshalNetMap(resp.DERPMap)
+
+	out := resp
+	switch {
+	case s.sent && len(resp.PacketFilter) == 0 && !sameNetMap(s.packetFilter, packetFilter):
+		// An empty packet filter is left out of the JSON, and the client
+		// would keep the previous one. The complete map is sent, with a
+		// rule matching nothing to block everything.
+		full := *resp
+		full.PacketFilter = []tailcfg.FilterRule{{SrcIPs: []string{}, DstPorts: []tailcfg.NetPortRange{}}}
+		out = &full
+	case s.delta && s.sent:
+		delta := *resp
+		delta.Peers = nil
+		delta.PeersChanged = []*tailcfg.Node{}
+		delta.PeersRemoved = []tailcfg.NodeID{}
+		for _, p := range resp.Peers {
+			if !sameNetMap(s.peers[p.ID], peers[p.ID]) {
+				delta.PeersChanged = append(delta.PeersChanged, p)
+			}
+		}
+		for id := range s.peers {
+			if _, ok := peers[id]; !ok {
+				delta.PeersRemoved = append(delta.PeersRemoved, id)
+			}
+		}
+		sort.Slice(delta.PeersRemoved, func(i, j int) bool { return delta.PeersRemoved[i] < delta.PeersRemoved[j] })
+
+		// Only the new and changed user profiles are sent
+		delta.UserProfiles = []tailcfg.UserProfile{}
+		for _, p := range resp.UserProfiles {
+			if !sameNetMap(s.userProfiles[p.ID], userProfiles[p.ID]) {
+				delta.UserProfiles = append(delta.UserProfiles, p)
+			}
+		}
+		// nil keeps the previous value, so removing it is sent as empty
+		switch {
+		case sameNetMap(s.dnsConfig, dnsConfig):
+			delta.DNSConfig = nil
+		case delta.DNSConfig == nil:
+			delta.DNSConfig = &tailcfg.DNSConfig{}
+		}
+		if sameNetMap(s.packetFilter, packetFilter) {
+			delta.PacketFilter = nil
+		}
+		if sameNetMap(s.derpMap, derpMap) {
+			delta.DERPMap = nil
+		}
+		out = &delta
+		netMapDeltaUpdatesSent.Inc()
+	}
+
+	s.sent = true
+	s.peers = peers
+	s.userProfiles = userProfiles
+	s.dnsConfig = dnsConfig
+	s.packetFilter = packetFilter
+	s.derpMap = derpMap
+	return out
+}
+
+// marshalNetMap is the JSON of a part of the map response, to compare it to
+// the one last sent, nil if it cannot be marshaled
+func marshalNetMap(v interface{}) []byte {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+	return b
+}
+
+// sameNetMap tells whether a part of the map response is unchanged. The
+// parts that could not be marshaled are sent again.
+func sameNetMap(sent []byte, current []byte) bool {
+	return sent != nil && current != nil && bytes.Equal(sent, current)
+}
@@ -0,0 +1,98 @@
+package headscale
+
+import (
+	"encoding/json"
+
+	"gopkg.in/check.v1"
+	"tailscale.com/tailcfg"
+)
+
+func (s *Suite) TestMapSessionDelta(c *check.C) {
+	full := func(peers ...*tailcfg.Node) *tailcfg.MapResponse {
+		return &tailcfg.MapResponse{
+			Node:         &tailcfg.Node{ID: 1, Name: "self"},
+			Peers:        peers,
+			DNSConfig:    &tailcfg.DNSConfig{Domains: []string{"headscale.net"}},
+			PacketFilter: []tailcfg.FilterRule{{SrcIPs: []string{"*"}}},
+			DERPMap:      &tailcfg.DERPMap{},
+			UserProfiles: []tailcfg.UserProfile{{ID: 1, LoginName: "test"}},
+		}
+	}
+	session := newMapSession(tailcfg.MapRequest{Stream: true, Version: deltaMapRequestVersion})
+
+	resp := session.update(full(&tailcfg.Node{ID: 2, Name: "a"}, &tailcfg.Node{ID: 3, Name: "b"}))
+	c.Assert(resp.Peers, check.HasLen, 2)
+	c.Assert(resp.DNSConfig, check.NotNil)
+
+	// b is renamed, a is removed and d is added
+	resp = session.update(full(&tailcfg.Node{ID: 3, Name: "c"}, &tailcfg.Node{ID: 4, Name: "d"}))
+	c.Assert(resp.Peers, check.HasLen, 0)
+	c.Assert(resp.PeersChanged, check.HasLen, 2)
+	c.Assert(resp.PeersChanged[0].Name, check.Equals, "c")
+	c.Assert(resp.PeersChanged[1].Name, check.Equals, "d")
+	c.Assert(resp.PeersRemoved, check.DeepEquals, []tailcfg.NodeID{2})
+	c.Assert(resp.Node, check.NotNil)
+	c.Assert(resp.DNSConfig, check.IsNil)
+	c.Assert(resp.PacketFilter, check.IsNil)
+	c.Assert(resp.DERPMap, check.IsNil)
+	c.Assert(resp.UserProfiles, check.HasLen, 0)
+
+	// An emptied packet filter is sent in a complete map, as a rule
+	// matching nothing: an empty one would be left out of the JSON
+	update := full(&tailcfg.Node{ID: 3, Name: "c"}, &tailcfg.Node{ID: 4, Name: "d"})
+	update.PacketFilter = nil
+	resp = session.update(update)
+	c.Assert(resp.Peers, check.HasLen, 2)
+	c.Assert(resp.PacketFilter, check.HasLen, 1)
+	c.Assert(resp.PacketFilter[0].SrcIPs, check.HasLen, 0)
+	c.Assert(resp.PacketFilter[0].DstPorts, check.HasLen, 0)
+
+	// It is then unchanged
+	resp = session.update(update)
+	c.Assert(resp.Peers, check.HasLen, 0)
+	c.Assert(resp.PacketFilter, check.IsNil)
+
+	// The older clients get complete maps
+	session = newMapSession(tailcfg.MapRequest{Stream: true, Version: deltaMapRequestVersion - 1})
+	session.update(full(&tailcfg.Node{ID: 2, Name: "a"}))
+	resp = session.update(full(&tailcfg.Node{ID: 2, Name: "a"}))
+	c.Assert(resp.Peers, check.HasLen, 1)
+	c.Assert(resp.DNSConfig, check.NotNil)
+}
+
+func (s *Suite) TestMapSessionDeltaJSON(c *check.C) {
+	roundTrip := func(resp *tailcfg.MapResponse) tailcfg.MapResponse {
+		b, err := json.Marshal(resp)
+		c.Assert(err, check.IsNil)
+		var out tailcfg.MapResponse
+		c.Assert(json.Unmarshal(b, &out), check.IsNil)
+		return out
+	}
+	resp := func(filter []tailcfg.FilterRule, peers ...*tailcfg.Node) *tailcfg.MapResponse {
+		return &tailcfg.MapResponse{
+			Node:         &tailcfg.Node{ID: 1, Name: "self"},
+			Peers:        peers,
+			PacketFilter: filter,
+		}
+	}
+	allowAll := []tailcfg.FilterRule{{SrcIPs: []string{"*"}}}
+	session := newMapSession(tailcfg.MapRequest{Stream: true, Version: deltaMapRequestVersion})
+	session.update(resp(allowAll, &tailcfg.Node{ID: 2, Name: "a"}))
+
+	// An unchanged packet filter is left out, the client keeps it
+	got := roundTrip(session.update(resp(allowAll, &tailcfg.Node{ID: 2, Name: "b"})))
+	c.Assert(got.PacketFilter, check.IsNil)
+	c.Assert(got.PeersChanged, check.HasLen, 1)
+
+	// An emptied one must reach the client to replace the previous rules
+	got = roundTrip(session.update(resp(nil, &tailcfg.Node{ID: 2, Name: "b"})))
+	c.Assert(got.PacketFilter, check.HasLen, 1)
+	c.Assert(got.PacketFilter[0].SrcIPs, check.HasLen, 0)
+	c.Assert(got.Peers, check.HasLen, 1)
+
+	// The clients without deltas also get complete maps replacing it
+	session = newMapSession(tailcfg.MapRequest{Stream: true, Version: deltaMapRequestVersion - 1})
+	session.update(resp(allowAll))
+	got = roundTrip(session.update(resp([]tailcfg.FilterRule{})))
+	c.Assert(got.PacketFilter, check.HasLen, 1)
+}
@@ -0,0 +1,271 @@
+package headscale
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/oauth2"
+	"gorm.io/gorm"
+	"tailscale.com/types/wgkey"
+)
+
+const oidcStateTimeout = 10 * time.Minute
+
+const errorOIDCStateInvalid = Error("unknown or expired OIDC state")
+const errorOIDCDomainNotAllowed = Error("the email domain is not allowed")
+const errorOIDCEmailNotVerified = Error("the email is not verified")
+const errorOIDCNoNamespace = Error("no namespace matches the claims of the user")
+
+// oidcState tracks the machines in the middle of the OIDC flow, indexed by
+// the random state given to the identity provider
+type oidcState struct {
+	mu     sync.Mutex
+	states map[string]oidcPendingRegistration
+
+	provider *oidc.Provider
+	verifier *oidc.IDTokenVerifier
+	oauth2   *oauth2.Config
+}
+
+type oidcPendingRegistration struct {
+	machineKey string
+	created    time.Time
+}
+
+// authURL is the URL the clients are sent to in order to be authenticated
+func (h *Headscale) authURL(mKey wgkey.Key) string {
+	if h.cfg.OIDCIssuer != "" {
+		return fmt.Sprintf("%s/oidc/register/%s", h.cfg.ServerURL, mKey.HexString())
+	}
+	return fmt.Sprintf("%s/register?key=%s", h.cfg.ServerURL, mKey.HexString())
+}
+
+// initOIDC discovers the endpoints of the identity provider. It is done on
+// the first registration, so the CLI does not depend on the provider.
+func (h *Headscale) initOIDC(ctx context.Context) error {
+	h.oidc.mu.Lock()
+	defer h.oidc.mu.Unlock()
+	if h.oidc.provider != nil {
+		return nil
+	}
+
+	provider, err := oidc.NewProvider(ctx, h.cfg.OIDCIssuer)
+	if err != nil {
+		return err
+	}
+	if len(h.cfg.OIDCScopes) == 0 {
+		h.cfg.OIDCScopes = []string{oidc.ScopeOpenID, "profile", "email"}
+	}
+	h.oidc.provider = provider
+	h.oidc.verifier = provider.Verifier(&oidc.Config{ClientID: h.cfg.OIDCClientID})
+	h.oidc.oauth2 = &oauth2.Config{
+		ClientID:     h.cfg.OIDCClientID,
+		ClientSecret: h.cfg.OIDCClientSecret,
+		Endpoint:     provider.Endpoint(),
+		RedirectURL:  fmt.Sprintf("%s/oidc/callback", strings.TrimSuffix(h.cfg.ServerURL, "/")),
+		Scopes:       h.cfg.OIDCScopes,
+	}
+	return nil
+}
+
+// RegisterOIDC redirects a registering machine to the identity provider
+// Listens in /oidc/register/:mkey
+func (h *Headscale) RegisterOIDC(c *gin.Context) {
+	mKey, err := wgkey.ParseHex(c.Param("mkey"))
+	if err != nil {
+		c.String(http.StatusBadRequest, "Wrong params")
+		return
+	}
+
+	err = h.initOIDC(c.Request.Context())
+	if err != nil {
+		log.Error().
+			Str("issuer", h.cfg.OIDCIssuer).
+			Err(err).
+			Msg("Could not reach the OIDC provider")
+		c.String(http.StatusInternalServerError, "Could not reach the identity provider")
+		return
+	}
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		c.String(http.StatusInternalServerError, "")
+		return
+	}
+	state := hex.EncodeToString(b)
+
+	h.oidc.mu.Lock()
+	now := time.Now()
+	for s, p := range h.oidc.states {
+		if now.Sub(p.created) > oidcStateTimeout {
+			delete(h.oidc.states, s)
+		}
+	}
+	h.oidc.states[state] = oidcPendingRegistration{
+		machineKey: mKey.HexString(),
+		created:    now,
+	}
+	h.oidc.mu.Unlock()
+
+	c.Redirect(http.StatusFound, h.oidc.oauth2.AuthCodeURL(state))
+}
+
+// OIDCCallback registers the machine in the namespace of the user once the
+// identity provider has authenticated them
+// Listens in /oidc/callback
+func (h *Headscale) OIDCCallback(c *gin.Context) {
+	code := c.Query("code")
+	state := c.Query("state")
+	if code == "" || state == "" {
+		c.String(http.StatusBadRequest, "Wrong params")
+		return
+	}
+
+	h.oidc.mu.Lock()
+	pending, ok := h.oidc.states[state]
+	delete(h.oidc.states, state)
+	h.oidc.mu.Unlock()
+	if !ok || time.Since(pending.created) > oidcStateTimeout {
+		c.String(http.StatusBadRequest, errorOIDCStateInvalid.Error())
+		return
+	}
+
+	token, err := h.oidc.oauth2.Exchange(c.Request.Context(), code)
+	if err != nil {
+		log.Error().
+			Err(err).
+			Msg("Could not exchange the OIDC code")
+		c.String(http.StatusBadRequest, "Could not authenticate")
+		return
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		c.String(http.StatusBadRequest, "Could not authenticate")
+		return
+	}
+	idToken, err := h.oidc.verifier.Verify(c.Request.Context(), rawIDToken)
+	if err != nil {
+		log.Error().
+			Err(err).
+			Msg("Could not verify the OIDC ID token")
+		c.String(http.StatusBadRequest, "Could not authenticate")
+		return
+	}
+	claims := map[string]interface{}{}
+	if err := idToken.Claims(&claims); err != nil {
+		c.String(http.StatusBadRequest, "Could not authenticate")
+		return
+	}
+
+	namespaceName, err := h.oidcNamespace(claims)
+	if err != nil {
+		log.Warn().
+			Str("subject", idToken.Subject).
+			Err(err).
+			Msg("Rejected OIDC registration")
+		c.String(http.StatusForbidden, err.Error())
+		return
+	}
+
+	m := Machine{}
+	if result := h.db.First(&m, "machine_key = ?", pending.machineKey); errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		c.String(http.StatusNotFound, "Machine not found")
+		return
+	}
+
+	ns, err := h.GetNamespace(namespaceName)
+	if errors.Is(err, errorNamespaceNotFound) {
+		ns, err = h.CreateNamespace(namespaceName)
+	}
+	if err != nil {
+		log.Error().
+			Str("namespace", namespaceName).
+			Err(err).
+			Msg("Could not get the namespace of the OIDC user")
+		c.String(http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	err = h.registerMachine(&m, ns, "oidc")
+	if err != nil {
+		log.Error().
+			Str("machine", m.Name).
+			Str("namespace", ns.Name).
+			Err(err).
+			Msg("Cannot register machine in namespace")
+		c.String(http.StatusForbidden, err.Error())
+		return
+	}
+	log.Info().
+		Str("machine", m.Name).
+		Str("namespace", ns.Name).
+		Bool("pending", m.Pending).
+		Msg("Successfully authenticated via OIDC")
+
+	h.renderRegistrationPage(c, "registered", registrationPage{MachineKey: m.MachineKey, Machine: m.Name, Namespace: ns.Name, Pending: m.Pending})
+}
+
+// oidcNamespace picks the namespace of a user from the claims of its ID token.
+//
+// With a namespace map, the first value of the namespace claim found in the
+// map wins. Otherwise the namespace is named after the first value of the claim.
+func (h *Headscale) oidcNamespace(claims map[string]interface{}) (string, error) {
+	email, _ := claims["email"].(string)
+	if len(h.cfg.OIDCAllowedDomains) > 0 {
+		at := strings.LastIndex(email, "@")
+		if at < 0 || !containsString(h.cfg.OIDCAllowedDomains, strings.ToLower(email[at+1:])) {
+			return "", errorOIDCDomainNotAllowed
+		}
+		if verified, ok := claims["email_verified"].(bool); ok && !verified {
+			return "", errorOIDCEmailNotVerified
+		}
+	}
+
+	claim := h.cfg.OIDCNamespaceClaim
+	if claim == "" {
+		claim = "email"
+	}
+	values := []string{}
+	switch v := claims[claim].(type) {
+	case string:
+		values = append(values, v)
+	case []interface{}:
+		for _, i := range v {
+			if s, ok := i.(string); ok {
+				values = append(values, s)
+			}
+		}
+	}
+
+	if len(h.cfg.OIDCNamespaceMap) > 0 {
+		for _, v := range values {
+			for claimValue, namespace := range h.cfg.OIDCNamespaceMap {
+				if strings.EqualFold(claimValue, v) {
+					return namespace, nil
+				}
+			}
+		}
+		return "", errorOIDCNoNamespace
+	}
+
+	for _, v := range values {
+		name := strings.Trim(dnsLabelInvalidChars.ReplaceAllString(strings.ToLower(v), "-"), "-")
+		if len(name) > 63 {
+			name = strings.Trim(name[:63], "-")
+		}
+		if namespaceNameRegexp.MatchString(name) {
+			return name, nil
+		}
+	}
+	return "", errorOIDCNoNamespace
+}
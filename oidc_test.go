@@ -0,0 +1,36 @@
+package headscale
+
+import (
+	"gopkg.in/check.v1"
+)
+
+func (s *Suite) TestOIDCNamespaceFromEmail(c *check.C) {
+	h.cfg.OIDCAllowedDomains = []string{"example.com"}
+	defer func() { h.cfg.OIDCAllowedDomains = nil }()
+
+	ns, err := h.oidcNamespace(map[string]interface{}{"email": "John.Doe@Example.com"})
+	c.Assert(err, check.IsNil)
+	c.Assert(ns, check.Equals, "john-doe-example-com")
+
+	_, err = h.oidcNamespace(map[string]interface{}{"email": "john@other.com"})
+	c.Assert(err, check.Equals, errorOIDCDomainNotAllowed)
+
+	_, err = h.oidcNamespace(map[string]interface{}{"email": "john@example.com", "email_verified": false})
+	c.Assert(err, check.Equals, errorOIDCEmailNotVerified)
+}
+
+func (s *Suite) TestOIDCNamespaceMap(c *check.C) {
+	h.cfg.OIDCNamespaceClaim = "groups"
+	h.cfg.OIDCNamespaceMap = map[string]string{"engineering": "eng"}
+	defer func() {
+		h.cfg.OIDCNamespaceClaim = ""
+		h.cfg.OIDCNamespaceMap = nil
+	}()
+
+	ns, err := h.oidcNamespace(map[string]interface{}{"groups": []interface{}{"Everyone", "Engineering"}})
+	c.Assert(err, check.IsNil)
+	c.Assert(ns, check.Equals, "eng")
+
+	_, err = h.oidcNamespace(map[string]interface{}{"groups": []interface{}{"Everyone"}})
+	c.Assert(err, check.Equals, errorOIDCNoNamespace)
+}
@@ -0,0 +1,130 @@
+package headscale
+
+import (
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"tailscale.com/tailcfg"
+)
+
+// peersCacheTTL bounds how long the nodes of a namespace are reused: the
+// LastSeen of the polling machines is written without changing their version
+const peersCacheTTL = 10 * time.Second
+
+// namespacePeers are the registered machines of a namespace and their nodes,
+// as sent to their peers. They are replaced, never modified, so they can be
+// read without holding mu.
+type namespacePeers struct {
+	mu       sync.Mutex
+	version  string
+	loadedAt time.Time
+	machines []Machine
+	nodes    map[uint64]*tailcfg.Node
+}
+
+// peersCache keeps the namespacePeers between two map responses. An entry is
+// reused while its version, taken from the database, is unchanged: any
+// registration, deletion or change of a machine (tags, routes, names,
+// expiry...) bumps it, including the ones made by the CLI from another
+// process. The ACL rules are applied on every map response.
+type peersCache struct {
+	mu         sync.Mutex
+	namespaces map[uint]*namespacePeers
+}
+
+func (c *peersCache) entry(namespaceID uint) *namespacePeers {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.namespaces == nil {
+		c.namespaces = map[uint]*namespacePeers{}
+	}
+	e, ok := c.namespaces[namespaceID]
+	if !ok {
+		e = &namespacePeers{}
+		c.namespaces[namespaceID] = e
+	}
+	return e
+}
+
+// namespaceVersion changes whenever a machine of the namespace, or the
+// namespace itself, is created, modified or deleted
+func (h *Headscale) namespaceVersion(namespaceID uint) (string, error) {
+	machines := struct {
+		Count   int64
+		Updated sql.NullString
+	}{}
+	if err := h.db.Model(&Machine{}).Where("namespace_id = ?", namespaceID).
+		Select("COUNT(*) AS count, MAX(updated_at) AS updated").Scan(&machines).Error; err != nil {
+		return "", err
+	}
+	ns := struct {
+		Updated sql.NullString
+	}{}
+	if err := h.db.Model(&Namespace{}).Where("id = ?", namespaceID).
+		Select("updated_at AS updated").Scan(&ns).Error; err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d/%s/%s", machines.Count, machines.Updated.String, ns.Updated.String), nil
+}
+
+// getNamespacePeers returns the registered machines of a namespace and their
+// nodes, with their MagicDNS names. Concurrent callers wait for the same
+// load instead of querying the database each. The result must not be
+// modified.
+func (h *Headscale) getNamespacePeers(namespaceID uint) ([]Machine, map[uint64]*tailcfg.Node, error) {
+	e := h.peers.entry(namespaceID)
+	// The version is read before the machines: a change made in between is
+	// loaded with the old version, and loaded again on the next call
+	version, err := h.namespaceVersion(namespaceID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.nodes != nil && e.version == version && time.Since(e.loadedAt) < peersCacheTTL {
+		return e.machines, e.nodes, nil
+	}
+
+	machines := []Machine{}
+	if err := h.db.Where("namespace_id = ? AND registered", namespaceID).Order("id").Find(&machines).Error; err != nil {
+		return nil, nil, err
+	}
+	names, err := h.getMagicDNSNames(namespaceID)
+	if err != nil {
+		return nil, nil, err
+	}
+	nodes := make(map[uint64]*tailcfg.Node, len(machines))
+	for _, m := range machines {
+		// Registered from the CLI, but the client has not connected yet
+		if m.NodeKey == "" {
+			continue
+		}
+		n, err := m.toNode()
+		if err != nil {
+			// Left out, so it only fails getPeers for the machines it is a
+			// peer of, rather than for the whole namespace
+			log.Error().
+				Err(err).
+				Str("machine", m.Name).
+				Msg("Cannot convert machine to node")
+			continue
+		}
+		if name, ok := names[m.ID]; ok {
+			n.Name = name
+		}
+		nodes[m.ID] = n
+	}
+	e.version, e.loadedAt, e.machines, e.nodes = version, time.Now(), machines, nodes
+	return machines, nodes, nil
+}
+
+// invalidatePeers drops the cached nodes of every namespace
+func (h *Headscale) invalidatePeers() {
+	h.peers.mu.Lock()
+	defer h.peers.mu.Unlock()
+	h.peers.namespaces = nil
+}
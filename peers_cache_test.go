@@ -0,0 +1,60 @@
+package headscale
+
+import (
+	"fmt"
+	"time"
+
+	"gopkg.in/check.v1"
+)
+
+func (s *Suite) TestPeersCache(c *check.C) {
+	n, err := h.CreateNamespace("test")
+	c.Assert(err, check.IsNil)
+
+	machines := []Machine{}
+	for i := 1; i <= 3; i++ {
+		m := Machine{
+			MachineKey:     fmt.Sprintf("%064x", i),
+			NodeKey:        fmt.Sprintf("%064x", 10+i),
+			DiscoKey:       fmt.Sprintf("%064x", 20+i),
+			IPAddress:      fmt.Sprintf("100.64.0.%d", i),
+			Name:           fmt.Sprintf("testmachine%d", i),
+			NamespaceID:    n.ID,
+			Registered:     true,
+			RegisterMethod: "cli",
+		}
+		h.db.Save(&m)
+		machines = append(machines, m)
+	}
+
+	peers, err := h.getPeers(machines[0])
+	c.Assert(err, check.IsNil)
+	c.Assert(*peers, check.HasLen, 2)
+
+	// The nodes are reused, the LastSeen of the polling machines does not
+	// change them
+	h.db.Model(&machines[1]).UpdateColumn("last_seen", time.Now().UTC())
+	cached, err := h.getPeers(machines[0])
+	c.Assert(err, check.IsNil)
+	c.Assert((*cached)[0], check.Equals, (*peers)[0])
+
+	_, err = h.RenameMachine(machines[1].ID, "renamed")
+	c.Assert(err, check.IsNil)
+	peers, err = h.getPeers(machines[0])
+	c.Assert(err, check.IsNil)
+	c.Assert((*peers)[0], check.Not(check.Equals), (*cached)[0])
+	c.Assert((*peers)[0].Name, check.Equals, "renamed")
+
+	err = h.DeleteMachine(machines[2].ID)
+	c.Assert(err, check.IsNil)
+	peers, err = h.getPeers(machines[0])
+	c.Assert(err, check.IsNil)
+	c.Assert(*peers, check.HasLen, 1)
+
+	// Expired entries are loaded again
+	e := h.peers.entry(n.ID)
+	e.loadedAt = e.loadedAt.Add(-peersCacheTTL)
+	cached, err = h.getPeers(machines[0])
+	c.Assert(err, check.IsNil)
+	c.Assert((*cached)[0], check.Not(check.Equals), (*peers)[0])
+}
@@ -3,15 +3,22 @@ package headscale
 import (
 	"crypto/rand"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"sort"
+	"strings"
 	"time"
 
+	"github.com/rs/zerolog/log"
+	"gorm.io/datatypes"
 	"gorm.io/gorm"
 )
 
 const errorAuthKeyNotFound = Error("AuthKey not found")
 const errorAuthKeyExpired = Error("AuthKey expired")
 const errorAuthKeyNotReusableAlreadyUsed = Error("AuthKey not reusable already used")
+const errorAuthKeyNamespaceRequired = Error("the pre-auth keys are handled in a namespace, which must be given")
 
 // PreAuthKey describes a pre-authorization key usable in a particular namespace
 type PreAuthKey struct {
@@ -21,17 +28,36 @@ type PreAuthKey struct {
 	Namespace   Namespace
 	Reusable    bool
 	Ephemeral   bool `gorm:"default:false"`
+	// ACLTags are given to the machines registered with the key
+	ACLTags datatypes.JSON
 
 	CreatedAt  *time.Time
 	Expiration *time.Time
 }
 
-// CreatePreAuthKey creates a new PreAuthKey in a namespace, and returns it
-func (h *Headscale) CreatePreAuthKey(namespaceName string, reusable bool, ephemeral bool, expiration *time.Time) (*PreAuthKey, error) {
-	n, err := h.GetNamespace(namespaceName)
+// CreatePreAuthKey creates a new PreAuthKey in a namespace, and returns it.
+// The ACL tags must be owned by the namespace.
+func (h *Headscale) CreatePreAuthKey(namespaceName string, reusable bool, ephemeral bool, expiration *time.Time, aclTags []string) (_ *PreAuthKey, err error) {
+	// The key itself is a secret, only its ID is logged
+	var keyID uint64
+	defer func() {
+		h.audit("preauthkey.create", fmt.Sprintf("namespace:%s key_id:%d reusable:%t ephemeral:%t tags:%s", namespaceName, keyID, reusable, ephemeral, strings.Join(aclTags, ",")), err)
+	}()
+	if err = h.checkMaintenance(); err != nil {
+		return nil, err
+	}
+	n, err := h.getPreAuthKeyNamespace(namespaceName)
 	if err != nil {
 		return nil, err
 	}
+	for _, t := range aclTags {
+		if err := h.checkTagOwner(t, n.Name); err != nil {
+			return nil, err
+		}
+	}
+	tags := append([]string{}, aclTags...)
+	sort.Strings(tags)
+	b, _ := json.Marshal(tags)
 
 	now := time.Now().UTC()
 	kstr, err := h.generateKey()
@@ -45,28 +71,130 @@ func (h *Headscale) CreatePreAuthKey(namespaceName string, reusable bool, epheme
 		Namespace:   *n,
 		Reusable:    reusable,
 		Ephemeral:   ephemeral,
+		ACLTags:     datatypes.JSON(b),
 		CreatedAt:   &now,
 		Expiration:  expiration,
 	}
 	h.db.Save(&k)
+	keyID = k.ID
 
 	return &k, nil
 }
 
+// getPreAuthKeyNamespace returns the namespace the pre-auth key methods work
+// in. They never return nor change a key of another namespace, so an operator
+// can be restricted to the keys of theirs.
+func (h *Headscale) getPreAuthKeyNamespace(namespaceName string) (*Namespace, error) {
+	if namespaceName == "" {
+		return nil, errorAuthKeyNamespaceRequired
+	}
+	return h.GetNamespace(namespaceName)
+}
+
 // GetPreAuthKeys returns the list of PreAuthKeys for a namespace
 func (h *Headscale) GetPreAuthKeys(namespaceName string) (*[]PreAuthKey, error) {
-	n, err := h.GetNamespace(namespaceName)
+	n, err := h.getPreAuthKeyNamespace(namespaceName)
 	if err != nil {
 		return nil, err
 	}
 
 	keys := []PreAuthKey{}
-	if err := h.db.Preload("Namespace").Where(&PreAuthKey{NamespaceID: n.ID}).Find(&keys).Error; err != nil {
+	if err := h.db.Preload("Namespace").Where("namespace_id = ?", n.ID).Order("id").Find(&keys).Error; err != nil {
 		return nil, err
 	}
 	return &keys, nil
 }
 
+// ExpirePreAuthKey expires a PreAuthKey of a namespace right away, so it can
+// no longer be used to register machines
+func (h *Headscale) ExpirePreAuthKey(namespaceName string, key string) (_ *PreAuthKey, err error) {
+	var keyID uint64
+	defer func() { h.audit("preauthkey.expire", fmt.Sprintf("namespace:%s key_id:%d", namespaceName, keyID), err) }()
+	if err = h.checkMaintenance(); err != nil {
+		return nil, err
+	}
+	n, err := h.getPreAuthKeyNamespace(namespaceName)
+	if err != nil {
+		return nil, err
+	}
+
+	k := PreAuthKey{}
+	if result := h.db.Preload("Namespace").First(&k, "key = ? AND namespace_id = ?", key, n.ID); errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return nil, errorAuthKeyNotFound
+	}
+	keyID = k.ID
+
+	// An expired key keeps its expiration time
+	if k.Expiration != nil && k.Expiration.Before(time.Now()) {
+		return &k, nil
+	}
+	now := time.Now().UTC()
+	k.Expiration = &now
+	if err := h.db.Save(&k).Error; err != nil {
+		return nil, err
+	}
+	return &k, nil
+}
+
+// GetPreAuthKeyMachines returns the machines registered with a PreAuthKey of
+// a namespace, to find out who used a leaked key. The machines moved to
+// another namespace since are left out.
+func (h *Headscale) GetPreAuthKeyMachines(namespaceName string, key string) (*[]Machine, error) {
+	n, err := h.getPreAuthKeyNamespace(namespaceName)
+	if err != nil {
+		return nil, err
+	}
+
+	k := PreAuthKey{}
+	if result := h.db.First(&k, "key = ? AND namespace_id = ?", key, n.ID); errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return nil, errorAuthKeyNotFound
+	}
+
+	machines := []Machine{}
+	if err := h.db.Preload("Namespace").Preload("AuthKey").Where("auth_key_id = ? AND namespace_id = ?", k.ID, n.ID).Order("id").Find(&machines).Error; err != nil {
+		return nil, err
+	}
+	return &machines, nil
+}
+
+// GetACLTags returns the ACL tags given to the machines registered with the
+// key
+func (k PreAuthKey) GetACLTags() ([]string, error) {
+	tags := []string{}
+	if len(k.ACLTags) != 0 {
+		if err := json.Unmarshal(k.ACLTags, &tags); err != nil {
+			return nil, err
+		}
+	}
+	return tags, nil
+}
+
+// applyPreAuthKeyTags gives a machine registered with the key its ACL tags.
+// The tags no longer owned by the namespace, after a change of the policy,
+// are skipped.
+func (h *Headscale) applyPreAuthKeyTags(m *Machine, k *PreAuthKey) error {
+	tags, err := k.GetACLTags()
+	if err != nil || len(tags) == 0 {
+		return err
+	}
+	valid := []string{}
+	for _, t := range tags {
+		if err := h.checkTagOwner(t, k.Namespace.Name); err != nil {
+			log.Warn().
+				Str("machine", m.Name).
+				Err(err).
+				Msg("Skipping a tag of the pre-auth key")
+			continue
+		}
+		valid = append(valid, t)
+	}
+	if len(valid) == 0 {
+		return nil
+	}
+	_, err = h.TagMachine(m.ID, valid, nil)
+	return err
+}
+
 // checkKeyValidity does the heavy lifting for validation of the PreAuthKey coming from a node
 // If returns no error and a PreAuthKey, it can be used
 func (h *Headscale) checkKeyValidity(k string) (*PreAuthKey, error) {
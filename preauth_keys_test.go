@@ -1,20 +1,23 @@
 package headscale
 
 import (
+	"errors"
+	"fmt"
 	"time"
 
 	"gopkg.in/check.v1"
+	"tailscale.com/tailcfg"
 )
 
 func (*Suite) TestCreatePreAuthKey(c *check.C) {
-	_, err := h.CreatePreAuthKey("bogus", true, false, nil)
+	_, err := h.CreatePreAuthKey("bogus", true, false, nil, nil)
 
 	c.Assert(err, check.NotNil)
 
 	n, err := h.CreateNamespace("test")
 	c.Assert(err, check.IsNil)
 
-	k, err := h.CreatePreAuthKey(n.Name, true, false, nil)
+	k, err := h.CreatePreAuthKey(n.Name, true, false, nil, nil)
 	c.Assert(err, check.IsNil)
 
 	// Did we get a valid key?
@@ -40,12 +43,29 @@ func (*Suite) TestExpiredPreAuthKey(c *check.C) {
 	c.Assert(err, check.IsNil)
 
 	now := time.Now()
-	pak, err := h.CreatePreAuthKey(n.Name, true, false, &now)
+	pak, err := h.CreatePreAuthKey(n.Name, true, false, &now, nil)
 	c.Assert(err, check.IsNil)
 
 	p, err := h.checkKeyValidity(pak.Key)
 	c.Assert(err, check.Equals, errorAuthKeyExpired)
 	c.Assert(p, check.IsNil)
+
+	k2, err := h.ExpirePreAuthKey(n.Name, pak.Key)
+	c.Assert(err, check.IsNil)
+	c.Assert(k2.Expiration.Equal(*pak.Expiration), check.Equals, true)
+}
+
+func (*Suite) TestNotYetExpiredPreAuthKey(c *check.C) {
+	n, err := h.CreateNamespace("test8")
+	c.Assert(err, check.IsNil)
+
+	expiration := time.Now().Add(time.Hour)
+	pak, err := h.CreatePreAuthKey(n.Name, true, false, &expiration, nil)
+	c.Assert(err, check.IsNil)
+
+	p, err := h.checkKeyValidity(pak.Key)
+	c.Assert(err, check.IsNil)
+	c.Assert(p.ID, check.Equals, pak.ID)
 }
 
 func (*Suite) TestPreAuthKeyDoesNotExist(c *check.C) {
@@ -58,7 +78,7 @@ func (*Suite) TestValidateKeyOk(c *check.C) {
 	n, err := h.CreateNamespace("test3")
 	c.Assert(err, check.IsNil)
 
-	pak, err := h.CreatePreAuthKey(n.Name, true, false, nil)
+	pak, err := h.CreatePreAuthKey(n.Name, true, false, nil, nil)
 	c.Assert(err, check.IsNil)
 
 	p, err := h.checkKeyValidity(pak.Key)
@@ -70,7 +90,7 @@ func (*Suite) TestAlreadyUsedKey(c *check.C) {
 	n, err := h.CreateNamespace("test4")
 	c.Assert(err, check.IsNil)
 
-	pak, err := h.CreatePreAuthKey(n.Name, false, false, nil)
+	pak, err := h.CreatePreAuthKey(n.Name, false, false, nil, nil)
 	c.Assert(err, check.IsNil)
 
 	m := Machine{
@@ -95,7 +115,7 @@ func (*Suite) TestReusableBeingUsedKey(c *check.C) {
 	n, err := h.CreateNamespace("test5")
 	c.Assert(err, check.IsNil)
 
-	pak, err := h.CreatePreAuthKey(n.Name, true, false, nil)
+	pak, err := h.CreatePreAuthKey(n.Name, true, false, nil, nil)
 	c.Assert(err, check.IsNil)
 
 	m := Machine{
@@ -120,7 +140,7 @@ func (*Suite) TestNotReusableNotBeingUsedKey(c *check.C) {
 	n, err := h.CreateNamespace("test6")
 	c.Assert(err, check.IsNil)
 
-	pak, err := h.CreatePreAuthKey(n.Name, false, false, nil)
+	pak, err := h.CreatePreAuthKey(n.Name, false, false, nil, nil)
 	c.Assert(err, check.IsNil)
 
 	p, err := h.checkKeyValidity(pak.Key)
@@ -132,7 +152,7 @@ func (*Suite) TestEphemeralKey(c *check.C) {
 	n, err := h.CreateNamespace("test7")
 	c.Assert(err, check.IsNil)
 
-	pak, err := h.CreatePreAuthKey(n.Name, false, true, nil)
+	pak, err := h.CreatePreAuthKey(n.Name, false, true, nil, nil)
 	c.Assert(err, check.IsNil)
 
 	now := time.Now()
@@ -163,3 +183,139 @@ func (*Suite) TestEphemeralKey(c *check.C) {
 	_, err = h.GetMachine("test7", "testest")
 	c.Assert(err, check.NotNil)
 }
+
+func (*Suite) TestExpirePreAuthKey(c *check.C) {
+	n, err := h.CreateNamespace("test9")
+	c.Assert(err, check.IsNil)
+
+	pak, err := h.CreatePreAuthKey(n.Name, true, false, nil, nil)
+	c.Assert(err, check.IsNil)
+
+	_, err = h.ExpirePreAuthKey("bogus", pak.Key)
+	c.Assert(err, check.NotNil)
+
+	_, err = h.ExpirePreAuthKey(n.Name, "bogus")
+	c.Assert(err, check.Equals, errorAuthKeyNotFound)
+
+	k, err := h.ExpirePreAuthKey(n.Name, pak.Key)
+	c.Assert(err, check.IsNil)
+	c.Assert(k.Expiration, check.NotNil)
+
+	p, err := h.checkKeyValidity(pak.Key)
+	c.Assert(err, check.Equals, errorAuthKeyExpired)
+	c.Assert(p, check.IsNil)
+}
+
+func (*Suite) TestPreAuthKeyMachines(c *check.C) {
+	n, err := h.CreateNamespace("test10")
+	c.Assert(err, check.IsNil)
+
+	pak, err := h.CreatePreAuthKey(n.Name, true, false, nil, nil)
+	c.Assert(err, check.IsNil)
+	other, err := h.CreatePreAuthKey(n.Name, true, false, nil, nil)
+	c.Assert(err, check.IsNil)
+
+	_, err = h.GetPreAuthKeyMachines(n.Name, "bogus")
+	c.Assert(err, check.Equals, errorAuthKeyNotFound)
+
+	now := time.Now().UTC()
+	for i, k := range []*PreAuthKey{pak, pak, other} {
+		m := Machine{
+			ID:             uint64(i + 1),
+			MachineKey:     fmt.Sprintf("foo%d", i),
+			NodeKey:        "bar",
+			Name:           fmt.Sprintf("testmachine%d", i),
+			NamespaceID:    n.ID,
+			Registered:     true,
+			RegisterMethod: "authKey",
+			RegisteredAt:   &now,
+			AuthKeyID:      uint(k.ID),
+		}
+		h.db.Save(&m)
+	}
+
+	machines, err := h.GetPreAuthKeyMachines(n.Name, pak.Key)
+	c.Assert(err, check.IsNil)
+	c.Assert(len(*machines), check.Equals, 2)
+	c.Assert((*machines)[0].Name, check.Equals, "testmachine0")
+	c.Assert((*machines)[0].RegisteredAt, check.NotNil)
+	c.Assert((*machines)[1].Namespace.Name, check.Equals, n.Name)
+}
+
+func (*Suite) TestPreAuthKeysNamespaceScope(c *check.C) {
+	n1, err := h.CreateNamespace("team1")
+	c.Assert(err, check.IsNil)
+	n2, err := h.CreateNamespace("team2")
+	c.Assert(err, check.IsNil)
+
+	k1, err := h.CreatePreAuthKey(n1.Name, true, false, nil, nil)
+	c.Assert(err, check.IsNil)
+	_, err = h.CreatePreAuthKey(n2.Name, true, false, nil, nil)
+	c.Assert(err, check.IsNil)
+
+	_, err = h.GetPreAuthKeys("")
+	c.Assert(err, check.Equals, errorAuthKeyNamespaceRequired)
+	_, err = h.CreatePreAuthKey("", true, false, nil, nil)
+	c.Assert(err, check.Equals, errorAuthKeyNamespaceRequired)
+
+	keys, err := h.GetPreAuthKeys(n1.Name)
+	c.Assert(err, check.IsNil)
+	c.Assert(len(*keys), check.Equals, 1)
+	c.Assert((*keys)[0].ID, check.Equals, k1.ID)
+
+	// The key of team1 is unknown to team2
+	_, err = h.ExpirePreAuthKey(n2.Name, k1.Key)
+	c.Assert(err, check.Equals, errorAuthKeyNotFound)
+	_, err = h.GetPreAuthKeyMachines(n2.Name, k1.Key)
+	c.Assert(err, check.Equals, errorAuthKeyNotFound)
+
+	_, err = h.checkKeyValidity(k1.Key)
+	c.Assert(err, check.IsNil)
+}
+
+func (*Suite) TestPreAuthKeyTags(c *check.C) {
+	n, err := h.CreateNamespace("test")
+	c.Assert(err, check.IsNil)
+	_, err = h.CreateNamespace("other")
+	c.Assert(err, check.IsNil)
+
+	// Without a policy there are no valid tags
+	_, err = h.CreatePreAuthKey(n.Name, true, false, nil, []string{"tag:server"})
+	c.Assert(errors.Is(err, errorInvalidTag), check.Equals, true)
+
+	policy := &ACLPolicy{
+		TagOwners: TagOwners{"tag:server": []string{"test"}, "tag:prod": []string{"test"}, "tag:other": []string{"other"}},
+	}
+	h.acl.Store(&aclState{policy: policy, rules: &[]tailcfg.FilterRule{}})
+	_, err = h.CreatePreAuthKey(n.Name, true, false, nil, []string{"tag:other"})
+	c.Assert(errors.Is(err, errorInvalidTag), check.Equals, true)
+
+	pak, err := h.CreatePreAuthKey(n.Name, true, false, nil, []string{"tag:server", "tag:prod"})
+	c.Assert(err, check.IsNil)
+	tags, err := pak.GetACLTags()
+	c.Assert(err, check.IsNil)
+	c.Assert(tags, check.DeepEquals, []string{"tag:prod", "tag:server"})
+
+	m := Machine{
+		MachineKey:     "foo",
+		NodeKey:        "bar",
+		DiscoKey:       "faa",
+		IPAddress:      "100.64.0.1",
+		Name:           "testmachine",
+		NamespaceID:    n.ID,
+		Registered:     true,
+		RegisterMethod: "authKey",
+		AuthKeyID:      uint(pak.ID),
+	}
+	h.db.Save(&m)
+
+	// The policy no longer lets the namespace own tag:prod
+	policy.TagOwners["tag:prod"] = []string{"other"}
+	err = h.applyPreAuthKeyTags(&m, pak)
+	c.Assert(err, check.IsNil)
+	m1, err := h.GetMachineByID(m.ID)
+	c.Assert(err, check.IsNil)
+	tags, err = m1.GetTags()
+	c.Assert(err, check.IsNil)
+	c.Assert(tags, check.DeepEquals, []string{"tag:server"})
+}
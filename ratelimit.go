@@ -0,0 +1,99 @@
+package headscale
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/time/rate"
+)
+
+// rateLimiterExpiry is how long the bucket of a source IP is kept after its
+// last request
+const rateLimiterExpiry = 10 * time.Minute
+
+// ipRateLimiter keeps a token bucket per source IP
+type ipRateLimiter struct {
+	limit rate.Limit
+	burst int
+
+	mu        sync.Mutex
+	limiters  map[string]*ipLimiter
+	lastSweep time.Time
+}
+
+type ipLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+func newIPRateLimiter(limit float64, burst int) *ipRateLimiter {
+	return &ipRateLimiter{
+		limit:     rate.Limit(limit),
+		burst:     burst,
+		limiters:  map[string]*ipLimiter{},
+		lastSweep: time.Now(),
+	}
+}
+
+// allow takes a token from the bucket of ip
+func (l *ipRateLimiter) allow(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(l.lastSweep) > rateLimiterExpiry {
+		for k, v := range l.limiters {
+			if now.Sub(v.lastSeen) > rateLimiterExpiry {
+				delete(l.limiters, k)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	entry, ok := l.limiters[ip]
+	if !ok {
+		entry = &ipLimiter{limiter: rate.NewLimiter(l.limit, l.burst)}
+		l.limiters[ip] = entry
+	}
+	entry.lastSeen = now
+	return entry.limiter.AllowN(now, 1)
+}
+
+// registrationRateLimit returns the middleware limiting the requests to the
+// registration endpoints, or nothing to do if registration_rate_limit is 0
+func (h *Headscale) registrationRateLimit() gin.HandlerFunc {
+	if h.cfg.RegistrationRateLimit <= 0 {
+		return func(c *gin.Context) {}
+	}
+	l := newIPRateLimiter(h.cfg.RegistrationRateLimit, h.cfg.RegistrationRateBurst)
+	return func(c *gin.Context) {
+		ip := remoteIP(c.Request)
+		if !l.allow(ip) {
+			log.Warn().
+				Str("handler", "RegistrationRateLimit").
+				Str("ip", ip).
+				Str("path", c.Request.URL.Path).
+				Msg("Too many registration requests")
+			registrationRequestsLimited.Inc()
+			c.String(http.StatusTooManyRequests, "Too many requests")
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// remoteIP is the address the request comes from. The X-Forwarded-For and
+// X-Real-IP headers read by gin's ClientIP are set by the client itself
+// without a proxy, which would get a new bucket with each request.
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
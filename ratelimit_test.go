@@ -0,0 +1,25 @@
+package headscale
+
+import (
+	"net/http/httptest"
+
+	"gopkg.in/check.v1"
+)
+
+func (s *Suite) TestIPRateLimiter(c *check.C) {
+	l := newIPRateLimiter(0.001, 3)
+	for i := 0; i < 3; i++ {
+		c.Assert(l.allow("192.0.2.1"), check.Equals, true)
+	}
+	c.Assert(l.allow("192.0.2.1"), check.Equals, false)
+
+	// Each source IP has its own bucket
+	c.Assert(l.allow("192.0.2.2"), check.Equals, true)
+}
+
+func (s *Suite) TestRemoteIPIgnoresForwardedFor(c *check.C) {
+	r := httptest.NewRequest("POST", "/machine/mkey", nil)
+	r.RemoteAddr = "192.0.2.1:41641"
+	r.Header.Set("X-Forwarded-For", "198.51.100.7")
+	c.Assert(remoteIP(r), check.Equals, "192.0.2.1")
+}
@@ -2,12 +2,31 @@ package headscale
 
 import (
 	"encoding/json"
-	"errors"
+	"fmt"
+	"strings"
 
+	"github.com/rs/zerolog/log"
 	"gorm.io/datatypes"
 	"inet.af/netaddr"
 )
 
+const errorRouteNotAdvertised = Error("could not find routable range")
+const errorRouteIsExitRoute = Error("default routes can only be enabled with enable-exit-node")
+const errorNotExitNode = Error("the machine does not advertise itself as an exit node")
+
+// exitRoutes are the default routes advertised by the exit nodes
+// (tailscale up --advertise-exit-node)
+var exitRoutes = []string{"0.0.0.0/0", "::/0"}
+
+// Route is a subnet route of a machine. Advertised routes are only sent to
+// the peers once they are enabled.
+type Route struct {
+	Prefix     netaddr.IPPrefix
+	Advertised bool
+	Enabled    bool
+	ExitRoute  bool
+}
+
 // GetNodeRoutes returns the subnet routes advertised by a node (identified by
 // namespace and node name)
 func (h *Headscale) GetNodeRoutes(namespace string, nodeName string) (*[]netaddr.IPPrefix, error) {
@@ -30,6 +49,58 @@ func (h *Headscale) EnableNodeRoute(namespace string, nodeName string, routeStr
 	if err != nil {
 		return nil, err
 	}
+	return h.EnableMachineRoute(m.ID, routeStr)
+}
+
+// GetMachineRoutes returns the routes advertised by a machine, and the ones
+// enabled for it
+func (h *Headscale) GetMachineRoutes(id uint64) (*[]Route, error) {
+	m, err := h.GetMachineByID(id)
+	if err != nil {
+		return nil, err
+	}
+	hi, err := m.GetHostInfo()
+	if err != nil {
+		return nil, err
+	}
+	enabled, err := m.getEnabledRoutes()
+	if err != nil {
+		return nil, err
+	}
+
+	routes := []Route{}
+	for _, r := range hi.RoutableIPs {
+		routes = append(routes, Route{
+			Prefix:     r,
+			Advertised: true,
+			Enabled:    containsIPPrefix(enabled, r),
+			ExitRoute:  isExitRoute(r),
+		})
+	}
+	// Enabled routes the machine no longer advertises are kept, but not sent to the peers
+	for _, r := range enabled {
+		if !containsIPPrefix(hi.RoutableIPs, r) {
+			routes = append(routes, Route{
+				Prefix:    r,
+				Enabled:   true,
+				ExitRoute: isExitRoute(r),
+			})
+		}
+	}
+	return &routes, nil
+}
+
+// EnableMachineRoute enables a subnet route advertised by a machine, and
+// updates its peers so they route the subnet through it
+func (h *Headscale) EnableMachineRoute(id uint64, routeStr string) (_ *netaddr.IPPrefix, err error) {
+	defer func() { h.audit("machine.enable_route", fmt.Sprintf("machine:%d route:%s", id, routeStr), err) }()
+	if err = h.checkMaintenance(); err != nil {
+		return nil, err
+	}
+	m, err := h.GetMachineByID(id)
+	if err != nil {
+		return nil, err
+	}
 	hi, err := m.GetHostInfo()
 	if err != nil {
 		return nil, err
@@ -38,28 +109,238 @@ func (h *Headscale) EnableNodeRoute(namespace string, nodeName string, routeStr
 	if err != nil {
 		return nil, err
 	}
+	if isExitRoute(route) {
+		return nil, errorRouteIsExitRoute
+	}
+	if !containsIPPrefix(hi.RoutableIPs, route) {
+		return nil, errorRouteNotAdvertised
+	}
+
+	err = h.enableMachineRoutes(m, []netaddr.IPPrefix{route})
+	if err != nil {
+		return nil, err
+	}
+	return &route, nil
+}
+
+// EnableMachineExitNode approves a machine advertising itself as an exit node.
+// Its default routes are then sent to the peers, which use them when they
+// select it as their exit node.
+func (h *Headscale) EnableMachineExitNode(id uint64) (_ *Machine, err error) {
+	defer func() { h.audit("machine.enable_exit_node", fmt.Sprintf("machine:%d", id), err) }()
+	if err = h.checkMaintenance(); err != nil {
+		return nil, err
+	}
+	m, err := h.GetMachineByID(id)
+	if err != nil {
+		return nil, err
+	}
+	hi, err := m.GetHostInfo()
+	if err != nil {
+		return nil, err
+	}
+
+	routes := []netaddr.IPPrefix{}
+	for _, r := range hi.RoutableIPs {
+		if isExitRoute(r) {
+			routes = append(routes, r)
+		}
+	}
+	if len(routes) == 0 {
+		return nil, errorNotExitNode
+	}
+
+	err = h.enableMachineRoutes(m, routes)
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// EnableAllMachineRoutes enables all the subnet routes advertised by a
+// machine, and returns them. The exit routes are left to
+// EnableMachineExitNode.
+func (h *Headscale) EnableAllMachineRoutes(id uint64) (_ []netaddr.IPPrefix, err error) {
+	defer func() { h.audit("machine.enable_all_routes", fmt.Sprintf("machine:%d", id), err) }()
+	if err = h.checkMaintenance(); err != nil {
+		return nil, err
+	}
+	m, err := h.GetMachineByID(id)
+	if err != nil {
+		return nil, err
+	}
+	hi, err := m.GetHostInfo()
+	if err != nil {
+		return nil, err
+	}
+
+	routes := []netaddr.IPPrefix{}
+	for _, r := range hi.RoutableIPs {
+		if !isExitRoute(r) {
+			routes = append(routes, r)
+		}
+	}
+	if len(routes) == 0 {
+		return routes, nil
+	}
+	err = h.enableMachineRoutes(m, routes)
+	if err != nil {
+		return nil, err
+	}
+	return routes, nil
+}
+
+// autoApproveRoutes enables the routes advertised by the machine that the
+// AutoApprovers of the ACL policy allow it to advertise. It is called when
+// the client sends its Hostinfo, the other routes still need an admin.
+func (h *Headscale) autoApproveRoutes(m *Machine) (err error) {
+	policy := h.loadACL().policy
+	if policy == nil || len(policy.AutoApprovers.Routes) == 0 {
+		return nil
+	}
+	hi, err := m.GetHostInfo()
+	if err != nil {
+		return err
+	}
+	enabled, err := m.getEnabledRoutes()
+	if err != nil {
+		return err
+	}
 
-	for _, rIP := range hi.RoutableIPs {
-		if rIP == route {
-			routes, _ := json.Marshal([]string{routeStr}) // TODO: only one for the time being, so overwriting the rest
-			m.EnabledRoutes = datatypes.JSON(routes)
-			h.db.Save(&m)
+	approved := []netaddr.IPPrefix{}
+	for _, r := range hi.RoutableIPs {
+		if isExitRoute(r) || containsIPPrefix(enabled, r) {
+			continue
+		}
+		ok, err := h.routeAutoApproved(policy, *m, r)
+		if err != nil {
+			return err
+		}
+		if ok {
+			approved = append(approved, r)
+		}
+	}
+	if len(approved) == 0 {
+		return nil
+	}
+
+	routes := []string{}
+	for _, r := range approved {
+		routes = append(routes, r.String())
+	}
+	defer func() {
+		h.audit("machine.auto_approve_routes", fmt.Sprintf("machine:%d routes:%s", m.ID, strings.Join(routes, ",")), err)
+	}()
+	log.Info().
+		Str("machine", m.Name).
+		Strs("routes", routes).
+		Msg("Enabling the routes allowed by the auto approvers")
+	return h.enableMachineRoutes(m, approved)
+}
 
-			// THIS IS COMPLETELY USELESS.
-			// The peers map is stored in memory in the server process.
-			// Definetely not accessible from the CLI tool.
-			// We need RPC to the server - or some kind of 'needsUpdate' field in the DB
-			peers, _ := h.getPeers(*m)
-			h.pollMu.Lock()
-			for _, p := range *peers {
-				if pUp, ok := h.clientsPolling[uint64(p.ID)]; ok {
-					pUp <- []byte{}
+// routeAutoApproved tells whether an auto approver of a prefix containing the
+// route matches the machine: its namespace, a group of its namespace or one
+// of its tags
+func (h *Headscale) routeAutoApproved(policy *ACLPolicy, m Machine, route netaddr.IPPrefix) (bool, error) {
+	for prefixStr, approvers := range policy.AutoApprovers.Routes {
+		prefix, err := netaddr.ParseIPPrefix(prefixStr)
+		if err != nil {
+			return false, err
+		}
+		if prefix.Bits() > route.Bits() || !prefix.Contains(route.IP()) {
+			continue
+		}
+		for _, a := range approvers {
+			switch {
+			case strings.HasPrefix(a, "tag:"):
+				hasTag, err := h.machineHasTag(policy, m, a)
+				if err != nil {
+					return false, err
+				}
+				if hasTag {
+					return true, nil
+				}
+			case strings.HasPrefix(a, "group:"):
+				namespaces, _ := policy.groupNamespaces(a)
+				if containsString(namespaces, m.Namespace.Name) {
+					return true, nil
+				}
+			default:
+				if a == m.Namespace.Name {
+					return true, nil
 				}
 			}
-			h.pollMu.Unlock()
-			return &rIP, nil
 		}
 	}
+	return false, nil
+}
 
-	return nil, errors.New("could not find routable range")
+// enableMachineRoutes adds routes to the enabled routes of a machine, and
+// notifies the machine and its peers
+func (h *Headscale) enableMachineRoutes(m *Machine, newRoutes []netaddr.IPPrefix) error {
+	enabled, err := m.getEnabledRoutes()
+	if err != nil {
+		return err
+	}
+	for _, r := range newRoutes {
+		if !containsIPPrefix(enabled, r) {
+			enabled = append(enabled, r)
+		}
+	}
+	routes := []string{}
+	for _, r := range enabled {
+		routes = append(routes, r.String())
+	}
+	b, _ := json.Marshal(routes)
+	m.EnabledRoutes = datatypes.JSON(b)
+	if err := h.db.Save(m).Error; err != nil {
+		return err
+	}
+
+	// The peers map is stored in memory in the server process, so this only
+	// has an effect when called from the server (e.g. through the gRPC API)
+	peers, err := h.getPeers(*m)
+	if err != nil {
+		return err
+	}
+	h.notifyNodes(*peers)
+	h.notifyMachine(m.ID)
+	return nil
+}
+
+// IsExitNode tells whether the machine is an approved exit node, that is, it
+// advertises default routes that have been enabled
+func (m Machine) IsExitNode() bool {
+	hi, err := m.GetHostInfo()
+	if err != nil {
+		return false
+	}
+	enabled, err := m.getEnabledRoutes()
+	if err != nil {
+		return false
+	}
+	for _, r := range enabled {
+		if isExitRoute(r) && containsIPPrefix(hi.RoutableIPs, r) {
+			return true
+		}
+	}
+	return false
+}
+
+func isExitRoute(p netaddr.IPPrefix) bool {
+	for _, r := range exitRoutes {
+		if p.String() == r {
+			return true
+		}
+	}
+	return false
+}
+
+func containsIPPrefix(list []netaddr.IPPrefix, p netaddr.IPPrefix) bool {
+	for _, i := range list {
+		if i == p {
+			return true
+		}
+	}
+	return false
 }
@@ -13,7 +13,7 @@ func (s *Suite) TestGetRoutes(c *check.C) {
 	n, err := h.CreateNamespace("test")
 	c.Assert(err, check.IsNil)
 
-	pak, err := h.CreatePreAuthKey(n.Name, false, false, nil)
+	pak, err := h.CreatePreAuthKey(n.Name, false, false, nil, nil)
 	c.Assert(err, check.IsNil)
 
 	_, err = h.GetMachine("test", "testmachine")
@@ -53,3 +53,222 @@ func (s *Suite) TestGetRoutes(c *check.C) {
 	c.Assert(err, check.IsNil)
 
 }
+
+func (s *Suite) TestEnableMachineRoute(c *check.C) {
+	n, err := h.CreateNamespace("test")
+	c.Assert(err, check.IsNil)
+
+	route1, err := netaddr.ParseIPPrefix("10.0.0.0/24")
+	c.Assert(err, check.IsNil)
+	route2, err := netaddr.ParseIPPrefix("10.1.0.0/24")
+	c.Assert(err, check.IsNil)
+
+	hi := tailcfg.Hostinfo{
+		RoutableIPs: []netaddr.IPPrefix{route1, route2},
+	}
+	hostinfo, err := json.Marshal(hi)
+	c.Assert(err, check.IsNil)
+
+	m := Machine{
+		ID:             0,
+		MachineKey:     "686824e749f3b7f2a5927ee6c1e422aee5292592d9179a271ed7b3e659b44a66",
+		NodeKey:        "686824e749f3b7f2a5927ee6c1e422aee5292592d9179a271ed7b3e659b44a66",
+		DiscoKey:       "686824e749f3b7f2a5927ee6c1e422aee5292592d9179a271ed7b3e659b44a66",
+		IPAddress:      "100.64.0.1",
+		Name:           "testmachine",
+		NamespaceID:    n.ID,
+		Registered:     true,
+		RegisterMethod: "cli",
+		HostInfo:       datatypes.JSON(hostinfo),
+	}
+	h.db.Save(&m)
+
+	routes, err := h.GetMachineRoutes(m.ID)
+	c.Assert(err, check.IsNil)
+	c.Assert(len(*routes), check.Equals, 2)
+	c.Assert((*routes)[0].Enabled, check.Equals, false)
+
+	// Advertised routes are not sent to the peers until they are enabled
+	node, err := m.toNode()
+	c.Assert(err, check.IsNil)
+	c.Assert(len(node.AllowedIPs), check.Equals, 1)
+
+	_, err = h.EnableMachineRoute(m.ID, "192.168.0.0/24")
+	c.Assert(err, check.Equals, errorRouteNotAdvertised)
+
+	// Enabling a route keeps the ones enabled before
+	_, err = h.EnableMachineRoute(m.ID, "10.0.0.0/24")
+	c.Assert(err, check.IsNil)
+	_, err = h.EnableMachineRoute(m.ID, "10.1.0.0/24")
+	c.Assert(err, check.IsNil)
+
+	routes, err = h.GetMachineRoutes(m.ID)
+	c.Assert(err, check.IsNil)
+	c.Assert((*routes)[0].Enabled, check.Equals, true)
+	c.Assert((*routes)[1].Enabled, check.Equals, true)
+
+	m1, err := h.GetMachineByID(m.ID)
+	c.Assert(err, check.IsNil)
+	node, err = m1.toNode()
+	c.Assert(err, check.IsNil)
+	c.Assert(len(node.AllowedIPs), check.Equals, 3)
+}
+
+func (s *Suite) TestEnableMachineExitNode(c *check.C) {
+	n, err := h.CreateNamespace("test")
+	c.Assert(err, check.IsNil)
+
+	route, err := netaddr.ParseIPPrefix("10.0.0.0/24")
+	c.Assert(err, check.IsNil)
+	exit4, err := netaddr.ParseIPPrefix("0.0.0.0/0")
+	c.Assert(err, check.IsNil)
+	exit6, err := netaddr.ParseIPPrefix("::/0")
+	c.Assert(err, check.IsNil)
+
+	hi := tailcfg.Hostinfo{
+		RoutableIPs: []netaddr.IPPrefix{route},
+	}
+	hostinfo, err := json.Marshal(hi)
+	c.Assert(err, check.IsNil)
+
+	m := Machine{
+		ID:             0,
+		MachineKey:     "686824e749f3b7f2a5927ee6c1e422aee5292592d9179a271ed7b3e659b44a66",
+		NodeKey:        "686824e749f3b7f2a5927ee6c1e422aee5292592d9179a271ed7b3e659b44a66",
+		DiscoKey:       "686824e749f3b7f2a5927ee6c1e422aee5292592d9179a271ed7b3e659b44a66",
+		IPAddress:      "100.64.0.1",
+		Name:           "testmachine",
+		NamespaceID:    n.ID,
+		Registered:     true,
+		RegisterMethod: "cli",
+		HostInfo:       datatypes.JSON(hostinfo),
+	}
+	h.db.Save(&m)
+
+	_, err = h.EnableMachineExitNode(m.ID)
+	c.Assert(err, check.Equals, errorNotExitNode)
+
+	hi.RoutableIPs = []netaddr.IPPrefix{route, exit4, exit6}
+	hostinfo, err = json.Marshal(hi)
+	c.Assert(err, check.IsNil)
+	m.HostInfo = datatypes.JSON(hostinfo)
+	h.db.Save(&m)
+
+	// The default routes are only enabled through enable-exit-node
+	_, err = h.EnableMachineRoute(m.ID, "0.0.0.0/0")
+	c.Assert(err, check.Equals, errorRouteIsExitRoute)
+
+	node, err := m.toNode()
+	c.Assert(err, check.IsNil)
+	c.Assert(len(node.AllowedIPs), check.Equals, 1)
+	c.Assert(m.IsExitNode(), check.Equals, false)
+
+	m1, err := h.EnableMachineExitNode(m.ID)
+	c.Assert(err, check.IsNil)
+	c.Assert(m1.IsExitNode(), check.Equals, true)
+
+	routes, err := h.GetMachineRoutes(m.ID)
+	c.Assert(err, check.IsNil)
+	c.Assert((*routes)[0].Enabled, check.Equals, false)
+	c.Assert((*routes)[1].ExitRoute, check.Equals, true)
+	c.Assert((*routes)[1].Enabled, check.Equals, true)
+
+	node, err = m1.toNode()
+	c.Assert(err, check.IsNil)
+	c.Assert(len(node.AllowedIPs), check.Equals, 3)
+}
+
+func (s *Suite) TestAutoApproveRoutes(c *check.C) {
+	n, err := h.CreateNamespace("test")
+	c.Assert(err, check.IsNil)
+	err = h.LoadACLPolicy("./tests/acls/acl_policy_auto_approvers.hujson")
+	c.Assert(err, check.IsNil)
+
+	hi := tailcfg.Hostinfo{
+		RoutableIPs: []netaddr.IPPrefix{
+			netaddr.MustParseIPPrefix("10.0.1.0/24"),
+			netaddr.MustParseIPPrefix("172.16.0.0/24"),
+			netaddr.MustParseIPPrefix("192.168.0.0/24"),
+			netaddr.MustParseIPPrefix("0.0.0.0/0"),
+		},
+	}
+	hostinfo, err := json.Marshal(hi)
+	c.Assert(err, check.IsNil)
+
+	m := Machine{
+		MachineKey:     "686824e749f3b7f2a5927ee6c1e422aee5292592d9179a271ed7b3e659b44a66",
+		NodeKey:        "686824e749f3b7f2a5927ee6c1e422aee5292592d9179a271ed7b3e659b44a66",
+		DiscoKey:       "686824e749f3b7f2a5927ee6c1e422aee5292592d9179a271ed7b3e659b44a66",
+		IPAddress:      "100.64.0.1",
+		Name:           "testmachine",
+		NamespaceID:    n.ID,
+		Registered:     true,
+		RegisterMethod: "authKey",
+		HostInfo:       datatypes.JSON(hostinfo),
+	}
+	h.db.Save(&m)
+
+	m1, err := h.GetMachineByID(m.ID)
+	c.Assert(err, check.IsNil)
+	err = h.autoApproveRoutes(m1)
+	c.Assert(err, check.IsNil)
+	enabled, err := m1.getEnabledRoutes()
+	c.Assert(err, check.IsNil)
+	c.Assert(enabled, check.DeepEquals, []netaddr.IPPrefix{netaddr.MustParseIPPrefix("10.0.1.0/24")})
+
+	// The prefix approved for the tag once the machine has it
+	m1.Tags = datatypes.JSON(`["tag:router"]`)
+	h.db.Save(m1)
+	err = h.autoApproveRoutes(m1)
+	c.Assert(err, check.IsNil)
+	enabled, err = m1.getEnabledRoutes()
+	c.Assert(err, check.IsNil)
+	c.Assert(len(enabled), check.Equals, 2)
+	c.Assert(m1.IsExitNode(), check.Equals, false)
+
+	routes, err := h.EnableAllMachineRoutes(m.ID)
+	c.Assert(err, check.IsNil)
+	c.Assert(len(routes), check.Equals, 3)
+	m2, err := h.GetMachineByID(m.ID)
+	c.Assert(err, check.IsNil)
+	enabled, err = m2.getEnabledRoutes()
+	c.Assert(err, check.IsNil)
+	c.Assert(containsIPPrefix(enabled, netaddr.MustParseIPPrefix("192.168.0.0/24")), check.Equals, true)
+	c.Assert(m2.IsExitNode(), check.Equals, false)
+}
+
+func (s *Suite) TestAutoApproveRequestedTagRoutes(c *check.C) {
+	n, err := h.CreateNamespace("test")
+	c.Assert(err, check.IsNil)
+	err = h.LoadACLPolicy("./tests/acls/acl_policy_auto_approvers.hujson")
+	c.Assert(err, check.IsNil)
+
+	// The client requests the tags with their tag: prefix
+	hi := tailcfg.Hostinfo{
+		RequestTags: []string{"tag:router"},
+		RoutableIPs: []netaddr.IPPrefix{netaddr.MustParseIPPrefix("172.16.0.0/24")},
+	}
+	hostinfo, err := json.Marshal(hi)
+	c.Assert(err, check.IsNil)
+
+	m := Machine{
+		MachineKey:     "686824e749f3b7f2a5927ee6c1e422aee5292592d9179a271ed7b3e659b44a66",
+		NodeKey:        "686824e749f3b7f2a5927ee6c1e422aee5292592d9179a271ed7b3e659b44a66",
+		DiscoKey:       "686824e749f3b7f2a5927ee6c1e422aee5292592d9179a271ed7b3e659b44a66",
+		IPAddress:      "100.64.0.1",
+		Name:           "testmachine",
+		NamespaceID:    n.ID,
+		Registered:     true,
+		RegisterMethod: "authKey",
+		HostInfo:       datatypes.JSON(hostinfo),
+	}
+	h.db.Save(&m)
+
+	m1, err := h.GetMachineByID(m.ID)
+	c.Assert(err, check.IsNil)
+	err = h.autoApproveRoutes(m1)
+	c.Assert(err, check.IsNil)
+	enabled, err := m1.getEnabledRoutes()
+	c.Assert(err, check.IsNil)
+	c.Assert(enabled, check.DeepEquals, []netaddr.IPPrefix{netaddr.MustParseIPPrefix("172.16.0.0/24")})
+}
@@ -0,0 +1,137 @@
+package headscale
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const errorSameNamespace = Error("the machine is already in this namespace")
+const errorMachineAlreadyShared = Error("the machine is already shared with this namespace")
+const errorMachineNotShared = Error("the machine is not shared with this namespace")
+
+// SharedMachine makes a machine visible to the machines of another namespace,
+// as with node sharing in Tailscale. The machine keeps its namespace and its
+// address; the ACL rules still apply to the traffic between them.
+type SharedMachine struct {
+	ID          uint64 `gorm:"primary_key"`
+	MachineID   uint64
+	Machine     Machine
+	NamespaceID uint
+	Namespace   Namespace
+
+	CreatedAt time.Time
+}
+
+// ShareMachine shares a machine with the machines of another namespace, and
+// updates both sides
+func (h *Headscale) ShareMachine(id uint64, namespaceName string) (_ *Machine, err error) {
+	defer func() { h.audit("machine.share", fmt.Sprintf("machine:%d namespace:%s", id, namespaceName), err) }()
+	if err = h.checkMaintenance(); err != nil {
+		return nil, err
+	}
+	m, err := h.GetMachineByID(id)
+	if err != nil {
+		return nil, err
+	}
+	n, err := h.GetNamespace(namespaceName)
+	if err != nil {
+		return nil, err
+	}
+	if m.NamespaceID == n.ID {
+		return nil, errorSameNamespace
+	}
+	if err := h.db.First(&SharedMachine{}, "machine_id = ? AND namespace_id = ?", m.ID, n.ID).Error; err == nil {
+		return nil, errorMachineAlreadyShared
+	}
+
+	sm := SharedMachine{
+		MachineID:   m.ID,
+		NamespaceID: n.ID,
+	}
+	if err := h.db.Create(&sm).Error; err != nil {
+		return nil, err
+	}
+
+	peers, err := h.getPeers(*m)
+	if err != nil {
+		return nil, err
+	}
+	h.notifyNodes(*peers)
+	h.notifyMachine(m.ID)
+	return m, nil
+}
+
+// UnshareMachine stops sharing a machine with another namespace, and updates
+// both sides
+func (h *Headscale) UnshareMachine(id uint64, namespaceName string) (_ *Machine, err error) {
+	defer func() { h.audit("machine.unshare", fmt.Sprintf("machine:%d namespace:%s", id, namespaceName), err) }()
+	if err = h.checkMaintenance(); err != nil {
+		return nil, err
+	}
+	m, err := h.GetMachineByID(id)
+	if err != nil {
+		return nil, err
+	}
+	n, err := h.GetNamespace(namespaceName)
+	if err != nil {
+		return nil, err
+	}
+	sm := SharedMachine{}
+	if result := h.db.First(&sm, "machine_id = ? AND namespace_id = ?", m.ID, n.ID); errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return nil, errorMachineNotShared
+	}
+
+	peers, err := h.getPeers(*m)
+	if err != nil {
+		return nil, err
+	}
+	if err := h.db.Delete(&sm).Error; err != nil {
+		return nil, err
+	}
+	h.notifyNodes(*peers)
+	h.notifyMachine(m.ID)
+	return m, nil
+}
+
+// ListSharedMachines returns the machines of other namespaces shared with a
+// namespace
+func (h *Headscale) ListSharedMachines(namespaceName string) (*[]Machine, error) {
+	n, err := h.GetNamespace(namespaceName)
+	if err != nil {
+		return nil, err
+	}
+	machines := []Machine{}
+	err = h.db.Preload("AuthKey").Preload("Namespace").
+		Where("id IN (?)", h.db.Model(&SharedMachine{}).Select("machine_id").Where("namespace_id = ?", n.ID)).
+		Order("id").Find(&machines).Error
+	if err != nil {
+		return nil, err
+	}
+	for i := range machines {
+		machines[i].Shared = true
+	}
+	return &machines, nil
+}
+
+// getSharedPeers returns the peers of a machine outside of its namespace:
+// the machines shared with its namespace, and the machines of the
+// namespaces it is shared with
+func (h *Headscale) getSharedPeers(m Machine) ([]Machine, error) {
+	machines := []Machine{}
+	sharedIn := h.db.Model(&SharedMachine{}).Select("machine_id").Where("namespace_id = ?", m.NamespaceID)
+	sharedWith := h.db.Model(&SharedMachine{}).Select("namespace_id").Where("machine_id = ?", m.ID)
+	err := h.db.Where("registered AND machine_key <> ? AND (id IN (?) OR namespace_id IN (?))", m.MachineKey, sharedIn, sharedWith).
+		Find(&machines).Error
+	if err != nil {
+		return nil, err
+	}
+	return machines, nil
+}
+
+// deleteMachineShares removes the shares of a machine being deleted
+func (h *Headscale) deleteMachineShares(id uint64) error {
+	return h.db.Where("machine_id = ?", id).Delete(&SharedMachine{}).Error
+}
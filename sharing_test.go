@@ -0,0 +1,67 @@
+package headscale
+
+import (
+	"gopkg.in/check.v1"
+)
+
+func (s *Suite) TestShareMachine(c *check.C) {
+	n1, err := h.CreateNamespace("test")
+	c.Assert(err, check.IsNil)
+	n2, err := h.CreateNamespace("test2")
+	c.Assert(err, check.IsNil)
+
+	m := Machine{
+		MachineKey:     "foo",
+		IPAddress:      "100.64.0.1",
+		Name:           "testmachine",
+		NamespaceID:    n1.ID,
+		Registered:     true,
+		RegisterMethod: "cli",
+	}
+	h.db.Save(&m)
+	other := Machine{
+		MachineKey:     "bar",
+		IPAddress:      "100.64.0.2",
+		Name:           "othermachine",
+		NamespaceID:    n2.ID,
+		Registered:     true,
+		RegisterMethod: "cli",
+	}
+	h.db.Save(&other)
+
+	_, err = h.ShareMachine(m.ID, n1.Name)
+	c.Assert(err, check.Equals, errorSameNamespace)
+	_, err = h.UnshareMachine(m.ID, n2.Name)
+	c.Assert(err, check.Equals, errorMachineNotShared)
+
+	_, err = h.ShareMachine(m.ID, n2.Name)
+	c.Assert(err, check.IsNil)
+	_, err = h.ShareMachine(m.ID, n2.Name)
+	c.Assert(err, check.Equals, errorMachineAlreadyShared)
+
+	// Both sides see each other, the machine keeps its namespace
+	peers, err := h.getSharedPeers(other)
+	c.Assert(err, check.IsNil)
+	c.Assert(len(peers), check.Equals, 1)
+	c.Assert(peers[0].ID, check.Equals, m.ID)
+	c.Assert(peers[0].NamespaceID, check.Equals, n1.ID)
+	peers, err = h.getSharedPeers(m)
+	c.Assert(err, check.IsNil)
+	c.Assert(len(peers), check.Equals, 1)
+	c.Assert(peers[0].ID, check.Equals, other.ID)
+
+	machines, err := h.ListMachines(MachineFilter{Namespace: n2.Name, IncludeShared: true})
+	c.Assert(err, check.IsNil)
+	c.Assert(len(*machines), check.Equals, 2)
+	c.Assert((*machines)[0].Shared, check.Equals, true)
+	c.Assert((*machines)[1].Shared, check.Equals, false)
+	machines, err = h.ListMachines(MachineFilter{Namespace: n2.Name})
+	c.Assert(err, check.IsNil)
+	c.Assert(len(*machines), check.Equals, 1)
+
+	_, err = h.UnshareMachine(m.ID, n2.Name)
+	c.Assert(err, check.IsNil)
+	peers, err = h.getSharedPeers(other)
+	c.Assert(err, check.IsNil)
+	c.Assert(len(peers), check.Equals, 0)
+}
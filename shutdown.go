@@ -0,0 +1,124 @@
+package headscale
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc"
+)
+
+const defaultShutdownTimeout = 30 * time.Second
+
+// serveUntilSignal runs the HTTP server until it fails, or until SIGTERM or
+// SIGINT is received. The server is then shut down gracefully: new
+// registrations are refused, the long polls are closed over the first half
+// of the shutdown timeout so the clients do not all reconnect at once, and
+// the requests in flight are given the rest of the timeout to complete.
+func (h *Headscale) serveUntilSignal(s *http.Server, serve func() error) error {
+	errs := make(chan error, 1)
+	go func() {
+		errs <- serve()
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	defer signal.Stop(signals)
+
+	select {
+	case err := <-errs:
+		return err
+	case sig := <-signals:
+		log.Info().
+			Str("signal", sig.String()).
+			Msg("Shutting down")
+	}
+
+	timeout := h.cfg.ShutdownTimeout
+	if timeout <= 0 {
+		timeout = defaultShutdownTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	close(h.shutdown)
+
+	for _, gs := range []*grpc.Server{h.grpcServer, h.grpcSocketServer} {
+		if gs == nil {
+			continue
+		}
+		gs := gs
+		stopped := make(chan struct{})
+		go func() {
+			gs.GracefulStop()
+			close(stopped)
+		}()
+		go func() {
+			select {
+			case <-ctx.Done():
+				gs.Stop()
+			case <-stopped:
+			}
+		}()
+	}
+
+	err := s.Shutdown(ctx)
+	if err != nil {
+		log.Warn().
+			Err(err).
+			Msg("Some requests did not complete before the shutdown timeout")
+	}
+	if err := <-errs; err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+
+	if db, err := h.db.DB(); err == nil {
+		if err := db.Close(); err != nil {
+			log.Error().
+				Err(err).
+				Msg("Could not close the database")
+		}
+	}
+	log.Info().Msg("Headscale stopped")
+	return nil
+}
+
+// isShuttingDown tells whether the server is shutting down
+func (h *Headscale) isShuttingDown() bool {
+	select {
+	case <-h.shutdown:
+		return true
+	default:
+		return false
+	}
+}
+
+// pollShutdown returns a channel closed after a random delay once the server
+// starts shutting down, or never if done is closed first. The delays are
+// spread over half of the shutdown timeout.
+func (h *Headscale) pollShutdown(done <-chan struct{}) <-chan struct{} {
+	closing := make(chan struct{})
+	go func() {
+		select {
+		case <-h.shutdown:
+		case <-done:
+			return
+		}
+		timeout := h.cfg.ShutdownTimeout
+		if timeout <= 0 {
+			timeout = defaultShutdownTimeout
+		}
+		select {
+		case <-time.After(time.Duration(rand.Int63n(int64(timeout/2) + 1))):
+			close(closing)
+		case <-done:
+		}
+	}()
+	return closing
+}
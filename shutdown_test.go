@@ -0,0 +1,48 @@
+package headscale
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gopkg.in/check.v1"
+	"tailscale.com/tailcfg"
+)
+
+func (s *Suite) TestShuttingDown(c *check.C) {
+	h.derpMap = &tailcfg.DERPMap{}
+	h.shutdown = make(chan struct{})
+	h.cfg.ShutdownTimeout = 10 * time.Millisecond
+	defer func() {
+		h.shutdown = nil
+		h.cfg.ShutdownTimeout = 0
+	}()
+
+	done := make(chan struct{})
+	defer close(done)
+	closing := h.pollShutdown(done)
+	c.Assert(h.isShuttingDown(), check.Equals, false)
+
+	close(h.shutdown)
+	c.Assert(h.isShuttingDown(), check.Equals, true)
+	select {
+	case <-closing:
+	case <-time.After(time.Second):
+		c.Fatal("the long poll was not closed")
+	}
+
+	// Registrations are refused, and the server is no longer ready
+	w := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	ctx.Request = httptest.NewRequest(http.MethodPost, "/machine/key", nil)
+	h.RegistrationHandler(ctx)
+	c.Assert(w.Code, check.Equals, http.StatusServiceUnavailable)
+
+	w = httptest.NewRecorder()
+	ctx, _ = gin.CreateTestContext(w)
+	ctx.Request = httptest.NewRequest(http.MethodGet, "/ready", nil)
+	h.ReadyHandler(ctx)
+	c.Assert(w.Code, check.Equals, http.StatusServiceUnavailable)
+	c.Assert(w.Body.String(), check.Matches, ".*shutting_down.*")
+}
@@ -0,0 +1,158 @@
+package headscale
+
+import (
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// stateVersion is the version of the format of the exported state. It only
+// changes when a State written by an older version cannot be imported as is.
+const stateVersion = 1
+
+const errorStateTooNew = Error("the state was exported by a newer version of headscale")
+const errorStateNotEmpty = Error("the database is not empty, use --force to replace its content")
+
+// State is a dump of the content of the database, independent of its engine.
+// The API keys are not part of it, as only their hash is stored: new ones have
+// to be created after an import.
+type State struct {
+	Version    int       `json:"version"`
+	ExportedAt time.Time `json:"exported_at"`
+
+	Namespaces     []Namespace     `json:"namespaces"`
+	Machines       []Machine       `json:"machines"`
+	PreAuthKeys    []PreAuthKey    `json:"pre_auth_keys"`
+	SharedMachines []SharedMachine `json:"shared_machines"`
+
+	// IPv6Prefix is the prefix generated when ip_prefixes has no IPv6 one,
+	// which the IPv6 addresses of the machines are in
+	IPv6Prefix string `json:"ipv6_prefix,omitempty"`
+}
+
+// ExportState returns the namespaces, machines (with their routes and tags),
+// pre-auth keys and shared machines of the database
+func (h *Headscale) ExportState() (*State, error) {
+	state := State{
+		Version:    stateVersion,
+		ExportedAt: time.Now().UTC(),
+	}
+	if err := h.db.Order("id").Find(&state.Namespaces).Error; err != nil {
+		return nil, err
+	}
+	if err := h.db.Order("id").Find(&state.Machines).Error; err != nil {
+		return nil, err
+	}
+	if err := h.db.Order("id").Find(&state.PreAuthKeys).Error; err != nil {
+		return nil, err
+	}
+	if err := h.db.Order("id").Find(&state.SharedMachines).Error; err != nil {
+		return nil, err
+	}
+	kv := []KV{}
+	if err := h.db.Where("key = ?", ulaPrefixKey).Find(&kv).Error; err != nil {
+		return nil, err
+	}
+	if len(kv) > 0 {
+		state.IPv6Prefix = kv[0].Value
+	}
+	return &state, nil
+}
+
+// ImportState loads a state exported by ExportState, keeping the IDs, in a
+// single transaction. A database that already has namespaces or machines is
+// only replaced with force.
+func (h *Headscale) ImportState(state *State, force bool) (err error) {
+	defer func() {
+		h.audit("state.import", fmt.Sprintf("namespaces:%d machines:%d force:%t", len(state.Namespaces), len(state.Machines), force), err)
+	}()
+	if err = h.checkMaintenance(); err != nil {
+		return err
+	}
+	if state.Version > stateVersion {
+		return errorStateTooNew
+	}
+	pending, err := h.PendingMigrations()
+	if err != nil {
+		return err
+	}
+	if len(pending) > 0 {
+		return errorSchemaPending
+	}
+
+	err = h.db.Transaction(func(tx *gorm.DB) error {
+		var namespaces, machines int64
+		if err := tx.Model(&Namespace{}).Count(&namespaces).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&Machine{}).Count(&machines).Error; err != nil {
+			return err
+		}
+		if namespaces+machines > 0 {
+			if !force {
+				return errorStateNotEmpty
+			}
+			// The children first, for the databases enforcing the foreign keys
+			for _, model := range []interface{}{&SharedMachine{}, &Machine{}, &PreAuthKey{}, &Namespace{}} {
+				if err := tx.Unscoped().Where("1 = 1").Delete(model).Error; err != nil {
+					return err
+				}
+			}
+		}
+
+		// The associations are omitted, they are restored through the IDs
+		if len(state.Namespaces) > 0 {
+			if err := tx.Omit(clause.Associations).Create(&state.Namespaces).Error; err != nil {
+				return err
+			}
+		}
+		if len(state.PreAuthKeys) > 0 {
+			if err := tx.Omit(clause.Associations).Create(&state.PreAuthKeys).Error; err != nil {
+				return err
+			}
+		}
+		if len(state.Machines) > 0 {
+			if err := tx.Omit(clause.Associations).Create(&state.Machines).Error; err != nil {
+				return err
+			}
+		}
+		if len(state.SharedMachines) > 0 {
+			if err := tx.Omit(clause.Associations).Create(&state.SharedMachines).Error; err != nil {
+				return err
+			}
+		}
+		// It replaces the one generated when the database was created
+		if state.IPv6Prefix != "" {
+			if err := tx.Where("key = ?", ulaPrefixKey).Delete(&KV{}).Error; err != nil {
+				return err
+			}
+			if err := tx.Create(&KV{Key: ulaPrefixKey, Value: state.IPv6Prefix}).Error; err != nil {
+				return err
+			}
+		}
+		return h.resetSequences(tx)
+	})
+	// The imported rows keep their timestamps, which may match the cached ones
+	h.invalidatePeers()
+	return err
+}
+
+// resetSequences moves the sequences of the IDs past the imported rows, as
+// PostgreSQL does not when the IDs are given. SQLite needs nothing.
+func (h *Headscale) resetSequences(tx *gorm.DB) error {
+	if h.dbType != "postgres" {
+		return nil
+	}
+	for _, table := range []string{"namespaces", "machines", "pre_auth_keys", "shared_machines"} {
+		err := tx.Exec(fmt.Sprintf(
+			"SELECT setval(pg_get_serial_sequence('%s', 'id'), COALESCE(MAX(id), 0) + 1, false) FROM %s",
+			table, table,
+		)).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
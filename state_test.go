@@ -0,0 +1,72 @@
+package headscale
+
+import (
+	"encoding/json"
+
+	"gopkg.in/check.v1"
+)
+
+func (s *Suite) TestExportImportState(c *check.C) {
+	n1, err := h.CreateNamespace("test")
+	c.Assert(err, check.IsNil)
+	n2, err := h.CreateNamespace("test2")
+	c.Assert(err, check.IsNil)
+	pak, err := h.CreatePreAuthKey(n1.Name, true, false, nil, nil)
+	c.Assert(err, check.IsNil)
+
+	m := Machine{
+		MachineKey:     "foo",
+		IPAddress:      "100.64.0.1",
+		Name:           "testmachine",
+		NamespaceID:    n1.ID,
+		Registered:     true,
+		RegisterMethod: "authKey",
+		AuthKeyID:      uint(pak.ID),
+		EnabledRoutes:  []byte(`["192.168.1.0/24"]`),
+	}
+	h.db.Save(&m)
+	_, err = h.ShareMachine(m.ID, n2.Name)
+	c.Assert(err, check.IsNil)
+
+	state, err := h.ExportState()
+	c.Assert(err, check.IsNil)
+	c.Assert(state.Version, check.Equals, stateVersion)
+	c.Assert(len(state.Namespaces), check.Equals, 2)
+	c.Assert(len(state.Machines), check.Equals, 1)
+	c.Assert(len(state.PreAuthKeys), check.Equals, 1)
+	c.Assert(len(state.SharedMachines), check.Equals, 1)
+
+	j, err := json.Marshal(state)
+	c.Assert(err, check.IsNil)
+	imported := State{}
+	err = json.Unmarshal(j, &imported)
+	c.Assert(err, check.IsNil)
+
+	err = h.ImportState(&imported, false)
+	c.Assert(err, check.Equals, errorStateNotEmpty)
+
+	err = h.ImportState(&imported, true)
+	c.Assert(err, check.IsNil)
+
+	m2, err := h.GetMachineByID(m.ID)
+	c.Assert(err, check.IsNil)
+	c.Assert(m2.Name, check.Equals, "testmachine")
+	c.Assert(m2.Namespace.Name, check.Equals, n1.Name)
+	c.Assert(string(m2.EnabledRoutes), check.Equals, `["192.168.1.0/24"]`)
+	keys, err := h.GetPreAuthKeys(n1.Name)
+	c.Assert(err, check.IsNil)
+	c.Assert(len(*keys), check.Equals, 1)
+	c.Assert((*keys)[0].Key, check.Equals, pak.Key)
+	shared, err := h.ListSharedMachines(n2.Name)
+	c.Assert(err, check.IsNil)
+	c.Assert(len(*shared), check.Equals, 1)
+	c.Assert((*shared)[0].ID, check.Equals, m.ID)
+
+	namespaces, err := h.ListNamespaces()
+	c.Assert(err, check.IsNil)
+	c.Assert(len(*namespaces), check.Equals, 2)
+
+	imported.Version = stateVersion + 1
+	err = h.ImportState(&imported, true)
+	c.Assert(err, check.Equals, errorStateTooNew)
+}
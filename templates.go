@@ -0,0 +1,92 @@
+package headscale
+
+import (
+	"bytes"
+	"html/template"
+	"net/http"
+	"os"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+)
+
+// defaultRegistrationTemplates are the pages shown in the browser during the
+// registration: "register" tells how to register the machine with the CLI,
+// and "registered" confirms the registration with OIDC, or tells that it
+// awaits approval
+const defaultRegistrationTemplates = `
+{{define "register"}}
+	<html>
+	<body>
+	<h1>headscale</h1>
+	<p>
+		Run the command below in the headscale server to add this machine to your network:
+	</p>
+
+	<p>
+		<code>
+			<b>headscale -n NAMESPACE nodes register {{.MachineKey}}</b>
+		</code>
+	</p>
+
+	</body>
+	</html>
+{{end}}
+{{define "registered"}}
+	<html>
+	<body>
+	<h1>headscale</h1>
+	<p>
+		{{if .Pending}}
+		Machine <b>{{.Machine}}</b> authenticated in namespace <b>{{.Namespace}}</b>. It joins the network once approved by an administrator. You can close this window.
+		{{else}}
+		Machine <b>{{.Machine}}</b> registered in namespace <b>{{.Namespace}}</b>. You can close this window.
+		{{end}}
+	</p>
+	</body>
+	</html>
+{{end}}
+`
+
+// registrationPage is given to the registration templates. Machine and
+// Namespace are only known once the machine is registered, and Pending is set
+// if it awaits approval.
+type registrationPage struct {
+	MachineKey string
+	Machine    string
+	Namespace  string
+	Pending    bool
+}
+
+var builtinRegistrationTemplates = template.Must(template.New("registration").Parse(defaultRegistrationTemplates))
+
+// loadRegistrationTemplates parses the templates of path over the default
+// ones, so the file can redefine "register", "registered" or both
+func loadRegistrationTemplates(path string) (*template.Template, error) {
+	t := template.Must(template.New("registration").Parse(defaultRegistrationTemplates))
+	if path == "" {
+		return t, nil
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return t.Parse(string(content))
+}
+
+func (h *Headscale) renderRegistrationPage(c *gin.Context, name string, page registrationPage) {
+	t := h.registrationTemplates
+	if t == nil {
+		t = builtinRegistrationTemplates
+	}
+	var b bytes.Buffer
+	if err := t.ExecuteTemplate(&b, name, page); err != nil {
+		log.Error().
+			Str("template", name).
+			Err(err).
+			Msg("Cannot render the registration page")
+		c.String(http.StatusInternalServerError, "")
+		return
+	}
+	c.Data(http.StatusOK, "text/html; charset=utf-8", b.Bytes())
+}
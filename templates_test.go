@@ -0,0 +1,42 @@
+package headscale
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+
+	"github.com/gin-gonic/gin"
+	"gopkg.in/check.v1"
+)
+
+func (s *Suite) TestRegistrationTemplates(c *check.C) {
+	render := func(name string, page registrationPage) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		ctx, _ := gin.CreateTestContext(w)
+		h.renderRegistrationPage(ctx, name, page)
+		return w
+	}
+
+	w := render("register", registrationPage{MachineKey: "<script>"})
+	c.Assert(w.Code, check.Equals, http.StatusOK)
+	c.Assert(w.Body.String(), check.Matches, "(?s).*nodes register &lt;script&gt;.*")
+
+	path := filepath.Join(c.MkDir(), "registration.html")
+	err := os.WriteFile(path, []byte(`{{define "registered"}}Welcome {{.Machine}} to {{.Namespace}}{{end}}`), 0o600)
+	c.Assert(err, check.IsNil)
+	h.registrationTemplates, err = loadRegistrationTemplates(path)
+	c.Assert(err, check.IsNil)
+	defer func() { h.registrationTemplates = nil }()
+
+	w = render("registered", registrationPage{Machine: "laptop", Namespace: "alice"})
+	c.Assert(w.Body.String(), check.Equals, "Welcome laptop to alice")
+	// The instructions are not redefined
+	w = render("register", registrationPage{MachineKey: "abc"})
+	c.Assert(w.Body.String(), check.Matches, "(?s).*nodes register abc.*")
+
+	err = os.WriteFile(path, []byte(`{{define "registered"}}{{.Machine}`), 0o600)
+	c.Assert(err, check.IsNil)
+	_, err = loadRegistrationTemplates(path)
+	c.Assert(err, check.NotNil)
+}
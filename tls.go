@@ -0,0 +1,91 @@
+package headscale
+
+import (
+	"crypto/tls"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// certCheckInterval is how often the certificate files are checked for
+// changes, at most once per handshake
+const certCheckInterval = 10 * time.Second
+
+// certFileLoader serves the certificate of TLSCertPath and TLSKeyPath, and
+// reloads it when the files are modified, so a rotated certificate is used
+// without restarting headscale
+type certFileLoader struct {
+	certPath string
+	keyPath  string
+	interval time.Duration
+
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	certMtime time.Time
+	keyMtime  time.Time
+	checked   time.Time
+}
+
+func newCertFileLoader(certPath, keyPath string) (*certFileLoader, error) {
+	l := &certFileLoader{certPath: certPath, keyPath: keyPath, interval: certCheckInterval}
+	certMtime, keyMtime, err := l.mtimes()
+	if err != nil {
+		return nil, err
+	}
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return nil, err
+	}
+	l.cert, l.certMtime, l.keyMtime, l.checked = &cert, certMtime, keyMtime, time.Now()
+	return l, nil
+}
+
+func (l *certFileLoader) mtimes() (time.Time, time.Time, error) {
+	c, err := os.Stat(l.certPath)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	k, err := os.Stat(l.keyPath)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	return c.ModTime(), k.ModTime(), nil
+}
+
+// getCertificate is the GetCertificate of the tls.Config of the servers
+func (l *certFileLoader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if time.Since(l.checked) < l.interval {
+		return l.cert, nil
+	}
+	l.checked = time.Now()
+
+	certMtime, keyMtime, err := l.mtimes()
+	if err != nil {
+		log.Warn().
+			Err(err).
+			Msg("Cannot check the certificate files, keeping the current certificate")
+		return l.cert, nil
+	}
+	if certMtime.Equal(l.certMtime) && keyMtime.Equal(l.keyMtime) {
+		return l.cert, nil
+	}
+	// The files may be replaced one after the other, the previous pair is
+	// kept until both match
+	cert, err := tls.LoadX509KeyPair(l.certPath, l.keyPath)
+	if err != nil {
+		log.Warn().
+			Err(err).
+			Str("cert", l.certPath).
+			Msg("Cannot load the modified certificate, keeping the current one")
+		return l.cert, nil
+	}
+	log.Info().
+		Str("cert", l.certPath).
+		Msg("Reloaded the TLS certificate")
+	l.cert, l.certMtime, l.keyMtime = &cert, certMtime, keyMtime
+	return l.cert, nil
+}
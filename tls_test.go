@@ -0,0 +1,76 @@
+package headscale
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+
+	"gopkg.in/check.v1"
+)
+
+func writeTestCert(c *check.C, certPath, keyPath string, serial int64, mtime time.Time) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, check.IsNil)
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "headscale.test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	c.Assert(err, check.IsNil)
+	b, err := x509.MarshalECPrivateKey(key)
+	c.Assert(err, check.IsNil)
+
+	if certPath != "" {
+		err = os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)
+		c.Assert(err, check.IsNil)
+		c.Assert(os.Chtimes(certPath, mtime, mtime), check.IsNil)
+	}
+	if keyPath != "" {
+		err = os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: b}), 0o600)
+		c.Assert(err, check.IsNil)
+		c.Assert(os.Chtimes(keyPath, mtime, mtime), check.IsNil)
+	}
+}
+
+func serialOf(c *check.C, l *certFileLoader) int64 {
+	cert, err := l.getCertificate(nil)
+	c.Assert(err, check.IsNil)
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	c.Assert(err, check.IsNil)
+	return leaf.SerialNumber.Int64()
+}
+
+func (s *Suite) TestCertFileLoaderReload(c *check.C) {
+	dir := c.MkDir()
+	certPath, keyPath := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	t := time.Now().Add(-time.Hour)
+	writeTestCert(c, certPath, keyPath, 1, t)
+
+	l, err := newCertFileLoader(certPath, keyPath)
+	c.Assert(err, check.IsNil)
+	l.interval = 0
+	c.Assert(serialOf(c, l), check.Equals, int64(1))
+
+	// The certificate is replaced before the key, the pair does not match
+	writeTestCert(c, certPath, "", 2, t.Add(time.Minute))
+	c.Assert(serialOf(c, l), check.Equals, int64(1))
+
+	writeTestCert(c, certPath, keyPath, 3, t.Add(2*time.Minute))
+	c.Assert(serialOf(c, l), check.Equals, int64(3))
+
+	// Removed files keep the current certificate too
+	c.Assert(os.Remove(keyPath), check.IsNil)
+	c.Assert(serialOf(c, l), check.Equals, int64(3))
+
+	_, err = newCertFileLoader(certPath, keyPath)
+	c.Assert(err, check.NotNil)
+}
@@ -0,0 +1,252 @@
+package headscale
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	webhookMachineOnline     = "machine.online"
+	webhookMachineOffline    = "machine.offline"
+	webhookMachineRegistered = "machine.registered"
+	webhookMachineDeleted    = "machine.deleted"
+)
+
+// webhookCheckInterval is how often the machines are compared with their
+// previous state to find the events
+const webhookCheckInterval = 5 * time.Second
+
+// webhookAttempts is how many times an event is posted before it is
+// dropped, waiting twice as long after every failure
+const (
+	webhookAttempts     = 5
+	webhookFirstBackoff = time.Second
+)
+
+// webhookSignatureHeader holds the hex HMAC-SHA256 of the body, keyed by
+// webhook_secret
+const webhookSignatureHeader = "X-Headscale-Signature"
+
+// WebhookEvent is the JSON body posted to webhook_url
+type WebhookEvent struct {
+	Type      string    `json:"type"`
+	MachineID uint64    `json:"machine_id"`
+	Machine   string    `json:"machine"`
+	Namespace string    `json:"namespace"`
+	Time      time.Time `json:"time"`
+}
+
+// webhookMachine is what is remembered of a machine between two checks
+type webhookMachine struct {
+	name       string
+	namespace  string
+	registered bool
+	online     bool
+}
+
+// webhookNotifier finds the machine events by comparing the machines in the
+// database with the previous check, so the changes made by the CLI from
+// another process are seen too, and posts them in the background
+type webhookNotifier struct {
+	h        *Headscale
+	client   *http.Client
+	events   chan WebhookEvent
+	machines map[uint64]webhookMachine
+	backoff  time.Duration
+}
+
+func (h *Headscale) newWebhookNotifier() (*webhookNotifier, error) {
+	n := &webhookNotifier{
+		h:       h,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		events:  make(chan WebhookEvent, 256),
+		backoff: webhookFirstBackoff,
+	}
+	// The machines already there when the server starts are not notified
+	machines, err := n.load()
+	if err != nil {
+		return nil, err
+	}
+	n.machines = machines
+	return n, nil
+}
+
+// NotifyMachineEvents posts the machine events to h.cfg.WebhookURL until the
+// server shuts down
+func (h *Headscale) NotifyMachineEvents() {
+	if h.cfg.WebhookURL == "" {
+		return
+	}
+	n, err := h.newWebhookNotifier()
+	if err != nil {
+		log.Error().
+			Err(err).
+			Msg("Cannot load the machines, the webhook is disabled")
+		return
+	}
+	go n.send()
+
+	ticker := time.NewTicker(webhookCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-h.shutdown:
+			close(n.events)
+			return
+		case <-ticker.C:
+			events, err := n.check()
+			if err != nil {
+				log.Error().
+					Err(err).
+					Msg("Cannot load the machines for the webhook")
+				continue
+			}
+			for _, e := range events {
+				select {
+				case n.events <- e:
+				default:
+					log.Error().
+						Str("type", e.Type).
+						Uint64("machine_id", e.MachineID).
+						Msg("Too many webhook events pending, dropping one")
+				}
+			}
+		}
+	}
+}
+
+func (n *webhookNotifier) load() (map[uint64]webhookMachine, error) {
+	machines, err := n.h.ListMachines(MachineFilter{})
+	if err != nil {
+		return nil, err
+	}
+	loaded := make(map[uint64]webhookMachine, len(*machines))
+	for _, m := range *machines {
+		loaded[m.ID] = webhookMachine{
+			name:       m.Name,
+			namespace:  m.Namespace.Name,
+			registered: m.Registered,
+			online:     m.Online,
+		}
+	}
+	return loaded, nil
+}
+
+// check returns the events since the previous check, in the order of the
+// machine IDs
+func (n *webhookNotifier) check() ([]WebhookEvent, error) {
+	machines, err := n.load()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	event := func(t string, id uint64, m webhookMachine) WebhookEvent {
+		return WebhookEvent{Type: t, MachineID: id, Machine: m.name, Namespace: m.namespace, Time: now}
+	}
+
+	events := []WebhookEvent{}
+	for _, id := range sortedMachineIDs(machines, n.machines) {
+		m, ok := machines[id]
+		prev, seen := n.machines[id]
+		switch {
+		case !ok:
+			if prev.registered {
+				events = append(events, event(webhookMachineDeleted, id, prev))
+			}
+		case !m.registered:
+		default:
+			if !seen || !prev.registered {
+				events = append(events, event(webhookMachineRegistered, id, m))
+			}
+			if m.online && !prev.online {
+				events = append(events, event(webhookMachineOnline, id, m))
+			} else if !m.online && prev.online {
+				events = append(events, event(webhookMachineOffline, id, m))
+			}
+		}
+	}
+	n.machines = machines
+	return events, nil
+}
+
+func sortedMachineIDs(a, b map[uint64]webhookMachine) []uint64 {
+	ids := []uint64{}
+	for id := range a {
+		ids = append(ids, id)
+	}
+	for id := range b {
+		if _, ok := a[id]; !ok {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// send posts the events one after the other, retrying the failures
+func (n *webhookNotifier) send() {
+	for e := range n.events {
+		backoff := n.backoff
+		for attempt := 1; ; attempt++ {
+			err := n.post(e)
+			if err == nil {
+				break
+			}
+			if attempt == webhookAttempts {
+				log.Error().
+					Str("type", e.Type).
+					Uint64("machine_id", e.MachineID).
+					Err(err).
+					Msg("Could not post the webhook event, dropping it")
+				break
+			}
+			log.Warn().
+				Str("type", e.Type).
+				Uint64("machine_id", e.MachineID).
+				Err(err).
+				Dur("retry_in", backoff).
+				Msg("Could not post the webhook event")
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+}
+
+func (n *webhookNotifier) post(e WebhookEvent) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, n.h.cfg.WebhookURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if n.h.cfg.WebhookSecret != "" {
+		req.Header.Set(webhookSignatureHeader, "sha256="+webhookSignature(n.h.cfg.WebhookSecret, body))
+	}
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+func webhookSignature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
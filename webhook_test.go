@@ -0,0 +1,100 @@
+package headscale
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	"gopkg.in/check.v1"
+)
+
+func (s *Suite) TestWebhookEvents(c *check.C) {
+	n, err := h.CreateNamespace("test")
+	c.Assert(err, check.IsNil)
+
+	notifier, err := h.newWebhookNotifier()
+	c.Assert(err, check.IsNil)
+
+	now := time.Now().UTC()
+	m := Machine{
+		MachineKey:     "foo",
+		NodeKey:        "bar",
+		DiscoKey:       "faa",
+		Name:           "testmachine",
+		NamespaceID:    n.ID,
+		Registered:     true,
+		RegisterMethod: "cli",
+		LastSeen:       &now,
+	}
+	h.db.Save(&m)
+
+	events, err := notifier.check()
+	c.Assert(err, check.IsNil)
+	c.Assert(events, check.HasLen, 2)
+	c.Assert(events[0].Type, check.Equals, webhookMachineRegistered)
+	c.Assert(events[0].Namespace, check.Equals, "test")
+	c.Assert(events[1].Type, check.Equals, webhookMachineOnline)
+
+	events, err = notifier.check()
+	c.Assert(err, check.IsNil)
+	c.Assert(events, check.HasLen, 0)
+
+	seen := now.Add(-time.Hour)
+	m.LastSeen = &seen
+	h.db.Save(&m)
+	events, err = notifier.check()
+	c.Assert(err, check.IsNil)
+	c.Assert(events, check.HasLen, 1)
+	c.Assert(events[0].Type, check.Equals, webhookMachineOffline)
+
+	err = h.DeleteMachine(m.ID)
+	c.Assert(err, check.IsNil)
+	events, err = notifier.check()
+	c.Assert(err, check.IsNil)
+	c.Assert(events, check.HasLen, 1)
+	c.Assert(events[0].Type, check.Equals, webhookMachineDeleted)
+	c.Assert(events[0].MachineID, check.Equals, m.ID)
+	c.Assert(events[0].Machine, check.Equals, "testmachine")
+}
+
+func (s *Suite) TestWebhookPost(c *check.C) {
+	var mu sync.Mutex
+	attempts := 0
+	received := make(chan WebhookEvent, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		attempts++
+		failing := attempts == 1
+		mu.Unlock()
+		if failing {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		c.Check(r.Header.Get(webhookSignatureHeader), check.Equals, "sha256="+webhookSignature("secret", body))
+		e := WebhookEvent{}
+		c.Check(json.Unmarshal(body, &e), check.IsNil)
+		received <- e
+	}))
+	defer server.Close()
+
+	h.cfg.WebhookURL = server.URL
+	h.cfg.WebhookSecret = "secret"
+	notifier, err := h.newWebhookNotifier()
+	c.Assert(err, check.IsNil)
+	notifier.backoff = time.Millisecond
+	go notifier.send()
+	defer close(notifier.events)
+
+	notifier.events <- WebhookEvent{Type: webhookMachineOnline, MachineID: 1, Time: time.Now().UTC()}
+	select {
+	case e := <-received:
+		c.Assert(e.Type, check.Equals, webhookMachineOnline)
+		c.Assert(e.MachineID, check.Equals, uint64(1))
+	case <-time.After(5 * time.Second):
+		c.Fatal("the event was not retried")
+	}
+}